@@ -0,0 +1,186 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"regexp"
+	"sync"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/bytesize"
+	"github.com/left2right/redis-port/pkg/libs/extsort"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// atomicGroup returns the group of a key for --atomic-group, keys without a
+// group are restored one by one as usual.
+var atomicGroup = func(key []byte) []byte {
+	return nil
+}
+
+// hashTag returns the part between the first '{' and the following '}', the
+// same rule redis cluster uses to map keys to slots.
+func hashTag(key []byte) []byte {
+	i := bytes.IndexByte(key, '{')
+	if i < 0 {
+		return nil
+	}
+	j := bytes.IndexByte(key[i+1:], '}')
+	if j <= 0 {
+		return nil
+	}
+	return key[i+1 : i+1+j]
+}
+
+// newAtomicGroup parses --atomic-group: 'hashtag', or a regular expression
+// whose first submatch (or whole match without submatch) names the group.
+func newAtomicGroup(s string) (func(key []byte) []byte, error) {
+	if s == "hashtag" {
+		return hashTag, nil
+	}
+	r, err := regexp.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+	return func(key []byte) []byte {
+		m := r.FindSubmatch(key)
+		switch {
+		case m == nil:
+			return nil
+		case len(m) > 1:
+			return m[1]
+		default:
+			return m[0]
+		}
+	}, nil
+}
+
+// atomicGroupBufferSize is the amount of grouped entries kept in memory before
+// spilling a sorted run to disk.
+const atomicGroupBufferSize = bytesize.MB * 256
+
+// atomicRestorer collects grouped entries during the rdb, sorted by db and
+// group, and restores every group inside MULTI/EXEC once the rdb is done,
+// because members of a group may be anywhere in the rdb.
+type atomicRestorer struct {
+	mu     sync.Mutex
+	sorter *extsort.Sorter
+}
+
+func newAtomicRestorer() *atomicRestorer {
+	return &atomicRestorer{sorter: extsort.New("", atomicGroupBufferSize, lessGroupEntry)}
+}
+
+// lessGroupEntry orders serialized group entries by db, then by group.
+func lessGroupEntry(a, b []byte) bool {
+	g1, e1 := parseGroupEntry(a)
+	g2, e2 := parseGroupEntry(b)
+	if e1.DB != e2.DB {
+		return e1.DB < e2.DB
+	}
+	return bytes.Compare(g1, g2) < 0
+}
+
+// newGroupEntry serializes an entry as
+// uvarint(len(group)) + group + db + expireat + uvarint(len(key)) + key + value.
+func newGroupEntry(group []byte, e *rdb.BinEntry) []byte {
+	var b bytes.Buffer
+	var n [binary.MaxVarintLen64]byte
+	b.Write(n[:binary.PutUvarint(n[:], uint64(len(group)))])
+	b.Write(group)
+	binary.Write(&b, binary.BigEndian, e.DB)
+	binary.Write(&b, binary.BigEndian, e.ExpireAt)
+	b.Write(n[:binary.PutUvarint(n[:], uint64(len(e.Key)))])
+	b.Write(e.Key)
+	b.Write(e.Value)
+	return b.Bytes()
+}
+
+func parseGroupEntry(p []byte) ([]byte, *rdb.BinEntry) {
+	n, i := binary.Uvarint(p)
+	group, p := p[i:i+int(n)], p[i+int(n):]
+	e := &rdb.BinEntry{
+		DB:       binary.BigEndian.Uint32(p[0:4]),
+		ExpireAt: binary.BigEndian.Uint64(p[4:12]),
+	}
+	p = p[12:]
+	n, i = binary.Uvarint(p)
+	e.Key, e.Value = p[i:i+int(n)], p[i+int(n):]
+	return group, e
+}
+
+func (a *atomicRestorer) Add(group []byte, e *rdb.BinEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.sorter.Add(newGroupEntry(group, e)); err != nil {
+		log.PanicError(err, "buffer atomic group entry failed")
+	}
+}
+
+// Restore sends every group as MULTI, RESTORE..., EXEC. Redis does not roll
+// back a transaction: a RESTORE failing inside EXEC (e.g. BUSYKEY) leaves the
+// rest of the group applied, which is logged with the failing keys. A group
+// rejected at queueing time (EXECABORT) is not applied at all.
+func (a *atomicRestorer) Restore(c redigo.Conn) (ngroup, nfailed int64) {
+	var lastdb uint32 = baseTargetDB()
+	var group []byte
+	var entries []*rdb.BinEntry
+	flush := func() {
+		if len(entries) == 0 {
+			return
+		}
+		ngroup++
+		if !restoreGroup(c, group, entries) {
+			nfailed++
+		}
+		entries = nil
+	}
+	err := a.sorter.Sort(func(p []byte) error {
+		g, e := parseGroupEntry(p)
+		if e.DB != lastdb || !bytes.Equal(g, group) {
+			flush()
+			group = append(group[:0], g...)
+		}
+		if e.DB != lastdb {
+			lastdb = e.DB
+			selectDB(c, lastdb)
+		}
+		e.Key = append([]byte(nil), e.Key...)
+		e.Value = append([]byte(nil), e.Value...)
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		log.PanicError(err, "sort atomic group entries failed")
+	}
+	flush()
+	return
+}
+
+func restoreGroup(c redigo.Conn, group []byte, entries []*rdb.BinEntry) bool {
+	if err := c.Send("multi"); err != nil {
+		log.PanicError(err, "send multi failed")
+	}
+	for _, e := range entries {
+		if err := c.Send(restoreCmd, restoreArgs(e)...); err != nil {
+			log.PanicError(err, "send restore failed")
+		}
+	}
+	replies, err := redigo.Values(c.Do("exec"))
+	if err != nil {
+		log.WarnErrorf(err, "restore atomic group '%s' failed, %d keys not applied", group, len(entries))
+		return false
+	}
+	ok := true
+	for i, r := range replies {
+		if err, isErr := r.(redigo.Error); isErr && i < len(entries) {
+			log.Warnf("restore atomic group '%s' key '%s' failed: %s", group, entries[i].Key, err)
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/libs/extsort"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+func TestNewAtomicGroup(t *testing.T) {
+	f, err := newAtomicGroup("hashtag")
+	assert.MustNoError(err)
+	assert.Must(string(f([]byte("order:{u1}:items"))) == "u1")
+	assert.Must(f([]byte("order:u1")) == nil)
+	assert.Must(f([]byte("order:{}:u1")) == nil)
+
+	f, err = newAtomicGroup(`^(user:\d+):`)
+	assert.MustNoError(err)
+	assert.Must(string(f([]byte("user:12:name"))) == "user:12")
+	assert.Must(f([]byte("session:12")) == nil)
+
+	f, err = newAtomicGroup(`^user:\d+`)
+	assert.MustNoError(err)
+	assert.Must(string(f([]byte("user:12:name"))) == "user:12")
+
+	_, err = newAtomicGroup("user:(")
+	assert.Must(err != nil)
+}
+
+// groupConn records the commands of atomic groups, RESTORE of the keys in
+// fail is answered with an error inside EXEC.
+type groupConn struct {
+	fail map[string]bool
+
+	queued  []string
+	groups  [][]string
+	selects []uint32
+}
+
+func (c *groupConn) Close() error { return nil }
+func (c *groupConn) Err() error   { return nil }
+func (c *groupConn) Flush() error { return nil }
+
+func (c *groupConn) Receive() (interface{}, error) {
+	panic("unexpected receive")
+}
+
+func (c *groupConn) Send(cmd string, args ...interface{}) error {
+	switch cmd {
+	case "multi":
+		c.queued = []string{}
+	default:
+		c.queued = append(c.queued, string(args[0].([]byte)))
+	}
+	return nil
+}
+
+func (c *groupConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "select":
+		c.selects = append(c.selects, args[0].(uint32))
+		return "OK", nil
+	case "exec":
+		var replies []interface{}
+		for _, key := range c.queued {
+			if c.fail[key] {
+				replies = append(replies, redigo.Error("BUSYKEY Target key name already exists."))
+			} else {
+				replies = append(replies, "OK")
+			}
+		}
+		c.groups = append(c.groups, c.queued)
+		c.queued = nil
+		return replies, nil
+	}
+	panic("unexpected command " + cmd)
+}
+
+func TestAtomicRestorer(t *testing.T) {
+	a := &atomicRestorer{sorter: extsort.New("", 256, lessGroupEntry)}
+	defer a.sorter.Close()
+
+	value, err := rdb.EncodeDump(rdb.String("v"))
+	assert.MustNoError(err)
+	for i := 0; i < 8; i++ {
+		for _, g := range []string{"u2", "u1"} {
+			for _, db := range []uint32{1, 0} {
+				e := &rdb.BinEntry{DB: db, Key: []byte(fmt.Sprintf("{%s}:%d:%d", g, db, i)), Value: value}
+				a.Add(hashTag(e.Key), e)
+			}
+		}
+	}
+	assert.Must(a.sorter.Runs() > 1)
+
+	c := &groupConn{fail: map[string]bool{"{u2}:1:3": true}}
+	ngroup, nfailed := a.Restore(c)
+	assert.Must(ngroup == 4 && nfailed == 1)
+	assert.Must(len(c.selects) == 1 && c.selects[0] == 1)
+
+	assert.Must(len(c.groups) == 4)
+	for i, prefix := range []string{"{u1}:0:", "{u2}:0:", "{u1}:1:", "{u2}:1:"} {
+		keys := c.groups[i]
+		assert.Must(len(keys) == 8)
+		sort.Strings(keys)
+		for j, key := range keys {
+			assert.Must(key == fmt.Sprintf("%s%d", prefix, j))
+		}
+	}
+}
+
+func TestRestoreGroupKeyError(t *testing.T) {
+	value, err := rdb.EncodeDump(rdb.String("v"))
+	assert.MustNoError(err)
+	var entries []*rdb.BinEntry
+	for _, key := range []string{"{g}:a", "{g}:b", "{g}:c"} {
+		entries = append(entries, &rdb.BinEntry{Key: []byte(key), Value: value})
+	}
+	c := &groupConn{fail: map[string]bool{"{g}:b": true}}
+	assert.Must(!restoreGroup(c, []byte("g"), entries))
+	assert.Must(len(c.groups) == 1 && strings.Join(c.groups[0], ",") == "{g}:a,{g}:b,{g}:c")
+
+	c = &groupConn{}
+	assert.Must(restoreGroup(c, []byte("g"), entries))
+}
@@ -0,0 +1,186 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// bigKey is a key of the --bigkeys report, bytes is the size of its dump
+// payload and elements the number of list, hash, set or zset elements,
+// stream entries, or the length of a string.
+type bigKey struct {
+	DB       uint32
+	Type     string
+	Key      []byte
+	Bytes    int64
+	Elements int64
+}
+
+// lessBigKey orders keys by size, ties are broken by db then key so that the
+// report doesn't depend on the order keys are decoded.
+func lessBigKey(a, b *bigKey) bool {
+	if a.Bytes != b.Bytes {
+		return a.Bytes < b.Bytes
+	}
+	if a.DB != b.DB {
+		return a.DB > b.DB
+	}
+	return bytes.Compare(a.Key, b.Key) > 0
+}
+
+// bigKeyHeap keeps the top keys with the smallest of them first.
+type bigKeyHeap []*bigKey
+
+func (h bigKeyHeap) Len() int            { return len(h) }
+func (h bigKeyHeap) Less(i, j int) bool  { return lessBigKey(h[i], h[j]) }
+func (h bigKeyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *bigKeyHeap) Push(x interface{}) { *h = append(*h, x.(*bigKey)) }
+func (h *bigKeyHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// bigKeys accumulates the --bigkeys report. Like typeStats every decode
+// worker fills its own and merges it into the shared one when done, so only
+// Merge locks.
+type bigKeys struct {
+	mu     sync.Mutex
+	top    int
+	keys   bigKeyHeap
+	byType map[string]*bigKey
+	cells  *typeStats
+}
+
+func newBigKeys(top int) *bigKeys {
+	return &bigKeys{
+		top:    top,
+		byType: make(map[string]*bigKey),
+		cells:  newTypeStats(),
+	}
+}
+
+// countElements returns the number of elements of the decoded value.
+func countElements(e *rdb.BinEntry) int64 {
+	o, err := rdb.DecodeDump(e.Value)
+	if err != nil {
+		log.PanicErrorf(err, "decode key '%s' failed", e.Key)
+	}
+	switch obj := o.(type) {
+	case rdb.String:
+		return int64(len(obj))
+	case rdb.List:
+		return int64(len(obj))
+	case rdb.Hash:
+		return int64(len(obj))
+	case rdb.Set:
+		return int64(len(obj))
+	case rdb.ZSet:
+		return int64(len(obj))
+	case rdb.Stream:
+		return int64(len(obj.Entries))
+	}
+	return 0
+}
+
+func (s *bigKeys) Add(e *rdb.BinEntry) {
+	k := &bigKey{
+		DB:       e.DB,
+		Type:     rdb.TypeName(e.Value),
+		Key:      e.Key,
+		Bytes:    int64(len(e.Value)),
+		Elements: countElements(e),
+	}
+	s.cells.add(typeStatKey{k.DB, k.Type}, 1, k.Bytes, k.Elements)
+	s.addTop(k)
+	s.addType(k)
+}
+
+func (s *bigKeys) addTop(k *bigKey) {
+	switch {
+	case len(s.keys) < s.top:
+		heap.Push(&s.keys, k)
+	case s.top != 0 && lessBigKey(s.keys[0], k):
+		s.keys[0] = k
+		heap.Fix(&s.keys, 0)
+	}
+}
+
+func (s *bigKeys) addType(k *bigKey) {
+	if x := s.byType[k.Type]; x == nil || lessBigKey(x, k) {
+		s.byType[k.Type] = k
+	}
+}
+
+func (s *bigKeys) Merge(o *bigKeys) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range o.keys {
+		s.addTop(k)
+	}
+	for _, k := range o.byType {
+		s.addType(k)
+	}
+	s.cells.Merge(o.cells)
+}
+
+type sortedBigKeys []*bigKey
+
+func (l sortedBigKeys) Len() int           { return len(l) }
+func (l sortedBigKeys) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l sortedBigKeys) Less(i, j int) bool { return lessBigKey(l[j], l[i]) }
+
+// Top returns the top keys, the largest first.
+func (s *bigKeys) Top() []*bigKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := append(sortedBigKeys{}, s.keys...)
+	sort.Sort(l)
+	return l
+}
+
+// ByType returns the largest key of every type, the largest first.
+func (s *bigKeys) ByType() []*bigKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := make(sortedBigKeys, 0, len(s.byType))
+	for _, k := range s.byType {
+		l = append(l, k)
+	}
+	sort.Sort(l)
+	return l
+}
+
+// WriteReport writes the top keys, the largest key per type and the totals
+// per db and type as plain text tables. Keys are quoted, so binary keys stay
+// on a single line.
+func (s *bigKeys) WriteReport(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "# top %d keys by size\n", s.top)
+	fmt.Fprintf(tw, "rank\tdb\ttype\tbytes\telements\tkey\t\n")
+	for i, k := range s.Top() {
+		fmt.Fprintf(tw, "%d\tdb%d\t%s\t%d\t%d\t%s\t\n", i+1, k.DB, k.Type, k.Bytes, k.Elements, strconv.Quote(string(k.Key)))
+	}
+	fmt.Fprintf(tw, "\n# biggest key per type\n")
+	fmt.Fprintf(tw, "type\tdb\tbytes\telements\tkey\t\n")
+	for _, k := range s.ByType() {
+		fmt.Fprintf(tw, "%s\tdb%d\t%d\t%d\t%s\t\n", k.Type, k.DB, k.Bytes, k.Elements, strconv.Quote(string(k.Key)))
+	}
+
+	fmt.Fprintf(tw, "\n# keys by db and type\n")
+	s.cells.writeTable(tw, true)
+	return tw.Flush()
+}
@@ -0,0 +1,552 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// cmdCheck verifies a migration: every key of the source, or the --sample of
+// them, must be on the target with the same type, expire and value, and every
+// key of the target must be on the source, unless --one-way. Writes going on
+// meanwhile may be reported as differences.
+type cmdCheck struct {
+	nscan, nchecked, nmissing, nextra, ntype, nttl, nvalue, nerror atomic2.Int64
+
+	mu   sync.Mutex
+	keys []*checkKey
+}
+
+type cmdCheckStat struct {
+	nscan, nchecked, nmissing, nextra, ntype, nttl, nvalue, nerror int64
+}
+
+func (cmd *cmdCheck) Stat() *cmdCheckStat {
+	return &cmdCheckStat{
+		nscan:    cmd.nscan.Get(),
+		nchecked: cmd.nchecked.Get(),
+		nmissing: cmd.nmissing.Get(),
+		nextra:   cmd.nextra.Get(),
+		ntype:    cmd.ntype.Get(),
+		nttl:     cmd.nttl.Get(),
+		nvalue:   cmd.nvalue.Get(),
+		nerror:   cmd.nerror.Get(),
+	}
+}
+
+func (s *cmdCheckStat) Failed() bool {
+	return s.nmissing+s.nextra+s.ntype+s.nttl+s.nvalue+s.nerror != 0
+}
+
+// exitCheckFailed is the exit code of a check that found differences.
+const exitCheckFailed = 2
+
+// checkBatch is the number of keys read by a pipeline of a check routine.
+const checkBatch = 64
+
+// maxCheckReport is the number of keys listed in the report, the counts go on.
+const maxCheckReport = 10000
+
+// checkKey is a key listed in the report, problem is "missing", "extra",
+// "type", "ttl", "value" or "error".
+type checkKey struct {
+	DB         uint32 `json:"db"`
+	Key        string `json:"key"`
+	Key64      string `json:"key64"`
+	Problem    string `json:"problem"`
+	SourceType string `json:"source_type,omitempty"`
+	TargetType string `json:"target_type,omitempty"`
+	SourceTTL  int64  `json:"source_ttl,omitempty"`
+	TargetTTL  int64  `json:"target_ttl,omitempty"`
+	SourceSum  string `json:"source_checksum,omitempty"`
+	TargetSum  string `json:"target_checksum,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (cmd *cmdCheck) Main() {
+	from, target := args.from, args.target
+	if len(from) == 0 {
+		log.Panic("invalid argument: from")
+	}
+	if len(target) == 0 {
+		log.Panic("invalid argument: target")
+	}
+	initTargetCluster(nil)
+
+	log.Infof("check from '%s' to '%s', sample = %g%%\n", from, target, args.sample)
+
+	wait := make(chan struct{})
+	go func() {
+		defer close(wait)
+		cmd.checkSource()
+		if !args.oneWay {
+			cmd.checkTarget()
+		}
+	}()
+
+	for done := false; !done; {
+		select {
+		case <-wait:
+			done = true
+		case <-time.After(time.Second):
+		}
+		stat := cmd.Stat()
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "check: scan=%-12d checked=%-12d", stat.nscan, stat.nchecked)
+		fmt.Fprintf(&b, "  missing=%d extra=%d type=%d ttl=%d value=%d", stat.nmissing, stat.nextra, stat.ntype, stat.nttl, stat.nvalue)
+		if stat.nerror != 0 {
+			fmt.Fprintf(&b, "  error=%d", stat.nerror)
+		}
+		log.Info(b.String())
+	}
+
+	stat := cmd.Stat()
+	if isStdio(args.output) {
+		if err := cmd.WriteReport(os.Stdout, stat); err != nil {
+			log.PanicError(err, "write check report failed")
+		}
+	} else {
+		f := openWriteFile(args.output)
+		if err := cmd.WriteReport(f, stat); err != nil {
+			log.PanicErrorf(err, "write check report '%s' failed", args.output)
+		}
+		f.Close()
+	}
+	if stat.Failed() {
+		log.Errorf("check: source and target differ")
+		os.Exit(exitCheckFailed)
+	}
+	log.Info("check: source and target match")
+}
+
+// checkSource compares the keys of the source with the target, db by db.
+func (cmd *cmdCheck) checkSource() {
+	c := openSourceRedisConn(args.from, args.passwd)
+	defer c.Close()
+	dbs, err := keyspaceDBs(c)
+	if err != nil {
+		log.PanicError(err, "read source keyspace failed")
+	}
+	for _, db := range dbs {
+		if !acceptDB(db) {
+			continue
+		}
+		if args.cluster != nil && db != 0 {
+			log.Warnf("check: redis cluster only has db 0, db%d is skipped", db)
+			continue
+		}
+		selectDB(c, db)
+		cmd.scan(c, db, cmd.compareKeys)
+	}
+}
+
+// checkTarget looks for keys of the target missing on the source, on every
+// master of --target-cluster.
+func (cmd *cmdCheck) checkTarget() {
+	var conns []redigo.Conn
+	if args.cluster != nil {
+		for _, addr := range args.cluster.Masters() {
+			conns = append(conns, args.cluster.dial(addr))
+		}
+	} else {
+		conns = append(conns, openRedisConn(args.target, args.auth))
+	}
+	for _, c := range conns {
+		dbs, err := keyspaceDBs(c)
+		if err != nil {
+			log.PanicError(err, "read target keyspace failed")
+		}
+		for _, db := range dbs {
+			if acceptDB(db) {
+				selectDB(c, db)
+				cmd.scan(c, db, cmd.existKeys)
+			}
+		}
+		c.Close()
+	}
+}
+
+// checkConns are the connections of a check routine, in the db being checked.
+type checkConns struct {
+	db       uint32
+	src, dst redigo.Conn
+}
+
+func (c *checkConns) Source() redigo.Conn {
+	if c.src == nil {
+		c.src = openSourceRedisConn(args.from, args.passwd)
+		selectDB(c.src, c.db)
+	}
+	return c.src
+}
+
+func (c *checkConns) Target() redigo.Conn {
+	if c.dst == nil {
+		c.dst = openRedisConn(args.target, args.auth)
+		selectDB(c.dst, c.db)
+	}
+	return c.dst
+}
+
+// Close closes the connections, they are opened again when needed.
+func (c *checkConns) Close() {
+	if c.src != nil {
+		c.src.Close()
+		c.src = nil
+	}
+	if c.dst != nil {
+		c.dst.Close()
+		c.dst = nil
+	}
+}
+
+// scan hands the sampled keys of the selected db over to --parallel routines
+// running check, in batches. A batch that fails is counted as errors and its
+// routine reconnects.
+func (cmd *cmdCheck) scan(c redigo.Conn, db uint32, check func(c *checkConns, keys [][]byte) error) {
+	batches := make(chan [][]byte, args.parallel)
+	var wg sync.WaitGroup
+	for i := 0; i < args.parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conns := &checkConns{db: db}
+			defer conns.Close()
+			for keys := range batches {
+				if err := check(conns, keys); err != nil {
+					log.WarnErrorf(err, "check: %d keys of db%d failed", len(keys), db)
+					cmd.nerror.Add(int64(len(keys)))
+					conns.Close()
+				}
+			}
+		}()
+	}
+	var keys [][]byte
+	err := scanKeys(c, func(key []byte) {
+		cmd.nscan.Incr()
+		if !acceptKey(key) || !sampled(key, args.sample) {
+			return
+		}
+		if keys = append(keys, key); len(keys) == checkBatch {
+			batches <- keys
+			keys = nil
+		}
+	})
+	if len(keys) != 0 {
+		batches <- keys
+	}
+	close(batches)
+	wg.Wait()
+	if err != nil {
+		log.PanicErrorf(err, "scan db%d failed", db)
+	}
+}
+
+// compareKeys reads the keys on both sides and reports those that differ.
+func (cmd *cmdCheck) compareKeys(c *checkConns, keys [][]byte) error {
+	s, err := readKeys(c.Source(), keys)
+	if err != nil {
+		return err
+	}
+	d, err := readKeys(c.Target(), keys)
+	if err != nil {
+		return err
+	}
+	db := c.db
+	for i, key := range keys {
+		if s[i].typ == "none" && s[i].err == nil {
+			// deleted or expired since the scan.
+			continue
+		}
+		cmd.nchecked.Incr()
+		problem := compareKey(s[i], d[i], args.ttlTolerance)
+		switch problem {
+		case "":
+			continue
+		case "missing":
+			cmd.nmissing.Incr()
+		case "type":
+			cmd.ntype.Incr()
+		case "ttl":
+			cmd.nttl.Incr()
+		case "value":
+			cmd.nvalue.Incr()
+		case "error":
+			cmd.nerror.Incr()
+		}
+		x := &checkKey{DB: db, Key: keyText(key), Key64: base64.StdEncoding.EncodeToString(key), Problem: problem}
+		x.SourceType, x.TargetType = s[i].typ, d[i].typ
+		x.SourceTTL, x.TargetTTL = s[i].pttl, d[i].pttl
+		if problem == "value" {
+			x.SourceSum, x.TargetSum = valueChecksum(s[i].dump), valueChecksum(d[i].dump)
+		}
+		if err := s[i].err; err != nil {
+			x.Error = err.Error()
+		} else if err := d[i].err; err != nil {
+			x.Error = err.Error()
+		}
+		cmd.report(x)
+	}
+	return nil
+}
+
+// existKeys reports the keys of the target missing on the source.
+func (cmd *cmdCheck) existKeys(c *checkConns, keys [][]byte) error {
+	src, db := c.Source(), c.db
+	for _, key := range keys {
+		if err := src.Send("exists", key); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := src.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	for _, key := range keys {
+		n, err := redigo.Int(src.Receive())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if n != 0 {
+			continue
+		}
+		cmd.nextra.Incr()
+		cmd.report(&checkKey{DB: db, Key: keyText(key), Key64: base64.StdEncoding.EncodeToString(key), Problem: "extra"})
+	}
+	return nil
+}
+
+func (cmd *cmdCheck) report(x *checkKey) {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	if len(cmd.keys) < maxCheckReport {
+		cmd.keys = append(cmd.keys, x)
+	}
+}
+
+// WriteReport writes the counts and the keys that differ as json.
+func (cmd *cmdCheck) WriteReport(w io.Writer, stat *cmdCheckStat) error {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	keys := cmd.keys
+	if keys == nil {
+		keys = []*checkKey{}
+	}
+	ndiff := stat.nmissing + stat.nextra + stat.ntype + stat.nttl + stat.nvalue + stat.nerror
+	b, err := json.Marshal(&struct {
+		Source    string      `json:"source"`
+		Target    string      `json:"target"`
+		Sample    float64     `json:"sample"`
+		Scanned   int64       `json:"scanned"`
+		Checked   int64       `json:"checked"`
+		Missing   int64       `json:"missing"`
+		Extra     int64       `json:"extra"`
+		Type      int64       `json:"type_mismatch"`
+		TTL       int64       `json:"ttl_mismatch"`
+		Value     int64       `json:"value_mismatch"`
+		Errors    int64       `json:"errors"`
+		OK        bool        `json:"ok"`
+		Truncated bool        `json:"truncated,omitempty"`
+		Keys      []*checkKey `json:"keys"`
+	}{
+		args.from, args.target, args.sample,
+		stat.nscan, stat.nchecked, stat.nmissing, stat.nextra, stat.ntype, stat.nttl, stat.nvalue, stat.nerror,
+		!stat.Failed(), ndiff > int64(len(keys)), keys,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = w.Write(append(b, '\n'))
+	return errors.Trace(err)
+}
+
+// scanKeys calls fn with every key of the selected db, SCAN may return a key
+// more than once.
+func scanKeys(c redigo.Conn, fn func(key []byte)) error {
+	cursor := "0"
+	for {
+		reply, err := redigo.Values(c.Do("scan", cursor, "count", 1000))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(reply) != 2 {
+			return errors.Errorf("invalid scan reply, %d elements", len(reply))
+		}
+		next, err := redigo.String(reply[0], nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		keys, err := redigo.ByteSlices(reply[1], nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, key := range keys {
+			fn(key)
+		}
+		if next == "0" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// keyState is a key read by TYPE, PTTL and DUMP, err is the error replied when
+// the key could not be read.
+type keyState struct {
+	typ  string
+	pttl int64
+	dump []byte
+	err  error
+}
+
+// readKeys reads the keys in one pipeline, an error is returned when the
+// connection fails.
+func readKeys(c redigo.Conn, keys [][]byte) ([]*keyState, error) {
+	for _, key := range keys {
+		c.Send("type", key)
+		c.Send("pttl", key)
+		c.Send("dump", key)
+	}
+	if err := c.Flush(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	states := make([]*keyState, len(keys))
+	for i := range keys {
+		s := &keyState{}
+		var errs [3]error
+		s.typ, errs[0] = redigo.String(c.Receive())
+		s.pttl, errs[1] = redigo.Int64(c.Receive())
+		s.dump, errs[2] = redigo.Bytes(c.Receive())
+		for _, err := range errs {
+			if err != nil && err != redigo.ErrNil && s.err == nil {
+				s.err = err
+			}
+		}
+		if err := c.Err(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		states[i] = s
+	}
+	return states, nil
+}
+
+// compareKey returns what differs between the key on the source and on the
+// target: "missing", "type", "ttl", "value" or "error" when it couldn't be
+// read, "" when they match. Expires may differ by tolerance.
+func compareKey(s, d *keyState, tolerance time.Duration) string {
+	switch {
+	case s.err != nil || d.err != nil:
+		return "error"
+	case d.typ == "none":
+		return "missing"
+	case s.typ != d.typ:
+		return "type"
+	case (s.pttl < 0) != (d.pttl < 0):
+		return "ttl"
+	case s.pttl >= 0 && math.Abs(float64(s.pttl-d.pttl)) > float64(tolerance/time.Millisecond):
+		return "ttl"
+	case !bytes.Equal(s.dump, d.dump) && valueChecksum(s.dump) != valueChecksum(d.dump):
+		return "value"
+	}
+	return ""
+}
+
+// valueChecksum is the checksum of the value of a dump payload, independent of
+// the encoding of strings, lists, sets, hashes and sorted sets and of the order
+// of their elements; other types are compared as dumped.
+func valueChecksum(p []byte) string {
+	h := fnv.New64a()
+	write := func(b []byte) {
+		var n [8]byte
+		binary.LittleEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	o, err := rdb.DecodeDump(p)
+	if err != nil {
+		o = nil
+	}
+	switch x := o.(type) {
+	case rdb.String:
+		write([]byte("string"))
+		write(x)
+	case rdb.List:
+		write([]byte("list"))
+		for _, e := range x {
+			write(e)
+		}
+	case rdb.Set:
+		write([]byte("set"))
+		sortBytesList(x)
+		for _, e := range x {
+			write(e)
+		}
+	case rdb.Hash:
+		write([]byte("hash"))
+		sort.Sort(rdb.HSortByField{Hash: x})
+		for _, e := range x {
+			write(e.Field)
+			write(e.Value)
+			if e.ExpireAt != 0 {
+				write([]byte(strconv.FormatUint(e.ExpireAt, 10)))
+			}
+		}
+	case rdb.ZSet:
+		write([]byte("zset"))
+		sort.Sort(rdb.ZSortByMember{ZSet: x})
+		for _, e := range x {
+			write(e.Member)
+			write([]byte(strconv.FormatFloat(e.Score, 'g', -1, 64)))
+		}
+	default:
+		// the rdb version and crc64 footer of the dump are left out.
+		if len(p) >= 10 {
+			p = p[:len(p)-10]
+		}
+		write([]byte("dump"))
+		write(p)
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// parseSample parses --sample, a percentage of the keys in (0, 100] with an
+// optional '%' suffix.
+func parseSample(s string) (float64, error) {
+	n, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if !(n > 0 && n <= 100) {
+		return 0, errors.Errorf("sample = %s, should be in (0%%, 100%%]", s)
+	}
+	return n, nil
+}
+
+// sampled picks the keys of the sample by the crc32 of the key, so a key is
+// picked in both directions and by every run with the same sample.
+func sampled(key []byte, sample float64) bool {
+	if sample >= 100 {
+		return true
+	}
+	return float64(crc32.ChecksumIEEE(key)%10000) < sample*100
+}
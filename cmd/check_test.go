@@ -0,0 +1,75 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+func TestParseSample(t *testing.T) {
+	for s, n := range map[string]float64{"10%": 10, "0.5%": 0.5, "100": 100, " 25% ": 25} {
+		x, err := parseSample(s)
+		assert.MustNoError(err)
+		assert.Must(x == n)
+	}
+	for _, s := range []string{"", "%", "0%", "-1%", "101%", "ten"} {
+		_, err := parseSample(s)
+		assert.Must(err != nil)
+	}
+}
+
+func TestSampled(t *testing.T) {
+	var n int
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key:%d", i))
+		assert.Must(sampled(key, 100))
+		if sampled(key, 10) {
+			n++
+			assert.Must(sampled(key, 10) && sampled(key, 20))
+		}
+	}
+	assert.Must(n > 800 && n < 1200)
+}
+
+func TestCompareKey(t *testing.T) {
+	dump := func(o interface{}) []byte {
+		p, err := rdb.EncodeDump(o)
+		assert.MustNoError(err)
+		return p
+	}
+	s1 := dump(rdb.Set{[]byte("a"), []byte("b"), []byte("c")})
+	s2 := dump(rdb.Set{[]byte("c"), []byte("a"), []byte("b")})
+	s3 := dump(rdb.Set{[]byte("a"), []byte("b")})
+	x := dump(rdb.String("x"))
+
+	src := &keyState{typ: "set", pttl: -1, dump: s1}
+	for _, c := range []struct {
+		dst     *keyState
+		problem string
+	}{
+		{&keyState{typ: "set", pttl: -1, dump: s1}, ""},
+		{&keyState{typ: "set", pttl: -1, dump: s2}, ""},
+		{&keyState{typ: "set", pttl: -1, dump: s3}, "value"},
+		{&keyState{typ: "none", pttl: -2}, "missing"},
+		{&keyState{typ: "string", pttl: -1, dump: x}, "type"},
+		{&keyState{typ: "set", pttl: 1000, dump: s1}, "ttl"},
+		{&keyState{typ: "set", err: fmt.Errorf("ERR")}, "error"},
+	} {
+		assert.Must(compareKey(src, c.dst, time.Second) == c.problem)
+	}
+
+	a := &keyState{typ: "string", pttl: 10000, dump: x}
+	assert.Must(compareKey(a, &keyState{typ: "string", pttl: 9500, dump: x}, time.Second) == "")
+	assert.Must(compareKey(a, &keyState{typ: "string", pttl: 8500, dump: x}, time.Second) == "ttl")
+	assert.Must(compareKey(a, &keyState{typ: "string", pttl: -1, dump: x}, time.Second) == "ttl")
+
+	assert.Must(valueChecksum(s1) == valueChecksum(s2))
+	assert.Must(valueChecksum(s1) != valueChecksum(s3))
+	assert.Must(valueChecksum(x) != valueChecksum(dump(rdb.List{[]byte("x")})))
+}
@@ -0,0 +1,139 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+)
+
+// loaderStop tells the rdb loaders to stop handing out entries, for a
+// checkpoint or --max-errors. The entries handed out already are still
+// restored or decoded, the loaders then close their pipes as at the end of
+// the rdb.
+var (
+	loaderStop     = make(chan struct{})
+	loaderStopOnce sync.Once
+)
+
+func stopLoaders() {
+	loaderStopOnce.Do(func() {
+		close(loaderStop)
+	})
+}
+
+func loadersStopped() bool {
+	select {
+	case <-loaderStop:
+		return true
+	default:
+		return false
+	}
+}
+
+// loadPos is the position of the loader of the input: the entries of the rdb
+// handed out, counted from its first one, and the bytes of the input read by
+// then.
+var loadPos struct {
+	entries, offset atomic2.Int64
+}
+
+// resumeEntries is the number of entries of the rdb --resume skips.
+var resumeEntries int64
+
+// checkpointed is set once SIGINT or SIGTERM asked for a checkpoint.
+var checkpointed atomic2.Bool
+
+// loadCheckpoint is the --checkpoint-file of restore and decode: the entries
+// of the rdb handed out, each of them restored or decoded, and the bytes of
+// the input read up to the last one.
+type loadCheckpoint struct {
+	Entries int64 `json:"entries"`
+	Offset  int64 `json:"offset"`
+}
+
+// readCheckpointFile reads the checkpoint file, a missing file means nothing
+// to resume and returns nil.
+func readCheckpointFile(name string) (*loadCheckpoint, error) {
+	p, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	c := &loadCheckpoint{}
+	if err := json.Unmarshal(p, c); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if c.Entries < 0 || c.Offset < 0 {
+		return nil, errors.Errorf("invalid checkpoint '%s'", strings.TrimSpace(string(p)))
+	}
+	return c, nil
+}
+
+func writeCheckpointFile(name string, c *loadCheckpoint) error {
+	p, err := json.Marshal(c)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return writeRenameFile(name, append(p, '\n'))
+}
+
+// initCheckpoint sets up --resume and --checkpoint-on-signal for restore and
+// decode, both need --checkpoint-file.
+func initCheckpoint(name string) {
+	if !args.resume && !args.checkpointOnSignal {
+		return
+	}
+	file := args.checkpointFile
+	if len(file) == 0 {
+		log.Panicf("%s: --resume and --checkpoint-on-signal need --checkpoint-file", name)
+	}
+	if args.resume {
+		c, err := readCheckpointFile(file)
+		if err != nil {
+			log.PanicErrorf(err, "read checkpoint file '%s' failed", file)
+		}
+		if c == nil {
+			log.Infof("%s: no checkpoint in '%s', start from the first entry", name, file)
+		} else {
+			resumeEntries = c.Entries
+			log.Infof("%s: resume after %d entries, offset = %d", name, c.Entries, c.Offset)
+		}
+	}
+	if args.checkpointOnSignal {
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+			sig := <-c
+			log.Infof("%s: got %s, finish the entries loaded and write checkpoint", name, sig)
+			checkpointed.Set(true)
+			stopLoaders()
+		}()
+	}
+}
+
+// writeCheckpoint writes --checkpoint-file once every entry handed out is
+// processed, it returns false when no checkpoint was asked for.
+func writeCheckpoint(name string) bool {
+	if !checkpointed.Get() {
+		return false
+	}
+	c := &loadCheckpoint{Entries: loadPos.entries.Get(), Offset: loadPos.offset.Get()}
+	if err := writeCheckpointFile(args.checkpointFile, c); err != nil {
+		log.PanicErrorf(err, "write checkpoint file '%s' failed", args.checkpointFile)
+	}
+	log.Infof("%s: checkpoint entries = %d, offset = %d written to '%s'", name, c.Entries, c.Offset, args.checkpointFile)
+	return true
+}
@@ -0,0 +1,83 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/libs/atomic2"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+func TestCheckpointFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.MustNoError(err)
+	defer os.RemoveAll(dir)
+	name := dir + "/checkpoint"
+
+	c, err := readCheckpointFile(name)
+	assert.MustNoError(err)
+	assert.Must(c == nil)
+
+	x := &loadCheckpoint{Entries: 12, Offset: 3456}
+	assert.MustNoError(writeCheckpointFile(name, x))
+	c, err = readCheckpointFile(name)
+	assert.MustNoError(err)
+	assert.Must(*c == *x)
+
+	for _, p := range []string{"", "x", `{"entries":-1,"offset":0}`} {
+		assert.MustNoError(ioutil.WriteFile(name, []byte(p), 0644))
+		_, err := readCheckpointFile(name)
+		assert.Must(err != nil)
+	}
+}
+
+func newTestRDB(n int) []byte {
+	var b bytes.Buffer
+	w := rdb.NewWriter(&b)
+	assert.MustNoError(w.WriteHeader())
+	for i := 0; i < n; i++ {
+		assert.MustNoError(w.WriteString([]byte(fmt.Sprintf("k%d", i)), []byte("v"), 0))
+	}
+	assert.MustNoError(w.WriteFooter())
+	return b.Bytes()
+}
+
+func TestRDBLoaderResume(t *testing.T) {
+	resumeEntries = 3
+	defer func() {
+		resumeEntries = 0
+	}()
+	var rbytes atomic2.Int64
+	var keys []string
+	for e := range newRDBLoader(bufio.NewReader(bytes.NewReader(newTestRDB(5))), &rbytes, 0) {
+		keys = append(keys, string(e.Key))
+	}
+	assert.Must(len(keys) == 2 && keys[0] == "k3" && keys[1] == "k4")
+	assert.Must(loadPos.entries.Get() == 5)
+}
+
+func TestRDBLoaderStop(t *testing.T) {
+	defer func() {
+		loaderStop, loaderStopOnce = make(chan struct{}), sync.Once{}
+	}()
+	var rbytes atomic2.Int64
+	pipe := newRDBLoader(bufio.NewReader(bytes.NewReader(newTestRDB(100))), &rbytes, 0)
+	n := 0
+	for _ = range pipe {
+		if n++; n == 2 {
+			stopLoaders()
+		}
+	}
+	// every entry handed out is counted, and none after the stop.
+	assert.Must(n >= 2 && n < 100)
+	assert.Must(loadPos.entries.Get() == int64(n))
+}
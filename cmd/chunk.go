@@ -0,0 +1,260 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/bytesize"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// maxBulkLen is the proto-max-bulk-len of the target, payloads larger than
+// it are rebuilt with plain type commands instead of RESTORE. 0 means unknown.
+var maxBulkLen int64
+
+const (
+	// defaultMaxBulkLen is the limit of servers without proto-max-bulk-len.
+	defaultMaxBulkLen = bytesize.MB * 512
+
+	chunkSize  = bytesize.MB * 4
+	chunkCount = 512
+)
+
+// detectMaxBulkLen asks the target for its proto-max-bulk-len. When it can't
+// be detected, defaultMaxBulkLen is assumed, or with --prefer-restore-over-
+// rebuild no limit at all: a key is only rebuilt when RESTORE would certainly
+// fail, every other payload is sent with a single RESTORE.
+func detectMaxBulkLen(target, passwd string) int64 {
+	c := openRedisConn(target, passwd)
+	defer c.Close()
+	return maxBulkLenOf(c, target)
+}
+
+func maxBulkLenOf(c redigo.Conn, target string) int64 {
+	var assume int64 = defaultMaxBulkLen
+	if args.preferRestore {
+		assume = 0
+	}
+	values, err := redigo.Strings(c.Do("config", "get", "proto-max-bulk-len"))
+	if err != nil || len(values) != 2 {
+		log.Warnf("detect proto-max-bulk-len of '%s' failed, assume %d", target, assume)
+		return assume
+	}
+	n, err := strconv.ParseInt(values[1], 10, 64)
+	if err != nil || n <= 0 {
+		log.Warnf("invalid proto-max-bulk-len = '%s', assume %d", values[1], assume)
+		return assume
+	}
+	return n
+}
+
+// oversized reports whether the payload can't be sent as a single bulk.
+func oversized(p []byte) bool {
+	return maxBulkLen != 0 && int64(len(p)) > maxBulkLen
+}
+
+// rebuilt reports whether the payload has to be restored by restoreChunked,
+// because it's too large or its encoding is too new for the target.
+func rebuilt(p []byte) bool {
+	return oversized(p) || !targetRestores(p)
+}
+
+// restoreChunked rebuilds the key from its decoded value, sending at most
+// chunkCount elements or chunkSize bytes per command. It stops at the first
+// command that fails, the key is then left partly rebuilt.
+func restoreChunked(c redigo.Conn, e *rdb.BinEntry, ttlms uint64) error {
+	o, err := rdb.DecodeDump(e.Value)
+	if err != nil {
+		return errors.Errorf("decode key '%s' failed: %s", e.Key, err)
+	}
+	if oversized(e.Value) {
+		log.Infof("restore key '%s' in chunks, payload = %d > proto-max-bulk-len = %d", e.Key, len(e.Value), maxBulkLen)
+	} else {
+		log.Infof("restore key '%s' in chunks, its encoding is too new for target version %s", e.Key, targetVersion)
+	}
+
+	size := int64(chunkSize)
+	if maxBulkLen != 0 && maxBulkLen < size {
+		size = maxBulkLen
+	}
+
+	if _, err := c.Do(delCmd(), e.Key); err != nil {
+		return errors.Errorf("%s key '%s' failed: %s", delCmd(), e.Key, err)
+	}
+
+	var lasterr error
+	rebuildCommands(o, size, func(cmd string, argv ...interface{}) {
+		if lasterr != nil {
+			return
+		}
+		name, cmdArgs := commandArgs(cmd, e.Key, argv)
+		if _, err := c.Do(name, cmdArgs...); err != nil {
+			lasterr = errors.Errorf("%s key '%s' failed: %s", cmd, e.Key, err)
+		}
+	})
+	if lasterr != nil {
+		return lasterr
+	}
+
+	if ttlms != 0 {
+		if _, err := c.Do("pexpire", e.Key, ttlms); err != nil {
+			return errors.Errorf("pexpire key '%s' failed: %s", e.Key, err)
+		}
+	}
+	return nil
+}
+
+// rebuildCommands calls do with the type commands rebuilding the decoded
+// value o on an empty key, every one of them carrying at most chunkCount
+// elements or size bytes. The key is left out of argv, see commandArgs.
+func rebuildCommands(o interface{}, size int64, do func(cmd string, argv ...interface{})) {
+	var cmd string
+	var argv []interface{}
+	var nbytes int64
+	flush := func() {
+		if len(argv) == 0 {
+			return
+		}
+		do(cmd, argv...)
+		argv, nbytes = argv[:0], 0
+	}
+	push := func(values ...[]byte) {
+		for _, v := range values {
+			argv = append(argv, v)
+			nbytes += int64(len(v))
+		}
+		if len(argv) >= chunkCount || nbytes >= size {
+			flush()
+		}
+	}
+
+	switch obj := o.(type) {
+	default:
+		log.Panicf("unknown object %v", o)
+	case rdb.String:
+		cmd = "append"
+		for p := []byte(obj); len(p) != 0; {
+			n := len(p)
+			if int64(n) > size {
+				n = int(size)
+			}
+			push(p[:n])
+			flush()
+			p = p[n:]
+		}
+	case rdb.List:
+		cmd = "rpush"
+		for _, ele := range obj {
+			push(ele)
+		}
+	case rdb.Set:
+		cmd = "sadd"
+		for _, ele := range obj {
+			push(ele)
+		}
+	case rdb.Hash:
+		cmd = "hmset"
+		var expires rdb.Hash
+		for _, ele := range obj {
+			push(ele.Field, ele.Value)
+			if ele.ExpireAt != 0 {
+				expires = append(expires, ele)
+			}
+		}
+		if len(expires) == 0 {
+			break
+		}
+		flush()
+		if !targetHas("HEXPIRE") {
+			log.Warnf("target version %s has no field expires, drop expires of %d fields", targetVersion, len(expires))
+			break
+		}
+		for _, ele := range expires {
+			do("hpexpireat", ele.ExpireAt, "FIELDS", 1, ele.Field)
+		}
+	case rdb.ZSet:
+		cmd = "zadd"
+		for _, ele := range obj {
+			push([]byte(strconv.FormatFloat(ele.Score, 'g', -1, 64)), ele.Member)
+		}
+	case rdb.Stream:
+		rebuildStream(&obj, do)
+	case rdb.Module:
+		log.Panicf("value of module %s can't be rebuilt, load the module on a target of 4.0+ to restore it", obj.Name)
+	}
+	flush()
+}
+
+// rebuildStream calls do with the commands rebuilding the stream: an XADD per
+// entry, XSETID for the last ID, then XGROUP CREATE per consumer group and an
+// XCLAIM per pending entry, recreating the PEL with its delivery time, count
+// and owner. A stream without entries is created by an XADD trimmed to none.
+// Commands with a subcommand have it in cmd, e.g. "xgroup create", the key
+// goes right after it.
+func rebuildStream(obj *rdb.Stream, do func(cmd string, argv ...interface{})) {
+	for _, ent := range obj.Entries {
+		argv := []interface{}{ent.ID.String()}
+		for _, f := range ent.Fields {
+			argv = append(argv, f.Field, f.Value)
+		}
+		do("xadd", argv...)
+	}
+	if len(obj.Entries) == 0 {
+		id := obj.LastID
+		if id == (rdb.StreamID{}) {
+			id.Seq = 1
+		}
+		do("xadd", "MAXLEN", 0, id.String(), "", "")
+	}
+	// entries added and read are only saved by 7.0+, they are 0 otherwise.
+	counters := targetHas("ENTRIESADDED") && obj.EntriesAdded != 0
+	if counters {
+		do("xsetid", obj.LastID.String(), "ENTRIESADDED", obj.EntriesAdded, "MAXDELETEDID", obj.MaxDeletedID.String())
+	} else {
+		do("xsetid", obj.LastID.String())
+	}
+
+	for _, g := range obj.Groups {
+		if counters && g.EntriesRead >= 0 {
+			do("xgroup create", g.Name, g.LastID.String(), "ENTRIESREAD", g.EntriesRead)
+		} else {
+			do("xgroup create", g.Name, g.LastID.String())
+		}
+		pending := make(map[rdb.StreamID]*rdb.StreamPending, len(g.Pending))
+		for _, p := range g.Pending {
+			pending[p.ID] = p
+		}
+		for _, c := range g.Consumers {
+			if len(c.Pending) == 0 {
+				if targetHas("CREATECONSUMER") {
+					do("xgroup createconsumer", g.Name, c.Name)
+				}
+				continue
+			}
+			for _, id := range c.Pending {
+				p := pending[id]
+				if p == nil {
+					continue
+				}
+				do("xclaim", g.Name, c.Name, 0, id.String(), "TIME", p.DeliveryTime, "RETRYCOUNT", p.DeliveryCount, "FORCE", "JUSTID")
+			}
+		}
+	}
+}
+
+// commandArgs returns the command and arguments of a rebuild command of the
+// key, cmd may hold a subcommand the key follows.
+func commandArgs(cmd string, key []byte, argv []interface{}) (string, []interface{}) {
+	var args []interface{}
+	if i := strings.IndexByte(cmd, ' '); i >= 0 {
+		cmd, args = cmd[:i], []interface{}{cmd[i+1:]}
+	}
+	args = append(args, key)
+	return cmd, append(args, argv...)
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+// brokenConn answers the first n commands, then breaks like a lost
+// connection.
+type brokenConn struct {
+	n    int
+	cmds []string
+	err  error
+}
+
+func (c *brokenConn) Close() error { return nil }
+func (c *brokenConn) Err() error   { return c.err }
+func (c *brokenConn) Flush() error { return nil }
+
+func (c *brokenConn) Send(cmd string, args ...interface{}) error {
+	panic("unexpected send")
+}
+
+func (c *brokenConn) Receive() (interface{}, error) {
+	panic("unexpected receive")
+}
+
+func (c *brokenConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if len(c.cmds) == c.n {
+		c.err = io.ErrUnexpectedEOF
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.cmds = append(c.cmds, cmd)
+	return int64(1), nil
+}
+
+func TestRestoreChunkedBroken(t *testing.T) {
+	var list rdb.List
+	for i := 0; i < chunkCount*3; i++ {
+		list = append(list, []byte(fmt.Sprint(i)))
+	}
+	p, err := rdb.EncodeDump(list)
+	assert.MustNoError(err)
+	e := &rdb.BinEntry{Key: []byte("list"), Value: p}
+
+	c := &brokenConn{n: 100}
+	assert.MustNoError(restoreChunked(c, e, 1000))
+	assert.Must(len(c.cmds) == 5 && c.cmds[4] == "pexpire")
+
+	// the connection breaks on the second chunk.
+	c = &brokenConn{n: 2}
+	assert.Must(restoreChunked(c, e, 0) != nil && len(c.cmds) == 2)
+
+	// a fan-out target retries the entry on a new connection.
+	bulk := maxBulkLen
+	maxBulkLen = 16
+	defer func() {
+		maxBulkLen = bulk
+	}()
+	var lastdb uint32
+	target := &syncTarget{addr: "127.0.0.1:1"}
+	assert.Must(!target.restore(&brokenConn{n: 2}, &lastdb, e))
+	assert.Must(target.restore(&brokenConn{n: len(list) + 2}, &lastdb, e))
+}
+
+// replyConn answers every command with reply and err.
+type replyConn struct {
+	reply interface{}
+	err   error
+}
+
+func (c *replyConn) Close() error                                            { return nil }
+func (c *replyConn) Err() error                                              { return nil }
+func (c *replyConn) Flush() error                                            { return nil }
+func (c *replyConn) Send(cmd string, args ...interface{}) error              { return nil }
+func (c *replyConn) Receive() (interface{}, error)                           { return c.reply, c.err }
+func (c *replyConn) Do(cmd string, args ...interface{}) (interface{}, error) { return c.reply, c.err }
+
+func TestMaxBulkLenOf(t *testing.T) {
+	prefer := args.preferRestore
+	defer func() {
+		args.preferRestore = prefer
+	}()
+
+	reply := func(values ...string) *replyConn {
+		var l []interface{}
+		for _, v := range values {
+			l = append(l, []byte(v))
+		}
+		return &replyConn{reply: l}
+	}
+	assert.Must(maxBulkLenOf(reply("proto-max-bulk-len", "1048576"), "target") == 1048576)
+
+	for _, preferRestore := range []bool{false, true} {
+		args.preferRestore = preferRestore
+		var assume int64 = defaultMaxBulkLen
+		if preferRestore {
+			assume = 0
+		}
+		for _, c := range []*replyConn{
+			{err: redigo.Error("ERR unknown command 'config'")},
+			{err: redigo.Error("NOPERM this user has no permissions to run the 'config' command")},
+			{err: io.ErrUnexpectedEOF},
+			reply(),
+			reply("proto-max-bulk-len", "x"),
+			reply("proto-max-bulk-len", "0"),
+		} {
+			assert.Must(maxBulkLenOf(c, "target") == assume)
+		}
+	}
+}
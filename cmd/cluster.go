@@ -0,0 +1,632 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/redis"
+)
+
+const (
+	clusterSlots = 16384
+
+	// clusterMaxRedirects bounds the MOVED/ASK/TRYAGAIN a single command may
+	// go through before its last error is returned.
+	clusterMaxRedirects = 16
+
+	clusterRetryInterval = time.Millisecond * 100
+
+	// clusterProbeTimeout bounds the PING of the preflight to a master.
+	clusterProbeTimeout = time.Second * 5
+)
+
+// cluster is the slot map of the --target-cluster, shared by every
+// connection to it. MOVED replies update it slot by slot.
+type cluster struct {
+	mu      sync.RWMutex
+	seeds   []string
+	masters [clusterSlots]string
+
+	dial  func(addr string) redigo.Conn
+	probe func(addr string) error
+}
+
+// parseCluster parses the comma separated host:port of --target-cluster, any
+// node of the cluster will do, the others are found by CLUSTER SLOTS.
+func parseCluster(s string, passwd string) (*cluster, error) {
+	cl := &cluster{}
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, errors.Trace(err)
+		}
+		cl.seeds = append(cl.seeds, addr)
+	}
+	if len(cl.seeds) == 0 {
+		return nil, errors.Errorf("invalid cluster nodes '%s', should be HOST:PORT[,HOST:PORT...]", s)
+	}
+	cl.dial = func(addr string) redigo.Conn {
+		return redigo.NewConn(countConn(limitConn(openNetConn(addr, passwd, args.targetConf))), 0, 0)
+	}
+	cl.probe = func(addr string) error {
+		nc := openNetConnSoft(addr, passwd, args.targetConf)
+		if nc == nil {
+			return errors.Errorf("cannot connect to '%s'", addr)
+		}
+		c := redigo.NewConn(nc, clusterProbeTimeout, clusterProbeTimeout)
+		defer c.Close()
+		_, err := c.Do("ping")
+		return errors.Trace(err)
+	}
+	return cl, nil
+}
+
+// clusterRange is a range of slots served by a master, both ends included.
+type clusterRange struct {
+	from, to int
+	addr     string
+}
+
+// parseClusterSlots parses the reply of CLUSTER SLOTS sent to the node from,
+// masters announced without ip are reached on the host of from.
+func parseClusterSlots(reply interface{}, from string) ([]*clusterRange, error) {
+	list, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("invalid cluster slots reply %v", reply)
+	}
+	host, _, err := net.SplitHostPort(from)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var ranges []*clusterRange
+	for _, x := range list {
+		r, ok := x.([]interface{})
+		if !ok || len(r) < 3 {
+			return nil, errors.Errorf("invalid cluster slots range %v", x)
+		}
+		node, ok := r[2].([]interface{})
+		if !ok || len(node) < 2 {
+			return nil, errors.Errorf("invalid cluster slots master %v", r[2])
+		}
+		lo, ok1 := r[0].(int64)
+		hi, ok2 := r[1].(int64)
+		ip, ok3 := node[0].([]byte)
+		port, ok4 := node[1].(int64)
+		if !ok1 || !ok2 || !ok3 || !ok4 || lo < 0 || lo > hi || hi >= clusterSlots {
+			return nil, errors.Errorf("invalid cluster slots range %v", x)
+		}
+		if len(ip) == 0 || string(ip) == "?" {
+			ip = []byte(host)
+		}
+		addr := net.JoinHostPort(string(ip), strconv.FormatInt(port, 10))
+		ranges = append(ranges, &clusterRange{from: int(lo), to: int(hi), addr: addr})
+	}
+	return ranges, nil
+}
+
+// Refresh loads the slot map from the first node, among the seeds and the
+// masters already known, that answers CLUSTER SLOTS.
+func (cl *cluster) Refresh() error {
+	nodes := append(append([]string{}, cl.seeds...), cl.Masters()...)
+	var lasterr error
+	for _, addr := range nodes {
+		c := cl.dial(addr)
+		reply, err := c.Do("cluster", "slots")
+		c.Close()
+		if err != nil {
+			lasterr = errors.Trace(err)
+			continue
+		}
+		ranges, err := parseClusterSlots(reply, addr)
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		var masters [clusterSlots]string
+		for _, r := range ranges {
+			for i := r.from; i <= r.to; i++ {
+				masters[i] = r.addr
+			}
+		}
+		cl.mu.Lock()
+		cl.masters = masters
+		cl.mu.Unlock()
+		return nil
+	}
+	return errors.Errorf("cluster slots of '%s' failed: %v", strings.Join(cl.seeds, ","), lasterr)
+}
+
+// Master returns the address of the master serving the slot, or "" if no
+// node does.
+func (cl *cluster) Master(slot int) string {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.masters[slot]
+}
+
+func (cl *cluster) setMaster(slot int, addr string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.masters[slot] = addr
+}
+
+// Masters returns the addresses of the masters, sorted.
+func (cl *cluster) Masters() []string {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	seen := make(map[string]bool)
+	var list []string
+	for _, addr := range cl.masters {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			list = append(list, addr)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+var crc16Table [256]uint16
+
+func init() {
+	for i := range crc16Table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+// crc16 is CRC-16/XMODEM, which redis cluster maps keys to slots with.
+func crc16(p []byte) uint16 {
+	var crc uint16
+	for _, b := range p {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// keySlot returns the slot of a key, only the hash tag counts when the key
+// has one.
+func keySlot(key []byte) int {
+	if tag := hashTag(key); tag != nil {
+		key = tag
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// clusterBroadcast are sent to every master, the reply of the first one is
+// returned.
+var clusterBroadcast = map[string]bool{
+	"flushall": true, "flushdb": true, "script": true, "function": true,
+}
+
+// clusterSplit are the multi-key commands sent as one command per slot when
+// their keys span slots, the integer replies are added up, MSET answers OK.
+// Other commands with keys in several slots can't be applied to a cluster.
+var clusterSplit = map[string]bool{
+	"del": true, "unlink": true, "exists": true, "touch": true, "mset": true,
+}
+
+// clusterAnywhere are the commands without keys any master may answer, other
+// keyless commands, e.g. SWAPDB or a script without KEYS, can't be routed.
+var clusterAnywhere = map[string]bool{
+	"ping": true, "publish": true,
+}
+
+// clusterCall is a command routed to its nodes, reply is set for commands
+// answered without asking any node. A command split per slot has a part for
+// every slot instead.
+type clusterCall struct {
+	cmd   string
+	args  []interface{}
+	slot  int
+	addrs []string
+	conns []redigo.Conn
+	parts []*clusterCall
+
+	reply interface{}
+	err   error
+}
+
+// clusterConn is a redigo.Conn to every master of the cluster: commands go
+// to the master of the slot of their keys, following MOVED and ASK.
+// Like redigo's, Send and Flush may be called by one goroutine while another
+// calls Receive, commands are answered in the order they were sent; Do must
+// not be mixed with a concurrent Receive.
+//
+// Transactions can't span slots, MULTI, EXEC and DISCARD are answered
+// without being sent, the commands between them run one by one. SELECT is
+// only allowed for db 0.
+type clusterConn struct {
+	cl *cluster
+
+	conns   map[string]redigo.Conn
+	pending chan *clusterCall
+
+	// spares are used by Receive for redirects, the commands pipelined on
+	// conns may still be waiting for their replies.
+	spares map[string]redigo.Conn
+}
+
+func newClusterConn(cl *cluster) *clusterConn {
+	return &clusterConn{
+		cl:      cl,
+		conns:   make(map[string]redigo.Conn),
+		pending: make(chan *clusterCall, 1024),
+		spares:  make(map[string]redigo.Conn),
+	}
+}
+
+func openConn(conns map[string]redigo.Conn, cl *cluster, addr string) redigo.Conn {
+	c := conns[addr]
+	if c == nil {
+		c = cl.dial(addr)
+		conns[addr] = c
+	}
+	return c
+}
+
+func argBytes(v interface{}) []byte {
+	switch x := v.(type) {
+	case []byte:
+		return x
+	case string:
+		return []byte(x)
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+// route finds the nodes of a command, or answers it.
+func (c *clusterConn) route(cmd string, argv []interface{}) *clusterCall {
+	cmd = strings.ToLower(cmd)
+	call := &clusterCall{cmd: cmd, args: argv}
+	switch cmd {
+	case "select":
+		if len(argv) == 1 && string(argBytes(argv[0])) == "0" {
+			call.reply = "OK"
+		} else {
+			call.err = errors.Errorf("redis cluster only has db 0, move the keys to it with --target-db=0")
+		}
+		return call
+	case "multi", "discard":
+		call.reply = "OK"
+		return call
+	case "exec":
+		call.reply = []interface{}{}
+		return call
+	}
+	if clusterBroadcast[cmd] {
+		call.addrs = c.cl.Masters()
+		return call
+	}
+	bargs := make([][]byte, len(argv))
+	for i, a := range argv {
+		bargs[i] = argBytes(a)
+	}
+	keys := commandKeys(cmd, bargs)
+	if len(keys) == 0 {
+		if !clusterAnywhere[cmd] {
+			call.err = errors.Errorf("command '%s' has no key, it can't be routed to a master of the cluster", cmd)
+			return call
+		}
+		c.locate(call, false)
+		return call
+	}
+	call.slot = keySlot(bargs[keys[0]])
+	for _, i := range keys[1:] {
+		if keySlot(bargs[i]) == call.slot {
+			continue
+		}
+		if !clusterSplit[cmd] {
+			call.err = errors.Errorf("CROSSSLOT keys of command '%s' don't hash to the same slot", cmd)
+			return call
+		}
+		return c.split(call, bargs, keys)
+	}
+	c.locate(call, true)
+	return call
+}
+
+// locate sets the master of the call, the one of its slot if keyed. A slot
+// no master is known for goes to the first master, which redirects it.
+func (c *clusterConn) locate(call *clusterCall, keyed bool) {
+	if keyed {
+		if addr := c.cl.Master(call.slot); addr != "" {
+			call.addrs = []string{addr}
+			return
+		}
+	}
+	if masters := c.cl.Masters(); len(masters) != 0 {
+		call.addrs = masters[:1]
+		return
+	}
+	call.err = errors.Errorf("no master serves slot %d", call.slot)
+}
+
+// split makes a part of the call for every slot of its keys, each with the
+// keys of that slot in their order, and the values of MSET.
+func (c *clusterConn) split(call *clusterCall, bargs [][]byte, keys []int) *clusterCall {
+	step := 1
+	if call.cmd == "mset" {
+		step = 2
+	}
+	parts := make(map[int]*clusterCall)
+	for _, i := range keys {
+		slot := keySlot(bargs[i])
+		p := parts[slot]
+		if p == nil {
+			p = &clusterCall{cmd: call.cmd, slot: slot}
+			parts[slot] = p
+			call.parts = append(call.parts, p)
+		}
+		j := i + step
+		if j > len(call.args) {
+			j = len(call.args)
+		}
+		p.args = append(p.args, call.args[i:j]...)
+	}
+	for _, p := range call.parts {
+		if c.locate(p, true); p.err != nil {
+			call.err = p.err
+			break
+		}
+	}
+	return call
+}
+
+func (c *clusterConn) Close() error {
+	for _, conns := range []map[string]redigo.Conn{c.conns, c.spares} {
+		for _, x := range conns {
+			x.Close()
+		}
+	}
+	return nil
+}
+
+func (c *clusterConn) Err() error {
+	return nil
+}
+
+func (c *clusterConn) Send(cmd string, argv ...interface{}) error {
+	call := c.route(cmd, argv)
+	if call.err != nil {
+		return call.err
+	}
+	parts := call.parts
+	if len(parts) == 0 {
+		parts = []*clusterCall{call}
+	}
+	for _, p := range parts {
+		for _, addr := range p.addrs {
+			x := openConn(c.conns, c.cl, addr)
+			if err := x.Send(p.cmd, p.args...); err != nil {
+				return err
+			}
+			p.conns = append(p.conns, x)
+		}
+	}
+	select {
+	case c.pending <- call:
+	default:
+		// the receiver may be waiting for a reply not flushed yet.
+		if err := c.Flush(); err != nil {
+			return err
+		}
+		c.pending <- call
+	}
+	return nil
+}
+
+func (c *clusterConn) Flush() error {
+	for _, x := range c.conns {
+		if err := x.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	call := <-c.pending
+	if len(call.parts) != 0 {
+		return c.receiveParts(call)
+	}
+	return c.receive(call)
+}
+
+// receiveParts reads the replies of every part of a split call, the first
+// error is returned once all of them are read.
+func (c *clusterConn) receiveParts(call *clusterCall) (interface{}, error) {
+	var n int64
+	var err error
+	for _, p := range call.parts {
+		r, e := c.receive(p)
+		if e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		if x, ok := r.(int64); ok {
+			n += x
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if call.cmd == "mset" {
+		return "OK", nil
+	}
+	return n, nil
+}
+
+func (c *clusterConn) receive(call *clusterCall) (interface{}, error) {
+	if len(call.conns) == 0 {
+		return call.reply, call.err
+	}
+	var reply interface{}
+	var err error
+	for i, x := range call.conns {
+		r, e := x.Receive()
+		if i == 0 {
+			reply, err = r, e
+		} else if err == nil && e != nil {
+			reply, err = r, e
+		}
+	}
+	if len(call.conns) != 1 {
+		return reply, err
+	}
+	return c.redirect(call, reply, err)
+}
+
+func (c *clusterConn) Do(cmd string, argv ...interface{}) (interface{}, error) {
+	if len(c.pending) != 0 {
+		if err := c.Flush(); err != nil {
+			return nil, err
+		}
+		for len(c.pending) != 0 {
+			c.Receive()
+		}
+	}
+	if cmd == "" {
+		return nil, nil
+	}
+	if err := c.Send(cmd, argv...); err != nil {
+		return nil, err
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	return c.Receive()
+}
+
+// redirect follows MOVED, ASK and TRYAGAIN until the command is answered by
+// the node serving its slot.
+func (c *clusterConn) redirect(call *clusterCall, reply interface{}, err error) (interface{}, error) {
+	from := call.addrs[0]
+	for i := 0; i < clusterMaxRedirects; i++ {
+		e, ok := err.(redigo.Error)
+		if !ok {
+			return reply, err
+		}
+		f := strings.Fields(string(e))
+		switch {
+		case len(f) == 3 && (f[0] == "MOVED" || f[0] == "ASK"):
+			slot, perr := strconv.Atoi(f[1])
+			if perr != nil || slot < 0 || slot >= clusterSlots {
+				return reply, e
+			}
+			addr := f[2]
+			if strings.HasPrefix(addr, ":") {
+				host, _, _ := net.SplitHostPort(from)
+				addr = net.JoinHostPort(host, addr[1:])
+			}
+			x := openConn(c.spares, c.cl, addr)
+			if f[0] == "MOVED" {
+				c.cl.setMaster(slot, addr)
+				reply, err = x.Do(call.cmd, call.args...)
+			} else {
+				reply, err = c.asking(x, call)
+			}
+			from = addr
+		case len(f) != 0 && (f[0] == "TRYAGAIN" || f[0] == "CLUSTERDOWN"):
+			time.Sleep(clusterRetryInterval)
+			if from = c.cl.Master(call.slot); from == "" {
+				return reply, e
+			}
+			reply, err = openConn(c.spares, c.cl, from).Do(call.cmd, call.args...)
+		default:
+			return reply, err
+		}
+	}
+	return reply, err
+}
+
+// asking sends the command to the node importing its slot, preceded by
+// ASKING, the slot map is left as it is until the migration is done.
+func (c *clusterConn) asking(x redigo.Conn, call *clusterCall) (interface{}, error) {
+	if err := x.Send("asking"); err != nil {
+		return nil, err
+	}
+	if err := x.Send(call.cmd, call.args...); err != nil {
+		return nil, err
+	}
+	if err := x.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := x.Receive(); err != nil {
+		x.Receive()
+		return nil, err
+	}
+	return x.Receive()
+}
+
+// openClusterStream returns the writer of the command stream for a cluster
+// target: the RESP commands written to it are routed to their masters, and
+// the replies read in the background, errors are logged. A command that
+// can't be routed, keyless or with keys across slots, aborts the stream.
+func openClusterStream(cl *cluster) io.WriteCloser {
+	r, w := io.Pipe()
+	c := newClusterConn(cl)
+	go func() {
+		defer c.Close()
+		br := bufio.NewReaderSize(r, ReaderBufferSize)
+		for {
+			resp, err := redis.Decode(br)
+			if err != nil {
+				r.CloseWithError(err)
+				return
+			}
+			scmd, argv, err := redis.ParseArgs(resp)
+			if err != nil {
+				log.PanicError(err, "parse command arguments failed")
+			}
+			x := make([]interface{}, len(argv))
+			for i, a := range argv {
+				x[i] = a
+			}
+			if err := c.Send(scmd, x...); err != nil {
+				log.PanicErrorf(err, "send command '%s' to cluster failed", scmd)
+			}
+			if br.Buffered() == 0 {
+				if err := c.Flush(); err != nil {
+					log.PanicError(err, "flush cluster commands failed")
+				}
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := c.Receive(); err != nil {
+				if _, ok := err.(redigo.Error); !ok {
+					log.PanicError(err, "receive cluster reply failed")
+				}
+				log.Warnf("cluster: command error: %s", err)
+			}
+		}
+	}()
+	return w
+}
@@ -0,0 +1,304 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+func TestKeySlot(t *testing.T) {
+	assert.Must(crc16([]byte("123456789")) == 0x31c3)
+	assert.Must(keySlot([]byte("foo")) == 12182)
+	assert.Must(keySlot([]byte("bar")) == 5061)
+	assert.Must(keySlot([]byte("{user1000}.following")) == keySlot([]byte("{user1000}.followers")))
+	assert.Must(keySlot([]byte("{user1000}.following")) == keySlot([]byte("user1000")))
+	assert.Must(keySlot([]byte("foo{bar}{zap}")) == keySlot([]byte("bar")))
+	assert.Must(keySlot([]byte("foo{{bar}}zap")) == keySlot([]byte("{bar")))
+	assert.Must(keySlot([]byte("foo{}{bar}")) == int(crc16([]byte("foo{}{bar}"))%clusterSlots))
+}
+
+func TestParseClusterSlots(t *testing.T) {
+	node := func(ip string, port int64) []interface{} {
+		return []interface{}{[]byte(ip), port, []byte("id")}
+	}
+	reply := []interface{}{
+		[]interface{}{int64(0), int64(5460), node("10.0.0.1", 7000), node("10.0.0.4", 7003)},
+		[]interface{}{int64(5461), int64(16383), node("", 7001)},
+	}
+	ranges, err := parseClusterSlots(reply, "10.0.0.9:7005")
+	assert.MustNoError(err)
+	assert.Must(len(ranges) == 2)
+	assert.Must(ranges[0].from == 0 && ranges[0].to == 5460 && ranges[0].addr == "10.0.0.1:7000")
+	assert.Must(ranges[1].from == 5461 && ranges[1].to == 16383 && ranges[1].addr == "10.0.0.9:7001")
+
+	for _, x := range []interface{}{
+		"ERR",
+		[]interface{}{[]interface{}{int64(0), int64(16384), node("a", 1)}},
+		[]interface{}{[]interface{}{int64(10), int64(9), node("a", 1)}},
+		[]interface{}{[]interface{}{int64(0), int64(1)}},
+	} {
+		_, err := parseClusterSlots(x, "a:1")
+		assert.Must(err != nil)
+	}
+
+	_, err = parseCluster("a:1, b:2", "")
+	assert.MustNoError(err)
+	for _, s := range []string{"", ",", "a"} {
+		_, err := parseCluster(s, "")
+		assert.Must(err != nil)
+	}
+}
+
+// fakeNode serves the slots of owned, keys of other slots get MOVED to
+// their owner, or ASK to it for the slots in migrating.
+type fakeNode struct {
+	addr      string
+	port      int64
+	owned     map[int]bool
+	migrating map[int]string
+	nodes     map[string]*fakeNode
+
+	applied []string
+}
+
+func (n *fakeNode) exec(asking bool, cmd string, argv []interface{}) (interface{}, error) {
+	s := cmd
+	for _, a := range argv {
+		s += " " + string(argBytes(a))
+	}
+	switch cmd {
+	case "cluster":
+		var reply []interface{}
+		for _, x := range n.nodes {
+			for slot := range x.owned {
+				reply = append(reply, []interface{}{int64(slot), int64(slot), []interface{}{[]byte("127.0.0.1"), x.port}})
+			}
+		}
+		return reply, nil
+	case "flushall":
+		n.applied = append(n.applied, s)
+		return "OK", nil
+	case "ping":
+		return "PONG", nil
+	case "randomkey":
+		return []byte(n.addr), nil
+	}
+	slot := keySlot(argBytes(argv[0]))
+	if to := n.migrating[slot]; to != "" {
+		return nil, redigo.Error(fmt.Sprintf("ASK %d %s", slot, to))
+	}
+	if !n.owned[slot] && !asking {
+		for _, x := range n.nodes {
+			if x.owned[slot] {
+				return nil, redigo.Error(fmt.Sprintf("MOVED %d %s", slot, x.addr))
+			}
+		}
+	}
+	n.applied = append(n.applied, s)
+	if cmd == "del" {
+		return int64(len(argv)), nil
+	}
+	return "OK", nil
+}
+
+// fakeNodeConn is a connection to a fakeNode.
+type fakeNodeConn struct {
+	node   *fakeNode
+	asking bool
+	queue  [][]interface{}
+}
+
+func (c *fakeNodeConn) Close() error { return nil }
+func (c *fakeNodeConn) Err() error   { return nil }
+func (c *fakeNodeConn) Flush() error { return nil }
+
+func (c *fakeNodeConn) Send(cmd string, argv ...interface{}) error {
+	c.queue = append(c.queue, append([]interface{}{cmd}, argv...))
+	return nil
+}
+
+func (c *fakeNodeConn) Receive() (interface{}, error) {
+	x := c.queue[0]
+	c.queue = c.queue[1:]
+	cmd := x[0].(string)
+	if cmd == "asking" {
+		c.asking = true
+		return "OK", nil
+	}
+	asking := c.asking
+	c.asking = false
+	return c.node.exec(asking, cmd, x[1:])
+}
+
+func (c *fakeNodeConn) Do(cmd string, argv ...interface{}) (interface{}, error) {
+	c.Send(cmd, argv...)
+	return c.Receive()
+}
+
+func TestClusterConn(t *testing.T) {
+	// "foo" is in slot 12182 and "bar" in 5061.
+	nodes := make(map[string]*fakeNode)
+	for port := int64(1); port <= 2; port++ {
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		nodes[addr] = &fakeNode{addr: addr, port: port, owned: make(map[int]bool), migrating: make(map[int]string), nodes: nodes}
+	}
+	a, b := nodes["127.0.0.1:1"], nodes["127.0.0.1:2"]
+	a.owned[12182], b.owned[5061] = true, true
+	for i := 0; i < clusterSlots; i++ {
+		if i != 12182 && i != 5061 {
+			a.owned[i] = true
+		}
+	}
+	cl, err := parseCluster("127.0.0.1:1", "")
+	assert.MustNoError(err)
+	cl.dial = func(addr string) redigo.Conn {
+		return &fakeNodeConn{node: nodes[addr]}
+	}
+	assert.MustNoError(cl.Refresh())
+	assert.Must(cl.Master(5061) == b.addr && cl.Master(12182) == a.addr)
+	assert.Must(len(cl.Masters()) == 2)
+
+	c := newClusterConn(cl)
+	defer c.Close()
+	_, err = c.Do("set", "bar", "1")
+	assert.MustNoError(err)
+	assert.Must(len(b.applied) == 1 && b.applied[0] == "set bar 1")
+
+	// the slot of bar moves to a, the first MOVED updates the slot map.
+	b.owned[5061], a.owned[5061] = false, true
+	_, err = c.Do("set", "bar", "2")
+	assert.MustNoError(err)
+	assert.Must(cl.Master(5061) == a.addr && a.applied[len(a.applied)-1] == "set bar 2")
+
+	// foo is being migrated to b, ASK leaves the slot map as it is.
+	a.migrating[12182] = b.addr
+	_, err = c.Do("set", "foo", "1")
+	assert.MustNoError(err)
+	assert.Must(cl.Master(12182) == a.addr && b.applied[len(b.applied)-1] == "set foo 1")
+	a.migrating[12182] = ""
+
+	// pipelined replies come back in order, across nodes.
+	a.applied, b.applied = nil, nil
+	cl.setMaster(5061, b.addr)
+	b.owned[5061], a.owned[5061] = true, false
+	for i := 0; i < 3; i++ {
+		assert.MustNoError(c.Send("set", "foo", i))
+		assert.MustNoError(c.Send("set", "bar", i))
+	}
+	assert.MustNoError(c.Flush())
+	for i := 0; i < 6; i++ {
+		_, err := c.Receive()
+		assert.MustNoError(err)
+	}
+	assert.Must(len(a.applied) == 3 && len(b.applied) == 3 && a.applied[2] == "set foo 2")
+
+	// only db 0, transactions are not sent, FLUSHALL goes everywhere.
+	_, err = c.Do("select", 0)
+	assert.MustNoError(err)
+	_, err = c.Do("select", 1)
+	assert.Must(err != nil)
+	_, err = c.Do("multi")
+	assert.MustNoError(err)
+	_, err = c.Do("flushall")
+	assert.MustNoError(err)
+	assert.Must(a.applied[3] == "flushall" && b.applied[3] == "flushall")
+
+	// keys across slots are split per slot, or fail if they can't be.
+	n, err := redigo.Int(c.Do("del", "foo", "bar", "{foo}x"))
+	assert.MustNoError(err)
+	assert.Must(n == 3 && a.applied[4] == "del foo {foo}x" && b.applied[4] == "del bar")
+	_, err = c.Do("mset", "bar", "1", "foo", "2")
+	assert.MustNoError(err)
+	assert.Must(a.applied[5] == "mset foo 2" && b.applied[5] == "mset bar 1")
+	_, err = c.Do("rename", "foo", "bar")
+	assert.Must(err != nil)
+	_, err = c.Do("rename", "foo", "{foo}x")
+	assert.MustNoError(err)
+	_, err = c.Do("swapdb", 0, 1)
+	assert.Must(err != nil)
+	_, err = c.Do("ping")
+	assert.MustNoError(err)
+}
+
+func TestClusterCoverage(t *testing.T) {
+	cl, err := parseCluster("127.0.0.1:1", "")
+	assert.MustNoError(err)
+	down := make(map[string]bool)
+	cl.probe = func(addr string) error {
+		if down[addr] {
+			return fmt.Errorf("cannot connect to '%s'", addr)
+		}
+		return nil
+	}
+	for i := 0; i < clusterSlots; i++ {
+		if i < clusterSlots/2 {
+			cl.setMaster(i, "127.0.0.1:1")
+		} else {
+			cl.setMaster(i, "127.0.0.1:2")
+		}
+	}
+	// "bar" is in slot 5061 and "foo" in 12182.
+	keys := [][]byte{[]byte("bar"), []byte("foo")}
+
+	cov := cl.Coverage(keys)
+	assert.Must(cov.Complete() && cov.SlotPercent() == 100 && cov.KeyPercent() == 100)
+
+	down["127.0.0.1:2"] = true
+	cov = cl.Coverage(keys)
+	assert.Must(!cov.Complete() && cov.unreachable == clusterSlots/2 && cov.unassigned == 0)
+	assert.Must(cov.SlotPercent() == 50 && cov.KeyPercent() == 50)
+	assert.Must(len(cov.down) == 1 && cov.down[0] == "127.0.0.1:2")
+
+	delete(down, "127.0.0.1:2")
+	cl.setMaster(12182, "")
+	cov = cl.Coverage(keys)
+	assert.Must(!cov.Complete() && cov.unassigned == 1 && cov.unreachable == 0 && cov.nmissed == 1)
+}
+
+func TestClusterBatcher(t *testing.T) {
+	nodes := make(map[string]*fakeNode)
+	for port := int64(1); port <= 2; port++ {
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		nodes[addr] = &fakeNode{addr: addr, port: port, owned: make(map[int]bool), migrating: make(map[int]string), nodes: nodes}
+	}
+	a, b := nodes["127.0.0.1:1"], nodes["127.0.0.1:2"]
+	for i := 0; i < clusterSlots; i++ {
+		a.owned[i] = true
+	}
+	delete(a.owned, keySlot([]byte("bar")))
+	b.owned[keySlot([]byte("bar"))] = true
+	cl, err := parseCluster("127.0.0.1:1", "")
+	assert.MustNoError(err)
+	cl.dial = func(addr string) redigo.Conn {
+		return &fakeNodeConn{node: nodes[addr]}
+	}
+	assert.MustNoError(cl.Refresh())
+
+	stats := newClusterNodes()
+	p := newClusterBatcher(cl, 3, pipelineContinue, stats)
+	defer p.Close()
+	restore := func(key string) {
+		assert.Must(len(p.Restore(&rdb.BinEntry{Key: []byte(key), Value: []byte("v")})) == 0)
+	}
+
+	// every master has a batch of its own, a's is sent once it is full.
+	restore("{foo}:1")
+	restore("{bar}:1")
+	restore("{foo}:2")
+	restore("{bar}:2")
+	assert.Must(len(a.applied) == 0 && len(b.applied) == 0)
+	restore("{foo}:3")
+	assert.Must(len(a.applied) == 3 && len(b.applied) == 0)
+
+	assert.Must(len(p.Flush()) == 0)
+	assert.Must(len(a.applied) == 3 && len(b.applied) == 2)
+	assert.Must(stats.Get(a.addr).nentry.Get() == 3 && stats.Get(b.addr).nentry.Get() == 2)
+	assert.Must(stats.Get(b.addr).nbytes.Get() == int64(len("{bar}:1v")*2))
+	assert.Must(len(stats.Counts()) == 2)
+}
@@ -0,0 +1,215 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/bytesize"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// clusterBatchBytes bounds the entries a restore routine buffers for a master
+// of --target-cluster, the batch is sent once it holds --pipeline entries or
+// this many bytes.
+const clusterBatchBytes = bytesize.MB * 4
+
+// entryPipeline is the --pipeline of a restore routine.
+type entryPipeline interface {
+	Restore(e *rdb.BinEntry) []*keyError
+	Flush() []*keyError
+	Report(errs []*keyError)
+}
+
+// clusterNode counts the entries restored to a master of --target-cluster.
+type clusterNode struct {
+	addr string
+
+	nentry, nbytes atomic2.Int64
+
+	// lastn is nentry at the previous stat line.
+	lastn int64
+}
+
+// clusterNodes are the masters restored to, shared by the restore routines.
+type clusterNodes struct {
+	mu    sync.Mutex
+	nodes map[string]*clusterNode
+
+	start, last time.Time
+}
+
+func newClusterNodes() *clusterNodes {
+	now := time.Now()
+	return &clusterNodes{nodes: make(map[string]*clusterNode), start: now, last: now}
+}
+
+func (s *clusterNodes) Get(addr string) *clusterNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.nodes[addr]
+	if n == nil {
+		n = &clusterNode{addr: addr}
+		if addr == "" {
+			n.addr = "unassigned"
+		}
+		s.nodes[addr] = n
+	}
+	return n
+}
+
+func (s *clusterNodes) list() []*clusterNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []string
+	for addr := range s.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var l []*clusterNode
+	for _, addr := range addrs {
+		l = append(l, s.nodes[addr])
+	}
+	return l
+}
+
+// rates returns the nodes and the entries per second restored to each since
+// the last call, it is only called by the stat loop.
+func (s *clusterNodes) rates() ([]*clusterNode, []float64) {
+	now := time.Now()
+	d := now.Sub(s.last).Seconds()
+	s.last = now
+	l := s.list()
+	rates := make([]float64, len(l))
+	for i, n := range l {
+		x := n.nentry.Get()
+		if d > 0 {
+			rates[i] = float64(x-n.lastn) / d
+		}
+		n.lastn = x
+	}
+	return l, rates
+}
+
+// Stat is the part of the stat line on the masters.
+func (s *clusterNodes) Stat() string {
+	var b bytes.Buffer
+	l, rates := s.rates()
+	for i, n := range l {
+		fmt.Fprintf(&b, "  [%s] entry=%d rate=%.0f/s", n.addr, n.nentry.Get(), rates[i])
+	}
+	return b.String()
+}
+
+// Counts is Stat for --stat-format=json.
+func (s *clusterNodes) Counts() []map[string]interface{} {
+	var l []map[string]interface{}
+	nodes, rates := s.rates()
+	for i, n := range nodes {
+		l = append(l, map[string]interface{}{
+			"node": n.addr, "entry": n.nentry.Get(), "bytes": n.nbytes.Get(), "rate": rates[i],
+		})
+	}
+	return l
+}
+
+// Report logs the entries restored to every master and the average rate.
+func (s *clusterNodes) Report() {
+	d := time.Since(s.start).Seconds()
+	for _, n := range s.list() {
+		var rate float64
+		if d > 0 {
+			rate = float64(n.nentry.Get()) / d
+		}
+		log.Infof("restore: node '%s' entry=%d bytes=%d rate=%.0f/s", n.addr, n.nentry.Get(), n.nbytes.Get(), rate)
+	}
+}
+
+// clusterBatcher is the --pipeline of a restore routine for --target-cluster:
+// entries are buffered per master of their slot, and the batch of a master is
+// sent on a connection of its own, instead of every batch spanning all the
+// masters and waiting for the slowest.
+type clusterBatcher struct {
+	cl   *cluster
+	size int
+	mode pipelineError
+
+	nodes   *clusterNodes
+	batches map[string]*clusterBatch
+}
+
+type clusterBatch struct {
+	c      redigo.Conn
+	pl     *restorePipeline
+	node   *clusterNode
+	nbytes int64
+}
+
+func newClusterBatcher(cl *cluster, size int, mode pipelineError, nodes *clusterNodes) *clusterBatcher {
+	return &clusterBatcher{cl: cl, size: size, mode: mode, nodes: nodes, batches: make(map[string]*clusterBatch)}
+}
+
+// Restore buffers the entry for the master of its slot, and sends the batch
+// of that master once it is full.
+func (p *clusterBatcher) Restore(e *rdb.BinEntry) []*keyError {
+	addr := p.cl.Master(keySlot(e.Key))
+	b := p.batches[addr]
+	if b == nil {
+		c := newClusterConn(p.cl)
+		b = &clusterBatch{c: c, pl: newRestorePipeline(c, p.size, p.mode), node: p.nodes.Get(addr)}
+		p.batches[addr] = b
+	}
+	n := len(b.pl.batch) + 1
+	b.nbytes += int64(len(e.Key) + len(e.Value))
+	errs := b.pl.Restore(e)
+	switch {
+	case len(b.pl.batch) == 0:
+		b.sent(n)
+	case b.nbytes >= clusterBatchBytes:
+		errs = p.flush(b)
+	}
+	return errs
+}
+
+func (p *clusterBatcher) flush(b *clusterBatch) []*keyError {
+	n := len(b.pl.batch)
+	errs := b.pl.Flush()
+	b.sent(n)
+	return errs
+}
+
+func (b *clusterBatch) sent(n int) {
+	if n == 0 {
+		return
+	}
+	b.node.nentry.Add(int64(n))
+	b.node.nbytes.Add(b.nbytes)
+	b.nbytes = 0
+}
+
+// Flush sends the batches of every master.
+func (p *clusterBatcher) Flush() []*keyError {
+	var errs []*keyError
+	for _, b := range p.batches {
+		errs = append(errs, p.flush(b)...)
+	}
+	return errs
+}
+
+func (p *clusterBatcher) Report(errs []*keyError) {
+	reportKeyErrors(p.mode, errs)
+}
+
+func (p *clusterBatcher) Close() {
+	for _, b := range p.batches {
+		b.c.Close()
+	}
+}
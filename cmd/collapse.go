@@ -0,0 +1,138 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+	"github.com/left2right/redis-port/pkg/redis"
+)
+
+// collapseRegexp is --collapse-pattern, its two submatches are the hash key
+// and the field a flat string key is written to.
+var collapseRegexp *regexp.Regexp
+
+func newCollapseRegexp(s string) (*regexp.Regexp, error) {
+	r, err := regexp.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+	if r.NumSubexp() != 2 {
+		return nil, errors.Errorf("expect 2 submatches (hash key and field), got %d", r.NumSubexp())
+	}
+	return r, nil
+}
+
+// collapseKey returns the hash key and field of a key that matches
+// --collapse-pattern, or nil.
+func collapseKey(key []byte) (hash, field []byte) {
+	if collapseRegexp == nil {
+		return nil, nil
+	}
+	m := collapseRegexp.FindSubmatch(key)
+	if m == nil || len(m[1]) == 0 {
+		return nil, nil
+	}
+	return m[1], m[2]
+}
+
+// restoreCollapsed writes a string entry as a field of its hash. Hash fields
+// have no ttl, so the expire of the flat key is dropped.
+func restoreCollapsed(c redigo.Conn, e *rdb.BinEntry, hash, field []byte) {
+	o, err := rdb.DecodeDump(e.Value)
+	if err != nil {
+		log.PanicErrorf(err, "decode key '%s' failed", e.Key)
+	}
+	if e.ExpireAt != 0 {
+		log.Warnf("collapse key '%s' into hash '%s', expire is dropped", e.Key, hash)
+	}
+	if _, err := c.Do("hset", hash, field, []byte(o.(rdb.String))); err != nil {
+		log.Warnf("collapse key '%s' into hash '%s' field '%s' failed: %s", e.Key, hash, field, err)
+	}
+}
+
+// collapseCommand rewrites the commands of the stream writing or deleting
+// flat keys to commands on their hashes: SET, SETNX, SETEX and PSETEX to HSET
+// or HSETNX, dropping expires and options as restoreCollapsed does, and DEL
+// and UNLINK to HDEL, along with a DEL of the keys that don't collapse. It
+// returns the commands to write instead, or nil when no key collapses.
+func collapseCommand(scmd string, argv [][]byte) []redis.Resp {
+	switch scmd {
+	case "del", "unlink":
+		return collapseDel(scmd, argv)
+	case "set", "setnx", "setex", "psetex":
+	default:
+		return nil
+	}
+	if len(argv) < 2 {
+		return nil
+	}
+	hash, field := collapseKey(argv[0])
+	if hash == nil {
+		return nil
+	}
+	switch scmd {
+	case "setnx":
+		return []redis.Resp{redis.NewCommand("hsetnx", hash, field, argv[1])}
+	case "setex", "psetex":
+		if len(argv) != 3 {
+			return nil
+		}
+		log.Warnf("collapse key '%s' into hash '%s', expire is dropped", argv[0], hash)
+		return []redis.Resp{redis.NewCommand("hset", hash, field, argv[2])}
+	}
+	hset := "hset"
+	var dropped []string
+	for _, opt := range argv[2:] {
+		if s := strings.ToUpper(string(opt)); s == "NX" {
+			hset = "hsetnx"
+		} else {
+			dropped = append(dropped, s)
+		}
+	}
+	if len(dropped) != 0 {
+		log.Warnf("collapse key '%s' into hash '%s', option %s is dropped", argv[0], hash, strings.Join(dropped, " "))
+	}
+	return []redis.Resp{redis.NewCommand(hset, hash, field, argv[1])}
+}
+
+// collapseDel rewrites DEL or UNLINK to an HDEL per hash, the keys that don't
+// collapse are left to scmd, renamed as usual.
+func collapseDel(scmd string, argv [][]byte) []redis.Resp {
+	var hashes []string
+	fields := make(map[string][]interface{})
+	var rest [][]byte
+	for _, key := range argv {
+		hash, field := collapseKey(key)
+		if hash == nil {
+			rest = append(rest, key)
+			continue
+		}
+		h := string(hash)
+		if _, ok := fields[h]; !ok {
+			hashes = append(hashes, h)
+		}
+		fields[h] = append(fields[h], field)
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	var l []redis.Resp
+	for _, h := range hashes {
+		l = append(l, redis.NewCommand("hdel", append([]interface{}{h}, fields[h]...)...))
+	}
+	if len(rest) != 0 {
+		argv := make([]interface{}, len(rest))
+		for i, key := range rest {
+			argv[i] = key
+		}
+		l = append(l, rewriteCommand(redis.NewCommand(scmd, argv...), scmd, rest))
+	}
+	return l
+}
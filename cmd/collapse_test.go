@@ -0,0 +1,83 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func TestCollapseKey(t *testing.T) {
+	r, err := newCollapseRegexp(`^(user:\d+):(\w+)$`)
+	assert.MustNoError(err)
+	collapseRegexp = r
+	defer func() {
+		collapseRegexp = nil
+	}()
+
+	for key, expect := range map[string][2]string{
+		"user:1:name":  {"user:1", "name"},
+		"user:12:mail": {"user:12", "mail"},
+		"user:x:name":  {"", ""},
+		"order:1:name": {"", ""},
+	} {
+		hash, field := collapseKey([]byte(key))
+		assert.Must(string(hash) == expect[0] && string(field) == expect[1])
+	}
+
+	_, err = newCollapseRegexp(`^(user:\d+)$`)
+	assert.Must(err != nil)
+}
+
+func TestCollapseCommand(t *testing.T) {
+	r, err := newCollapseRegexp(`^(user:\d+):(\w+)$`)
+	assert.MustNoError(err)
+	collapseRegexp = r
+	defer func() {
+		collapseRegexp = nil
+	}()
+
+	command := func(s string) []byte {
+		var argv []interface{}
+		f := strings.Fields(s)
+		for _, x := range f[1:] {
+			argv = append(argv, x)
+		}
+		return redis.MustEncodeToBytes(redis.NewCommand(f[0], argv...))
+	}
+	for _, c := range []struct {
+		cmd    string
+		expect []string
+	}{
+		{"set user:1:name bob", []string{"hset user:1 name bob"}},
+		{"set user:1:name bob PXAT 1700000000000", []string{"hset user:1 name bob"}},
+		{"set user:1:name bob ex 10 nx", []string{"hsetnx user:1 name bob"}},
+		{"setnx user:1:name bob", []string{"hsetnx user:1 name bob"}},
+		{"setex user:1:name 10 bob", []string{"hset user:1 name bob"}},
+		{"psetex user:1:name 10000 bob", []string{"hset user:1 name bob"}},
+		{"del user:1:name", []string{"hdel user:1 name"}},
+		{"unlink user:1:name", []string{"hdel user:1 name"}},
+		{"del user:1:name user:2:name user:1:mail", []string{"hdel user:1 name mail", "hdel user:2 name"}},
+		{"unlink user:1:name other", []string{"hdel user:1 name", "unlink other"}},
+		{"set other bob", nil},
+		{"del other another", nil},
+		{"incr user:1:name", nil},
+		{"set user:1:name", nil},
+	} {
+		f := strings.Fields(c.cmd)
+		var argv [][]byte
+		for _, x := range f[1:] {
+			argv = append(argv, []byte(x))
+		}
+		l := collapseCommand(f[0], argv)
+		assert.Must(len(l) == len(c.expect))
+		for i, r := range l {
+			assert.Must(bytes.Equal(redis.MustEncodeToBytes(r), command(c.expect[i])))
+		}
+	}
+}
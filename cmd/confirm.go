@@ -0,0 +1,170 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/log"
+)
+
+// confirmTarget prints what is about to be written to the target on stderr
+// and waits for "yes" on stdin, unless --yes (or --force) is given.
+func confirmTarget(name, input string) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s to target '%s', version %s\n", name, targetNames(), targetVersion)
+	fmt.Fprintf(&b, "  source     : %s\n", input)
+	fmt.Fprintf(&b, "  to write   : %s\n", sourceEstimate(name, input))
+	fmt.Fprintf(&b, "  target dbs : %s\n", args.filterdb)
+	if args.selectdb >= 0 {
+		fmt.Fprintf(&b, "  select db  : %d on connect\n", args.selectdb)
+	}
+	fate := targetKeysFate()
+	for _, target := range targetAddrs() {
+		if n, err := targetKeys(target); err != nil {
+			fmt.Fprintf(&b, "  target keys: unknown, %s\n", err)
+		} else if len(args.targets) > 1 {
+			fmt.Fprintf(&b, "  target keys: %d on %s, %s\n", n, target, fate)
+		} else {
+			fmt.Fprintf(&b, "  target keys: %d, %s\n", n, fate)
+		}
+	}
+	var flags []string
+	if args.flushTarget {
+		flags = append(flags, "--flush-target (FLUSHALL before restore)")
+	}
+	if args.replace {
+		flags = append(flags, "--replace (existing keys are overwritten)")
+	}
+	if restoreCmd == "del" || restoreCmd == "DEL" {
+		flags = append(flags, "--restorecmd=del (keys are deleted)")
+	}
+	if len(flags) == 0 {
+		flags = append(flags, "none")
+	}
+	fmt.Fprintf(&b, "  destructive: %s\n", strings.Join(flags, ", "))
+	fmt.Fprint(os.Stderr, b.String())
+
+	if args.yes {
+		return
+	}
+	if name == "restore" && isStdio(args.input) {
+		log.Panic("the rdb is read from stdin, confirm with --yes")
+	}
+	r := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprintf(os.Stderr, "Are you sure to continue (yes/no)? ")
+		s, err := r.ReadString('\n')
+		if err != nil {
+			log.PanicError(err, "input yes/no err")
+		}
+		switch strings.TrimSpace(s) {
+		case "yes":
+			return
+		case "no":
+			os.Exit(1)
+		default:
+			fmt.Fprintf(os.Stderr, "Input the wrong value, you should input yes or no\n")
+		}
+	}
+}
+
+// targetKeysFate tells what happens to the keys already on the target, by
+// the destructive flags in effect.
+func targetKeysFate() string {
+	switch {
+	case args.flushTarget:
+		return "will be flushed"
+	case restoreCmd == "del" || restoreCmd == "DEL":
+		return "the keys of the source will be deleted"
+	case args.replace:
+		return "the keys of the source will be overwritten"
+	}
+	return "will be kept, restoring a key already there fails with BUSYKEY"
+}
+
+// sourceEstimate is how much is about to be written: the keys of the dbs
+// accepted in INFO keyspace of the master for sync, the size of the rdb for
+// restore, its keys are only known once it is read.
+func sourceEstimate(name, input string) string {
+	if name == "sync" {
+		c := openSourceRedisConn(input, args.passwd)
+		defer c.Close()
+		n, err := keyspaceKeys(c, acceptDB)
+		if err != nil {
+			return fmt.Sprintf("unknown, %s", err)
+		}
+		if args.filterKeys {
+			return fmt.Sprintf("at most %d keys of the source keyspace, --filter-key applies", n)
+		}
+		return fmt.Sprintf("%d keys of the source keyspace", n)
+	}
+	if isStdio(args.input) {
+		return "unknown, the rdb is read from stdin"
+	}
+	f, err := os.Stat(args.input)
+	if err != nil {
+		return fmt.Sprintf("unknown, %s", err)
+	}
+	if !f.Mode().IsRegular() {
+		return "unknown, the input is not a regular file"
+	}
+	return fmt.Sprintf("rdb of %d bytes", f.Size()-args.inputOffset)
+}
+
+// targetKeys sums up the keys of every db in INFO keyspace of the target.
+func targetKeys(target string) (int64, error) {
+	c := openRedisConn(target, args.auth)
+	defer c.Close()
+	return keyspaceKeys(c, func(db uint32) bool {
+		return true
+	})
+}
+
+// keyspaceKeys sums up the keys of the dbs in INFO keyspace that accept takes.
+func keyspaceKeys(c redigo.Conn, accept func(db uint32) bool) (int64, error) {
+	info, err := redigo.String(c.Do("info", "keyspace"))
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, line := range strings.Split(info, "\n") {
+		if !strings.HasPrefix(line, "db") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		if db, err := strconv.ParseUint(line[2:i], 10, 32); err != nil || !accept(uint32(db)) {
+			continue
+		}
+		for _, kv := range strings.Split(strings.TrimSpace(line[i+1:]), ",") {
+			if s := strings.TrimPrefix(kv, "keys="); s != kv {
+				v, err := strconv.ParseInt(s, 10, 64)
+				if err != nil {
+					return 0, err
+				}
+				n += v
+			}
+		}
+	}
+	return n, nil
+}
+
+// flushTarget runs FLUSHALL on the target for --flush-target.
+func flushTarget() {
+	c := openRedisConn(args.target, args.auth)
+	defer c.Close()
+	if _, err := c.Do("flushall"); err != nil {
+		log.PanicError(err, "flush target failed")
+	}
+	log.Infof("flush target '%s' done\n", args.target)
+}
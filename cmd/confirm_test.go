@@ -0,0 +1,50 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+)
+
+// infoConn answers every command with info.
+type infoConn struct {
+	info string
+}
+
+func (c *infoConn) Close() error                                            { return nil }
+func (c *infoConn) Err() error                                              { return nil }
+func (c *infoConn) Flush() error                                            { return nil }
+func (c *infoConn) Send(cmd string, args ...interface{}) error              { return nil }
+func (c *infoConn) Receive() (interface{}, error)                           { return c.info, nil }
+func (c *infoConn) Do(cmd string, args ...interface{}) (interface{}, error) { return c.info, nil }
+
+func TestKeyspaceKeys(t *testing.T) {
+	c := &infoConn{info: "# Keyspace\r\ndb0:keys=10,expires=1,avg_ttl=0\r\ndb3:keys=5,expires=0,avg_ttl=0\r\n"}
+	n, err := keyspaceKeys(c, func(db uint32) bool {
+		return true
+	})
+	assert.MustNoError(err)
+	assert.Must(n == 15)
+
+	n, err = keyspaceKeys(c, func(db uint32) bool {
+		return db == 3
+	})
+	assert.MustNoError(err)
+	assert.Must(n == 5)
+}
+
+func TestTargetKeysFate(t *testing.T) {
+	flush, replace, cmd := args.flushTarget, args.replace, restoreCmd
+	defer func() {
+		args.flushTarget, args.replace, restoreCmd = flush, replace, cmd
+	}()
+	args.flushTarget, args.replace, restoreCmd = false, false, "restore"
+	assert.Must(targetKeysFate() == "will be kept, restoring a key already there fails with BUSYKEY")
+	args.replace = true
+	assert.Must(targetKeysFate() == "the keys of the source will be overwritten")
+	args.flushTarget = true
+	assert.Must(targetKeysFate() == "will be flushed")
+}
@@ -7,65 +7,180 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/bytesize"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/extsort"
 	"github.com/left2right/redis-port/pkg/libs/log"
 	"github.com/left2right/redis-port/pkg/rdb"
+	"github.com/left2right/redis-port/pkg/redis"
 )
 
 type cmdDecode struct {
-	rbytes, wbytes, nentry atomic2.Int64
+	rbytes, wbytes, nentry, ignore, skipped atomic2.Int64
+
+	// errors counts the keys skipped by --continue-on-error, aborted is set
+	// once --max-errors of them stopped the decode.
+	errors  atomic2.Int64
+	aborted atomic2.Bool
+
+	source string
+
+	roll *rollWriter
+
+	types *typeStats
+
+	bigkeys *bigKeys
+}
+
+// decodeMeta is the envelope attached to every record with --envelope.
+type decodeMeta struct {
+	Version  string `json:"version"`
+	Source   string `json:"source"`
+	DecodeAt int64  `json:"decodeat"`
 }
 
 type cmdDecodeStat struct {
-	rbytes, wbytes, nentry int64
+	rbytes, wbytes, nentry, ignore, skipped int64
+
+	errors int64
 }
 
 func (cmd *cmdDecode) Stat() *cmdDecodeStat {
 	return &cmdDecodeStat{
-		rbytes: cmd.rbytes.Get(),
-		wbytes: cmd.wbytes.Get(),
-		nentry: cmd.nentry.Get(),
+		rbytes:  cmd.rbytes.Get(),
+		wbytes:  cmd.wbytes.Get(),
+		nentry:  cmd.nentry.Get(),
+		ignore:  cmd.ignore.Get(),
+		skipped: cmd.skipped.Get(),
+
+		errors: cmd.errors.Get(),
 	}
 }
 
 func (cmd *cmdDecode) Main() {
+	cmd.decode()
+	if cmd.aborted.Get() {
+		os.Exit(exitMaxErrors)
+	}
+}
+
+func (cmd *cmdDecode) decode() {
 	input, output := args.input, args.output
-	if len(input) == 0 {
-		input = "/dev/stdin"
+
+	from := inputName(input)
+	if len(args.inputDir) != 0 {
+		from = args.inputDir
 	}
-	if len(output) == 0 {
-		output = "/dev/stdout"
+	log.Infof("decode from '%s' to '%s'\n", from, outputName(output))
+
+	cmd.source = args.sourceid
+	if len(cmd.source) == 0 {
+		cmd.source = from
 	}
 
-	log.Infof("decode from '%s' to '%s'\n", input, output)
+	if (args.resume || args.checkpointOnSignal) && len(args.inputDir) != 0 {
+		log.Panic("--resume and --checkpoint-on-signal can't be used with --input-dir")
+	}
+	if args.resume && (args.compress || args.rollBytes != 0 || args.groupByKey || args.parquet) {
+		log.Panic("--resume can't be used with --compress, --roll-bytes, --group-by-key or --output-format=parquet")
+	}
+	initCheckpoint("decode")
 
-	var readin io.ReadCloser
+	var ipipe chan *rdb.BinEntry
 	var nsize int64
-	if input != "/dev/stdin" {
-		readin, nsize = openReadFile(input)
-		defer readin.Close()
+	if len(args.inputDir) != 0 {
+		if !isStdio(input) || args.inputOffset != 0 {
+			log.Panic("--input-dir can't be used with --input or --input-offset")
+		}
+		var files []string
+		files, nsize = listInputDir(args.inputDir)
+		ipipe = newDirLoader(files, &cmd.rbytes, args.parallel*32)
 	} else {
-		readin, nsize = os.Stdin, 0
+		var readin io.ReadCloser
+		if !isStdio(input) {
+			readin, nsize = openInputFile(input)
+			defer readin.Close()
+		} else {
+			if args.inputOffset != 0 {
+				log.Panic("--input-offset needs --input")
+			}
+			readin, nsize = os.Stdin, 0
+		}
+		reader := bufio.NewReaderSize(readin, ReaderBufferSize)
+		ipipe = newRDBLoader(reader, &cmd.rbytes, args.parallel*32)
 	}
 
 	var saveto io.WriteCloser
-	if output != "/dev/stdout" {
-		saveto = openWriteFile(output)
+	if args.compress || args.rollBytes != 0 {
+		if args.rollBytes != 0 && isStdio(output) {
+			log.Panic("--roll-bytes needs --output")
+		}
+		cmd.roll = newRollWriter(output, args.compress, args.rollBytes)
+		saveto = cmd.roll
+		defer saveto.Close()
+	} else if !isStdio(output) {
+		if args.resume {
+			saveto = openAppendFile(output)
+		} else {
+			saveto = openWriteFile(output)
+		}
 		defer saveto.Close()
 	} else {
 		saveto = os.Stdout
 	}
 
-	reader := bufio.NewReaderSize(readin, ReaderBufferSize)
+	if args.outputFormat == "rdb" {
+		log.Panic("decode can't write --output-format=rdb, use encode")
+	}
+	if args.redisPipe && (args.envelope || args.groupByKey) {
+		log.Panic("--output-format=redis-pipe can't be used with --envelope or --group-by-key")
+	}
+	if args.resp && (args.envelope || args.groupByKey) {
+		log.Panic("--output-format=resp can't be used with --envelope or --group-by-key")
+	}
+	if args.parquet && (args.envelope || args.groupByKey || args.compress || args.rollBytes != 0 || args.evictionPolicy != nil) {
+		log.Panic("--output-format=parquet can't be used with --envelope, --group-by-key, --compress, --roll-bytes or --eviction-policy")
+	}
+	if args.valueMatch != nil && (args.redisPipe || args.resp || args.groupByKey) {
+		log.Panic("--value-match can't be used with --output-format=redis-pipe, resp or --group-by-key")
+	}
+
+	if args.stale != nil {
+		f := openWriteFile(args.staleReport)
+		defer f.Close()
+		w := bufio.NewWriterSize(f, WriterBufferSize)
+		defer flushWriter(w)
+		args.stale.report = w
+	}
+
+	if args.typeStats || len(args.summary) != 0 {
+		cmd.types = newTypeStats()
+	}
+
+	if args.bigkeys != 0 {
+		if args.envelope || args.groupByKey || args.redisPipe || args.resp || args.parquet || args.valueMatch != nil {
+			log.Panic("--bigkeys can't be used with --envelope, --group-by-key, --output-format or --value-match")
+		}
+		cmd.bigkeys = newBigKeys(args.bigkeys)
+	}
+
+	if len(args.metricsAddr) != 0 {
+		cmd.exportMetrics(nsize)
+		serveMetrics(args.metricsAddr)
+	}
+
 	writer := bufio.NewWriterSize(saveto, WriterBufferSize)
 
-	ipipe := newRDBLoader(reader, &cmd.rbytes, args.parallel*32)
 	opipe := make(chan string, cap(ipipe))
 
 	go func() {
@@ -84,15 +199,41 @@ func (cmd *cmdDecode) Main() {
 		}
 	}()
 
+	// records are only ordered by --group-by-key or --input-dir, the latter
+	// merges the records of every file by db then key.
+	var records <-chan string = opipe
+	if len(args.inputDir) != 0 && !args.groupByKey {
+		records = cmd.mergeRecords(opipe)
+	}
+
 	wait := make(chan struct{})
 	go func() {
 		defer close(wait)
-		for s := range opipe {
-			cmd.wbytes.Add(int64(len(s)))
-			if _, err := writer.WriteString(s); err != nil {
-				log.PanicError(err, "write string failed")
+		if args.groupByKey {
+			cmd.groupByKey(opipe, writer)
+			return
+		}
+		if args.parquet {
+			cmd.writeParquet(records, writer)
+			return
+		}
+		ticker := time.NewTicker(decodeFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case s, ok := <-records:
+				if !ok {
+					flushWriter(writer)
+					return
+				}
+				cmd.wbytes.Add(int64(len(s)))
+				if _, err := writer.WriteString(s); err != nil {
+					log.PanicError(err, "write string failed")
+				}
+				cmd.flush(writer)
+			case <-ticker.C:
+				flushWriter(writer)
 			}
-			flushWriter(writer)
 		}
 	}()
 
@@ -103,6 +244,13 @@ func (cmd *cmdDecode) Main() {
 		case <-time.After(time.Second):
 		}
 		stat := cmd.Stat()
+		if statJSON() {
+			logStat("decode", map[string]interface{}{
+				"total": nsize, "rbytes": stat.rbytes, "wbytes": stat.wbytes, "entry": stat.nentry,
+				"skipped": stat.skipped, "ignore": stat.ignore, "errors": stat.errors,
+			})
+			continue
+		}
 		var b bytes.Buffer
 		fmt.Fprintf(&b, "decode: ")
 		if nsize != 0 {
@@ -112,35 +260,221 @@ func (cmd *cmdDecode) Main() {
 		}
 		fmt.Fprintf(&b, "  write=%-12d", stat.wbytes)
 		fmt.Fprintf(&b, "  entry=%-12d", stat.nentry)
+		if args.filter != nil {
+			fmt.Fprintf(&b, "  skipped=%-12d", stat.skipped)
+		}
+		if stat.ignore != 0 {
+			fmt.Fprintf(&b, "  ignore=%-12d", stat.ignore)
+		}
+		if args.continueOnError {
+			fmt.Fprintf(&b, "  errors=%-12d", stat.errors)
+		}
 		log.Info(b.String())
 	}
+	if args.stale != nil {
+		log.Infof("decode: %d stale keys written to '%s'", args.stale.Flagged(), args.staleReport)
+	}
+	if cmd.bigkeys != nil {
+		if err := cmd.bigkeys.WriteReport(writer); err != nil {
+			log.PanicError(err, "write bigkeys report failed")
+		}
+		flushWriter(writer)
+	}
+	if args.typeStats {
+		log.Infof("decode: keys by db and type\n%s", cmd.types.Table())
+	}
+	if len(args.summary) != 0 {
+		f := openWriteFile(args.summary)
+		defer f.Close()
+		if err := cmd.types.WriteSummary(f, cmd.Stat()); err != nil {
+			log.PanicErrorf(err, "write summary '%s' failed", args.summary)
+		}
+	}
+	if writeCheckpoint("decode") {
+		return
+	}
+	if cmd.aborted.Get() {
+		log.Errorf("decode: aborted by --max-errors, %d keys failed to decode", cmd.errors.Get())
+		return
+	}
 	log.Info("decode: done")
 }
 
+// decodeChunkSize is the size of the records of a single list buffered before
+// they are handed to the writer.
+const decodeChunkSize = bytesize.MB
+
 func (cmd *cmdDecode) decoderMain(ipipe <-chan *rdb.BinEntry, opipe chan<- string) {
-	toText := func(p []byte) string {
-		var b bytes.Buffer
-		for _, c := range p {
-			switch {
-			case c >= '#' && c <= '~':
-				b.WriteByte(c)
-			default:
-				b.WriteByte('.')
-			}
-		}
-		return b.String()
-	}
 	toBase64 := func(p []byte) string {
 		return base64.StdEncoding.EncodeToString(p)
 	}
+	var meta *decodeMeta
+	if args.envelope {
+		meta = &decodeMeta{
+			Version:  version,
+			Source:   cmd.source,
+			DecodeAt: time.Now().UnixNano() / int64(time.Millisecond),
+		}
+	}
+	var evictable bool
 	toJson := func(o interface{}) string {
 		b, err := json.Marshal(o)
 		if err != nil {
 			log.PanicError(err, "encode to json failed")
 		}
+		if args.evictionPolicy != nil {
+			b = append(b[:len(b)-1], fmt.Sprintf(`,"evictable":%t}`, evictable)...)
+		}
+		if meta != nil {
+			b, err = json.Marshal(&struct {
+				Meta *decodeMeta     `json:"meta"`
+				Data json.RawMessage `json:"data"`
+			}{meta, b})
+			if err != nil {
+				log.PanicError(err, "encode to json failed")
+			}
+		}
 		return string(b)
 	}
+	match := func(p []byte) bool {
+		return args.valueMatch == nil || args.valueMatch.Match(p)
+	}
+	var types *typeStats
+	if cmd.types != nil {
+		types = newTypeStats()
+		defer cmd.types.Merge(types)
+	}
+	var bigkeys *bigKeys
+	if cmd.bigkeys != nil {
+		bigkeys = newBigKeys(args.bigkeys)
+		defer cmd.bigkeys.Merge(bigkeys)
+	}
+	// with --input-dir records are tagged with their entry to be merged in
+	// order, the records of an entry are numbered to keep their order.
+	var seq uint32
+	send := func(e *rdb.BinEntry, s string) {
+		if len(args.inputDir) == 0 || args.groupByKey {
+			opipe <- s
+			return
+		}
+		opipe <- string(newMergeRecord(e, seq, s))
+		seq++
+	}
 	for e := range ipipe {
+		seq = 0
+		encoding := rdb.EncodingName(e.Value)
+		if args.filter != nil && !args.filter.Accept(e.Key) {
+			cmd.skipped.Incr()
+			continue
+		}
+		if !acceptKey(e.Key) {
+			cmd.ignore.Incr()
+			continue
+		}
+		if args.continueOnError {
+			if err := checkDecode(e); err != nil {
+				cmd.decodeError(e, err)
+				continue
+			}
+		}
+		if types != nil {
+			types.Add(e)
+		}
+		countEntryType(e)
+		if bigkeys != nil {
+			cmd.nentry.Incr()
+			bigkeys.Add(e)
+			continue
+		}
+		if args.groupByKey {
+			cmd.nentry.Incr()
+			opipe <- string(newGroupRecord(e))
+			continue
+		}
+		if args.redisPipe {
+			if rdb.IsEmptyObject(e.Value) {
+				log.Warnf("decode skip empty aggregate key: %s", e.Key)
+				cmd.ignore.Incr()
+				continue
+			}
+			cmd.nentry.Incr()
+			send(e, string(newPipeRecord(e)))
+			continue
+		}
+		if args.resp {
+			if rdb.IsEmptyObject(e.Value) {
+				log.Warnf("decode skip empty aggregate key: %s", e.Key)
+				cmd.ignore.Incr()
+				continue
+			}
+			if e.ExpireAt != 0 && e.ExpireAt <= uint64(time.Now().UnixNano()/int64(time.Millisecond)) {
+				cmd.ignore.Incr()
+				continue
+			}
+			cmd.nentry.Incr()
+			send(e, string(newRespRecord(e)))
+			continue
+		}
+		if args.stale != nil {
+			args.stale.Check(e)
+		}
+		if args.evictionPolicy != nil {
+			evictable = args.evictionPolicy.evictable(e.ExpireAt)
+		}
+		if args.parquet {
+			n := newParquetRecords(e, match, func(p []byte) {
+				send(e, string(p))
+			})
+			if n == 0 && args.valueMatch != nil {
+				cmd.ignore.Incr()
+				continue
+			}
+			cmd.nentry.Incr()
+			continue
+		}
+		if rdb.TypeName(e.Value) == "list" {
+			// lists are streamed: records leave every decodeChunkSize bytes
+			// and quicklist nodes are decompressed one by one, so a huge
+			// list is never held in memory as a whole.
+			var b bytes.Buffer
+			var i, n int
+			err := rdb.ForEachListElement(e.Value, func(ele []byte) error {
+				if !match(ele) {
+					i++
+					return nil
+				}
+				o := &struct {
+					DB       uint32 `json:"db"`
+					Type     string `json:"type"`
+					Encoding string `json:"encoding"`
+					ExpireAt uint64 `json:"expireat"`
+					Key      string `json:"key"`
+					Key64    string `json:"key64"`
+					Index    int    `json:"index"`
+					Value64  string `json:"value64"`
+				}{
+					e.DB, "list", encoding, e.ExpireAt, keyText(e.Key), toBase64(e.Key),
+					i, toBase64(ele),
+				}
+				fmt.Fprintf(&b, "%s\n", toJson(o))
+				n++
+				if i++; b.Len() >= decodeChunkSize {
+					send(e, b.String())
+					b.Reset()
+				}
+				return nil
+			})
+			if err != nil {
+				log.PanicError(err, "decode failed")
+			}
+			if n == 0 && args.valueMatch != nil {
+				cmd.ignore.Incr()
+				continue
+			}
+			cmd.nentry.Incr()
+			send(e, b.String())
+			continue
+		}
 		o, err := rdb.DecodeDump(e.Value)
 		if err != nil {
 			log.PanicError(err, "decode failed")
@@ -150,86 +484,493 @@ func (cmd *cmdDecode) decoderMain(ipipe <-chan *rdb.BinEntry, opipe chan<- strin
 		default:
 			log.Panicf("unknown object %v", o)
 		case rdb.String:
+			if !match(obj) {
+				break
+			}
+			if bitmapKey(e.Key) {
+				o := &struct {
+					DB       uint32  `json:"db"`
+					Type     string  `json:"type"`
+					Encoding string  `json:"encoding"`
+					ExpireAt uint64  `json:"expireat"`
+					Key      string  `json:"key"`
+					Key64    string  `json:"key64"`
+					BitCount int64   `json:"bitcount"`
+					Bits     []int64 `json:"bits,omitempty"`
+				}{
+					e.DB, "bitmap", encoding, e.ExpireAt, keyText(e.Key), toBase64(e.Key),
+					bitCount(obj), nil,
+				}
+				if !args.bitmapSummary {
+					o.Bits = bitPositions(obj)
+				}
+				fmt.Fprintf(&b, "%s\n", toJson(o))
+				break
+			}
 			o := &struct {
 				DB       uint32 `json:"db"`
 				Type     string `json:"type"`
+				Encoding string `json:"encoding"`
 				ExpireAt uint64 `json:"expireat"`
 				Key      string `json:"key"`
 				Key64    string `json:"key64"`
 				Value64  string `json:"value64"`
 			}{
-				e.DB, "string", e.ExpireAt, toText(e.Key), toBase64(e.Key),
+				e.DB, "string", encoding, e.ExpireAt, keyText(e.Key), toBase64(e.Key),
 				toBase64(obj),
 			}
 			fmt.Fprintf(&b, "%s\n", toJson(o))
-		case rdb.List:
-			for i, ele := range obj {
-				o := &struct {
-					DB       uint32 `json:"db"`
-					Type     string `json:"type"`
-					ExpireAt uint64 `json:"expireat"`
-					Key      string `json:"key"`
-					Key64    string `json:"key64"`
-					Index    int    `json:"index"`
-					Value64  string `json:"value64"`
-				}{
-					e.DB, "list", e.ExpireAt, toText(e.Key), toBase64(e.Key),
-					i, toBase64(ele),
-				}
-				fmt.Fprintf(&b, "%s\n", toJson(o))
-			}
 		case rdb.Hash:
 			for _, ele := range obj {
+				if !match(ele.Value) {
+					continue
+				}
 				o := &struct {
 					DB       uint32 `json:"db"`
 					Type     string `json:"type"`
+					Encoding string `json:"encoding"`
 					ExpireAt uint64 `json:"expireat"`
 					Key      string `json:"key"`
 					Key64    string `json:"key64"`
 					Field    string `json:"field"`
 					Field64  string `json:"field64"`
 					Value64  string `json:"value64"`
+
+					FieldExpireAt uint64 `json:"field_expireat,omitempty"`
 				}{
-					e.DB, "hash", e.ExpireAt, toText(e.Key), toBase64(e.Key),
-					toText(ele.Field), toBase64(ele.Field), toBase64(ele.Value),
+					e.DB, "hash", encoding, e.ExpireAt, keyText(e.Key), toBase64(e.Key),
+					keyText(ele.Field), toBase64(ele.Field), toBase64(ele.Value),
+					ele.ExpireAt,
 				}
 				fmt.Fprintf(&b, "%s\n", toJson(o))
 			}
 		case rdb.Set:
 			for _, mem := range obj {
+				if !match(mem) {
+					continue
+				}
 				o := &struct {
 					DB       uint32 `json:"db"`
 					Type     string `json:"type"`
+					Encoding string `json:"encoding"`
 					ExpireAt uint64 `json:"expireat"`
 					Key      string `json:"key"`
 					Key64    string `json:"key64"`
 					Member   string `json:"member"`
 					Member64 string `json:"member64"`
 				}{
-					e.DB, "set", e.ExpireAt, toText(e.Key), toBase64(e.Key),
-					toText(mem), toBase64(mem),
+					e.DB, "set", encoding, e.ExpireAt, keyText(e.Key), toBase64(e.Key),
+					keyText(mem), toBase64(mem),
 				}
 				fmt.Fprintf(&b, "%s\n", toJson(o))
 			}
 		case rdb.ZSet:
 			for _, ele := range obj {
+				if !match(ele.Member) {
+					continue
+				}
 				o := &struct {
-					DB       uint32  `json:"db"`
-					Type     string  `json:"type"`
-					ExpireAt uint64  `json:"expireat"`
-					Key      string  `json:"key"`
-					Key64    string  `json:"key64"`
-					Member   string  `json:"member"`
-					Member64 string  `json:"member64"`
-					Score    float64 `json:"score"`
+					DB       uint32    `json:"db"`
+					Type     string    `json:"type"`
+					Encoding string    `json:"encoding"`
+					ExpireAt uint64    `json:"expireat"`
+					Key      string    `json:"key"`
+					Key64    string    `json:"key64"`
+					Member   string    `json:"member"`
+					Member64 string    `json:"member64"`
+					Score    zsetScore `json:"score"`
 				}{
-					e.DB, "zset", e.ExpireAt, toText(e.Key), toBase64(e.Key),
-					toText(ele.Member), toBase64(ele.Member), ele.Score,
+					e.DB, "zset", encoding, e.ExpireAt, keyText(e.Key), toBase64(e.Key),
+					keyText(ele.Member), toBase64(ele.Member), zsetScore(ele.Score),
 				}
 				fmt.Fprintf(&b, "%s\n", toJson(o))
 			}
+		case rdb.Stream:
+			// a stream-info record with the metadata, then one record per
+			// entry and one per consumer group.
+			if args.valueMatch == nil {
+				o := &struct {
+					DB           uint32 `json:"db"`
+					Type         string `json:"type"`
+					Encoding     string `json:"encoding"`
+					ExpireAt     uint64 `json:"expireat"`
+					Key          string `json:"key"`
+					Key64        string `json:"key64"`
+					Length       int    `json:"length"`
+					LastID       string `json:"last_id"`
+					FirstID      string `json:"first_id"`
+					MaxDeletedID string `json:"max_deleted_id"`
+					EntriesAdded uint64 `json:"entries_added"`
+					Groups       int    `json:"groups"`
+				}{
+					e.DB, "stream-info", encoding, e.ExpireAt, keyText(e.Key), toBase64(e.Key),
+					len(obj.Entries), obj.LastID.String(), obj.FirstID.String(), obj.MaxDeletedID.String(), obj.EntriesAdded, len(obj.Groups),
+				}
+				fmt.Fprintf(&b, "%s\n", toJson(o))
+			}
+			for _, ent := range obj.Entries {
+				matched := false
+				fields := make([]string, len(ent.Fields))
+				fields64 := make([]string, len(ent.Fields))
+				values64 := make([]string, len(ent.Fields))
+				for i, f := range ent.Fields {
+					matched = matched || match(f.Value)
+					fields[i], fields64[i], values64[i] = keyText(f.Field), toBase64(f.Field), toBase64(f.Value)
+				}
+				if !matched && args.valueMatch != nil {
+					continue
+				}
+				o := &struct {
+					DB       uint32   `json:"db"`
+					Type     string   `json:"type"`
+					Encoding string   `json:"encoding"`
+					ExpireAt uint64   `json:"expireat"`
+					Key      string   `json:"key"`
+					Key64    string   `json:"key64"`
+					ID       string   `json:"id"`
+					Field    []string `json:"field"`
+					Field64  []string `json:"field64"`
+					Value64  []string `json:"value64"`
+				}{
+					e.DB, "stream", encoding, e.ExpireAt, keyText(e.Key), toBase64(e.Key),
+					ent.ID.String(), fields, fields64, values64,
+				}
+				fmt.Fprintf(&b, "%s\n", toJson(o))
+			}
+			if args.valueMatch != nil {
+				break
+			}
+			type pending struct {
+				ID            string `json:"id"`
+				DeliveryTime  uint64 `json:"delivery_time"`
+				DeliveryCount uint64 `json:"delivery_count"`
+			}
+			type consumer struct {
+				Name       string   `json:"name"`
+				Name64     string   `json:"name64"`
+				SeenTime   uint64   `json:"seen_time"`
+				ActiveTime uint64   `json:"active_time"`
+				Pending    []string `json:"pending"`
+			}
+			for _, g := range obj.Groups {
+				o := &struct {
+					DB          uint32      `json:"db"`
+					Type        string      `json:"type"`
+					Encoding    string      `json:"encoding"`
+					ExpireAt    uint64      `json:"expireat"`
+					Key         string      `json:"key"`
+					Key64       string      `json:"key64"`
+					Group       string      `json:"group"`
+					Group64     string      `json:"group64"`
+					LastID      string      `json:"last_id"`
+					EntriesRead int64       `json:"entries_read"`
+					Pending     []*pending  `json:"pending"`
+					Consumers   []*consumer `json:"consumers"`
+				}{
+					e.DB, "stream-group", encoding, e.ExpireAt, keyText(e.Key), toBase64(e.Key),
+					keyText(g.Name), toBase64(g.Name), g.LastID.String(), g.EntriesRead,
+					[]*pending{}, []*consumer{},
+				}
+				for _, p := range g.Pending {
+					o.Pending = append(o.Pending, &pending{p.ID.String(), p.DeliveryTime, p.DeliveryCount})
+				}
+				for _, c := range g.Consumers {
+					x := &consumer{keyText(c.Name), toBase64(c.Name), c.SeenTime, c.ActiveTime, []string{}}
+					for _, id := range c.Pending {
+						x.Pending = append(x.Pending, id.String())
+					}
+					o.Consumers = append(o.Consumers, x)
+				}
+				fmt.Fprintf(&b, "%s\n", toJson(o))
+			}
+		case rdb.Module:
+			if args.valueMatch != nil {
+				break
+			}
+			o := &struct {
+				DB         uint32 `json:"db"`
+				Type       string `json:"type"`
+				Encoding   string `json:"encoding"`
+				ExpireAt   uint64 `json:"expireat"`
+				Key        string `json:"key"`
+				Key64      string `json:"key64"`
+				Module     string `json:"module"`
+				EncVersion int    `json:"encoding_version"`
+			}{
+				e.DB, "module", encoding, e.ExpireAt, keyText(e.Key), toBase64(e.Key),
+				obj.Name, obj.Version,
+			}
+			fmt.Fprintf(&b, "%s\n", toJson(o))
+		}
+		if b.Len() == 0 && args.valueMatch != nil {
+			cmd.ignore.Incr()
+			continue
 		}
 		cmd.nentry.Incr()
-		opipe <- b.String()
+		send(e, b.String())
+	}
+}
+
+// exitMaxErrors is the exit code of a decode aborted by --max-errors.
+const exitMaxErrors = 3
+
+// checkDecode decodes the value of the entry without writing anything, so
+// that with --continue-on-error a corrupt value is skipped before any of its
+// records, lists are streamed, is written.
+func checkDecode(e *rdb.BinEntry) error {
+	if rdb.TypeName(e.Value) == "list" {
+		return rdb.ForEachListElement(e.Value, func([]byte) error {
+			return nil
+		})
+	}
+	_, err := rdb.DecodeDump(e.Value)
+	return err
+}
+
+// decodeError skips a key whose value failed to decode. Once --max-errors keys
+// are skipped the loader stops, the entries it handed out are still decoded
+// and written, and Main exits with exitMaxErrors after the summary.
+func (cmd *cmdDecode) decodeError(e *rdb.BinEntry, err error) {
+	n := cmd.errors.Incr()
+	log.WarnErrorf(err, "decode key '%s' failed, skipped", e.Key)
+	if args.maxErrors != 0 && n == args.maxErrors {
+		log.Errorf("decode: abort, %d keys failed to decode, the last one is '%s' of db%d", n, e.Key, e.DB)
+		cmd.aborted.Set(true)
+		stopLoaders()
+	}
+}
+
+// newPipeRecord returns the commands recreating the entry, for
+// --output-format=redis-pipe: SELECT db, RESTORE key 0 payload and, for keys
+// with an expire, PEXPIREAT key expireat. Records are written in no particular
+// order, so every one of them selects its db.
+func newPipeRecord(e *rdb.BinEntry) []byte {
+	var b bytes.Buffer
+	b.Write(redis.MustEncodeToBytes(redis.NewCommand("select", e.DB)))
+	b.Write(redis.MustEncodeToBytes(redis.NewCommand("restore", e.Key, 0, e.Value)))
+	if e.ExpireAt != 0 {
+		b.Write(redis.MustEncodeToBytes(redis.NewCommand("pexpireat", e.Key, e.ExpireAt)))
+	}
+	return b.Bytes()
+}
+
+// newRespRecord returns the commands recreating the entry on the target of
+// --target-version, for --output-format=resp. The payload is restored with
+// RESTORE when the target understands its encoding, with the expire as an
+// ABSTTL if the target supports it, or the key is deleted and rebuilt with
+// type commands as restore does; the expire is set by PEXPIREAT otherwise.
+func newRespRecord(e *rdb.BinEntry) []byte {
+	var b bytes.Buffer
+	write := func(cmd string, argv ...interface{}) {
+		b.Write(redis.MustEncodeToBytes(redis.NewCommand(cmd, argv...)))
+	}
+	write("select", e.DB)
+	switch {
+	case !targetRestores(e.Value):
+		o, err := rdb.DecodeDump(e.Value)
+		if err != nil {
+			log.PanicErrorf(err, "decode key '%s' failed", e.Key)
+		}
+		write(delCmd(), e.Key)
+		rebuildCommands(o, chunkSize, func(cmd string, argv ...interface{}) {
+			name, cmdArgs := commandArgs(cmd, e.Key, argv)
+			write(name, cmdArgs...)
+		})
+	case e.ExpireAt != 0 && targetHas("ABSTTL"):
+		write("restore", e.Key, e.ExpireAt, e.Value, "absttl")
+		return b.Bytes()
+	default:
+		write("restore", e.Key, 0, e.Value)
+	}
+	if e.ExpireAt != 0 {
+		write("pexpireat", e.Key, e.ExpireAt)
+	}
+	return b.Bytes()
+}
+
+// groupBufferSize is the amount of records --group-by-key keeps in memory
+// before spilling a sorted run to disk.
+const groupBufferSize = bytesize.MB * 256
+
+// newGroupRecord serializes the location of an entry as
+// uvarint(len(key)) + key + db + expireat + type, see parseGroupRecord.
+func newGroupRecord(e *rdb.BinEntry) []byte {
+	var b bytes.Buffer
+	var n [binary.MaxVarintLen64]byte
+	b.Write(n[:binary.PutUvarint(n[:], uint64(len(e.Key)))])
+	b.Write(e.Key)
+	binary.Write(&b, binary.BigEndian, e.DB)
+	binary.Write(&b, binary.BigEndian, e.ExpireAt)
+	b.WriteString(rdb.TypeName(e.Value))
+	return b.Bytes()
+}
+
+type groupLocation struct {
+	DB        uint32 `json:"db"`
+	Type      string `json:"type"`
+	ExpireAt  uint64 `json:"expireat"`
+	Evictable *bool  `json:"evictable,omitempty"`
+}
+
+func parseGroupRecord(p []byte) ([]byte, *groupLocation) {
+	n, i := binary.Uvarint(p)
+	key, p := p[i:i+int(n)], p[i+int(n):]
+	return key, &groupLocation{
+		DB:       binary.BigEndian.Uint32(p[0:4]),
+		ExpireAt: binary.BigEndian.Uint64(p[4:12]),
+		Type:     string(p[12:]),
+	}
+}
+
+// groupByKey sorts the records by key then db, spilling to disk for huge
+// inputs, and writes one line per key listing every db holding it.
+func (cmd *cmdDecode) groupByKey(opipe <-chan string, writer *bufio.Writer) {
+	sorter := extsort.New("", groupBufferSize, func(a, b []byte) bool {
+		k1, l1 := parseGroupRecord(a)
+		k2, l2 := parseGroupRecord(b)
+		if c := bytes.Compare(k1, k2); c != 0 {
+			return c < 0
+		}
+		return l1.DB < l2.DB
+	})
+	for s := range opipe {
+		if err := sorter.Add([]byte(s)); err != nil {
+			log.PanicError(err, "buffer decode record failed")
+		}
+	}
+	log.Infof("decode: group by key, %d runs spilled to disk", sorter.Runs())
+
+	var key []byte
+	var dbs []*groupLocation
+	flush := func() {
+		if len(dbs) == 0 {
+			return
+		}
+		o := &struct {
+			Key   string           `json:"key"`
+			Key64 string           `json:"key64"`
+			DBs   []*groupLocation `json:"dbs"`
+		}{
+			keyText(key), base64.StdEncoding.EncodeToString(key), dbs,
+		}
+		b, err := json.Marshal(o)
+		if err != nil {
+			log.PanicError(err, "encode to json failed")
+		}
+		b = append(b, '\n')
+		cmd.wbytes.Add(int64(len(b)))
+		if _, err := writer.Write(b); err != nil {
+			log.PanicError(err, "write string failed")
+		}
+		cmd.flush(writer)
+	}
+	err := sorter.Sort(func(p []byte) error {
+		k, l := parseGroupRecord(p)
+		if args.evictionPolicy != nil {
+			evictable := args.evictionPolicy.evictable(l.ExpireAt)
+			l.Evictable = &evictable
+		}
+		if !bytes.Equal(k, key) || len(dbs) == 0 {
+			flush()
+			key, dbs = append(key[:0], k...), nil
+		}
+		dbs = append(dbs, l)
+		return nil
+	})
+	if err != nil {
+		log.PanicError(err, "sort decode records failed")
+	}
+	flush()
+	flushWriter(writer)
+}
+
+// decodeFlushInterval bounds how long a record may wait in the write buffer,
+// so a slow decode piped to another process still shows up.
+const decodeFlushInterval = time.Millisecond * 100
+
+// flush is called after every record, so that --roll-bytes only starts a new
+// file on a record boundary. The writer is only flushed when the file is due
+// to roll; otherwise bufio writes once its buffer is full, and the writers
+// flush by decodeFlushInterval and when the records end.
+func (cmd *cmdDecode) flush(writer *bufio.Writer) {
+	if cmd.roll == nil || !cmd.roll.Due(writer.Buffered()) {
+		return
+	}
+	flushWriter(writer)
+	if err := cmd.roll.Roll(); err != nil {
+		log.PanicError(err, "roll output file failed")
+	}
+}
+
+// zsetScore marshals infinite and NaN scores, which json can't represent as
+// numbers, as the strings "+inf", "-inf" and "nan". With --normalize-floats
+// -0 becomes 0 and scores are formatted like redis does, with %.17g.
+type zsetScore float64
+
+func (f zsetScore) MarshalJSON() ([]byte, error) {
+	switch v := float64(f); {
+	case math.IsInf(v, 1):
+		return []byte(`"+inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-inf"`), nil
+	case math.IsNaN(v):
+		return []byte(`"nan"`), nil
+	case args.normalizeFloats:
+		if v == 0 {
+			// -0 == 0 as well, it becomes 0.
+			v = 0
+		}
+		return []byte(strconv.FormatFloat(v, 'g', 17, 64)), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// UnmarshalJSON reads the scores written by MarshalJSON back, for encode.
+func (f *zsetScore) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var v float64
+		if err := json.Unmarshal(b, &v); err != nil {
+			return err
+		}
+		*f = zsetScore(v)
+		return nil
+	}
+	switch s {
+	case "+inf":
+		*f = zsetScore(math.Inf(1))
+	case "-inf":
+		*f = zsetScore(math.Inf(-1))
+	case "nan":
+		*f = zsetScore(math.NaN())
+	default:
+		return errors.Errorf("invalid score '%s'", s)
+	}
+	return nil
+}
+
+// bitCount returns the number of set bits, same as BITCOUNT.
+func bitCount(p []byte) int64 {
+	var n int64
+	for _, c := range p {
+		for ; c != 0; c &= c - 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// bitPositions returns the offsets of the set bits, using the same bit order
+// as GETBIT/SETBIT: offset 0 is the most significant bit of the first byte.
+func bitPositions(p []byte) []int64 {
+	var bits []int64
+	for i, c := range p {
+		for j := 0; j < 8; j++ {
+			if c&(0x80>>uint(j)) != 0 {
+				bits = append(bits, int64(i)*8+int64(j))
+			}
+		}
 	}
+	return bits
 }
@@ -0,0 +1,468 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+func TestZSetScoreJSON(t *testing.T) {
+	docheck := func(score float64, expect string) {
+		b, err := json.Marshal(&struct {
+			Score zsetScore `json:"score"`
+		}{zsetScore(score)})
+		assert.MustNoError(err)
+		assert.Must(string(b) == `{"score":`+expect+`}`)
+	}
+	docheck(math.Inf(1), `"+inf"`)
+	docheck(math.Inf(-1), `"-inf"`)
+	docheck(math.NaN(), `"nan"`)
+	docheck(0, `0`)
+	docheck(-1.5, `-1.5`)
+
+	args.normalizeFloats = true
+	defer func() {
+		args.normalizeFloats = false
+	}()
+	docheck(math.Copysign(0, -1), `0`)
+	docheck(0.1, `0.10000000000000001`)
+	docheck(-1.5, `-1.5`)
+	docheck(1e21, `1e+21`)
+	docheck(math.Inf(-1), `"-inf"`)
+}
+
+func TestPipeRecord(t *testing.T) {
+	e := &rdb.BinEntry{DB: 3, Key: []byte("k\r\n"), Value: []byte{0, 1, '\n', 0xff}}
+	expect := "*2\r\n$6\r\nselect\r\n$1\r\n3\r\n" +
+		"*4\r\n$7\r\nrestore\r\n$3\r\nk\r\n\r\n$1\r\n0\r\n$4\r\n\x00\x01\n\xff\r\n"
+	assert.Must(string(newPipeRecord(e)) == expect)
+
+	e.ExpireAt = 1500000000000
+	expect += "*3\r\n$9\r\npexpireat\r\n$3\r\nk\r\n\r\n$13\r\n1500000000000\r\n"
+	assert.Must(string(newPipeRecord(e)) == expect)
+}
+
+func TestRespRecord(t *testing.T) {
+	defer func(v redisVersion) {
+		targetVersion = v
+	}(targetVersion)
+
+	p, err := rdb.EncodeDump(rdb.List{[]byte("a"), []byte("b")})
+	assert.MustNoError(err)
+	e := &rdb.BinEntry{DB: 3, Key: []byte("k"), Value: p, ExpireAt: 1500000000000}
+	assert.Must(bytes.Equal(newRespRecord(e), newPipeRecord(e)))
+
+	targetVersion = redisVersion{major: 5}
+	expect := "*2\r\n$6\r\nselect\r\n$1\r\n3\r\n" +
+		"*5\r\n$7\r\nrestore\r\n$1\r\nk\r\n$13\r\n1500000000000\r\n$" + strconv.Itoa(len(p)) + "\r\n" + string(p) + "\r\n$6\r\nabsttl\r\n"
+	assert.Must(string(newRespRecord(e)) == expect)
+
+	targetVersion = redisVersion{major: 2, minor: 4}
+	expect = "*2\r\n$6\r\nselect\r\n$1\r\n3\r\n" +
+		"*2\r\n$3\r\ndel\r\n$1\r\nk\r\n" +
+		"*4\r\n$5\r\nrpush\r\n$1\r\nk\r\n$1\r\na\r\n$1\r\nb\r\n" +
+		"*3\r\n$9\r\npexpireat\r\n$1\r\nk\r\n$13\r\n1500000000000\r\n"
+	assert.Must(string(newRespRecord(e)) == expect)
+}
+
+func TestRebuildFieldExpires(t *testing.T) {
+	defer func(v redisVersion) {
+		targetVersion = v
+	}(targetVersion)
+
+	hash := rdb.Hash{
+		&rdb.HashElement{Field: []byte("a"), Value: []byte("1"), ExpireAt: 1720000000000},
+		&rdb.HashElement{Field: []byte("b"), Value: []byte("2")},
+	}
+	targetVersion = redisVersion{7, 4, 0}
+	assert.Must(rebuiltCommands(hash) == "hmset k a 1 b 2\nhpexpireat k 1720000000000 FIELDS 1 a")
+	targetVersion = redisVersion{7, 2, 0}
+	assert.Must(rebuiltCommands(hash) == "hmset k a 1 b 2")
+}
+
+// rebuiltCommands returns the commands rebuilding o as key k, one per line.
+func rebuiltCommands(o interface{}) string {
+	var cmds []string
+	rebuildCommands(o, chunkSize, func(cmd string, argv ...interface{}) {
+		name, argv := commandArgs(cmd, []byte("k"), argv)
+		s := []string{name}
+		for _, v := range argv {
+			if p, ok := v.([]byte); ok {
+				v = string(p)
+			}
+			s = append(s, fmt.Sprint(v))
+		}
+		cmds = append(cmds, strings.Join(s, " "))
+	})
+	return strings.Join(cmds, "\n")
+}
+
+func TestRebuildStream(t *testing.T) {
+	defer func(v redisVersion) {
+		targetVersion = v
+	}(targetVersion)
+
+	id1, id2 := rdb.StreamID{Ms: 1526919030474}, rdb.StreamID{Ms: 1526919030474, Seq: 1}
+	stream := rdb.Stream{
+		Entries: []*rdb.StreamEntry{
+			{ID: id1, Fields: []*rdb.HashElement{{Field: []byte("f1"), Value: []byte("v1")}}},
+			{ID: id2, Fields: []*rdb.HashElement{{Field: []byte("f1"), Value: []byte("v2")}, {Field: []byte("f2"), Value: []byte("v3")}}},
+		},
+		LastID:       rdb.StreamID{Ms: 1526919030480},
+		MaxDeletedID: rdb.StreamID{Ms: 1526919030480},
+		EntriesAdded: 3,
+		Groups: []*rdb.StreamGroup{{
+			Name:        []byte("g1"),
+			LastID:      id2,
+			EntriesRead: 2,
+			Pending: []*rdb.StreamPending{
+				{ID: id1, DeliveryTime: 1526919030500, DeliveryCount: 2},
+				{ID: id2, DeliveryTime: 1526919030600, DeliveryCount: 1},
+			},
+			Consumers: []*rdb.StreamConsumer{
+				{Name: []byte("c1"), Pending: []rdb.StreamID{id2}},
+				{Name: []byte("c2"), Pending: []rdb.StreamID{id1}},
+				{Name: []byte("c3")},
+			},
+		}},
+	}
+	targetVersion = redisVersion{7, 0, 0}
+	assert.Must(rebuiltCommands(stream) == strings.Join([]string{
+		"xadd k 1526919030474-0 f1 v1",
+		"xadd k 1526919030474-1 f1 v2 f2 v3",
+		"xsetid k 1526919030480-0 ENTRIESADDED 3 MAXDELETEDID 1526919030480-0",
+		"xgroup create k g1 1526919030474-1 ENTRIESREAD 2",
+		"xclaim k g1 c1 0 1526919030474-1 TIME 1526919030600 RETRYCOUNT 1 FORCE JUSTID",
+		"xclaim k g1 c2 0 1526919030474-0 TIME 1526919030500 RETRYCOUNT 2 FORCE JUSTID",
+		"xgroup createconsumer k g1 c3",
+	}, "\n"))
+
+	targetVersion = redisVersion{5, 0, 0}
+	stream.Entries = nil
+	assert.Must(rebuiltCommands(stream) == strings.Join([]string{
+		"xadd k MAXLEN 0 1526919030480-0  ",
+		"xsetid k 1526919030480-0",
+		"xgroup create k g1 1526919030474-1",
+		"xclaim k g1 c1 0 1526919030474-1 TIME 1526919030600 RETRYCOUNT 1 FORCE JUSTID",
+		"xclaim k g1 c2 0 1526919030474-0 TIME 1526919030500 RETRYCOUNT 2 FORCE JUSTID",
+	}, "\n"))
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	docheck := func(s string, persistent, volatile bool) {
+		p, err := parseEvictionPolicy(s)
+		assert.MustNoError(err)
+		assert.Must(p.evictable(0) == persistent && p.evictable(1500000000000) == volatile)
+	}
+	docheck("noeviction", false, false)
+	docheck("allkeys-lru", true, true)
+	docheck("allkeys-random", true, true)
+	docheck("volatile-lfu", false, true)
+	docheck("volatile-ttl", false, true)
+	_, err := parseEvictionPolicy("lru")
+	assert.Must(err != nil)
+}
+
+func TestValueMatch(t *testing.T) {
+	docheck := func(pattern string, value []byte, match bool) {
+		m, err := newValueMatch(pattern)
+		assert.MustNoError(err)
+		assert.Must(m.Match(value) == match)
+	}
+	docheck("^user:", []byte("user:1"), true)
+	docheck("^user:", []byte("x-user:1"), false)
+	docheck(`^\xff.\x00$`, []byte{0xff, 0x80, 0x00}, true)
+	docheck(`^.$`, []byte{0xc3, 0xa9}, false)
+	docheck("café", []byte("un café"), true)
+	docheck("caf.$", []byte{'c', 'a', 'f', 0xe9}, true)
+}
+
+func TestParquetRecords(t *testing.T) {
+	docheck := func(o interface{}, match func([]byte) bool, expect [][]interface{}) {
+		p, err := rdb.EncodeDump(o)
+		assert.MustNoError(err)
+		e := &rdb.BinEntry{DB: 2, Key: []byte("k"), Value: p, ExpireAt: 1500000000000}
+		var b []byte
+		n := newParquetRecords(e, match, func(p []byte) {
+			b = append(b, p...)
+		})
+		assert.Must(n == len(expect))
+		for _, x := range expect {
+			var row []interface{}
+			row, b = parseParquetRow(b)
+			assert.Must(len(row) == len(parquetColumns))
+			assert.Must(row[0] == int32(2) && row[7] == int64(1500000000000) && string(row[2].([]byte)) == "k")
+			assert.Must(string(row[1].([]byte)) == x[0])
+			for i, v := range x[1:] {
+				switch v := v.(type) {
+				case nil:
+					assert.Must(row[i+3] == nil)
+				case string:
+					assert.Must(string(row[i+3].([]byte)) == v)
+				case float64:
+					assert.Must(row[i+3] == v)
+				}
+			}
+		}
+		assert.Must(len(b) == 0)
+	}
+	all := func([]byte) bool { return true }
+	docheck(rdb.String("v"), all, [][]interface{}{{"string", nil, nil, nil, "v"}})
+	docheck(rdb.String(""), all, [][]interface{}{{"string", nil, nil, nil, ""}})
+	docheck(rdb.Hash{{Field: []byte("f"), Value: []byte("v")}}, all, [][]interface{}{{"hash", "f", nil, nil, "v"}})
+	docheck(rdb.Set{[]byte("a"), []byte("b")}, all, [][]interface{}{{"set", nil, "a", nil, nil}, {"set", nil, "b", nil, nil}})
+	docheck(rdb.ZSet{{Member: []byte("m"), Score: math.Inf(-1)}}, all, [][]interface{}{{"zset", nil, "m", math.Inf(-1), nil}})
+	docheck(rdb.List{[]byte("x"), []byte("y")}, func(p []byte) bool {
+		return string(p) == "y"
+	}, [][]interface{}{{"list", nil, nil, nil, "y"}})
+	docheck(newTestStream(), all, [][]interface{}{{"stream", "f", "1-0", nil, "a"}, {"stream", "g", "1-0", nil, "b"}, {"stream", "f", "2-5", nil, "c"}})
+}
+
+func newTestStream() rdb.Stream {
+	return rdb.Stream{
+		Entries: []*rdb.StreamEntry{
+			{ID: rdb.StreamID{Ms: 1}, Fields: []*rdb.HashElement{{Field: []byte("f"), Value: []byte("a")}, {Field: []byte("g"), Value: []byte("b")}}},
+			{ID: rdb.StreamID{Ms: 2, Seq: 5}, Fields: []*rdb.HashElement{{Field: []byte("f"), Value: []byte("c")}}},
+		},
+		LastID: rdb.StreamID{Ms: 2, Seq: 5},
+		Groups: []*rdb.StreamGroup{{
+			Name:      []byte("g1"),
+			LastID:    rdb.StreamID{Ms: 1},
+			Pending:   []*rdb.StreamPending{{ID: rdb.StreamID{Ms: 1}, DeliveryTime: 1000, DeliveryCount: 2}},
+			Consumers: []*rdb.StreamConsumer{{Name: []byte("c1"), SeenTime: 1000, Pending: []rdb.StreamID{{Ms: 1}}}},
+		}},
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	docheck := func(s rdb.Stream) []map[string]interface{} {
+		p, err := rdb.EncodeDump(s)
+		assert.MustNoError(err)
+		ipipe := make(chan *rdb.BinEntry, 1)
+		opipe := make(chan string, 1)
+		ipipe <- &rdb.BinEntry{Key: []byte("s"), Value: p}
+		close(ipipe)
+		go func() {
+			defer close(opipe)
+			(&cmdDecode{}).decoderMain(ipipe, opipe)
+		}()
+		var records []map[string]interface{}
+		for s := range opipe {
+			dec := json.NewDecoder(bytes.NewBufferString(s))
+			for dec.More() {
+				var r map[string]interface{}
+				assert.MustNoError(dec.Decode(&r))
+				records = append(records, r)
+			}
+		}
+		return records
+	}
+	r := docheck(newTestStream())
+	assert.Must(len(r) == 4)
+	assert.Must(r[0]["type"] == "stream-info" && r[0]["length"] == float64(2) && r[0]["last_id"] == "2-5")
+	assert.Must(r[1]["type"] == "stream" && r[1]["id"] == "1-0" && len(r[1]["field64"].([]interface{})) == 2)
+	assert.Must(r[1]["value64"].([]interface{})[1] == "Yg==")
+	assert.Must(r[2]["type"] == "stream" && r[2]["id"] == "2-5")
+	assert.Must(r[3]["type"] == "stream-group" && r[3]["group"] == "g1" && r[3]["last_id"] == "1-0")
+	assert.Must(len(r[3]["pending"].([]interface{})) == 1 && len(r[3]["consumers"].([]interface{})) == 1)
+
+	// a stream without entries keeps its groups.
+	s := newTestStream()
+	s.Entries = nil
+	r = docheck(s)
+	assert.Must(len(r) == 2 && r[0]["length"] == float64(0) && r[1]["type"] == "stream-group")
+}
+
+func TestDecodeContinueOnError(t *testing.T) {
+	args.continueOnError = true
+	defer func() {
+		args.continueOnError = false
+	}()
+	p, err := rdb.EncodeDump(rdb.Hash{{Field: []byte("f"), Value: []byte("v")}})
+	assert.MustNoError(err)
+	bad := append([]byte{}, p...)
+	bad[len(bad)-1] ^= 0xff
+	_, err = rdb.DecodeDump(bad)
+	assert.Must(err != nil)
+
+	ipipe := make(chan *rdb.BinEntry, 3)
+	opipe := make(chan string, 3)
+	ipipe <- &rdb.BinEntry{Key: []byte("a"), Value: p}
+	ipipe <- &rdb.BinEntry{Key: []byte("b"), Value: bad}
+	ipipe <- &rdb.BinEntry{Key: []byte("c"), Value: p}
+	close(ipipe)
+	cmd := &cmdDecode{}
+	cmd.decoderMain(ipipe, opipe)
+	close(opipe)
+	var keys []string
+	for s := range opipe {
+		var r map[string]interface{}
+		assert.MustNoError(json.Unmarshal([]byte(s), &r))
+		keys = append(keys, r["key"].(string))
+	}
+	assert.Must(len(keys) == 2 && keys[0] == "a" && keys[1] == "c")
+	assert.Must(cmd.Stat().errors == 1 && cmd.Stat().nentry == 2)
+}
+
+func TestDecodeMaxErrors(t *testing.T) {
+	args.continueOnError, args.maxErrors = true, 1
+	defer func() {
+		args.continueOnError, args.maxErrors = false, 0
+		loaderStop, loaderStopOnce = make(chan struct{}), sync.Once{}
+	}()
+	p, err := rdb.EncodeDump(rdb.String("v"))
+	assert.MustNoError(err)
+	bad := append([]byte{}, p...)
+	bad[len(bad)-1] ^= 0xff
+
+	// the entries handed out after the limit are still decoded.
+	ipipe := make(chan *rdb.BinEntry, 3)
+	opipe := make(chan string, 3)
+	ipipe <- &rdb.BinEntry{Key: []byte("a"), Value: bad}
+	ipipe <- &rdb.BinEntry{Key: []byte("b"), Value: p}
+	ipipe <- &rdb.BinEntry{Key: []byte("c"), Value: bad}
+	close(ipipe)
+	cmd := &cmdDecode{}
+	cmd.decoderMain(ipipe, opipe)
+	close(opipe)
+	assert.Must(len(opipe) == 1 && cmd.Stat().errors == 2)
+	assert.Must(cmd.aborted.Get() && loadersStopped())
+}
+
+func TestTypeStats(t *testing.T) {
+	s := newTypeStats()
+	dump := func(o interface{}) []byte {
+		p, err := rdb.EncodeDump(o)
+		assert.MustNoError(err)
+		return p
+	}
+	str, set := dump(rdb.String("v")), dump(rdb.Set{[]byte("a")})
+	workers := []*typeStats{newTypeStats(), newTypeStats()}
+	for i := 0; i < 10; i++ {
+		w := workers[i%2]
+		w.Add(&rdb.BinEntry{DB: 1, Key: []byte("k"), Value: str})
+		if i < 3 {
+			w.Add(&rdb.BinEntry{DB: 0, Key: []byte("k"), Value: set})
+		}
+	}
+	for _, w := range workers {
+		s.Merge(w)
+	}
+	cells := s.Cells()
+	assert.Must(len(cells) == 2)
+	assert.Must(cells[0].DB == 0 && cells[0].Type == "set" && cells[0].Keys == 3 && cells[0].Bytes == int64(3*(1+len(set))))
+	assert.Must(cells[1].DB == 1 && cells[1].Type == "string" && cells[1].Keys == 10)
+
+	var b bytes.Buffer
+	assert.MustNoError(s.WriteSummary(&b, &cmdDecodeStat{nentry: 13}))
+	var o struct {
+		Entry int64       `json:"entry"`
+		Types []*typeStat `json:"types"`
+	}
+	assert.MustNoError(json.Unmarshal(b.Bytes(), &o))
+	assert.Must(o.Entry == 13 && len(o.Types) == 2 && *o.Types[1] == *cells[1])
+}
+
+func TestBigKeys(t *testing.T) {
+	s := newBigKeys(3)
+	workers := []*bigKeys{newBigKeys(3), newBigKeys(3)}
+	for i := 0; i < 20; i++ {
+		var l rdb.List
+		for j := 0; j < i; j++ {
+			l = append(l, []byte("element"))
+		}
+		p, err := rdb.EncodeDump(l)
+		assert.MustNoError(err)
+		workers[i%2].Add(&rdb.BinEntry{DB: 0, Key: []byte("list:" + strconv.Itoa(i)), Value: p})
+	}
+	p, err := rdb.EncodeDump(rdb.String("v"))
+	assert.MustNoError(err)
+	workers[0].Add(&rdb.BinEntry{DB: 1, Key: []byte("str"), Value: p})
+	for _, w := range workers {
+		s.Merge(w)
+	}
+
+	top := s.Top()
+	assert.Must(len(top) == 3)
+	assert.Must(string(top[0].Key) == "list:19" && top[0].Elements == 19 && top[0].Type == "list")
+	assert.Must(string(top[1].Key) == "list:18" && string(top[2].Key) == "list:17")
+	types := s.ByType()
+	assert.Must(len(types) == 2 && string(types[0].Key) == "list:19")
+	assert.Must(string(types[1].Key) == "str" && types[1].DB == 1 && types[1].Elements == 1)
+
+	// the cells are a typeStats counting the payload and the elements.
+	cells := s.cells.Cells()
+	assert.Must(len(cells) == 2 && cells[0].Keys == 20 && cells[0].Elements == 190)
+	assert.Must(cells[1].Bytes == int64(len(p)) && cells[1].Elements == 1)
+}
+
+func TestKeyFilter(t *testing.T) {
+	docheck := func(pattern, key string, match bool) {
+		assert.Must(globMatch(pattern, []byte(key)) == match)
+	}
+	docheck("*", "", true)
+	docheck("session:*", "session:1", true)
+	docheck("session:*", "x-session:1", false)
+	docheck("*:user:*", "cache:user:42", true)
+	docheck("h?llo", "hello", true)
+	docheck("h?llo", "hllo", false)
+	docheck("h[ae]llo", "hallo", true)
+	docheck("h[^e]llo", "hello", false)
+	docheck("h[a-b]llo", "hbllo", true)
+	docheck("h[b-a]llo", "hallo", true)
+	docheck(`h\*llo`, "h*llo", true)
+	docheck(`h\*llo`, "hello", false)
+	docheck("a*b*c", "aXbYbZc", true)
+	docheck("a*b*c", "aXbYbZ", false)
+	docheck("*a*a*a*a*a*a*a*a*b", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", false)
+	docheck("k[\xff]", "k\xff", true)
+
+	f, err := newKeyFilter([]string{"session:*", "cache:user:*"}, []string{`^\xff`}, []string{"*:tmp"})
+	assert.MustNoError(err)
+	assert.Must(f.Accept([]byte("session:1")) && f.Accept([]byte("cache:user:1")) && f.Accept([]byte{0xff, 'k'}))
+	assert.Must(!f.Accept([]byte("cache:item:1")) && !f.Accept([]byte("session:tmp")))
+
+	f, err = newKeyFilter(nil, nil, []string{"tmp:*"})
+	assert.MustNoError(err)
+	assert.Must(f.Accept([]byte("a")) && !f.Accept([]byte("tmp:a")))
+}
+
+func TestMergeRecords(t *testing.T) {
+	entry := func(db uint32, key string) *rdb.BinEntry {
+		return &rdb.BinEntry{DB: db, Key: []byte(key)}
+	}
+	records := [][]byte{
+		newMergeRecord(entry(1, "a"), 0, "1a"),
+		newMergeRecord(entry(0, "b"), 1, "0b-1"),
+		newMergeRecord(entry(0, "b"), 0, "0b-0"),
+		newMergeRecord(entry(0, "a"), 0, "0a-y"),
+		newMergeRecord(entry(0, "a"), 0, "0a-x"),
+		newMergeRecord(entry(0, ""), 0, "0"),
+	}
+	sort.Sort(mergeRecords(records))
+	var s []string
+	for _, p := range records {
+		db, _, _, r := parseMergeRecord(p)
+		assert.Must(db == uint32(r[0]-'0'))
+		s = append(s, string(r))
+	}
+	assert.Must(strings.Join(s, ",") == "0,0a-x,0a-y,0b-0,0b-1,1a")
+}
+
+type mergeRecords [][]byte
+
+func (r mergeRecords) Len() int           { return len(r) }
+func (r mergeRecords) Less(i, j int) bool { return lessMergeRecord(r[i], r[j]) }
+func (r mergeRecords) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
@@ -0,0 +1,85 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/left2right/redis-port/pkg/libs/log"
+)
+
+// deleteLog appends the deletions forwarded by sync to a file, see
+// --delete-log. Records are buffered and flushed once per second.
+type deleteLog struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func openDeleteLog(name string) *deleteLog {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.PanicErrorf(err, "cannot open delete log '%s'", name)
+	}
+	d := &deleteLog{f: f, w: bufio.NewWriter(f)}
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			d.Flush()
+		}
+	}()
+	return d
+}
+
+// Record logs the command when it deletes keys: one line per key of
+// DEL/UNLINK/GETDEL, one line without key for FLUSHDB/FLUSHALL.
+func (d *deleteLog) Record(db uint32, scmd string, args [][]byte) {
+	var keys [][]byte
+	switch scmd {
+	default:
+		return
+	case "del", "unlink":
+		keys = args
+	case "getdel":
+		if len(args) != 0 {
+			keys = args[:1]
+		}
+	case "flushdb", "flushall":
+		keys = [][]byte{nil}
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		o := &struct {
+			Time  int64  `json:"time"`
+			DB    uint32 `json:"db"`
+			Cmd   string `json:"cmd"`
+			Key   string `json:"key,omitempty"`
+			Key64 string `json:"key64,omitempty"`
+		}{
+			now, db, scmd, keyText(key), base64.StdEncoding.EncodeToString(key),
+		}
+		b, err := json.Marshal(o)
+		if err != nil {
+			log.PanicError(err, "encode to json failed")
+		}
+		if _, err := d.w.Write(append(b, '\n')); err != nil {
+			log.PanicError(err, "write delete log failed")
+		}
+	}
+}
+
+func (d *deleteLog) Flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.w.Flush(); err != nil {
+		log.PanicError(err, "flush delete log failed")
+	}
+}
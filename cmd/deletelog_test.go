@@ -0,0 +1,41 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+)
+
+func TestDeleteLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "deletelog")
+	assert.MustNoError(err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	d := openDeleteLog(f.Name())
+	d.Record(3, "set", [][]byte{[]byte("a"), []byte("b")})
+	d.Record(3, "del", [][]byte{[]byte("a"), []byte("b\n")})
+	d.Record(0, "flushall", nil)
+	d.Flush()
+
+	p, err := ioutil.ReadFile(f.Name())
+	assert.MustNoError(err)
+	lines := strings.Split(strings.TrimSpace(string(p)), "\n")
+	assert.Must(len(lines) == 3)
+	var o struct {
+		DB    uint32 `json:"db"`
+		Cmd   string `json:"cmd"`
+		Key   string `json:"key"`
+		Key64 string `json:"key64"`
+	}
+	assert.MustNoError(json.Unmarshal([]byte(lines[1]), &o))
+	assert.Must(o.DB == 3 && o.Cmd == "del" && o.Key == "b." && o.Key64 == "Ygo=")
+	assert.Must(!strings.Contains(lines[2], "key"))
+}
@@ -6,15 +6,20 @@ package main
 import (
 	"bufio"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"time"
 
 	"github.com/left2right/redis-port/pkg/libs/atomic2"
 	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/libs/stats"
+	"github.com/left2right/redis-port/pkg/rdb"
+	"github.com/left2right/redis-port/pkg/redis"
 )
 
 type cmdDump struct {
+	lua *luaDumper
 }
 
 func (cmd *cmdDump) Main() {
@@ -22,20 +27,26 @@ func (cmd *cmdDump) Main() {
 	if len(from) == 0 {
 		log.Panic("invalid argument: from")
 	}
-	if len(output) == 0 {
-		output = "/dev/stdout"
-	}
 
-	log.Infof("dump from '%s' to '%s'\n", from, output)
+	log.Infof("dump from '%s' to '%s'\n", from, outputName(output))
 
 	var dumpto io.WriteCloser
-	if output != "/dev/stdout" {
+	if !isStdio(output) {
 		dumpto = openWriteFile(output)
 		defer dumpto.Close()
 	} else {
 		dumpto = os.Stdout
 	}
 
+	if len(args.dumpLua) != 0 {
+		f := openWriteFile(args.dumpLua)
+		defer f.Close()
+		cmd.lua = newLuaDumper(f)
+		if v := detectSourceVersion(from, args.passwd); v.atLeast(7, 0) {
+			log.Warnf("dump: master is redis %s, redis 7.0+ saves no lua aux field and replicates neither EVAL nor SCRIPT LOAD, --dump-lua will likely write no script", v)
+		}
+	}
+
 	master, nsize := cmd.SendCmd(from, args.passwd)
 	defer master.Close()
 
@@ -44,13 +55,22 @@ func (cmd *cmdDump) Main() {
 	reader := bufio.NewReaderSize(master, ReaderBufferSize)
 	writer := bufio.NewWriterSize(dumpto, WriterBufferSize)
 
-	cmd.DumpRDBFile(reader, writer, nsize)
+	filter := args.filterKeys || rewriting() || args.dropFunctions || args.dropModuleAux
+	if filter {
+		cmd.FilterRDBFile(reader, writer, nsize)
+	} else {
+		cmd.DumpRDBFile(reader, writer, nsize)
+	}
 
 	if !args.extra {
 		return
 	}
 
-	cmd.DumpCommand(reader, writer, nsize)
+	if filter {
+		cmd.FilterCommand(reader, writer, nsize)
+	} else {
+		cmd.DumpCommand(reader, writer, nsize)
+	}
 }
 
 func (cmd *cmdDump) SendCmd(master, passwd string) (net.Conn, int64) {
@@ -70,6 +90,14 @@ func (cmd *cmdDump) SendCmd(master, passwd string) (net.Conn, int64) {
 }
 
 func (cmd *cmdDump) DumpRDBFile(reader *bufio.Reader, writer *bufio.Writer, nsize int64) {
+	var copyto io.Writer = writer
+	if cmd.lua != nil {
+		r, w := io.Pipe()
+		defer w.Close()
+		go cmd.lua.WatchRDB(r)
+		copyto = io.MultiWriter(writer, w)
+	}
+
 	var nread atomic2.Int64
 	wait := make(chan struct{})
 	go func() {
@@ -77,7 +105,7 @@ func (cmd *cmdDump) DumpRDBFile(reader *bufio.Reader, writer *bufio.Writer, nsiz
 		p := make([]byte, WriterBufferSize)
 		for nsize != nread.Get() {
 			nstep := int(nsize - nread.Get())
-			ncopy := int64(iocopy(reader, writer, p, nstep))
+			ncopy := int64(iocopy(reader, copyto, p, nstep))
 			nread.Add(ncopy)
 			flushWriter(writer)
 		}
@@ -97,11 +125,18 @@ func (cmd *cmdDump) DumpRDBFile(reader *bufio.Reader, writer *bufio.Writer, nsiz
 }
 
 func (cmd *cmdDump) DumpCommand(reader *bufio.Reader, writer *bufio.Writer, nsize int64) {
+	var copyto io.Writer = writer
+	if cmd.lua != nil {
+		r, w := io.Pipe()
+		go cmd.lua.WatchCommands(r)
+		copyto = io.MultiWriter(writer, w)
+	}
+
 	var nread atomic2.Int64
 	go func() {
 		p := make([]byte, ReaderBufferSize)
 		for {
-			ncopy := int64(iocopy(reader, writer, p, len(p)))
+			ncopy := int64(iocopy(reader, copyto, p, len(p)))
 			nread.Add(ncopy)
 			flushWriter(writer)
 		}
@@ -112,3 +147,131 @@ func (cmd *cmdDump) DumpCommand(reader *bufio.Reader, writer *bufio.Writer, nsiz
 		log.Infof("dump: total = %d\n", nsize+nread.Get())
 	}
 }
+
+// FilterRDBFile writes the entries of the rdb that pass --filter-key and
+// --filter-db, renamed by --rename-prefix and moved by --target-db, as an rdb
+// of the same version. Aux fields are left out, function libraries and module
+// aux sections are copied unless --drop-functions or --drop-module-aux.
+func (cmd *cmdDump) FilterRDBFile(reader *bufio.Reader, writer *bufio.Writer, nsize int64) {
+	var input io.Reader = io.LimitReader(reader, nsize)
+	if cmd.lua != nil {
+		r, w := io.Pipe()
+		defer w.Close()
+		go cmd.lua.WatchRDB(r)
+		input = io.TeeReader(input, w)
+	}
+
+	var nread, nentry, ignore, ndrop atomic2.Int64
+	wait := make(chan struct{})
+	go func() {
+		defer close(wait)
+		l := rdb.NewLoader(stats.NewCountReader(input, &nread))
+		l.SetStrict(args.strict)
+		if err := l.Header(); err != nil {
+			log.PanicError(err, "parse rdb header error")
+		}
+		w := rdb.NewBinWriter(writer)
+		if err := w.WriteHeader(l.Version()); err != nil {
+			log.PanicError(err, "write rdb header error")
+		}
+		l.SetSection(func(kind string, raw []byte) {
+			if (kind == rdb.SectionFunction && args.dropFunctions) || (kind == rdb.SectionModuleAux && args.dropModuleAux) {
+				log.Warnf("dump: %s section of %d bytes dropped", kind, len(raw))
+				ndrop.Incr()
+				return
+			}
+			if err := w.WriteSection(raw); err != nil {
+				log.PanicErrorf(err, "write rdb %s section error", kind)
+			}
+		})
+		for {
+			e, err := l.NextBinEntry()
+			if err != nil {
+				log.PanicError(err, "parse rdb entry error")
+			}
+			if e == nil {
+				break
+			}
+			if !acceptDB(e.DB) || !acceptKey(e.Key) || skipKey(e.Key) {
+				ignore.Incr()
+				continue
+			}
+			rewriteEntry(e)
+			if err := w.WriteEntry(e); err != nil {
+				log.PanicErrorf(err, "write rdb entry of key '%s' error", e.Key)
+			}
+			nentry.Incr()
+		}
+		if err := l.Footer(); err != nil {
+			log.PanicError(err, "parse rdb checksum error")
+		}
+		if err := w.WriteFooter(); err != nil {
+			log.PanicError(err, "write rdb checksum error")
+		}
+		if _, err := io.Copy(ioutil.Discard, input); err != nil {
+			log.PanicError(err, "read rdb error")
+		}
+		flushWriter(writer)
+	}()
+
+	for done := false; !done; {
+		select {
+		case <-wait:
+			done = true
+		case <-time.After(time.Second):
+		}
+		n := nread.Get()
+		p := 100 * n / nsize
+		log.Infof("total = %d - %12d [%3d%%]  entry=%-12d ignore=%-12d\n", nsize, n, p, nentry.Get(), ignore.Get())
+	}
+	if n := ndrop.Get(); n != 0 {
+		log.Warnf("dump: %d function or module aux sections dropped, the target needs them loaded some other way", n)
+	}
+	log.Info("dump: rdb done")
+}
+
+// FilterCommand writes the commands of the replication stream that pass the
+// same filters as FilterRDBFile, with the same renames.
+func (cmd *cmdDump) FilterCommand(reader *bufio.Reader, writer *bufio.Writer, nsize int64) {
+	var nread, nbypass atomic2.Int64
+	var input io.Reader = stats.NewCountReader(reader, &nread)
+	if cmd.lua != nil {
+		r, w := io.Pipe()
+		go cmd.lua.WatchCommands(r)
+		input = io.TeeReader(input, w)
+	}
+
+	go func() {
+		br := bufio.NewReaderSize(input, ReaderBufferSize)
+		var bypass bool
+		for {
+			resp := redis.MustDecode(br)
+			scmd, argv, err := redis.ParseArgs(resp)
+			if err != nil {
+				log.PanicError(err, "parse command arguments failed")
+			}
+			if scmd == "select" {
+				if len(argv) != 1 {
+					log.Panicf("select command len(args) = %d", len(argv))
+				}
+				s := string(argv[0])
+				n, err := parseInt(s, MinDB, MaxDB)
+				if err != nil {
+					log.PanicErrorf(err, "parse db = %s failed", s)
+				}
+				bypass = !acceptDB(uint32(n))
+			}
+			if scmd != "ping" && (bypass || !acceptCommand(scmd, argv) || (len(argv) > 0 && skipKey(argv[0]))) {
+				nbypass.Incr()
+				continue
+			}
+			redis.MustEncode(writer, rewriteCommand(resp, scmd, argv))
+			flushWriter(writer)
+		}
+	}()
+
+	for {
+		time.Sleep(time.Second)
+		log.Infof("dump: total = %d  bypass=%-12d\n", nsize+nread.Get(), nbypass.Get())
+	}
+}
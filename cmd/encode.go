@@ -0,0 +1,559 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/libs/stats"
+	"github.com/left2right/redis-port/pkg/rdb"
+	"github.com/left2right/redis-port/pkg/redis"
+)
+
+// cmdEncode is the reverse of decode: it reads the json records of decode and
+// writes the keys as an rdb file, or as the commands of --output-format
+// redis-pipe or resp.
+type cmdEncode struct {
+	rbytes, wbytes, nrecord, nentry, ignore atomic2.Int64
+
+	// fieldExpires counts the hash field expires the rdb can't hold.
+	fieldExpires atomic2.Int64
+}
+
+type cmdEncodeStat struct {
+	rbytes, wbytes, nrecord, nentry, ignore int64
+}
+
+func (cmd *cmdEncode) Stat() *cmdEncodeStat {
+	return &cmdEncodeStat{
+		rbytes:  cmd.rbytes.Get(),
+		wbytes:  cmd.wbytes.Get(),
+		nrecord: cmd.nrecord.Get(),
+		nentry:  cmd.nentry.Get(),
+		ignore:  cmd.ignore.Get(),
+	}
+}
+
+func (cmd *cmdEncode) Main() {
+	input, output := args.input, args.output
+
+	switch args.outputFormat {
+	case "", "rdb", "redis-pipe", "resp":
+	default:
+		log.Panicf("encode can't write --output-format=%s, should be rdb, redis-pipe or resp", args.outputFormat)
+	}
+
+	log.Infof("encode from '%s' to '%s'\n", inputName(input), outputName(output))
+
+	var readin io.ReadCloser
+	var nsize int64
+	if !isStdio(input) {
+		readin, nsize = openInputFile(input)
+		defer readin.Close()
+	} else {
+		readin, nsize = os.Stdin, 0
+	}
+	reader := bufio.NewReaderSize(readin, ReaderBufferSize)
+	if p, err := reader.Peek(2); err == nil && p[0] == 0x1f && p[1] == 0x8b {
+		r, err := gzip.NewReader(reader)
+		if err != nil {
+			log.PanicError(err, "open gzip reader failed")
+		}
+		reader, nsize = bufio.NewReaderSize(r, ReaderBufferSize), 0
+	}
+
+	var saveto io.WriteCloser
+	if !isStdio(output) {
+		saveto = openWriteFile(output)
+		defer saveto.Close()
+	} else {
+		saveto = os.Stdout
+	}
+	writer := bufio.NewWriterSize(saveto, WriterBufferSize)
+
+	wait := make(chan struct{})
+	go func() {
+		defer close(wait)
+		objs, err := cmd.readRecords(reader)
+		if err != nil {
+			log.PanicError(err, "read records failed")
+		}
+		cmd.writeKeys(objs, writer)
+		flushWriter(writer)
+	}()
+
+	for done := false; !done; {
+		select {
+		case <-wait:
+			done = true
+		case <-time.After(time.Second):
+		}
+		stat := cmd.Stat()
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "encode: ")
+		if nsize != 0 {
+			fmt.Fprintf(&b, "total = %d - %12d [%3d%%]", nsize, stat.rbytes, 100*stat.rbytes/nsize)
+		} else {
+			fmt.Fprintf(&b, "total = %12d", stat.rbytes)
+		}
+		fmt.Fprintf(&b, "  record=%-12d", stat.nrecord)
+		fmt.Fprintf(&b, "  write=%-12d", stat.wbytes)
+		fmt.Fprintf(&b, "  entry=%-12d", stat.nentry)
+		if stat.ignore != 0 {
+			fmt.Fprintf(&b, "  ignore=%-12d", stat.ignore)
+		}
+		log.Info(b.String())
+	}
+	if n := cmd.fieldExpires.Get(); n != 0 {
+		log.Warnf("encode: expires of %d hash fields dropped, the output can't hold them", n)
+	}
+	log.Info("encode: done")
+}
+
+type encodePending struct {
+	ID            string `json:"id"`
+	DeliveryTime  uint64 `json:"delivery_time"`
+	DeliveryCount uint64 `json:"delivery_count"`
+}
+
+type encodeConsumer struct {
+	Name64     string   `json:"name64"`
+	SeenTime   uint64   `json:"seen_time"`
+	ActiveTime uint64   `json:"active_time"`
+	Pending    []string `json:"pending"`
+}
+
+// encodeRecord holds the fields of the decode records encode reads back, the
+// fields a type doesn't use stay empty. field64 and value64 are strings,
+// except for stream entries where they are lists.
+type encodeRecord struct {
+	DB       uint32  `json:"db"`
+	Type     string  `json:"type"`
+	ExpireAt uint64  `json:"expireat"`
+	Key64    *string `json:"key64"`
+
+	Index    int             `json:"index"`
+	Field64  json.RawMessage `json:"field64"`
+	Value64  json.RawMessage `json:"value64"`
+	Member64 string          `json:"member64"`
+	Score    zsetScore       `json:"score"`
+	BitCount int64           `json:"bitcount"`
+	Bits     []int64         `json:"bits"`
+
+	FieldExpireAt uint64 `json:"field_expireat"`
+
+	ID           string `json:"id"`
+	LastID       string `json:"last_id"`
+	FirstID      string `json:"first_id"`
+	MaxDeletedID string `json:"max_deleted_id"`
+	EntriesAdded uint64 `json:"entries_added"`
+
+	Group64     string            `json:"group64"`
+	EntriesRead int64             `json:"entries_read"`
+	Pending     []*encodePending  `json:"pending"`
+	Consumers   []*encodeConsumer `json:"consumers"`
+
+	// Data is the record wrapped by --envelope.
+	Data *encodeRecord `json:"data"`
+}
+
+// encodeType returns the type of the key holding the record.
+func encodeType(t string) string {
+	switch t {
+	case "bitmap":
+		return "string"
+	case "stream-info", "stream-group":
+		return "stream"
+	}
+	return t
+}
+
+type encodeKey struct {
+	db  uint32
+	key string
+}
+
+type listElement struct {
+	index int
+	value []byte
+}
+
+type sortedListElements []listElement
+
+func (l sortedListElements) Len() int           { return len(l) }
+func (l sortedListElements) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l sortedListElements) Less(i, j int) bool { return l[i].index < l[j].index }
+
+type sortedStreamEntries []*rdb.StreamEntry
+
+func (l sortedStreamEntries) Len() int           { return len(l) }
+func (l sortedStreamEntries) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l sortedStreamEntries) Less(i, j int) bool { return l[i].ID.Less(l[j].ID) }
+
+// encodeObject is a key built from its records.
+type encodeObject struct {
+	db       uint32
+	key      []byte
+	expireat uint64
+	typ      string
+
+	value  []byte
+	list   sortedListElements
+	hash   rdb.Hash
+	set    rdb.Set
+	zset   rdb.ZSet
+	stream rdb.Stream
+}
+
+// readRecords reads the records of every key, keys are returned in the order
+// of their first record. decode writes the records of a key together, except
+// for lists large enough to be written in several chunks, so the whole input
+// is held in memory until it's read.
+func (cmd *cmdEncode) readRecords(reader *bufio.Reader) ([]*encodeObject, error) {
+	var objs []*encodeObject
+	index := make(map[encodeKey]*encodeObject)
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, errors.Trace(err)
+		}
+		cmd.rbytes.Add(int64(len(b)))
+		if p := bytes.TrimSpace(b); len(p) != 0 {
+			r := &encodeRecord{}
+			if err := json.Unmarshal(p, r); err != nil {
+				return nil, errors.Errorf("parse record at line %d failed: %s", line, err)
+			}
+			if r.Data != nil {
+				r = r.Data
+			}
+			if r.Key64 == nil || len(r.Type) == 0 {
+				return nil, errors.Errorf("record at line %d is not a record of decode", line)
+			}
+			key, err := base64.StdEncoding.DecodeString(*r.Key64)
+			if err != nil {
+				return nil, errors.Errorf("invalid key64 at line %d", line)
+			}
+			o := index[encodeKey{r.DB, string(key)}]
+			if o == nil {
+				o = &encodeObject{db: r.DB, key: key, expireat: r.ExpireAt, typ: encodeType(r.Type)}
+				index[encodeKey{r.DB, string(key)}] = o
+				objs = append(objs, o)
+			}
+			if err := o.add(r); err != nil {
+				return nil, errors.Errorf("record at line %d: %s", line, err)
+			}
+			cmd.nrecord.Incr()
+		}
+		if err == io.EOF {
+			return objs, nil
+		}
+	}
+}
+
+func decodeBase64(raw json.RawMessage) ([]byte, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+func decodeBase64List(raw json.RawMessage) ([][]byte, error) {
+	var l []string
+	if err := json.Unmarshal(raw, &l); err != nil {
+		return nil, err
+	}
+	list := make([][]byte, len(l))
+	for i, s := range l {
+		p, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = p
+	}
+	return list, nil
+}
+
+// bitmapBytes returns the string with the bits set, trailing zero bytes of
+// the original value are lost.
+func bitmapBytes(bits []int64) []byte {
+	var p []byte
+	for _, n := range bits {
+		for int64(len(p)) <= n/8 {
+			p = append(p, 0)
+		}
+		p[n/8] |= 0x80 >> uint(n%8)
+	}
+	return p
+}
+
+func (o *encodeObject) add(r *encodeRecord) error {
+	if t := encodeType(r.Type); t != o.typ {
+		return errors.Errorf("key '%s' of db%d has both %s and %s records", o.key, o.db, o.typ, t)
+	}
+	if r.ExpireAt != o.expireat {
+		return errors.Errorf("key '%s' of db%d has records of different expireat", o.key, o.db)
+	}
+	switch r.Type {
+	default:
+		return errors.Errorf("unknown record type '%s'", r.Type)
+	case "string":
+		p, err := decodeBase64(r.Value64)
+		if err != nil {
+			return errors.Errorf("invalid value64: %s", err)
+		}
+		o.value = p
+	case "bitmap":
+		if r.BitCount != 0 && len(r.Bits) == 0 {
+			return errors.Errorf("bitmap key '%s' was decoded with --bitmap-summary, its bits are unknown", o.key)
+		}
+		o.value = bitmapBytes(r.Bits)
+	case "list":
+		p, err := decodeBase64(r.Value64)
+		if err != nil {
+			return errors.Errorf("invalid value64: %s", err)
+		}
+		o.list = append(o.list, listElement{r.Index, p})
+	case "hash":
+		field, err := decodeBase64(r.Field64)
+		if err != nil {
+			return errors.Errorf("invalid field64: %s", err)
+		}
+		value, err := decodeBase64(r.Value64)
+		if err != nil {
+			return errors.Errorf("invalid value64: %s", err)
+		}
+		o.hash = append(o.hash, &rdb.HashElement{Field: field, Value: value, ExpireAt: r.FieldExpireAt})
+	case "set":
+		p, err := base64.StdEncoding.DecodeString(r.Member64)
+		if err != nil {
+			return errors.Errorf("invalid member64: %s", err)
+		}
+		o.set = append(o.set, p)
+	case "zset":
+		p, err := base64.StdEncoding.DecodeString(r.Member64)
+		if err != nil {
+			return errors.Errorf("invalid member64: %s", err)
+		}
+		o.zset = append(o.zset, &rdb.ZSetElement{Member: p, Score: float64(r.Score)})
+	case "stream-info":
+		for _, x := range []struct {
+			s  string
+			id *rdb.StreamID
+		}{
+			{r.LastID, &o.stream.LastID}, {r.FirstID, &o.stream.FirstID}, {r.MaxDeletedID, &o.stream.MaxDeletedID},
+		} {
+			id, err := rdb.ParseStreamID(x.s)
+			if err != nil {
+				return err
+			}
+			*x.id = id
+		}
+		o.stream.EntriesAdded = r.EntriesAdded
+	case "stream":
+		id, err := rdb.ParseStreamID(r.ID)
+		if err != nil {
+			return err
+		}
+		fields, err := decodeBase64List(r.Field64)
+		if err != nil {
+			return errors.Errorf("invalid field64: %s", err)
+		}
+		values, err := decodeBase64List(r.Value64)
+		if err != nil || len(values) != len(fields) {
+			return errors.Errorf("invalid value64 of entry %s", r.ID)
+		}
+		ent := &rdb.StreamEntry{ID: id}
+		for i := range fields {
+			ent.Fields = append(ent.Fields, &rdb.HashElement{Field: fields[i], Value: values[i]})
+		}
+		o.stream.Entries = append(o.stream.Entries, ent)
+	case "stream-group":
+		g, err := r.streamGroup()
+		if err != nil {
+			return err
+		}
+		o.stream.Groups = append(o.stream.Groups, g)
+	case "module":
+		// the value of module keys is not in the records.
+	}
+	return nil
+}
+
+func (r *encodeRecord) streamGroup() (*rdb.StreamGroup, error) {
+	name, err := base64.StdEncoding.DecodeString(r.Group64)
+	if err != nil {
+		return nil, errors.Errorf("invalid group64: %s", err)
+	}
+	last, err := rdb.ParseStreamID(r.LastID)
+	if err != nil {
+		return nil, err
+	}
+	g := &rdb.StreamGroup{Name: name, LastID: last, EntriesRead: r.EntriesRead}
+	for _, p := range r.Pending {
+		id, err := rdb.ParseStreamID(p.ID)
+		if err != nil {
+			return nil, err
+		}
+		g.Pending = append(g.Pending, &rdb.StreamPending{ID: id, DeliveryTime: p.DeliveryTime, DeliveryCount: p.DeliveryCount})
+	}
+	for _, c := range r.Consumers {
+		name, err := base64.StdEncoding.DecodeString(c.Name64)
+		if err != nil {
+			return nil, errors.Errorf("invalid name64: %s", err)
+		}
+		x := &rdb.StreamConsumer{Name: name, SeenTime: c.SeenTime, ActiveTime: c.ActiveTime}
+		for _, s := range c.Pending {
+			id, err := rdb.ParseStreamID(s)
+			if err != nil {
+				return nil, err
+			}
+			x.Pending = append(x.Pending, id)
+		}
+		g.Consumers = append(g.Consumers, x)
+	}
+	return g, nil
+}
+
+// Object returns the value of the key. List elements are ordered by their
+// index and stream entries by ID, whatever the order of their records.
+func (o *encodeObject) Object() interface{} {
+	switch o.typ {
+	case "string":
+		return rdb.String(o.value)
+	case "list":
+		sort.Stable(o.list)
+		list := make(rdb.List, len(o.list))
+		for i, ele := range o.list {
+			list[i] = ele.value
+		}
+		return list
+	case "hash":
+		return o.hash
+	case "set":
+		return o.set
+	case "zset":
+		return o.zset
+	case "stream":
+		s := o.stream
+		sort.Sort(sortedStreamEntries(s.Entries))
+		if n := len(s.Entries); n != 0 && s.LastID.Less(s.Entries[n-1].ID) {
+			s.LastID = s.Entries[n-1].ID
+		}
+		return s
+	}
+	return nil
+}
+
+// writeKeys writes the keys as an rdb file, or as the commands of decode's
+// --output-format=redis-pipe or resp. Module keys have no value in the
+// records, they are skipped.
+func (cmd *cmdEncode) writeKeys(objs []*encodeObject, writer *bufio.Writer) {
+	out := stats.NewCountWriter(writer, &cmd.wbytes)
+	write := func(p []byte) {
+		if _, err := out.Write(p); err != nil {
+			log.PanicError(err, "write failed")
+		}
+	}
+	var w *rdb.Writer
+	if !args.redisPipe && !args.resp {
+		w = rdb.NewWriter(out)
+		if err := w.WriteHeader(); err != nil {
+			log.PanicError(err, "write rdb header failed")
+		}
+	}
+	now := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for _, o := range objs {
+		if o.typ == "module" {
+			log.Warnf("module key '%s' of db%d skipped, its value is not in the records", o.key, o.db)
+			cmd.ignore.Incr()
+			continue
+		}
+		if w != nil {
+			if err := cmd.writeObject(w, o); err != nil {
+				log.PanicErrorf(err, "encode key '%s' failed", o.key)
+			}
+			cmd.nentry.Incr()
+			continue
+		}
+		if args.resp && o.expireat != 0 && o.expireat <= now {
+			cmd.ignore.Incr()
+			continue
+		}
+		p, err := rdb.EncodeDump(o.Object())
+		if err != nil {
+			log.PanicErrorf(err, "encode key '%s' failed", o.key)
+		}
+		e := &rdb.BinEntry{DB: o.db, Key: o.key, Value: p, ExpireAt: o.expireat}
+		if args.resp {
+			write(newRespRecord(e))
+		} else {
+			write(newPipeRecord(e))
+		}
+		write(cmd.fieldExpireCommands(o, p))
+		cmd.nentry.Incr()
+	}
+	if w != nil {
+		if err := w.WriteFooter(); err != nil {
+			log.PanicError(err, "write rdb footer failed")
+		}
+	}
+}
+
+func (cmd *cmdEncode) writeObject(w *rdb.Writer, o *encodeObject) error {
+	w.SelectDB(o.db)
+	switch obj := o.Object().(type) {
+	case rdb.String:
+		return w.WriteString(o.key, obj, o.expireat)
+	case rdb.List:
+		return w.WriteList(o.key, obj, o.expireat)
+	case rdb.Hash:
+		for _, ele := range obj {
+			if ele.ExpireAt != 0 {
+				cmd.fieldExpires.Incr()
+			}
+		}
+		return w.WriteHash(o.key, obj, o.expireat)
+	case rdb.Set:
+		return w.WriteSet(o.key, obj, o.expireat)
+	case rdb.ZSet:
+		return w.WriteZSet(o.key, obj, o.expireat)
+	case rdb.Stream:
+		return errors.Errorf("rdb version 6 has no streams, use --output-format=redis-pipe or resp")
+	}
+	return errors.Errorf("unknown type %s", o.typ)
+}
+
+// fieldExpireCommands returns the HPEXPIREAT commands of the hash fields with
+// an expire, the restored payload has none. With resp they are only sent to
+// targets of 7.4+, rebuilt keys already got them.
+func (cmd *cmdEncode) fieldExpireCommands(o *encodeObject, p []byte) []byte {
+	if o.typ != "hash" || (args.resp && !targetRestores(p)) {
+		return nil
+	}
+	var b bytes.Buffer
+	for _, ele := range o.hash {
+		if ele.ExpireAt == 0 {
+			continue
+		}
+		if args.resp && !targetHas("HEXPIRE") {
+			cmd.fieldExpires.Incr()
+			continue
+		}
+		b.Write(redis.MustEncodeToBytes(redis.NewCommand("hpexpireat", o.key, ele.ExpireAt, "FIELDS", 1, ele.Field)))
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,181 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+// decodeRecords returns the json records decode writes for the entries.
+func decodeRecords(entries ...*rdb.BinEntry) string {
+	ipipe := make(chan *rdb.BinEntry, len(entries))
+	for _, e := range entries {
+		ipipe <- e
+	}
+	close(ipipe)
+	opipe := make(chan string, len(entries))
+	new(cmdDecode).decoderMain(ipipe, opipe)
+	close(opipe)
+	var b bytes.Buffer
+	for s := range opipe {
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	dump := func(o interface{}) []byte {
+		p, err := rdb.EncodeDump(o)
+		assert.MustNoError(err)
+		return p
+	}
+	id := rdb.StreamID{Ms: 1526919030474}
+	entries := []*rdb.BinEntry{
+		{DB: 0, Key: []byte("string\r\n"), Value: dump(rdb.String("hello\x00")), ExpireAt: 1500000000000},
+		{DB: 1, Key: []byte("list"), Value: dump(rdb.List{[]byte("a"), []byte("b"), []byte("c")})},
+		{DB: 1, Key: []byte("hash"), Value: dump(rdb.Hash{{Field: []byte("f"), Value: []byte("v")}})},
+		{DB: 0, Key: []byte("set"), Value: dump(rdb.Set{[]byte("m")})},
+		{DB: 0, Key: []byte("zset"), Value: dump(rdb.ZSet{{Member: []byte("m"), Score: math.Inf(-1)}, {Member: []byte("n"), Score: 1.5}})},
+	}
+	records := decodeRecords(entries...)
+
+	cmd := &cmdEncode{}
+	objs, err := cmd.readRecords(bufio.NewReader(strings.NewReader(records)))
+	assert.MustNoError(err)
+	assert.Must(len(objs) == len(entries) && cmd.nrecord.Get() == 8)
+
+	var b bytes.Buffer
+	writer := bufio.NewWriter(&b)
+	cmd.writeKeys(objs, writer)
+	flushWriter(writer)
+
+	l := rdb.NewLoader(bytes.NewReader(b.Bytes()))
+	assert.MustNoError(l.Header())
+	for _, x := range entries {
+		e, err := l.NextBinEntry()
+		assert.MustNoError(err)
+		assert.Must(e.DB == x.DB && bytes.Equal(e.Key, x.Key) && e.ExpireAt == x.ExpireAt)
+		assert.Must(decodeRecords(e) == decodeRecords(x))
+	}
+	e, err := l.NextBinEntry()
+	assert.MustNoError(err)
+	assert.Must(e == nil)
+
+	// streams need redis-pipe or resp.
+	stream := rdb.Stream{
+		Entries: []*rdb.StreamEntry{{ID: id, Fields: []*rdb.HashElement{{Field: []byte("f1"), Value: []byte("v1")}}}},
+		LastID:  id,
+		Groups: []*rdb.StreamGroup{{
+			Name:      []byte("g1"),
+			LastID:    id,
+			Pending:   []*rdb.StreamPending{{ID: id, DeliveryTime: 1526919030500, DeliveryCount: 1}},
+			Consumers: []*rdb.StreamConsumer{{Name: []byte("c1"), SeenTime: 1526919030500, Pending: []rdb.StreamID{id}}},
+		}},
+	}
+	x := &rdb.BinEntry{DB: 2, Key: []byte("stream"), Value: dump(stream)}
+	objs, err = cmd.readRecords(bufio.NewReader(strings.NewReader(decodeRecords(x))))
+	assert.MustNoError(err)
+	assert.Must(len(objs) == 1)
+	assert.Must(cmd.writeObject(rdb.NewWriter(&b), objs[0]) != nil)
+
+	args.redisPipe = true
+	defer func() {
+		args.redisPipe = false
+	}()
+	b.Reset()
+	cmd.writeKeys(objs, writer)
+	flushWriter(writer)
+	assert.Must(b.String() == string(newPipeRecord(x)))
+}
+
+// TestEncodeRoundTripEncodings decodes keys of the compact encodings, encodes
+// the records back to an rdb and decodes that again. The encoder writes the
+// plain encodings, so only the encoding of the records changes.
+func TestEncodeRoundTripEncodings(t *testing.T) {
+	dumps := []string{
+		"0a161600000012000000040000017803f802017903fe9cff0600a2f6e86fcf606a48",
+		"0b0e0200000003000000010002002c01060073fdda0e8ec01539",
+		"0c1e1e0000001a000000060000016103f20201620303322e3505016303fefdff0600aa70c0236e2ac3ba",
+		"0d1a1a00000016000000040000026631040276310402663204fe64ff0600797da2cf0ea7f405",
+		"0e02131300000010000000030000016103016203f2ff12120000000e000000020000c02c01040163ff090064032b7986401d2b",
+		"12020210100000000300816102816202dff902ff0105706c61696e0a00f453c95d50e9ab30",
+		"140f0f00000003008178020c01817902ff0b00eb9325dae452bc13",
+		"1115150000000400816d0283312e3504816e02dffe02ff0a005ec7b37afd6d8ccc",
+		"10151500000004008266310382763103826632031401ff0a0045f4ab198b83a066",
+	}
+	var entries []*rdb.BinEntry
+	for i, s := range dumps {
+		p, err := hex.DecodeString(s)
+		assert.MustNoError(err)
+		assert.Must(rdb.EncodingName(p) != "hashtable" && rdb.EncodingName(p) != "linkedlist")
+		entries = append(entries, &rdb.BinEntry{DB: uint32(i % 3), Key: []byte(fmt.Sprintf("key%d", i)), Value: p, ExpireAt: uint64(i) * 1000})
+	}
+	cmd := &cmdEncode{}
+	objs, err := cmd.readRecords(bufio.NewReader(strings.NewReader(decodeRecords(entries...))))
+	assert.MustNoError(err)
+	assert.Must(len(objs) == len(entries))
+
+	var b bytes.Buffer
+	writer := bufio.NewWriter(&b)
+	cmd.writeKeys(objs, writer)
+	flushWriter(writer)
+
+	encoding := regexp.MustCompile(`"encoding":"[a-z]+",`)
+	l := rdb.NewLoader(bytes.NewReader(b.Bytes()))
+	assert.MustNoError(l.Header())
+	for _, x := range entries {
+		e, err := l.NextBinEntry()
+		assert.MustNoError(err)
+		assert.Must(e.DB == x.DB && bytes.Equal(e.Key, x.Key) && e.ExpireAt == x.ExpireAt)
+		r1 := encoding.ReplaceAllString(decodeRecords(e), "")
+		r2 := encoding.ReplaceAllString(decodeRecords(x), "")
+		assert.Must(r1 == r2 && strings.Count(r1, "\n") >= 2)
+	}
+	e, err := l.NextBinEntry()
+	assert.MustNoError(err)
+	assert.Must(e == nil)
+}
+
+func TestEncodeRecords(t *testing.T) {
+	docheck := func(records string) []*encodeObject {
+		objs, err := new(cmdEncode).readRecords(bufio.NewReader(strings.NewReader(records)))
+		assert.MustNoError(err)
+		return objs
+	}
+	// list elements are ordered by index, envelopes are unwrapped.
+	objs := docheck(`{"meta":{"version":"x"},"data":{"db":0,"type":"list","expireat":0,"key64":"bA==","index":1,"value64":"Yg=="}}` + "\n" +
+		`{"db":0,"type":"list","expireat":0,"key64":"bA==","index":0,"value64":"YQ=="}`)
+	assert.Must(len(objs) == 1)
+	list := objs[0].Object().(rdb.List)
+	assert.Must(len(list) == 2 && string(list[0]) == "a" && string(list[1]) == "b")
+
+	// bitmaps are rebuilt from their bits.
+	objs = docheck(`{"db":0,"type":"bitmap","expireat":0,"key64":"Yg==","bitcount":2,"bits":[1,9]}`)
+	assert.Must(string(objs[0].Object().(rdb.String)) == "\x40\x40")
+
+	// hash field expires are kept.
+	objs = docheck(`{"db":0,"type":"hash","expireat":0,"key64":"aA==","field64":"Zg==","value64":"dg==","field_expireat":1720000000000}`)
+	assert.Must(objs[0].Object().(rdb.Hash)[0].ExpireAt == 1720000000000)
+
+	for _, s := range []string{
+		`{"db":0,"type":"string","key64":"aw==","value64":"eA=="}` + "\n" + `{"db":0,"type":"set","key64":"aw==","member64":"eA=="}`,
+		`{"db":0,"type":"string","key64":"aw==","value64":"eA=="}` + "\n" + `{"db":0,"type":"string","expireat":1,"key64":"aw==","value64":"eA=="}`,
+		`{"db":0,"type":"bitmap","key64":"aw==","bitcount":1}`,
+		`{"key":"k","key64":"aw==","dbs":[0]}`,
+		`not json`,
+	} {
+		_, err := new(cmdEncode).readRecords(bufio.NewReader(strings.NewReader(s)))
+		assert.Must(err != nil)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"github.com/left2right/redis-port/pkg/libs/errors"
+)
+
+// evictionPolicy tells which keys a maxmemory-policy may evict, see
+// --eviction-policy.
+type evictionPolicy int
+
+const (
+	evictNone evictionPolicy = iota
+	evictAllKeys
+	evictVolatile
+)
+
+func parseEvictionPolicy(s string) (evictionPolicy, error) {
+	switch s {
+	case "noeviction":
+		return evictNone, nil
+	case "allkeys-lru", "allkeys-lfu", "allkeys-random":
+		return evictAllKeys, nil
+	case "volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl":
+		return evictVolatile, nil
+	}
+	return 0, errors.Errorf("unknown eviction policy '%s'", s)
+}
+
+// evictable reports whether a key with the expire can be evicted under the
+// policy, volatile policies only evict keys with an expire.
+func (p evictionPolicy) evictable(expireat uint64) bool {
+	switch p {
+	case evictAllKeys:
+		return true
+	case evictVolatile:
+		return expireat != 0
+	}
+	return false
+}
@@ -0,0 +1,381 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// targetQueueSize is the number of commands of the stream a target of a
+// fan-out may lag behind before the others wait for it.
+const targetQueueSize = 1 << 16
+
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Second * 30
+)
+
+func nextRetryDelay(d time.Duration) time.Duration {
+	if d *= 2; d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// parseTargets splits the addresses of --target at ',', sync writes to all
+// of them.
+func parseTargets(s string) ([]string, error) {
+	var l []string
+	seen := make(map[string]bool)
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) == 0 {
+			return nil, errors.Errorf("empty address in '%s'", s)
+		}
+		if seen[addr] {
+			return nil, errors.Errorf("address '%s' given twice", addr)
+		}
+		seen[addr] = true
+		l = append(l, addr)
+	}
+	return l, nil
+}
+
+// targetAddrs are the addresses of the target, more than one for a fan-out.
+func targetAddrs() []string {
+	if len(args.targets) > 1 {
+		return args.targets
+	}
+	return []string{args.target}
+}
+
+// targetNames is the target as logged, every address of a fan-out.
+func targetNames() string {
+	return strings.Join(targetAddrs(), ",")
+}
+
+// syncTarget is one of the targets of sync with several --target addresses.
+// Every target has its own queues, connections and position in the stream,
+// a slow or broken one holds back the others only once its queue is full.
+type syncTarget struct {
+	addr, passwd string
+
+	pipe  chan *rdb.BinEntry
+	queue chan *streamChunk
+
+	// pos is the position of the last chunk written to the target, seq is
+	// the number of the chunk.
+	pos streamPos
+	seq atomic2.Int64
+
+	nentry, forward, wbytes, nretry, nstall atomic2.Int64
+}
+
+// streamChunk is a command of the stream as written to the targets, offset
+// and db are the position of the stream after it. sel is the last SELECT
+// before it, written again first on a new connection.
+type streamChunk struct {
+	p, sel []byte
+
+	seq    int64
+	offset int64
+	db     uint32
+}
+
+func newSyncTargets(addrs []string, passwd string) []*syncTarget {
+	var l []*syncTarget
+	for _, addr := range addrs {
+		l = append(l, &syncTarget{
+			addr: addr, passwd: passwd,
+			pipe:  make(chan *rdb.BinEntry, args.parallel*32),
+			queue: make(chan *streamChunk, targetQueueSize),
+		})
+	}
+	return l
+}
+
+// dial connects to the target, and keeps trying with backoff while it is
+// unreachable.
+func (t *syncTarget) dial() net.Conn {
+	for d := minRetryDelay; ; d = nextRetryDelay(d) {
+		if c := openTargetConnSoft(t.addr, t.passwd); c != nil {
+			return c
+		}
+		t.nretry.Incr()
+		log.Warnf("sync: connect to target '%s' failed, retry in %s", t.addr, d)
+		time.Sleep(d)
+	}
+}
+
+// stalled logs how long the other targets waited for the full queue of t.
+func (t *syncTarget) stalled(start time.Time) {
+	t.nstall.Incr()
+	if d := time.Since(start); d >= time.Second {
+		log.Warnf("sync: target '%s' is behind, the others waited %s for its queue", t.addr, d)
+	}
+}
+
+// Restore restores the entries of the rdb sent to the target. An entry the
+// connection broke on is restored again on a new connection, it may have
+// been applied already.
+func (t *syncTarget) Restore() {
+	runWorkers(t.pipe, &t.nentry, func(stop <-chan struct{}) {
+		var c redigo.Conn
+		var lastdb uint32
+		defer func() {
+			if c != nil {
+				c.Close()
+			}
+		}()
+		for e, ok := nextEntry(t.pipe, stop); ok; e, ok = nextEntry(t.pipe, stop) {
+			for d := minRetryDelay; ; d = nextRetryDelay(d) {
+				if c == nil {
+					c, lastdb = redigo.NewConn(t.dial(), 0, 0), baseTargetDB()
+				}
+				if t.restore(c, &lastdb, e) {
+					break
+				}
+				log.WarnErrorf(c.Err(), "sync: target '%s' is broken, restore key '%s' again in %s", t.addr, keyText(e.Key), d)
+				c.Close()
+				c = nil
+				t.nretry.Incr()
+				time.Sleep(d)
+			}
+			t.nentry.Incr()
+		}
+	})
+}
+
+// restore returns false when the connection broke on the entry.
+func (t *syncTarget) restore(c redigo.Conn, lastdb *uint32, e *rdb.BinEntry) bool {
+	if e.DB != *lastdb {
+		if _, err := c.Do("select", e.DB); err != nil {
+			if c.Err() != nil {
+				return false
+			}
+			log.PanicError(err, "select command error")
+		}
+		*lastdb = e.DB
+	}
+	if err := restoreRdbEntry(c, e); err != nil && c.Err() == nil {
+		log.PanicErrorf(err, "sync: restore key '%s' to target '%s' failed", keyText(e.Key), t.addr)
+	}
+	return c.Err() == nil
+}
+
+// Forward writes the chunks of the stream to the target, the replies are
+// discarded. A chunk that failed is written again on a new connection after
+// the last SELECT; the chunks written just before may be lost with the old
+// connection.
+func (t *syncTarget) Forward() {
+	var c net.Conn
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+	for k := range t.queue {
+		for d := minRetryDelay; ; d = nextRetryDelay(d) {
+			var err error
+			if c == nil {
+				c = t.dial()
+				go io.Copy(ioutil.Discard, c)
+				if len(k.sel) != 0 {
+					_, err = c.Write(k.sel)
+				}
+			}
+			if err == nil {
+				if _, err = c.Write(k.p); err == nil {
+					break
+				}
+			}
+			log.WarnErrorf(err, "sync: write to target '%s' failed, offset = %d, retry in %s", t.addr, k.offset, d)
+			c.Close()
+			c = nil
+			t.nretry.Incr()
+			time.Sleep(d)
+		}
+		t.forward.Incr()
+		t.wbytes.Add(int64(len(k.p)))
+		t.pos.Set(k.offset, k.db)
+		t.seq.Set(k.seq)
+	}
+}
+
+// restoreTargets restores the rdb to every target, the filters and rewrites
+// are applied once for all of them.
+func (cmd *cmdSync) restoreTargets(pipe chan *rdb.BinEntry) {
+	var wg sync.WaitGroup
+	for _, t := range cmd.targets {
+		wg.Add(1)
+		go func(t *syncTarget) {
+			defer wg.Done()
+			t.Restore()
+		}(t)
+	}
+	for e := range pipe {
+		if !cmd.acceptEntry(e) {
+			continue
+		}
+		for _, t := range cmd.targets {
+			select {
+			case t.pipe <- e:
+			default:
+				start := time.Now()
+				t.pipe <- e
+				t.stalled(start)
+			}
+		}
+	}
+	for _, t := range cmd.targets {
+		close(t.pipe)
+	}
+	wg.Wait()
+}
+
+// fanoutWriter is the command stream written to the targets, it buffers
+// the bytes of a command until Flush hands them to every target at once.
+type fanoutWriter struct {
+	cmd *cmdSync
+
+	p, sel []byte
+}
+
+// openFanout starts writing the stream to the targets, from the position
+// the stream starts at.
+func (cmd *cmdSync) openFanout() *fanoutWriter {
+	offset, db := cmd.pos.Get()
+	for _, t := range cmd.targets {
+		t.pos.Set(offset, db)
+		go t.Forward()
+	}
+	return &fanoutWriter{cmd: cmd}
+}
+
+func (w *fanoutWriter) Write(p []byte) (int, error) {
+	w.p = append(w.p, p...)
+	return len(p), nil
+}
+
+// Flush sends the command buffered to the targets, sel is set for SELECT.
+func (w *fanoutWriter) Flush(sel bool) {
+	if len(w.p) == 0 {
+		return
+	}
+	offset, db := w.cmd.pos.Get()
+	k := &streamChunk{p: w.p, sel: w.sel, seq: w.cmd.seq.Incr(), offset: offset, db: db}
+	if sel {
+		w.sel = w.p
+	}
+	w.p = nil
+	for _, t := range w.cmd.targets {
+		select {
+		case t.queue <- k:
+		default:
+			start := time.Now()
+			t.queue <- k
+			t.stalled(start)
+		}
+	}
+}
+
+func (w *fanoutWriter) Close() error {
+	for _, t := range w.cmd.targets {
+		close(t.queue)
+	}
+	return nil
+}
+
+// position is the position of the stream every target got to, the one to
+// resume from. A target that wrote out its queue is at cmd.pos.
+func (cmd *cmdSync) position() (int64, uint32) {
+	offset, db := cmd.pos.Get()
+	seq := cmd.seq.Get()
+	for _, t := range cmd.targets {
+		if t.seq.Get() == seq {
+			continue
+		}
+		if n, x := t.pos.Get(); n < offset {
+			offset, db = n, x
+		}
+	}
+	return offset, db
+}
+
+// targetLag is how many bytes of the stream read are not written to t yet.
+func (cmd *cmdSync) targetLag(t *syncTarget) int64 {
+	offset := cmd.pos.Offset()
+	if t.seq.Get() == cmd.seq.Get() {
+		return 0
+	}
+	if n := offset - t.pos.Offset(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// targetStat is the part of the stat lines on the targets of a fan-out, for
+// the rdb or for the command stream.
+func (cmd *cmdSync) targetStat(stream bool) string {
+	var b bytes.Buffer
+	for _, t := range cmd.targets {
+		if stream {
+			fmt.Fprintf(&b, "  [%s] forward=%d lag=%d queue=%d", t.addr, t.forward.Get(), cmd.targetLag(t), len(t.queue))
+		} else {
+			fmt.Fprintf(&b, "  [%s] entry=%d queue=%d", t.addr, t.nentry.Get(), len(t.pipe))
+		}
+		if n := t.nretry.Get(); n != 0 {
+			fmt.Fprintf(&b, " retry=%d", n)
+		}
+		if n := t.nstall.Get(); n != 0 {
+			fmt.Fprintf(&b, " stall=%d", n)
+		}
+	}
+	return b.String()
+}
+
+// targetCounts is targetStat for --stat-format=json.
+func (cmd *cmdSync) targetCounts(stream bool) []map[string]interface{} {
+	var l []map[string]interface{}
+	for _, t := range cmd.targets {
+		m := map[string]interface{}{
+			"target": t.addr, "retry": t.nretry.Get(), "stall": t.nstall.Get(),
+		}
+		if stream {
+			m["forward"], m["wbytes"], m["lag"], m["queue"] = t.forward.Get(), t.wbytes.Get(), cmd.targetLag(t), len(t.queue)
+		} else {
+			m["entry"], m["queue"] = t.nentry.Get(), len(t.pipe)
+		}
+		l = append(l, m)
+	}
+	return l
+}
+
+func (cmd *cmdSync) exportTargetMetrics() {
+	for _, t := range cmd.targets {
+		t := t
+		labels := fmt.Sprintf("target=%q", t.addr)
+		exportMetric("redis_port_target_entries_total", "counter", "Entries of the rdb restored to the target of a fan-out.", labels, t.nentry.Get)
+		exportMetric("redis_port_target_forward_commands_total", "counter", "Commands of the stream written to the target of a fan-out.", labels, t.forward.Get)
+		exportMetric("redis_port_target_write_bytes_total", "counter", "Bytes of the stream written to the target of a fan-out.", labels, t.wbytes.Get)
+		exportMetric("redis_port_target_lag_bytes", "gauge", "Bytes of the stream read but not written to the target of a fan-out.", labels, func() int64 {
+			return cmd.targetLag(t)
+		})
+		exportMetric("redis_port_target_retries_total", "counter", "Times the target of a fan-out was reconnected to.", labels, t.nretry.Get)
+		exportMetric("redis_port_target_stalls_total", "counter", "Times the other targets waited for the full queue of the target.", labels, t.nstall.Get)
+	}
+}
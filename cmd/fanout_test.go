@@ -0,0 +1,86 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func TestParseTargets(t *testing.T) {
+	l, err := parseTargets("127.0.0.1:6380")
+	assert.MustNoError(err)
+	assert.Must(len(l) == 1 && l[0] == "127.0.0.1:6380")
+
+	l, err = parseTargets("10.0.0.1:6379, 10.0.0.2:6379")
+	assert.MustNoError(err)
+	assert.Must(len(l) == 2 && l[0] == "10.0.0.1:6379" && l[1] == "10.0.0.2:6379")
+
+	for _, s := range []string{"", "a:1,", "a:1,,b:1", "a:1,a:1"} {
+		_, err := parseTargets(s)
+		assert.Must(err != nil)
+	}
+}
+
+func TestNextRetryDelay(t *testing.T) {
+	d := minRetryDelay
+	for i := 0; i < 4; i++ {
+		d = nextRetryDelay(d)
+	}
+	assert.Must(d == time.Second*16)
+	assert.Must(nextRetryDelay(d) == maxRetryDelay)
+	assert.Must(nextRetryDelay(maxRetryDelay) == maxRetryDelay)
+}
+
+func TestFanoutWriter(t *testing.T) {
+	cmd := &cmdSync{}
+	cmd.targets = newSyncTargets([]string{"a:1", "b:1"}, "")
+	cmd.pos.Set(100, 0)
+	w := &fanoutWriter{cmd: cmd}
+
+	send := func(offset int64, resp redis.Resp) {
+		cmd.pos.Update(offset, resp)
+		w.Write(redis.MustEncodeToBytes(resp))
+		_, sel := selectedDB(resp)
+		w.Flush(sel)
+	}
+	send(120, redis.NewCommand("select", 2))
+	send(150, redis.NewCommand("set", "k", "v"))
+	w.Flush(false)
+
+	var chunks []*streamChunk
+	for _, x := range cmd.targets {
+		assert.Must(len(x.queue) == 2)
+		k1, k2 := <-x.queue, <-x.queue
+		assert.Must(k1.sel == nil && k1.offset == 120 && k1.db == 2 && k1.seq == 1)
+		assert.Must(bytes.Equal(k2.sel, k1.p) && k2.offset == 150 && k2.db == 2 && k2.seq == 2)
+		chunks = append(chunks, k1, k2)
+	}
+	assert.Must(chunks[0] == chunks[2] && chunks[1] == chunks[3])
+
+	a, b := cmd.targets[0], cmd.targets[1]
+	a.pos.Set(100, 0)
+	b.pos.Set(100, 0)
+	n, db := cmd.position()
+	assert.Must(n == 100 && db == 0)
+	assert.Must(cmd.targetLag(a) == 50)
+
+	a.pos.Set(150, 2)
+	a.seq.Set(2)
+	b.pos.Set(120, 2)
+	b.seq.Set(1)
+	n, db = cmd.position()
+	assert.Must(n == 120 && db == 2)
+	assert.Must(cmd.targetLag(a) == 0 && cmd.targetLag(b) == 30)
+
+	b.pos.Set(150, 2)
+	b.seq.Set(2)
+	cmd.pos.Set(180, 2)
+	n, _ = cmd.position()
+	assert.Must(n == 180)
+}
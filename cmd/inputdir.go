@@ -0,0 +1,142 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/bytesize"
+	"github.com/left2right/redis-port/pkg/libs/extsort"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// mergeBufferSize is the amount of records --input-dir keeps in memory before
+// spilling a sorted run to disk.
+const mergeBufferSize = bytesize.MB * 256
+
+// listInputDir returns the *.rdb files of dir sorted by name, and their total
+// size.
+func listInputDir(dir string) ([]string, int64) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.rdb"))
+	if err != nil {
+		log.PanicErrorf(err, "list input dir '%s' failed", dir)
+	}
+	if len(files) == 0 {
+		log.Panicf("no *.rdb file in input dir '%s'", dir)
+	}
+	sort.Strings(files)
+	var size int64
+	for _, name := range files {
+		s, err := os.Stat(name)
+		if err != nil {
+			log.PanicErrorf(err, "cannot stat file-reader '%s'", name)
+		}
+		size += s.Size()
+	}
+	log.Infof("decode %d rdb files, total = %d", len(files), size)
+	return files, size
+}
+
+// newDirLoader loads the rdb files into a single pipe, at most --parallel of
+// them at a time.
+func newDirLoader(files []string, rbytes *atomic2.Int64, size int) chan *rdb.BinEntry {
+	pipe := make(chan *rdb.BinEntry, size)
+	go func() {
+		defer close(pipe)
+		group := make(chan int, args.parallel)
+		for _, name := range files {
+			if loadersStopped() {
+				break
+			}
+			group <- 0
+			go func(name string) {
+				defer func() {
+					<-group
+				}()
+				f, _ := openInputFile(name)
+				defer f.Close()
+				reader := bufio.NewReaderSize(f, ReaderBufferSize)
+				for e := range newRDBLoader(reader, rbytes, size) {
+					pipe <- e
+				}
+				log.Infof("decode: '%s' done", name)
+			}(name)
+		}
+		for i := 0; i < cap(group); i++ {
+			group <- 0
+		}
+	}()
+	return pipe
+}
+
+// newMergeRecord tags a record of the entry as
+// db + uvarint(len(key)) + key + seq + record, see lessMergeRecord.
+func newMergeRecord(e *rdb.BinEntry, seq uint32, s string) []byte {
+	var b bytes.Buffer
+	var n [binary.MaxVarintLen64]byte
+	binary.Write(&b, binary.BigEndian, e.DB)
+	b.Write(n[:binary.PutUvarint(n[:], uint64(len(e.Key)))])
+	b.Write(e.Key)
+	binary.Write(&b, binary.BigEndian, seq)
+	b.WriteString(s)
+	return b.Bytes()
+}
+
+func parseMergeRecord(p []byte) (db uint32, key []byte, seq uint32, record []byte) {
+	db = binary.BigEndian.Uint32(p[0:4])
+	n, i := binary.Uvarint(p[4:])
+	p = p[4+i:]
+	key, p = p[:n], p[n:]
+	return db, key, binary.BigEndian.Uint32(p[0:4]), p[4:]
+}
+
+// lessMergeRecord orders records by db, key and seq. A key found in several
+// files is ordered by its records, so the output doesn't depend on which
+// file is decoded first.
+func lessMergeRecord(a, b []byte) bool {
+	db1, k1, seq1, r1 := parseMergeRecord(a)
+	db2, k2, seq2, r2 := parseMergeRecord(b)
+	if db1 != db2 {
+		return db1 < db2
+	}
+	if c := bytes.Compare(k1, k2); c != 0 {
+		return c < 0
+	}
+	if seq1 != seq2 {
+		return seq1 < seq2
+	}
+	return bytes.Compare(r1, r2) < 0
+}
+
+// mergeRecords sorts the records of all files, spilling to disk for huge
+// inputs; nothing is written before every file is decoded.
+func (cmd *cmdDecode) mergeRecords(opipe <-chan string) <-chan string {
+	records := make(chan string, cap(opipe))
+	go func() {
+		defer close(records)
+		sorter := extsort.New("", mergeBufferSize, lessMergeRecord)
+		for s := range opipe {
+			if err := sorter.Add([]byte(s)); err != nil {
+				log.PanicError(err, "buffer decode record failed")
+			}
+		}
+		log.Infof("decode: merge records, %d runs spilled to disk", sorter.Runs())
+		err := sorter.Sort(func(p []byte) error {
+			_, _, _, r := parseMergeRecord(p)
+			records <- string(r)
+			return nil
+		})
+		if err != nil {
+			log.PanicError(err, "sort decode records failed")
+		}
+	}()
+	return records
+}
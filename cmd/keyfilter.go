@@ -0,0 +1,120 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+// keyFilter is the --filter, --filter-regexp and --filter-out of decode. A key
+// passes if it matches any --filter glob or --filter-regexp, when there are
+// some, and none of the --filter-out globs. Keys are matched as raw bytes.
+type keyFilter struct {
+	globs   []string
+	regexps []*valueMatch
+	out     []string
+}
+
+func newKeyFilter(globs, regexps, out []string) (*keyFilter, error) {
+	f := &keyFilter{globs: globs, out: out}
+	for _, s := range regexps {
+		m, err := newValueMatch(s)
+		if err != nil {
+			return nil, err
+		}
+		f.regexps = append(f.regexps, m)
+	}
+	return f, nil
+}
+
+func (f *keyFilter) Accept(key []byte) bool {
+	for _, p := range f.out {
+		if globMatch(p, key) {
+			return false
+		}
+	}
+	if len(f.globs) == 0 && len(f.regexps) == 0 {
+		return true
+	}
+	for _, p := range f.globs {
+		if globMatch(p, key) {
+			return true
+		}
+	}
+	for _, m := range f.regexps {
+		if m.Match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch reports whether s matches the glob pattern the way redis KEYS
+// does: '*' matches any bytes, '?' a single byte, '[abc]', '[^abc]' and
+// '[a-z]' a byte of the set and '\' escapes the next byte. On a mismatch the
+// last '*' is retried one byte further, so no pattern is exponential.
+func globMatch(pattern string, s []byte) bool {
+	var px, sx int
+	starPx, starSx := -1, 0
+	for px < len(pattern) || sx < len(s) {
+		if px < len(pattern) {
+			if pattern[px] == '*' {
+				starPx, starSx = px, sx+1
+				px++
+				continue
+			}
+			if sx < len(s) {
+				if n, ok := globByte(pattern[px:], s[sx]); ok {
+					px, sx = px+n, sx+1
+					continue
+				}
+			}
+		}
+		if starPx >= 0 && starSx <= len(s) {
+			px, sx = starPx, starSx
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// globByte matches c against the first token of p, it returns the length of
+// the token and whether c matches it.
+func globByte(p string, c byte) (int, bool) {
+	switch p[0] {
+	case '?':
+		return 1, true
+	case '\\':
+		if len(p) >= 2 {
+			return 2, p[1] == c
+		}
+	case '[':
+		i := 1
+		not := i < len(p) && p[i] == '^'
+		if not {
+			i++
+		}
+		var match bool
+		for i < len(p) {
+			switch {
+			case p[i] == '\\' && i+1 < len(p):
+				match = match || p[i+1] == c
+				i += 2
+				continue
+			case p[i] == ']':
+				return i + 1, match != not
+			case i+2 < len(p) && p[i+1] == '-':
+				start, end := p[i], p[i+2]
+				if start > end {
+					start, end = end, start
+				}
+				match = match || (c >= start && c <= end)
+				i += 3
+				continue
+			}
+			match = match || p[i] == c
+			i++
+		}
+		// an unterminated set ends with the pattern.
+		return i, match != not
+	}
+	return 1, p[0] == c
+}
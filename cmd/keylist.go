@@ -0,0 +1,57 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+)
+
+// keySet holds exact key names loaded from --allowlist-file/--denylist-file.
+type keySet map[string]struct{}
+
+func (s keySet) has(key []byte) bool {
+	_, ok := s[string(key)]
+	return ok
+}
+
+// parseKeyName returns the key written as is, or as 'base64:<encoded>' for
+// binary keys.
+func parseKeyName(s string) ([]byte, error) {
+	if strings.HasPrefix(s, "base64:") {
+		p, err := base64.StdEncoding.DecodeString(s[len("base64:"):])
+		return p, errors.Trace(err)
+	}
+	return []byte(s), nil
+}
+
+// loadKeySet reads one key per line, binary keys are written as
+// 'base64:<encoded>'. Empty lines are ignored.
+func loadKeySet(name string) (keySet, error) {
+	f, _ := openReadFile(name)
+	defer f.Close()
+	set := make(keySet)
+	r := bufio.NewReaderSize(f, ReaderBufferSize)
+	for n := 1; ; n++ {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, errors.Trace(err)
+		}
+		if key := strings.TrimRight(line, "\r\n"); len(key) != 0 {
+			p, err := parseKeyName(key)
+			if err != nil {
+				return nil, errors.Errorf("%s:%d invalid base64 key", name, n)
+			}
+			set[string(p)] = struct{}{}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return set, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/limiter"
+)
+
+// Scoped limiters throttle the commands forwarded by sync, keyed by the db the
+// command is applied to or by the lower-cased command name.
+var (
+	limitDB  = make(map[uint32]*limiter.Limiter)
+	limitCmd = make(map[string]*limiter.Limiter)
+)
+
+// qpsLimit and bandwidthLimit are shared by the restore routines and the
+// command forwarder of sync, see --qps-limit and --bandwidth-limit. A restored
+// entry counts as one command, whatever the number of commands it takes.
+var (
+	qpsLimit       *limiter.Limiter
+	bandwidthLimit *limiter.Limiter
+)
+
+// limitConn throttles the writes to a target by --bandwidth-limit.
+func limitConn(c net.Conn) net.Conn {
+	if bandwidthLimit == nil {
+		return c
+	}
+	return &limitedConn{Conn: c, l: bandwidthLimit}
+}
+
+type limitedConn struct {
+	net.Conn
+	l *limiter.Limiter
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	c.l.Wait(int64(len(p)))
+	return c.Conn.Write(p)
+}
+
+// parseRate parses '1000/s' or '1000' as a number of operations per second.
+func parseRate(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s")
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if n <= 0 {
+		return 0, errors.Errorf("invalid rate %d", n)
+	}
+	return n, nil
+}
+
+// parseScopedLimits parses comma separated 'scope:rate' pairs.
+func parseScopedLimits(s string, fn func(scope string, rate int64) error) error {
+	for _, x := range strings.Split(s, ",") {
+		i := strings.LastIndex(x, ":")
+		if i <= 0 {
+			return errors.Errorf("invalid limit '%s', should be scope:rate", x)
+		}
+		n, err := parseRate(x[i+1:])
+		if err != nil {
+			return err
+		}
+		if err := fn(strings.TrimSpace(x[:i]), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseLimitDB(s string) error {
+	return parseScopedLimits(s, func(scope string, rate int64) error {
+		db, err := parseInt(scope, MinDB, MaxDB)
+		if err != nil {
+			return err
+		}
+		limitDB[uint32(db)] = limiter.New(rate)
+		return nil
+	})
+}
+
+func parseLimitCmd(s string) error {
+	return parseScopedLimits(s, func(scope string, rate int64) error {
+		limitCmd[strings.ToLower(scope)] = limiter.New(rate)
+		return nil
+	})
+}
+
+// throttleCommand blocks until the scoped limiters of db and cmd accept one
+// more command, unscoped commands are never delayed here.
+func throttleCommand(db uint32, cmd string) {
+	if l := limitDB[db]; l != nil {
+		l.Wait(1)
+	}
+	if l := limitCmd[cmd]; l != nil {
+		l.Wait(1)
+	}
+}
+
+// forEachLimiter calls fn with the limiters set, named qps, bandwidth, by db
+// as db<N> and by command.
+func forEachLimiter(fn func(scope string, l *limiter.Limiter)) {
+	if qpsLimit != nil {
+		fn("qps", qpsLimit)
+	}
+	if bandwidthLimit != nil {
+		fn("bandwidth", bandwidthLimit)
+	}
+	var dbs []int
+	for db := range limitDB {
+		dbs = append(dbs, int(db))
+	}
+	sort.Ints(dbs)
+	for _, db := range dbs {
+		fn(fmt.Sprintf("db%d", db), limitDB[uint32(db)])
+	}
+	var cmds []string
+	for cmd := range limitCmd {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	for _, cmd := range cmds {
+		fn(cmd, limitCmd[cmd])
+	}
+}
+
+// throttleStat reports the number of throttle events of every scope that has
+// been throttled at least once.
+func throttleStat() string {
+	var b bytes.Buffer
+	forEachLimiter(func(scope string, l *limiter.Limiter) {
+		if n := l.Throttled(); n != 0 {
+			fmt.Fprintf(&b, " throttle[%s]=%d", scope, n)
+		}
+	})
+	return b.String()
+}
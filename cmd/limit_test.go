@@ -0,0 +1,36 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/libs/limiter"
+)
+
+func TestLimitConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	assert.Must(limitConn(a) == a)
+
+	bandwidthLimit = limiter.New(100000)
+	defer func() {
+		bandwidthLimit = nil
+	}()
+	c := limitConn(a)
+	assert.Must(c != a)
+	go io.Copy(ioutil.Discard, b)
+	for i := 0; i < 2; i++ {
+		_, err := c.Write(make([]byte, 60000))
+		assert.MustNoError(err)
+	}
+	assert.Must(bandwidthLimit.Throttled() != 0)
+	assert.Must(strings.Contains(throttleStat(), " throttle[bandwidth]="))
+}
@@ -0,0 +1,96 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+	"github.com/left2right/redis-port/pkg/redis"
+)
+
+// luaDumper collects the lua scripts seen in the rdb aux fields (saved by
+// redis 5.0 to 6.2 for replicas) and in EVAL/SCRIPT LOAD of the replication
+// stream, and writes every new one as a SCRIPT LOAD command, so the file can
+// be replayed to the target before switching EVALSHA clients to it. Redis
+// 7.0+ saves no lua aux field, replicates the effects of EVAL instead of the
+// script and does not replicate SCRIPT LOAD, dump warns about it.
+type luaDumper struct {
+	mu   sync.Mutex
+	w    *bufio.Writer
+	seen map[string]bool
+}
+
+func newLuaDumper(w io.Writer) *luaDumper {
+	return &luaDumper{w: bufio.NewWriter(w), seen: make(map[string]bool)}
+}
+
+func (d *luaDumper) add(script []byte) {
+	sum := sha1.Sum(script)
+	sha := hex.EncodeToString(sum[:])
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen[sha] {
+		return
+	}
+	d.seen[sha] = true
+	redis.MustEncode(d.w, redis.NewCommand("script", "load", script))
+	flushWriter(d.w)
+	log.Infof("dump: lua script %s, %d scripts", sha, len(d.seen))
+}
+
+// WatchRDB parses the rdb copied to r for 'lua' aux fields.
+func (d *luaDumper) WatchRDB(r io.Reader) {
+	defer io.Copy(ioutil.Discard, r)
+	l := rdb.NewLoader(r)
+	l.SetAux(func(key, value []byte) {
+		if string(key) == "lua" {
+			d.add(value)
+		}
+	})
+	if err := l.Header(); err != nil {
+		log.WarnError(err, "dump: parse rdb header for lua scripts failed")
+		return
+	}
+	for {
+		e, err := l.NextBinEntry()
+		if err != nil {
+			log.WarnError(err, "dump: parse rdb for lua scripts failed")
+			return
+		}
+		if e == nil {
+			return
+		}
+	}
+}
+
+// WatchCommands decodes the replication stream copied to r for scripts.
+func (d *luaDumper) WatchCommands(r io.Reader) {
+	defer io.Copy(ioutil.Discard, r)
+	br := bufio.NewReaderSize(r, ReaderBufferSize)
+	for {
+		resp, err := redis.Decode(br)
+		if err != nil {
+			log.WarnError(err, "dump: decode command for lua scripts failed")
+			return
+		}
+		scmd, argv, err := redis.ParseArgs(resp)
+		if err != nil {
+			continue
+		}
+		switch {
+		case scmd == "eval" && len(argv) != 0:
+			d.add(argv[0])
+		case scmd == "script" && len(argv) == 2 && strings.ToLower(string(argv[0])) == "load":
+			d.add(argv[1])
+		}
+	}
+}
@@ -9,12 +9,12 @@ import (
 	"strconv"
 	"strings"
 	"time"
-	"fmt"
-	"os"
+	"unicode"
 
 	"github.com/docopt/docopt-go"
 	"github.com/left2right/redis-port/pkg/libs/bytesize"
 	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/limiter"
 	"github.com/left2right/redis-port/pkg/libs/log"
 )
 
@@ -29,14 +29,114 @@ var args struct {
 	target string
 	extra  bool
 
+	targets []string
+
 	sockfile string
 	filesize int64
 
 	shift time.Duration
 	psync bool
 	force bool
+
+	selectdb int
+
+	envelope bool
+	sourceid string
+
+	bitmapSummary bool
+	groupByKey    bool
+
+	reconcile       time.Duration
+	reconcileSample int
+
+	listen string
+
+	offsetFile string
+	stateFile  string
+
+	rdbDoneFile string
+
+	dumpLua string
+
+	dropFunctions bool
+	dropModuleAux bool
+
+	deleteLog string
+
+	checkpointOnSignal bool
+	checkpointFile     string
+	resume             bool
+
+	strict bool
+
+	atomicGroup bool
+
+	compress  bool
+	rollBytes int64
+
+	inputOffset int64
+	inputDir    string
+
+	resumeFromKey []byte
+
+	typeStats bool
+	bigkeys   int
+
+	continueOnError bool
+	maxErrors       int64
+
+	normalizeFloats bool
+	summary         string
+
+	clientName string
+
+	socks5 *socks5Dialer
+
+	autoParallel bool
+	maxParallel  int
+
+	outputFormat string
+
+	redisPipe bool
+	resp      bool
+	parquet   bool
+
+	evictionPolicy *evictionPolicy
+
+	valueMatch *valueMatch
+
+	filter *keyFilter
+
+	stale       *staleCheck
+	staleReport string
+
+	filterdb    string
+	yes         bool
+	flushTarget bool
+	replace     bool
+
+	preferRestore bool
+
+	filterKeys   bool
+	renamePrefix *renamePrefix
+	targetDB     int
+
+	cluster *cluster
+
+	sourceConf *connConfig
+	targetConf *connConfig
+
+	sample       float64
+	ttlTolerance time.Duration
+	oneWay       bool
+
+	metricsAddr string
+	statFormat  string
 }
 
+// version is overwritten at build time, see Makefile.
+var version = "unknown"
+
 const (
 	ReaderBufferSize = bytesize.MB * 32
 	WriterBufferSize = bytesize.MB * 8
@@ -90,32 +190,137 @@ var sorted2setKey = func(key []byte) bool {
 	return false
 }
 
+var bitmapKey = func(key []byte) bool {
+	return false
+}
+
+// newKeyMatcher compiles comma separated regular expressions, the returned
+// func reports whether any of them matches the key.
+func newKeyMatcher(s string) (func(key []byte) bool, error) {
+	keys := strings.Split(s, ",")
+	keyRegexps := make([]*regexp.Regexp, len(keys))
+	for i, key := range keys {
+		r, err := regexp.Compile(key)
+		if err != nil {
+			return nil, err
+		}
+		keyRegexps[i] = r
+	}
+	return func(key []byte) bool {
+		for _, reg := range keyRegexps {
+			if reg.Match(key) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
 
 func main() {
 	usage := `
 Usage:
-	redis-port decode   [--ncpu=N]  [--parallel=M]  [--input=INPUT]  [--output=OUTPUT]
-	redis-port restore  [--ncpu=N]  [--parallel=M]  [--input=INPUT]   --target=TARGET   [--auth=AUTH]  [--extra] [--faketime=FAKETIME]  [--filterdb=DB] 
+	redis-port decode   [--ncpu=N]  [--parallel=M]  [--input=INPUT]  [--output=OUTPUT] [--envelope [--source-id=ID]] [--decode-bitmap=keys [--bitmap-summary]]
+                        [--allowlist-file=FILE] [--denylist-file=FILE] [--group-by-key] [--compress=gzip] [--roll-bytes=SIZE]
+                        [--output-format=FORMAT] [--eviction-policy=POLICY] [--stale-threshold=DURATION --stale-extractor=RULE --stale-report=FILE] [--strict]
+                        [--value-match=REGEXP] [--input-offset=N] [--type-stats] [--summary=FILE] [--normalize-floats]
+                        [--filter=GLOB...] [--filter-regexp=REGEXP...] [--filter-out=GLOB...] [--input-dir=DIR] [--target-version=VERSION]
+                        [--bigkeys [--top=N]] [--continue-on-error [--max-errors=N]] [--metrics-addr=ADDR] [--stat-format=FORMAT]
+                        [--checkpoint-on-signal] [--checkpoint-file=FILE] [--resume]
+	redis-port encode   [--ncpu=N]  [--input=INPUT]  [--output=OUTPUT] [--output-format=FORMAT] [--target-version=VERSION]
+	redis-port restore  [--ncpu=N]  [--parallel=M]  [--input=INPUT]   (--target=TARGET | --target-cluster=NODES)   [--auth=AUTH]  [--extra] [--faketime=FAKETIME]  [--filterdb=DB] [--target-select-on-connect=N]
+                        [--target-proto-max-bulk-len=SIZE] [--qps-limit=N] [--bandwidth-limit=SIZE] [--allowlist-file=FILE] [--denylist-file=FILE] [--atomic-group=GROUP]
+                        [--collapse-pattern=REGEXP] [--pipeline=N [--pipeline-error=MODE]] [--client-name=NAME]
+                        [--auto-parallel [--max-parallel=N]] [--target-version=VERSION] [--flush-target] [--replace] [--yes] [--force] [--strict] [--input-offset=N] [--socks5=PROXY]
+                        [--resume-from-key=KEY] [--prefer-restore-over-rebuild] [--metrics-addr=ADDR] [--stat-format=FORMAT]
+                        [--checkpoint-on-signal] [--checkpoint-file=FILE] [--resume]
+                        [--filter-key=REGEXP] [--filter-db=N] [--rename-prefix=OLD:NEW] [--target-db=N]
+                        [--target-auth=USER:PASSWORD] [--target-tls] [--tls-ca=FILE] [--tls-cert=FILE --tls-key=FILE] [--tls-skip-verify]
                         [--filterkeys=keys] [--skipkeys=keys] [--restorecmd=slotsrestore] [--aggregatetype=type] [--aggregatekeys=keys] [--aggregateTargetKey=key] 
-	redis-port dump     [--ncpu=N]  [--parallel=M]   --from=MASTER   [--password=PASSWORD]  [--output=OUTPUT]  [--extra]
-	redis-port sync     [--ncpu=N]  [--parallel=M]   --from=MASTER   [--password=PASSWORD]   --target=TARGET   [--auth=AUTH]  [--sockfile=FILE [--filesize=SIZE]] [--filterdb=DB] [--psync] [--force]
+	redis-port dump     [--ncpu=N]  [--parallel=M]   --from=MASTER   [--password=PASSWORD]  [--output=OUTPUT]  [--extra] [--dump-lua=FILE] [--client-name=NAME] [--socks5=PROXY]
+                        [--drop-functions] [--drop-module-aux]
+                        [--filter-key=REGEXP] [--filter-db=N] [--rename-prefix=OLD:NEW] [--target-db=N]
+                        [--source-auth=USER:PASSWORD] [--source-tls] [--tls-ca=FILE] [--tls-cert=FILE --tls-key=FILE] [--tls-skip-verify]
+	redis-port sync     [--ncpu=N]  [--parallel=M]   --from=MASTER   [--password=PASSWORD]   (--target=TARGET | --target-cluster=NODES)   [--auth=AUTH]  [--sockfile=FILE [--filesize=SIZE]] [--filterdb=DB] [--psync] [--force] [--target-select-on-connect=N]
+                        [--limit-db=LIMITS] [--limit-cmd=LIMITS] [--qps-limit=N] [--bandwidth-limit=SIZE] [--reconcile-interval=INTERVAL [--reconcile-sample=N]] [--allowlist-file=FILE] [--denylist-file=FILE]
+                        [--offset-file=FILE] [--state-file=FILE] [--rdb-done-file=FILE] [--source-db=DBS] [--client-name=NAME] [--auto-parallel [--max-parallel=N]]
+                        [--target-version=VERSION] [--yes] [--delete-log=FILE] [--strict] [--checkpoint-on-signal] [--socks5=PROXY] [--metrics-addr=ADDR] [--stat-format=FORMAT]
+                        [--filter-key=REGEXP] [--filter-db=N] [--rename-prefix=OLD:NEW] [--target-db=N]
+                        [--source-auth=USER:PASSWORD] [--target-auth=USER:PASSWORD] [--source-tls] [--target-tls] [--tls-ca=FILE] [--tls-cert=FILE --tls-key=FILE] [--tls-skip-verify]
                         [--filterkeys=keys] [--skipkeys=keys] [--restorecmd=slotsrestore] [--aggregatetype=type] [--aggregatekeys=keys] [--aggregateTargetKey=key] [--set2sortedkeys=keys] [--sorted2setkeys=keys]
+	redis-port check    [--ncpu=N]  [--parallel=M]   --from=MASTER   [--password=PASSWORD]   (--target=TARGET | --target-cluster=NODES)   [--auth=AUTH]  [--output=OUTPUT] [--sample=RATE] [--ttl-tolerance=DURATION] [--one-way]
+                        [--filter-key=REGEXP] [--filter-db=N] [--client-name=NAME] [--socks5=PROXY]
+                        [--source-auth=USER:PASSWORD] [--target-auth=USER:PASSWORD] [--source-tls] [--target-tls] [--tls-ca=FILE] [--tls-cert=FILE --tls-key=FILE] [--tls-skip-verify]
+	redis-port serve    [--ncpu=N]   --input=INPUT   --listen=ADDR   [--auth=AUTH]  [--force]
 
 Options:
 	-n N, --ncpu=N                    Set runtime.GOMAXPROCS to N.
 	-p M, --parallel=M                Set the number of parallel routines to M.
-	-i INPUT, --input=INPUT           Set input file, default is stdin ('/dev/stdin').
-	-o OUTPUT, --output=OUTPUT        Set output file, default is stdout ('/dev/stdout').
+	--auto-parallel                   Adjust the number of rdb restore routines to the observed throughput, starting from --parallel.
+	--max-parallel=N                  Set the upper bound of --auto-parallel, default is 64.
+	-i INPUT, --input=INPUT           Set input file, default or '-' is stdin.
+	-o OUTPUT, --output=OUTPUT        Set output file, default or '-' is stdout.
+	-l ADDR, --listen=ADDR            Set listen address, replicas connect to it as to a master.
 	-f MASTER, --from=MASTER          Set host:port of master redis.
-	-t TARGET, --target=TARGET        Set host:port of slave redis.
+	-t TARGET, --target=TARGET        Set host:port of slave redis, sync takes several separated by comma.
+	--target-cluster=NODES            Set host:port of some nodes of the target redis cluster, separated by ','.
 	-P PASSWORD, --password=PASSWORD  Set redis auth password.
 	-A AUTH, --auth=AUTH              Set auth password for target.
+	--source-auth=USER:PASSWORD       Authenticate to the master as the ACL user USER, instead of --password.
+	--target-auth=USER:PASSWORD       Authenticate to the target as the ACL user USER, instead of --auth.
+	--source-tls                      Connect to the master over TLS, the replication connection too.
+	--target-tls                      Connect to the target over TLS.
+	--tls-ca=FILE                     Verify the servers against the CA certificates in FILE, default is the system ones.
+	--tls-cert=FILE                   Present the client certificate in FILE, with the key in --tls-key.
+	--tls-key=FILE                    Set the private key of --tls-cert.
+	--tls-skip-verify                 Do not verify the certificates of the servers.
+	--sample=RATE                     Check RATE percent of the keys (e.g. 10%), picked by a hash of the key, default is all of them.
+	--ttl-tolerance=DURATION          Report expires of a key differing by more than DURATION, default is 5s.
+	--one-way                         Do not look for keys of the target missing on the source.
+	--metrics-addr=ADDR               Serve Prometheus metrics on http://ADDR/metrics, e.g. ':9090'.
+	--stat-format=FORMAT              Write the progress lines as 'text' or 'json', default is 'text'.
 	--faketime=FAKETIME               Set current system time to adjust key's expire time.
 	--sockfile=FILE                   Use FILE to as socket buffer, default is disabled.
 	--filesize=SIZE                   Set FILE size, default value is 1gb.
 	-e, --extra                       Set ture to send/receive following redis commands, default is false.
 	--filterdb=DB                     Filter db = DB, default is *.
+	--source-db=DBS                   Only sync the dbs in DBS, seperated by comma, default is *.
+	--filter-key=REGEXP               Only restore, sync or dump the keys matching REGEXP.
+	--filter-db=N                     Only restore, sync or dump the keys of db N.
+	--rename-prefix=OLD:NEW           Replace the prefix OLD of keys by NEW on the target, escape colons of the prefixes as '\:'.
+	--target-db=N                     Move the keys of every db to db N on the target.
+	--envelope                        Wrap every decoded record as {"meta":{...},"data":{...}}, default is disabled.
+	--source-id=ID                    Set the source identifier in the envelope, default is the input file.
+	--decode-bitmap=keys              Decode string key in keys as bitmap, keys is seperated by comma and supports regular expression.
+	--bitmap-summary                  Only emit the bit count of bitmap keys, not the set bit positions.
+	--output-format=FORMAT            Set the decode output format, 'json', 'redis-pipe', 'resp' or 'parquet', default is 'json'; encode writes 'rdb' (the default), 'redis-pipe' or 'resp'.
+	--eviction-policy=POLICY          Add "evictable" to every decoded record, whether POLICY (e.g. 'volatile-lru') may evict the key.
+	--normalize-floats                Write zset scores of decode as redis formats them, with %.17g, and -0 as 0.
+	--type-stats                      Log a table of the keys and bytes per db and type when decode is done.
+	--summary=FILE                    Write the decode totals and the keys and bytes per db and type to FILE as json.
+	--bigkeys                         Write a report of the largest keys and the totals per db and type instead of the records.
+	--top=N                           Set the number of largest keys in the --bigkeys report, default is 10.
+	--continue-on-error               Skip the keys whose value fails to decode instead of aborting the decode.
+	--max-errors=N                    Abort with exit code 3 once N keys failed to decode, default is no limit.
+	--resume-from-key=KEY             Skip the rdb entries before the first key KEY, binary keys as 'base64:<encoded>'.
+	--input-dir=DIR                   Decode every *.rdb file of DIR in parallel, the output is sorted by db then key.
+	--input-offset=N                  Start reading the rdb at byte N of --input, e.g. in a block device image.
+	--filter=GLOB                     Only decode keys matching GLOB as redis KEYS does, repeat it to match any of several.
+	--filter-regexp=REGEXP            Only decode keys matching REGEXP, byte by byte, repeat it to match any of several.
+	--filter-out=GLOB                 Skip the keys matching GLOB, repeat it to skip several.
+	--value-match=REGEXP              Only decode string values, list elements, hash values and set/zset members matching REGEXP, byte by byte.
+	--stale-threshold=DURATION        Flag keys without expire whose embedded timestamp is older than DURATION, e.g. '72h'.
+	--stale-extractor=RULE            Where the timestamp is, 'SOURCE=REGEXP' with SOURCE key, value, hash:FIELD or json:FIELD.
+	--stale-report=FILE               Write the keys flagged by --stale-threshold to FILE as json lines.
+	--compress=gzip                   Compress the decode output with gzip, default is disabled.
+	--roll-bytes=SIZE                 Start a new decode output file every SIZE bytes, default is disabled.
+	--group-by-key                    Emit one record per key name listing every db holding it, sorted by key.
+	--target-select-on-connect=N      Issue SELECT N on every new target connection, default is disabled.
+	--target-version=VERSION          Set the redis version of the target, e.g. '7.0', default is detected by INFO.
+	--target-proto-max-bulk-len=SIZE  Rebuild keys whose payload exceeds SIZE with type commands, default is detected by CONFIG GET.
+	--prefer-restore-over-rebuild     Don't assume a proto-max-bulk-len the target doesn't report, send every payload it may accept with RESTORE.
     --filterkeys=keys                 Filter key in keys, keys is seperated by comma and supports regular expression.
+	--allowlist-file=FILE             Only accept keys listed in FILE, one per line, binary keys as 'base64:<encoded>'.
+	--denylist-file=FILE              Ignore keys listed in FILE, same format as --allowlist-file.
     --skipkeys=keys                   Skip key in keys, keys is seperated by comma and supports regular expression.
 	--restorecmd=slotsrestore		  Restore command, slotsrestore for codis, restore for redis, if the from and target server are the same, use '--restorecmd=del' will delete the keys, togegher with
                                       filterkeys, it will delete the keys filtered in the server. 
@@ -125,7 +330,33 @@ Options:
     --set2sortedkeys=keys             Convert set key in keys to sorted set, keys is seperated by comma and supports regular expression.
     --sorted2setkeys=keys             Convert sorted set key in keys to set, keys is seperated by comma and supports regular expression.
 	--psync                           Use PSYNC command.
-	--force                           Use force, do not need to enter "yes", you mustn't use it ,unless you konw what you are doing.
+	--reconcile-interval=INTERVAL     Compare and repair sampled keys between source and target every INTERVAL (e.g. 10m), default is disabled.
+	--reconcile-sample=N              Sample N random keys per db on each side in every reconcile round, default is 100.
+	--limit-db=LIMITS                 Throttle forwarded commands per db, e.g. '0:1000/s,1:200/s', default is unlimited.
+	--limit-cmd=LIMITS                Throttle forwarded commands per command, e.g. 'set:500/s,del:100/s', default is unlimited.
+	--qps-limit=N                     Send at most N restored entries and forwarded commands per second in total, default is unlimited.
+	--bandwidth-limit=SIZE            Write at most SIZE bytes per second to the target in total (e.g. 20mb), default is unlimited.
+	--atomic-group=GROUP              Restore keys of the same group in MULTI/EXEC, GROUP is 'hashtag' or a regular expression.
+	--collapse-pattern=REGEXP         Restore string keys matching REGEXP as a field of a hash, the 2 submatches are the hash key and the field.
+	--pipeline=N                      Send N restore commands before reading the replies, default is 1.
+	--pipeline-error=MODE             When a pipelined command fails, MODE is 'continue' or 'abort', default is 'continue'.
+	--dump-lua=FILE                   Write lua scripts found in the rdb and the command stream to FILE as SCRIPT LOAD commands.
+	--drop-functions                  Leave the function libraries out of the rdb written by dump.
+	--drop-module-aux                 Leave the module aux sections out of the rdb written by dump.
+	--strict                          Fail on unknown aux fields and malformed module aux sections in the rdb instead of skipping them.
+	--delete-log=FILE                 Append every key deletion forwarded by sync to FILE as json lines.
+	--checkpoint-on-signal            On SIGINT or SIGTERM, write --offset-file and --state-file and flush --delete-log (sync) or --checkpoint-file (decode, restore) before exiting.
+	--checkpoint-file=FILE            Write the rdb entries decoded or restored to FILE on a signal, for --checkpoint-on-signal and --resume.
+	--resume                          Skip the rdb entries counted in --checkpoint-file, decode appends to --output.
+	--offset-file=FILE                Write the processed master replication offset to FILE every second, default is disabled.
+	--state-file=FILE                 Keep the replication id, offset and db of the stream in FILE, and resume from it by PSYNC, implies --psync.
+	--rdb-done-file=FILE              Write a json marker with the fullresync offset to FILE once the rdb is synced.
+	--socks5=PROXY                    Connect to masters and targets through the SOCKS5 proxy [USER:PASSWORD@]HOST:PORT.
+	--client-name=NAME                Issue CLIENT SETNAME NAME on every connection, default is 'redis-port-<command>'.
+	--flush-target                    Run FLUSHALL on the target before the restore.
+	--replace                         Overwrite existing keys, RESTORE with REPLACE.
+	-y, --yes                         Do not ask for confirmation before writing to the target.
+	--force                           Use force, do not need to enter "yes", and go on when the slots of --target-cluster are not all covered, you mustn't use it ,unless you konw what you are doing.
 `
 	d, err := docopt.Parse(usage, nil, true, "", false)
 	if err != nil {
@@ -155,41 +386,97 @@ Options:
 		args.parallel = 4
 	}
 
+	args.autoParallel, _ = d["--auto-parallel"].(bool)
+	args.maxParallel = 64
+	if s, ok := d["--max-parallel"].(string); ok && s != "" {
+		n, err := parseInt(s, 1, 1024)
+		if err != nil {
+			log.PanicErrorf(err, "parse --max-parallel failed")
+		}
+		args.maxParallel = n
+	}
+	if args.maxParallel < args.parallel {
+		args.maxParallel = args.parallel
+	}
+
 	args.input, _ = d["--input"].(string)
 	args.output, _ = d["--output"].(string)
+	args.inputDir, _ = d["--input-dir"].(string)
 
 	args.from, _ = d["--from"].(string)
 	args.passwd, _ = d["--password"].(string)
 	args.auth, _ = d["--auth"].(string)
-	args.target, _ = d["--target"].(string)
+	if s, ok := d["--source-auth"].(string); ok && s != "" {
+		if args.passwd != "" {
+			log.Panic("--source-auth can't be used with --password")
+		}
+		args.sourceConf = &connConfig{}
+		args.sourceConf.user, args.passwd = parseUserPassword(s)
+	}
+	if s, ok := d["--target-auth"].(string); ok && s != "" {
+		if args.auth != "" {
+			log.Panic("--target-auth can't be used with --auth")
+		}
+		args.targetConf = &connConfig{}
+		args.targetConf.user, args.auth = parseUserPassword(s)
+	}
+	if err := parseTLS(d); err != nil {
+		log.PanicError(err, "parse tls options failed")
+	}
+	if s, ok := d["--target"].(string); ok && s != "" {
+		l, err := parseTargets(s)
+		if err != nil {
+			log.PanicError(err, "parse --target failed")
+		}
+		if len(l) > 1 {
+			if !d["sync"].(bool) {
+				log.Panic("several --target addresses can only be used with sync")
+			}
+			for _, flag := range []string{"--aggregatekeys", "--set2sortedkeys", "--sorted2setkeys"} {
+				if s, _ := d[flag].(string); s != "" && s != "*" {
+					log.Panicf("several --target addresses can't be used with %s", flag)
+				}
+			}
+		}
+		args.targets, args.target = l, l[0]
+	}
+	if s, ok := d["--target-cluster"].(string); ok && s != "" {
+		cl, err := parseCluster(s, args.auth)
+		if err != nil {
+			log.PanicError(err, "parse --target-cluster failed")
+		}
+		args.cluster, args.target = cl, cl.seeds[0]
+	}
+	args.listen, _ = d["--listen"].(string)
+	args.offsetFile, _ = d["--offset-file"].(string)
+	args.stateFile, _ = d["--state-file"].(string)
+	args.rdbDoneFile, _ = d["--rdb-done-file"].(string)
+	args.dumpLua, _ = d["--dump-lua"].(string)
+	args.dropFunctions, _ = d["--drop-functions"].(bool)
+	args.dropModuleAux, _ = d["--drop-module-aux"].(bool)
+	args.deleteLog, _ = d["--delete-log"].(string)
 
 	args.extra, _ = d["--extra"].(bool)
 	args.psync, _ = d["--psync"].(bool)
+	args.psync = args.psync || len(args.stateFile) != 0
+	args.strict, _ = d["--strict"].(bool)
+	args.typeStats, _ = d["--type-stats"].(bool)
+	args.normalizeFloats, _ = d["--normalize-floats"].(bool)
+	args.summary, _ = d["--summary"].(string)
+	args.checkpointOnSignal, _ = d["--checkpoint-on-signal"].(bool)
+	args.checkpointFile, _ = d["--checkpoint-file"].(string)
+	args.resume, _ = d["--resume"].(bool)
 	args.force, _ = d["--force"].(bool)
+	args.yes, _ = d["--yes"].(bool)
+	args.yes = args.yes || args.force
+	args.flushTarget, _ = d["--flush-target"].(bool)
+	args.replace, _ = d["--replace"].(bool)
+	args.preferRestore, _ = d["--prefer-restore-over-rebuild"].(bool)
 	args.sockfile, _ = d["--sockfile"].(string)
-
-        var input string
-	for {
-		if args.force {
-            		goto CONTINUE
-		}
-                fmt.Printf("Are you sure to continue (yes/no)?\n")
-		_, err := fmt.Scanf("%s\r\n", &input)
-		if err !=nil {
-			log.PanicError(err, "input yes/no err")
-		}
-                switch input {
-        	default:
-                	fmt.Printf("Input the wrong value, you should input yes or no")
-            		continue
-        	case "yes":
-            		goto CONTINUE
-        	case "no":
-            		os.Exit(1)
-        }
-	}
-
-        CONTINUE:
+	args.envelope, _ = d["--envelope"].(bool)
+	args.sourceid, _ = d["--source-id"].(string)
+	args.bitmapSummary, _ = d["--bitmap-summary"].(bool)
+	args.groupByKey, _ = d["--group-by-key"].(bool)
 
 	if s, ok := d["--faketime"].(string); ok && s != "" {
 		switch s[0] {
@@ -214,6 +501,13 @@ Options:
 		}
 	}
 
+	args.filterdb = "*"
+	if s, ok := d["--filterdb"].(string); ok && s != "" {
+		args.filterdb = s
+	}
+	if s, ok := d["--source-db"].(string); ok && s != "" {
+		args.filterdb = s
+	}
 	if s, ok := d["--filterdb"].(string); ok && s != "" && s != "*" {
 		n, err := parseInt(s, MinDB, MaxDB)
 		if err != nil {
@@ -225,6 +519,50 @@ Options:
 		}
 	}
     
+	if s, ok := d["--source-db"].(string); ok && s != "" && s != "*" {
+		dbs := make(map[uint32]bool)
+		for _, x := range strings.Split(s, ",") {
+			n, err := parseInt(strings.TrimSpace(x), MinDB, MaxDB)
+			if err != nil {
+				log.PanicError(err, "parse --source-db failed")
+			}
+			dbs[uint32(n)] = true
+		}
+		accept := acceptDB
+		acceptDB = func(db uint32) bool {
+			return dbs[db] && accept(db)
+		}
+	}
+
+	if s, ok := d["--filter-db"].(string); ok && s != "" {
+		n, err := parseInt(s, MinDB, MaxDB)
+		if err != nil {
+			log.PanicError(err, "parse --filter-db failed")
+		}
+		u, accept := uint32(n), acceptDB
+		acceptDB = func(db uint32) bool {
+			return db == u && accept(db)
+		}
+		args.filterKeys = true
+	}
+
+	args.targetDB = -1
+	if s, ok := d["--target-db"].(string); ok && s != "" {
+		n, err := parseInt(s, MinDB, MaxDB)
+		if err != nil {
+			log.PanicError(err, "parse --target-db failed")
+		}
+		args.targetDB = n
+	}
+
+	if s, ok := d["--rename-prefix"].(string); ok && s != "" {
+		r, err := parseRenamePrefix(s)
+		if err != nil {
+			log.PanicError(err, "parse --rename-prefix failed")
+		}
+		args.renamePrefix = r
+	}
+
 	if s, ok := d["--filterkeys"].(string); ok && s != "" && s != "*" {
 		keys := strings.Split(s, ",")
 
@@ -269,6 +607,75 @@ Options:
 		}
 	}
 
+	if s, ok := d["--filter-key"].(string); ok && s != "" {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			log.PanicError(err, "parse --filter-key failed")
+		}
+		accept := acceptKey
+		acceptKey = func(key []byte) bool {
+			return re.Match(key) && accept(key)
+		}
+		args.filterKeys = true
+	}
+
+	if s, ok := d["--allowlist-file"].(string); ok && s != "" {
+		set, err := loadKeySet(s)
+		if err != nil {
+			log.PanicError(err, "parse --allowlist-file failed")
+		}
+		log.Infof("load %d keys from allowlist '%s'\n", len(set), s)
+		accept := acceptKey
+		acceptKey = func(key []byte) bool {
+			return set.has(key) && accept(key)
+		}
+	}
+
+	if s, ok := d["--denylist-file"].(string); ok && s != "" {
+		set, err := loadKeySet(s)
+		if err != nil {
+			log.PanicError(err, "parse --denylist-file failed")
+		}
+		log.Infof("load %d keys from denylist '%s'\n", len(set), s)
+		accept := acceptKey
+		acceptKey = func(key []byte) bool {
+			return !set.has(key) && accept(key)
+		}
+	}
+
+	if s, ok := d["--atomic-group"].(string); ok && s != "" {
+		f, err := newAtomicGroup(s)
+		if err != nil {
+			log.PanicError(err, "parse --atomic-group failed")
+		}
+		atomicGroup = f
+		args.atomicGroup = true
+	}
+
+	if s, ok := d["--collapse-pattern"].(string); ok && s != "" {
+		r, err := newCollapseRegexp(s)
+		if err != nil {
+			log.PanicError(err, "parse --collapse-pattern failed")
+		}
+		collapseRegexp = r
+	}
+
+	if s, ok := d["--pipeline"].(string); ok && s != "" {
+		n, err := parseInt(s, 1, 65536)
+		if err != nil {
+			log.PanicErrorf(err, "parse --pipeline failed")
+		}
+		pipelineSize = n
+	}
+
+	if s, ok := d["--pipeline-error"].(string); ok && s != "" {
+		m, err := parsePipelineError(s)
+		if err != nil {
+			log.PanicError(err, "parse --pipeline-error failed")
+		}
+		pipelineMode = m
+	}
+
 	if s, ok := d["--restorecmd"].(string); ok && s != "" {
 		restoreCmd = strings.TrimSpace(s)
 	}
@@ -355,6 +762,205 @@ Options:
 		}
 	}
 
+	args.selectdb = -1
+	if s, ok := d["--target-select-on-connect"].(string); ok && s != "" {
+		n, err := parseInt(s, MinDB, MaxDB)
+		if err != nil {
+			log.PanicError(err, "parse --target-select-on-connect failed")
+		}
+		args.selectdb = n
+	}
+	if args.cluster != nil && args.selectdb >= 0 {
+		log.Panic("--target-select-on-connect can't be used with --target-cluster")
+	}
+
+	if s, ok := d["--target-version"].(string); ok && s != "" {
+		v, err := parseRedisVersion(s)
+		if err != nil {
+			log.PanicError(err, "parse --target-version failed")
+		}
+		targetVersion = v
+	}
+
+	if s, ok := d["--limit-db"].(string); ok && s != "" {
+		if err := parseLimitDB(s); err != nil {
+			log.PanicError(err, "parse --limit-db failed")
+		}
+	}
+
+	if s, ok := d["--limit-cmd"].(string); ok && s != "" {
+		if err := parseLimitCmd(s); err != nil {
+			log.PanicError(err, "parse --limit-cmd failed")
+		}
+	}
+
+	if s, ok := d["--qps-limit"].(string); ok && s != "" {
+		n, err := parseRate(s)
+		if err != nil {
+			log.PanicError(err, "parse --qps-limit failed")
+		}
+		qpsLimit = limiter.New(n)
+	}
+
+	if s, ok := d["--bandwidth-limit"].(string); ok && s != "" {
+		n, err := bytesize.Parse(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s"))
+		if err != nil {
+			log.PanicError(err, "parse --bandwidth-limit failed")
+		}
+		if n <= 0 {
+			log.Panicf("parse --bandwidth-limit = %d, invalid number", n)
+		}
+		bandwidthLimit = limiter.New(n)
+	}
+
+	if s, ok := d["--decode-bitmap"].(string); ok && s != "" {
+		bitmapKey, err = newKeyMatcher(s)
+		if err != nil {
+			log.PanicError(err, "parse --decode-bitmap failed")
+		}
+	}
+
+	if s, ok := d["--reconcile-interval"].(string); ok && s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			log.PanicError(err, "parse --reconcile-interval failed")
+		}
+		if d <= 0 {
+			log.Panicf("parse --reconcile-interval = %s, invalid interval", s)
+		}
+		args.reconcile = d
+	}
+
+	if b, _ := d["--bigkeys"].(bool); b {
+		args.bigkeys = 10
+		if s, ok := d["--top"].(string); ok && s != "" {
+			n, err := parseInt(s, 1, 1000000)
+			if err != nil {
+				log.PanicError(err, "parse --top failed")
+			}
+			args.bigkeys = n
+		}
+	}
+
+	args.continueOnError, _ = d["--continue-on-error"].(bool)
+	if s, ok := d["--max-errors"].(string); ok && s != "" {
+		n, err := parseInt(s, 1, 1000000000)
+		if err != nil {
+			log.PanicError(err, "parse --max-errors failed")
+		}
+		args.maxErrors = int64(n)
+	}
+
+	args.reconcileSample = 100
+	if s, ok := d["--reconcile-sample"].(string); ok && s != "" {
+		n, err := parseInt(s, 1, 1000000)
+		if err != nil {
+			log.PanicError(err, "parse --reconcile-sample failed")
+		}
+		args.reconcileSample = n
+	}
+
+	if s, ok := d["--output-format"].(string); ok && s != "" {
+		args.outputFormat = s
+		switch s {
+		case "json", "rdb":
+		case "redis-pipe":
+			args.redisPipe = true
+		case "resp":
+			args.resp = true
+		case "parquet":
+			args.parquet = true
+		default:
+			log.Panicf("parse --output-format = '%s', should be json, rdb, redis-pipe, resp or parquet", s)
+		}
+	}
+
+	if s, ok := d["--eviction-policy"].(string); ok && s != "" {
+		p, err := parseEvictionPolicy(s)
+		if err != nil {
+			log.PanicError(err, "parse --eviction-policy failed")
+		}
+		args.evictionPolicy = &p
+	}
+
+	if s, ok := d["--value-match"].(string); ok && s != "" {
+		m, err := newValueMatch(s)
+		if err != nil {
+			log.PanicError(err, "parse --value-match failed")
+		}
+		args.valueMatch = m
+	}
+
+	globs, _ := d["--filter"].([]string)
+	regexps, _ := d["--filter-regexp"].([]string)
+	out, _ := d["--filter-out"].([]string)
+	if len(globs) != 0 || len(regexps) != 0 || len(out) != 0 {
+		f, err := newKeyFilter(globs, regexps, out)
+		if err != nil {
+			log.PanicError(err, "parse --filter-regexp failed")
+		}
+		args.filter = f
+	}
+
+	if s, ok := d["--stale-threshold"].(string); ok && s != "" {
+		threshold, err := time.ParseDuration(s)
+		if err != nil {
+			log.PanicError(err, "parse --stale-threshold failed")
+		}
+		rule, _ := d["--stale-extractor"].(string)
+		c, err := newStaleCheck(rule, threshold)
+		if err != nil {
+			log.PanicError(err, "parse --stale-extractor failed")
+		}
+		args.stale = c
+		args.staleReport, _ = d["--stale-report"].(string)
+	}
+
+	if s, ok := d["--compress"].(string); ok && s != "" {
+		if s != "gzip" {
+			log.Panicf("parse --compress = '%s', only gzip is supported", s)
+		}
+		args.compress = true
+	}
+
+	if s, ok := d["--roll-bytes"].(string); ok && s != "" {
+		n, err := bytesize.Parse(s)
+		if err != nil {
+			log.PanicError(err, "parse --roll-bytes failed")
+		}
+		if n <= 0 {
+			log.Panicf("parse --roll-bytes = %d, invalid number", n)
+		}
+		args.rollBytes = n
+	}
+
+	if s, ok := d["--socks5"].(string); ok && s != "" {
+		p, err := parseSocks5(s)
+		if err != nil {
+			log.PanicError(err, "parse --socks5 failed")
+		}
+		args.socks5 = p
+	}
+
+	if s, ok := d["--resume-from-key"].(string); ok && s != "" {
+		key, err := parseKeyName(s)
+		if err != nil {
+			log.PanicError(err, "parse --resume-from-key failed")
+		}
+		args.resumeFromKey = key
+	}
+
+	if s, ok := d["--input-offset"].(string); ok && s != "" {
+		n, err := bytesize.Parse(s)
+		if err != nil {
+			log.PanicError(err, "parse --input-offset failed")
+		}
+		if n < 0 {
+			log.Panicf("parse --input-offset = %d, invalid number", n)
+		}
+		args.inputOffset = n
+	}
+
 	if s, ok := d["--filesize"].(string); ok && s != "" {
 		if len(args.sockfile) == 0 {
 			log.Panic("please specify --sockfile first")
@@ -371,16 +977,76 @@ Options:
 		args.filesize = bytesize.GB
 	}
 
+	if s, ok := d["--target-proto-max-bulk-len"].(string); ok && s != "" {
+		n, err := bytesize.Parse(s)
+		if err != nil {
+			log.PanicError(err, "parse --target-proto-max-bulk-len failed")
+		}
+		if n <= 0 {
+			log.Panicf("parse --target-proto-max-bulk-len = %d, invalid number", n)
+		}
+		maxBulkLen = n
+	}
+
+	for _, name := range []string{"restore", "dump", "sync", "check"} {
+		if d[name].(bool) {
+			args.clientName = "redis-port-" + name
+		}
+	}
+	if s, ok := d["--client-name"].(string); ok && s != "" {
+		if strings.IndexFunc(s, unicode.IsSpace) >= 0 {
+			log.Panicf("parse --client-name = '%s', spaces are not allowed", s)
+		}
+		args.clientName = s
+	}
+
+	args.sample = 100
+	if s, ok := d["--sample"].(string); ok && s != "" {
+		n, err := parseSample(s)
+		if err != nil {
+			log.PanicError(err, "parse --sample failed")
+		}
+		args.sample = n
+	}
+	args.ttlTolerance = 5 * time.Second
+	if s, ok := d["--ttl-tolerance"].(string); ok && s != "" {
+		t, err := time.ParseDuration(s)
+		if err != nil {
+			log.PanicError(err, "parse --ttl-tolerance failed")
+		}
+		if t < 0 {
+			log.Panicf("parse --ttl-tolerance = %s, invalid duration", s)
+		}
+		args.ttlTolerance = t
+	}
+	args.oneWay, _ = d["--one-way"].(bool)
+
+	args.metricsAddr, _ = d["--metrics-addr"].(string)
+	if s, ok := d["--stat-format"].(string); ok && s != "" {
+		switch s {
+		case "text", "json":
+			args.statFormat = s
+		default:
+			log.Panicf("parse --stat-format = %s, should be text or json", s)
+		}
+	}
+
 	log.Infof("set ncpu = %d, parallel = %d\n", ncpu, args.parallel)
 
 	switch {
 	case d["decode"].(bool):
 		new(cmdDecode).Main()
+	case d["encode"].(bool):
+		new(cmdEncode).Main()
 	case d["restore"].(bool):
 		new(cmdRestore).Main()
 	case d["dump"].(bool):
 		new(cmdDump).Main()
 	case d["sync"].(bool):
 		new(cmdSync).Main()
+	case d["check"].(bool):
+		new(cmdCheck).Main()
+	case d["serve"].(bool):
+		new(cmdServe).Main()
 	}
 }
@@ -0,0 +1,288 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/limiter"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// metricFamily is a metric served on --metrics-addr in the Prometheus text
+// format, its values are read when it is scraped.
+type metricFamily struct {
+	name, kind, help string
+
+	values []*metricValue
+}
+
+type metricValue struct {
+	labels string
+	value  func() int64
+}
+
+var metricFamilies struct {
+	sync.Mutex
+	list []*metricFamily
+}
+
+// exportMetric adds a value of the counter or gauge name, labels are written
+// as they are, e.g. `type="hash"`.
+func exportMetric(name, kind, help, labels string, value func() int64) {
+	metricFamilies.Lock()
+	defer metricFamilies.Unlock()
+	var m *metricFamily
+	for _, x := range metricFamilies.list {
+		if x.name == name {
+			m = x
+		}
+	}
+	if m == nil {
+		m = &metricFamily{name: name, kind: kind, help: help}
+		metricFamilies.list = append(metricFamilies.list, m)
+	}
+	m.values = append(m.values, &metricValue{labels: labels, value: value})
+}
+
+func writeMetrics(w io.Writer) error {
+	metricFamilies.Lock()
+	defer metricFamilies.Unlock()
+	for _, m := range metricFamilies.list {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+		for _, v := range m.values {
+			name := m.name
+			if len(v.labels) != 0 {
+				name += "{" + v.labels + "}"
+			}
+			if _, err := fmt.Fprintf(w, "%s %d\n", name, v.value()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// serveMetrics serves /metrics on addr, along with the metrics shared by the
+// commands: entries by type, throttle events and errors logged.
+func serveMetrics(addr string) {
+	for _, t := range entryTypeNames {
+		exportMetric("redis_port_type_entries_total", "counter", "Entries of the rdb decoded, restored or synced, by type.",
+			fmt.Sprintf("type=%q", t), entryTypes[t].Get)
+	}
+	forEachLimiter(func(scope string, l *limiter.Limiter) {
+		exportMetric("redis_port_throttled_total", "counter", "Times a limit delayed the writes to the target.",
+			fmt.Sprintf("limit=%q", scope), l.Throttled)
+	})
+	for _, x := range []struct {
+		level string
+		t     log.LogType
+	}{{"error", log.TYPE_ERROR}, {"warn", log.TYPE_WARN}} {
+		t := x.t
+		exportMetric("redis_port_errors_total", "counter", "Errors and warnings logged, e.g. keys that failed or were skipped.",
+			fmt.Sprintf("level=%q", x.level), func() int64 {
+				return log.Count(t)
+			})
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.PanicErrorf(err, "listen on --metrics-addr '%s' failed", addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.WarnErrorf(err, "serve --metrics-addr '%s' failed", addr)
+		}
+	}()
+	log.Infof("metrics on 'http://%s/metrics'", l.Addr())
+}
+
+// entryTypes counts the entries decoded, restored or synced by their type,
+// as named by rdb.TypeName.
+var (
+	entryTypeNames = []string{"string", "list", "set", "zset", "hash", "stream", "module", "unknown"}
+	entryTypes     = make(map[string]*atomic2.Int64)
+)
+
+func init() {
+	for _, t := range entryTypeNames {
+		entryTypes[t] = &atomic2.Int64{}
+	}
+}
+
+func countEntryType(e *rdb.BinEntry) {
+	if n := entryTypes[rdb.TypeName(e.Value)]; n != nil {
+		n.Incr()
+	} else {
+		entryTypes["unknown"].Incr()
+	}
+}
+
+// targetBytes counts the bytes written to the targets with --metrics-addr.
+var targetBytes atomic2.Int64
+
+func countConn(c net.Conn) net.Conn {
+	if len(args.metricsAddr) == 0 {
+		return c
+	}
+	return &countedConn{Conn: c}
+}
+
+type countedConn struct {
+	net.Conn
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	targetBytes.Add(int64(n))
+	return n, err
+}
+
+// infoInt returns the integer field of an INFO reply.
+func infoInt(s, field string) (int64, bool) {
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, field+":") {
+			continue
+		}
+		n, err := strconv.ParseInt(line[len(field)+1:], 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// PollMasterOffset reads master_repl_offset of the master every 5 seconds,
+// for the replication lag of --metrics-addr. The master may be unreachable
+// for a while, the last offset read is kept then.
+func (cmd *cmdSync) PollMasterOffset(master, passwd string) {
+	var c redigo.Conn
+	for ; ; time.Sleep(time.Second * 5) {
+		if c == nil {
+			nc := openNetConnSoft(master, passwd, args.sourceConf)
+			if nc == nil {
+				continue
+			}
+			c = redigo.NewConn(nc, 0, 0)
+		}
+		s, err := redigo.String(c.Do("info", "replication"))
+		if err != nil {
+			log.WarnErrorf(err, "sync: read master_repl_offset failed")
+			c.Close()
+			c = nil
+			continue
+		}
+		if n, ok := infoInt(s, "master_repl_offset"); ok {
+			cmd.masterOffset.Set(n)
+		}
+	}
+}
+
+// logStat writes a progress line of --stat-format=json to stderr: the fields
+// of the text line of stage, along with the unix time in ms.
+func logStat(stage string, fields map[string]interface{}) {
+	fields["stage"] = stage
+	fields["time"] = time.Now().UnixNano() / int64(time.Millisecond)
+	b, err := json.Marshal(fields)
+	if err != nil {
+		log.PanicError(err, "encode to json failed")
+	}
+	os.Stderr.Write(append(b, '\n'))
+}
+
+// statJSON reports whether the progress lines are json, see --stat-format.
+func statJSON() bool {
+	return args.statFormat == "json"
+}
+
+// throttleCounts is throttleStat for --stat-format=json.
+func throttleCounts() map[string]int64 {
+	m := make(map[string]int64)
+	forEachLimiter(func(scope string, l *limiter.Limiter) {
+		if n := l.Throttled(); n != 0 {
+			m[scope] = n
+		}
+	})
+	return m
+}
+
+func (cmd *cmdDecode) exportMetrics(nsize int64) {
+	exportMetric("redis_port_rdb_size_bytes", "gauge", "Size of the rdb, 0 when unknown.", "", func() int64 {
+		return nsize
+	})
+	exportMetric("redis_port_read_bytes_total", "counter", "Bytes of the rdb read.", "", cmd.rbytes.Get)
+	exportMetric("redis_port_write_bytes_total", "counter", "Bytes of records written.", "", cmd.wbytes.Get)
+	exportMetric("redis_port_entries_total", "counter", "Entries decoded.", "", cmd.nentry.Get)
+	exportMetric("redis_port_ignored_entries_total", "counter", "Entries filtered out.", "", func() int64 {
+		return cmd.ignore.Get() + cmd.skipped.Get()
+	})
+	exportMetric("redis_port_decode_errors_total", "counter", "Entries skipped by --continue-on-error.", "", cmd.errors.Get)
+}
+
+func (cmd *cmdRestore) exportMetrics(nsize int64) {
+	exportMetric("redis_port_rdb_size_bytes", "gauge", "Size of the rdb, 0 when unknown.", "", func() int64 {
+		return nsize
+	})
+	exportMetric("redis_port_read_bytes_total", "counter", "Bytes of the rdb read.", "", cmd.rbytes.Get)
+	exportMetric("redis_port_write_bytes_total", "counter", "Bytes written to the target.", "", targetBytes.Get)
+	exportMetric("redis_port_entries_total", "counter", "Entries restored.", "", cmd.nentry.Get)
+	exportMetric("redis_port_ignored_entries_total", "counter", "Entries filtered out.", "", cmd.ignore.Get)
+	exportMetric("redis_port_forward_commands_total", "counter", "Commands after the rdb forwarded to the target.", "", cmd.forward.Get)
+	exportMetric("redis_port_bypass_commands_total", "counter", "Commands after the rdb filtered out.", "", cmd.nbypass.Get)
+}
+
+// exportMetrics adds the metrics of sync, offsets are those of the master
+// counted from base as in the --offset-file.
+func (cmd *cmdSync) exportMetrics(nsize, base int64) {
+	exportMetric("redis_port_rdb_size_bytes", "gauge", "Size of the rdb, 0 when unknown.", "", func() int64 {
+		return nsize
+	})
+	exportMetric("redis_port_read_bytes_total", "counter", "Bytes of the rdb read.", "", cmd.rbytes.Get)
+	exportMetric("redis_port_master_read_bytes_total", "counter", "Bytes read from the master, the rdb and the command stream.", "", cmd.ibytes.Get)
+	exportMetric("redis_port_write_bytes_total", "counter", "Bytes written to the target.", "", targetBytes.Get)
+	exportMetric("redis_port_entries_total", "counter", "Entries of the rdb synced.", "", cmd.nentry.Get)
+	exportMetric("redis_port_ignored_entries_total", "counter", "Entries of the rdb filtered out.", "", cmd.ignore.Get)
+	exportMetric("redis_port_forward_commands_total", "counter", "Commands of the stream forwarded to the target.", "", cmd.forward.Get)
+	exportMetric("redis_port_bypass_commands_total", "counter", "Commands of the stream filtered out.", "", cmd.nbypass.Get)
+	exportMetric("redis_port_sync_offset", "gauge", "Master offset of the last command read from the stream.", "", func() int64 {
+		return base + cmd.pos.Offset()
+	})
+	exportMetric("redis_port_sync_pending_bytes", "gauge", "Bytes read from the master not processed yet.", "", func() int64 {
+		if n := cmd.pos.Offset(); n != 0 {
+			return cmd.ibytes.Get() - n
+		}
+		return 0
+	})
+	if args.psync {
+		exportMetric("redis_port_sync_lag_bytes", "gauge", "Master offset minus the offset of sync, master_repl_offset is read every 5s.", "", func() int64 {
+			master := cmd.masterOffset.Get()
+			if master == 0 {
+				return 0
+			}
+			if n := cmd.pos.Offset(); n != 0 {
+				return master - (base + n)
+			}
+			return master - cmd.psyncOffset
+		})
+	}
+	cmd.exportTargetMetrics()
+}
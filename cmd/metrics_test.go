@@ -0,0 +1,58 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	n := int64(7)
+	exportMetric("test_entries_total", "counter", "Test entries.", `type="hash"`, func() int64 {
+		return n
+	})
+	exportMetric("test_entries_total", "counter", "Test entries.", `type="set"`, func() int64 {
+		return 1
+	})
+	exportMetric("test_lag_bytes", "gauge", "Test lag.", "", func() int64 {
+		return -3
+	})
+	n = 8
+	var b bytes.Buffer
+	assert.MustNoError(writeMetrics(&b))
+	assert.Must(strings.Contains(b.String(), `# HELP test_entries_total Test entries.
+# TYPE test_entries_total counter
+test_entries_total{type="hash"} 8
+test_entries_total{type="set"} 1
+# HELP test_lag_bytes Test lag.
+# TYPE test_lag_bytes gauge
+test_lag_bytes -3
+`))
+}
+
+func TestCountEntryType(t *testing.T) {
+	p, err := rdb.EncodeDump(rdb.Hash{{Field: []byte("f"), Value: []byte("v")}})
+	assert.MustNoError(err)
+	n := entryTypes["hash"].Get()
+	countEntryType(&rdb.BinEntry{Key: []byte("k"), Value: p})
+	assert.Must(entryTypes["hash"].Get() == n+1)
+	m := entryTypes["unknown"].Get()
+	countEntryType(&rdb.BinEntry{Key: []byte("k")})
+	assert.Must(entryTypes["unknown"].Get() == m+1)
+}
+
+func TestInfoInt(t *testing.T) {
+	s := "# Replication\r\nrole:master\r\nconnected_slaves:1\r\nmaster_repl_offset:123456\r\nrepl_backlog_active:1\r\n"
+	n, ok := infoInt(s, "master_repl_offset")
+	assert.Must(ok && n == 123456)
+	_, ok = infoInt(s, "role")
+	assert.Must(!ok)
+	_, ok = infoInt(s, "slave_repl_offset")
+	assert.Must(!ok)
+}
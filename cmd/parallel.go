@@ -0,0 +1,123 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"time"
+
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+const (
+	tuneInterval    = time.Second * 5
+	tuneHoldRounds  = 6
+	tuneMinGain     = 1.05
+	tuneStarvedFill = 0.1
+)
+
+// parallelTuner picks the number of restore routines for --auto-parallel.
+// Routines are added one at a time while entries queue up in front of them
+// and each new one raises the throughput; a routine that brings nothing is
+// taken back and growing pauses for a while, so the level settles instead of
+// swinging around the best value.
+type parallelTuner struct {
+	n, max int
+
+	rate  float64
+	grown bool
+	hold  int
+}
+
+func newParallelTuner(n, max int) *parallelTuner {
+	return &parallelTuner{n: n, max: max}
+}
+
+// Next returns the number of routines for the next round, given the entries
+// per second restored in the last one and how full the entry queue is.
+func (t *parallelTuner) Next(rate, fill float64) int {
+	switch {
+	case fill < tuneStarvedFill:
+		// routines are waiting for the rdb loader, more of them won't help.
+		if t.n > 1 {
+			t.n--
+		}
+		t.grown = false
+	case t.grown && rate < t.rate*tuneMinGain:
+		t.n--
+		t.grown, t.hold = false, tuneHoldRounds
+	case t.hold > 0:
+		t.hold--
+	case t.n < t.max:
+		t.n++
+		t.grown = true
+	default:
+		t.grown = false
+	}
+	t.rate = rate
+	return t.n
+}
+
+// runWorkers runs the routines restoring the entries of pipe and returns once
+// all of them are done. A routine has to return when it receives from stop,
+// which only happens with --auto-parallel when the level goes down.
+func runWorkers(pipe chan *rdb.BinEntry, nentry *atomic2.Int64, worker func(stop <-chan struct{})) {
+	exit := make(chan struct{})
+	stop := make(chan struct{}, args.maxParallel+args.parallel)
+	spawn := func() {
+		go func() {
+			defer func() {
+				exit <- struct{}{}
+			}()
+			worker(stop)
+		}()
+	}
+
+	running := 0
+	for ; running < args.parallel; running++ {
+		spawn()
+	}
+
+	var tuner *parallelTuner
+	var tick <-chan time.Time
+	if args.autoParallel {
+		tuner = newParallelTuner(args.parallel, args.maxParallel)
+		t := time.NewTicker(tuneInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	lastn := nentry.Get()
+	for running != 0 {
+		select {
+		case <-exit:
+			running--
+		case <-tick:
+			n := nentry.Get()
+			rate := float64(n-lastn) / tuneInterval.Seconds()
+			lastn = n
+			fill := float64(len(pipe)) / float64(cap(pipe))
+			want := tuner.Next(rate, fill)
+			for ; running-len(stop) < want; running++ {
+				spawn()
+			}
+			for running-len(stop) > want {
+				stop <- struct{}{}
+			}
+			log.Infof("auto-parallel: routines = %d, entry = %.0f/s, queue = %3d%%", want, rate, int(fill*100))
+		}
+	}
+}
+
+// nextEntry receives the next entry of pipe, it returns false once pipe is
+// closed or the routine is asked to stop.
+func nextEntry(pipe chan *rdb.BinEntry, stop <-chan struct{}) (*rdb.BinEntry, bool) {
+	select {
+	case e, ok := <-pipe:
+		return e, ok
+	case <-stop:
+		return nil, false
+	}
+}
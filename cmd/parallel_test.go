@@ -0,0 +1,41 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+)
+
+func TestParallelTunerConverge(t *testing.T) {
+	// the target saturates at 6 routines of 1000 entries/s each.
+	tuner := newParallelTuner(2, 16)
+	n, seen := 2, make(map[int]int)
+	for i := 0; i < 100; i++ {
+		rate := float64(n) * 1000
+		if n > 6 {
+			rate = 6000
+		}
+		n = tuner.Next(rate, 0.9)
+		seen[n]++
+	}
+	assert.Must(n >= 6 && n <= 7)
+	assert.Must(seen[6] >= 60)
+	assert.Must(seen[8] == 0)
+}
+
+func TestParallelTunerLimits(t *testing.T) {
+	tuner := newParallelTuner(2, 4)
+	for i := 0; i < 10; i++ {
+		tuner.Next(float64(i+1)*1e6, 0.9)
+	}
+	assert.Must(tuner.n == 4)
+
+	tuner = newParallelTuner(4, 8)
+	for i := 0; i < 10; i++ {
+		tuner.Next(1000, 0)
+	}
+	assert.Must(tuner.n == 1)
+}
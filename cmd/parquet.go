@@ -0,0 +1,221 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/libs/parquet"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// parquetColumns is the schema of --output-format=parquet, one row per
+// element like the json records. field, member, score and value are null
+// where the type has no such thing, stream rows are the fields of the entries
+// with the entry ID as member; consumer groups are not written.
+var parquetColumns = []parquet.Column{
+	{Name: "db", Type: parquet.Int32},
+	{Name: "type", Type: parquet.ByteArray, UTF8: true},
+	{Name: "key", Type: parquet.ByteArray},
+	{Name: "field", Type: parquet.ByteArray, Optional: true},
+	{Name: "member", Type: parquet.ByteArray, Optional: true},
+	{Name: "score", Type: parquet.Double, Optional: true},
+	{Name: "value", Type: parquet.ByteArray, Optional: true},
+	{Name: "expireat", Type: parquet.Int64},
+}
+
+const (
+	parquetHasField = 1 << iota
+	parquetHasMember
+	parquetHasScore
+	parquetHasValue
+)
+
+// newParquetRecords decodes the entry into rows, serialized as
+// uvarint(db) + uvarint(expireat) + type + key + flags + field, member, score
+// and value when present, see parseParquetRow. Rows are handed to emit every
+// decodeChunkSize bytes so lists are streamed; the number of rows is returned.
+func newParquetRecords(e *rdb.BinEntry, match func([]byte) bool, emit func([]byte)) int {
+	typ := rdb.TypeName(e.Value)
+	var b bytes.Buffer
+	var n int
+	var v [binary.MaxVarintLen64]byte
+	writeBytes := func(p []byte) {
+		b.Write(v[:binary.PutUvarint(v[:], uint64(len(p)))])
+		b.Write(p)
+	}
+	add := func(field, member []byte, score *float64, value []byte) {
+		b.Write(v[:binary.PutUvarint(v[:], uint64(e.DB))])
+		b.Write(v[:binary.PutUvarint(v[:], e.ExpireAt)])
+		writeBytes([]byte(typ))
+		writeBytes(e.Key)
+		var flags byte
+		if field != nil {
+			flags |= parquetHasField
+		}
+		if member != nil {
+			flags |= parquetHasMember
+		}
+		if score != nil {
+			flags |= parquetHasScore
+		}
+		if value != nil {
+			flags |= parquetHasValue
+		}
+		b.WriteByte(flags)
+		if field != nil {
+			writeBytes(field)
+		}
+		if member != nil {
+			writeBytes(member)
+		}
+		if score != nil {
+			binary.Write(&b, binary.BigEndian, math.Float64bits(*score))
+		}
+		if value != nil {
+			writeBytes(value)
+		}
+		if n++; b.Len() >= decodeChunkSize {
+			emit(b.Bytes())
+			b.Reset()
+		}
+	}
+	// nil means null, empty elements must still be written.
+	nonNil := func(p []byte) []byte {
+		if p == nil {
+			return []byte{}
+		}
+		return p
+	}
+
+	if typ == "list" {
+		err := rdb.ForEachListElement(e.Value, func(ele []byte) error {
+			if match(ele) {
+				add(nil, nil, nil, nonNil(ele))
+			}
+			return nil
+		})
+		if err != nil {
+			log.PanicError(err, "decode failed")
+		}
+	} else {
+		o, err := rdb.DecodeDump(e.Value)
+		if err != nil {
+			log.PanicError(err, "decode failed")
+		}
+		switch obj := o.(type) {
+		default:
+			log.Panicf("unknown object %v", o)
+		case rdb.String:
+			if match(obj) {
+				add(nil, nil, nil, nonNil(obj))
+			}
+		case rdb.Hash:
+			for _, ele := range obj {
+				if match(ele.Value) {
+					add(nonNil(ele.Field), nil, nil, nonNil(ele.Value))
+				}
+			}
+		case rdb.Set:
+			for _, mem := range obj {
+				if match(mem) {
+					add(nil, nonNil(mem), nil, nil)
+				}
+			}
+		case rdb.ZSet:
+			for _, ele := range obj {
+				if match(ele.Member) {
+					score := ele.Score
+					if args.normalizeFloats && score == 0 {
+						// -0 == 0 as well, it becomes 0.
+						score = 0
+					}
+					add(nil, nonNil(ele.Member), &score, nil)
+				}
+			}
+		case rdb.Stream:
+			for _, ent := range obj.Entries {
+				id := []byte(ent.ID.String())
+				for _, f := range ent.Fields {
+					if match(f.Value) {
+						add(nonNil(f.Field), id, nil, nonNil(f.Value))
+					}
+				}
+			}
+		case rdb.Module:
+			if args.valueMatch == nil {
+				add(nil, nil, nil, nil)
+			}
+		}
+	}
+	if b.Len() != 0 {
+		emit(b.Bytes())
+	}
+	return n
+}
+
+// parseParquetRow parses the first row of p into the values of
+// parquetColumns, and returns the rest of p.
+func parseParquetRow(p []byte) ([]interface{}, []byte) {
+	readUvarint := func() uint64 {
+		v, i := binary.Uvarint(p)
+		p = p[i:]
+		return v
+	}
+	readBytes := func() []byte {
+		n := readUvarint()
+		x := p[:n]
+		p = p[n:]
+		return x
+	}
+	row := make([]interface{}, len(parquetColumns))
+	row[0] = int32(readUvarint())
+	row[7] = int64(readUvarint())
+	row[1] = readBytes()
+	row[2] = readBytes()
+	flags := p[0]
+	p = p[1:]
+	if flags&parquetHasField != 0 {
+		row[3] = readBytes()
+	}
+	if flags&parquetHasMember != 0 {
+		row[4] = readBytes()
+	}
+	if flags&parquetHasScore != 0 {
+		row[5] = math.Float64frombits(binary.BigEndian.Uint64(p))
+		p = p[8:]
+	}
+	if flags&parquetHasValue != 0 {
+		row[6] = readBytes()
+	}
+	return row, p
+}
+
+// writeParquet writes the rows of all records as a single parquet file.
+func (cmd *cmdDecode) writeParquet(opipe <-chan string, writer *bufio.Writer) {
+	w, err := parquet.NewWriter(writer, parquetColumns)
+	if err != nil {
+		log.PanicError(err, "create parquet writer failed")
+	}
+	for s := range opipe {
+		p := []byte(s)
+		for len(p) != 0 {
+			var row []interface{}
+			row, p = parseParquetRow(p)
+			if err := w.Write(row...); err != nil {
+				log.PanicError(err, "write parquet row failed")
+			}
+		}
+		cmd.wbytes.Set(w.Offset())
+	}
+	if err := w.Close(); err != nil {
+		log.PanicError(err, "write parquet footer failed")
+	}
+	cmd.wbytes.Set(w.Offset())
+	flushWriter(writer)
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+var (
+	pipelineSize = 1
+	pipelineMode = pipelineContinue
+)
+
+// pipelineError describes what to do when a command inside a pipelined batch
+// of RESTOREs fails, see --pipeline-error.
+type pipelineError int
+
+const (
+	// pipelineContinue receives every reply of the batch, failed keys are
+	// collected and reported one by one.
+	pipelineContinue pipelineError = iota
+	// pipelineAbort stops at the first failure, the failed keys of the batch
+	// are retried individually and a failure that persists aborts the restore.
+	pipelineAbort
+)
+
+func parsePipelineError(s string) (pipelineError, error) {
+	switch s {
+	case "continue":
+		return pipelineContinue, nil
+	case "abort":
+		return pipelineAbort, nil
+	}
+	return 0, errors.Errorf("invalid pipeline error mode '%s', should be continue or abort", s)
+}
+
+// keyError is the failure of restoring a single key.
+type keyError struct {
+	Key []byte
+	Err error
+}
+
+// restorePipeline sends up to size RESTOREs before reading the replies.
+// Replies already queued on the connection are lost by redigo's Do, so Flush
+// must be called before using the connection for anything else.
+type restorePipeline struct {
+	c    redigo.Conn
+	size int
+	mode pipelineError
+
+	batch []*rdb.BinEntry
+}
+
+func newRestorePipeline(c redigo.Conn, size int, mode pipelineError) *restorePipeline {
+	return &restorePipeline{c: c, size: size, mode: mode}
+}
+
+// Restore queues the entry and sends the batch once it is full.
+func (p *restorePipeline) Restore(e *rdb.BinEntry) []*keyError {
+	if err := p.c.Send(restoreCmd, restoreArgs(e)...); err != nil {
+		log.PanicErrorf(err, "send %s key '%s' failed", restoreCmd, e.Key)
+	}
+	p.batch = append(p.batch, e)
+	if len(p.batch) < p.size {
+		return nil
+	}
+	return p.Flush()
+}
+
+// Flush sends the queued RESTOREs and reads all their replies, it returns the
+// keys that failed for good.
+func (p *restorePipeline) Flush() []*keyError {
+	if len(p.batch) == 0 {
+		return nil
+	}
+	batch := p.batch
+	p.batch = nil
+	if err := p.c.Flush(); err != nil {
+		log.PanicError(err, "flush pipeline failed")
+	}
+	var failed []*keyError
+	for _, e := range batch {
+		// replies of the whole batch must be read even when aborting, since
+		// the commands have already been sent.
+		if _, err := p.c.Receive(); err != nil {
+			if _, ok := err.(redigo.Error); !ok {
+				log.PanicErrorf(err, "receive %s key '%s' failed", restoreCmd, e.Key)
+			}
+			failed = append(failed, &keyError{Key: e.Key, Err: err})
+			if p.mode == pipelineAbort {
+				log.Warnf("pipeline: %s key '%s' failed: %s, abort the batch", restoreCmd, e.Key, err)
+			}
+		}
+	}
+	if p.mode == pipelineContinue || len(failed) == 0 {
+		return failed
+	}
+	return p.retry(batch, failed)
+}
+
+// Report logs every failed key, in abort mode a key that failed again when
+// retried alone stops the restore.
+func (p *restorePipeline) Report(errs []*keyError) {
+	reportKeyErrors(p.mode, errs)
+}
+
+func reportKeyErrors(mode pipelineError, errs []*keyError) {
+	for _, e := range errs {
+		if mode == pipelineAbort {
+			log.PanicErrorf(e.Err, "restore error, when '%s' '%s'", restoreCmd, e.Key)
+		}
+		log.Warnf("restore error, when '%s' '%s': %s", restoreCmd, e.Key, e.Err)
+	}
+}
+
+// retry restores the failed keys of a batch one by one.
+func (p *restorePipeline) retry(batch []*rdb.BinEntry, failed []*keyError) []*keyError {
+	entries := make(map[string]*rdb.BinEntry, len(batch))
+	for _, e := range batch {
+		entries[string(e.Key)] = e
+	}
+	var errs []*keyError
+	for _, f := range failed {
+		e := entries[string(f.Key)]
+		if _, err := p.c.Do(restoreCmd, restoreArgs(e)...); err != nil {
+			errs = append(errs, &keyError{Key: e.Key, Err: err})
+		}
+	}
+	return errs
+}
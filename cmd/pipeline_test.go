@@ -0,0 +1,88 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+// fakeConn fails RESTORE of the keys in fail, retries with Do succeed unless
+// the key is also in failAgain.
+type fakeConn struct {
+	fail, failAgain map[string]bool
+
+	sent, done []string
+	replies    []error
+}
+
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Err() error   { return nil }
+func (c *fakeConn) Flush() error { return nil }
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	key := string(args[0].([]byte))
+	c.sent = append(c.sent, key)
+	if c.fail[key] {
+		c.replies = append(c.replies, redigo.Error("BUSYKEY Target key name already exists."))
+	} else {
+		c.replies = append(c.replies, nil)
+	}
+	return nil
+}
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	err := c.replies[0]
+	c.replies = c.replies[1:]
+	if err != nil {
+		return nil, err
+	}
+	return "OK", nil
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	key := string(args[0].([]byte))
+	c.done = append(c.done, key)
+	if c.failAgain[key] {
+		return nil, redigo.Error("ERR Bad data format")
+	}
+	return "OK", nil
+}
+
+func testPipeline(mode pipelineError, fail, failAgain string) (*fakeConn, []*keyError) {
+	set := func(s string) map[string]bool {
+		m := make(map[string]bool)
+		for _, k := range strings.Split(s, ",") {
+			m[k] = true
+		}
+		return m
+	}
+	c := &fakeConn{fail: set(fail), failAgain: set(failAgain)}
+	p := newRestorePipeline(c, 4, mode)
+	var errs []*keyError
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		errs = append(errs, p.Restore(&rdb.BinEntry{Key: []byte(k)})...)
+	}
+	errs = append(errs, p.Flush()...)
+	assert.Must(strings.Join(c.sent, ",") == "a,b,c,d,e")
+	assert.Must(len(c.replies) == 0)
+	return c, errs
+}
+
+func TestPipelineContinue(t *testing.T) {
+	c, errs := testPipeline(pipelineContinue, "b,c", "")
+	assert.Must(len(errs) == 2)
+	assert.Must(string(errs[0].Key) == "b" && string(errs[1].Key) == "c")
+	assert.Must(len(c.done) == 0)
+}
+
+func TestPipelineAbort(t *testing.T) {
+	c, errs := testPipeline(pipelineAbort, "b,c,e", "c")
+	assert.Must(strings.Join(c.done, ",") == "b,c,e")
+	assert.Must(len(errs) == 1 && string(errs[0].Key) == "c")
+}
@@ -0,0 +1,170 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"strings"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// clusterSampleKeys is the number of keys of the source the preflight of
+// --target-cluster maps to slots.
+const clusterSampleKeys = 10000
+
+// clusterCoverage is what the preflight of --target-cluster found: slots no
+// master serves, slots of masters not answering PING, and how many of the
+// sampled keys fall in them.
+type clusterCoverage struct {
+	unassigned, unreachable int
+	down                    []string
+
+	nkeys, nmissed int
+}
+
+func (c *clusterCoverage) Complete() bool {
+	return c.unassigned == 0 && c.unreachable == 0
+}
+
+// SlotPercent is the percentage of the slots served by a reachable master.
+func (c *clusterCoverage) SlotPercent() float64 {
+	return float64(clusterSlots-c.unassigned-c.unreachable) * 100 / clusterSlots
+}
+
+// KeyPercent is the percentage of the sampled keys in those slots.
+func (c *clusterCoverage) KeyPercent() float64 {
+	if c.nkeys == 0 {
+		return 100
+	}
+	return float64(c.nkeys-c.nmissed) * 100 / float64(c.nkeys)
+}
+
+// Coverage sends PING to every master of the slot map, and maps the keys to
+// the slots served by the masters that answered.
+func (cl *cluster) Coverage(keys [][]byte) *clusterCoverage {
+	cov := &clusterCoverage{nkeys: len(keys)}
+	down := make(map[string]bool)
+	for _, addr := range cl.Masters() {
+		if err := cl.probe(addr); err != nil {
+			log.WarnErrorf(err, "cluster: master '%s' is not reachable", addr)
+			down[addr] = true
+			cov.down = append(cov.down, addr)
+		}
+	}
+	for i := 0; i < clusterSlots; i++ {
+		switch addr := cl.Master(i); {
+		case addr == "":
+			cov.unassigned++
+		case down[addr]:
+			cov.unreachable++
+		}
+	}
+	for _, key := range keys {
+		if addr := cl.Master(keySlot(key)); addr == "" || down[addr] {
+			cov.nmissed++
+		}
+	}
+	return cov
+}
+
+// initTargetCluster loads the slot map of --target-cluster and checks it
+// before anything is written: writes to a slot no reachable master serves
+// would be lost. keys, a sample of the keys to be written, are mapped to
+// slots for the report. An incomplete coverage aborts, unless --force.
+func initTargetCluster(keys [][]byte) {
+	cl := args.cluster
+	if err := cl.Refresh(); err != nil {
+		log.PanicError(err, "load target cluster slots failed")
+	}
+	cov := cl.Coverage(keys)
+	log.Infof("target cluster = %s\n", strings.Join(cl.Masters(), ","))
+	log.Infof("target cluster slot coverage = %.2f%%, unassigned = %d, unreachable = %d\n", cov.SlotPercent(), cov.unassigned, cov.unreachable)
+	if cov.nkeys != 0 {
+		log.Infof("target cluster key coverage = %.2f%% of %d sampled keys\n", cov.KeyPercent(), cov.nkeys)
+	}
+	if cov.Complete() {
+		return
+	}
+	if args.force {
+		log.Warnf("target cluster coverage is incomplete, %d sampled keys not covered, go on because of --force", cov.nmissed)
+		return
+	}
+	log.Panicf("target cluster coverage is incomplete: %d slots not served by any master, %d served by unreachable masters [%s], use --force to go on anyway",
+		cov.unassigned, cov.unreachable, strings.Join(cov.down, ","))
+}
+
+// sampleKey returns the key an accepted entry is written to, or nil.
+func sampleKey(db uint32, key []byte) []byte {
+	if !acceptDB(db) || !acceptKey(key) || skipKey(key) {
+		return nil
+	}
+	if hash, _ := collapseKey(key); hash != nil {
+		return hash
+	}
+	return rewriteKey(key)
+}
+
+// sampleInputKeys reads the keys of the first entries of the input rdb. The
+// input is read again by the restore, stdin can't be sampled.
+func sampleInputKeys(input string) [][]byte {
+	if isStdio(input) {
+		return nil
+	}
+	f, _ := openInputFile(input)
+	defer f.Close()
+	l := rdb.NewLoader(bufio.NewReaderSize(f, ReaderBufferSize))
+	if err := l.Header(); err != nil {
+		log.PanicError(err, "parse rdb header error")
+	}
+	var keys [][]byte
+	for len(keys) < clusterSampleKeys {
+		e, err := l.NextBinEntry()
+		if err != nil {
+			log.WarnErrorf(err, "sample keys of '%s' stopped", input)
+			break
+		}
+		if e == nil {
+			break
+		}
+		if key := sampleKey(e.DB, e.Key); key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// sampleSourceKeys picks keys of db 0 of the master by RANDOMKEY, the only
+// db a cluster has.
+func sampleSourceKeys(master, passwd string) [][]byte {
+	if !acceptDB(0) {
+		return nil
+	}
+	c := openSourceRedisConn(master, passwd)
+	defer c.Close()
+	for i := 0; i < clusterSampleKeys; i++ {
+		if err := c.Send("randomkey"); err != nil {
+			log.PanicError(err, "send randomkey failed")
+		}
+	}
+	if err := c.Flush(); err != nil {
+		log.PanicError(err, "flush randomkey failed")
+	}
+	var keys [][]byte
+	for i := 0; i < clusterSampleKeys; i++ {
+		key, err := redigo.Bytes(c.Receive())
+		if err != nil {
+			if err != redigo.ErrNil {
+				log.WarnErrorf(err, "sample keys of '%s' failed", master)
+			}
+			break
+		}
+		if key = sampleKey(0, key); key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
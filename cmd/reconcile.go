@@ -0,0 +1,315 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// reconciler periodically samples random keys on both sides of a sync and
+// repairs the target when they diverge. The live command stream keeps being
+// applied meanwhile, so a key written between the reads may be reported as
+// mismatched. A repair only goes ahead if the source still holds the value
+// dumped and the target the value compared, see repairScript, the key is
+// skipped until the next round otherwise. Streams and modules can't be
+// compared, they are only restored when missing on the target.
+type reconciler struct {
+	from, passwd string
+	target, auth string
+
+	nround, nchecked, nmissing, nmismatch, nextra, nrepaired, nskipped, nfailed atomic2.Int64
+}
+
+// repairScript deletes KEYS[1] on the target and restores it with ARGV[2..4]
+// as restoreCmd, ttl and payload, only if it still holds the dump ARGV[1],
+// empty for a missing key. It returns 0 when the key changed meanwhile.
+const repairScript = `
+local v = redis.call('dump', KEYS[1]) or ''
+if v ~= ARGV[1] then
+	return 0
+end
+redis.call('del', KEYS[1])
+if #ARGV > 1 then
+	redis.call(ARGV[2], KEYS[1], ARGV[3], ARGV[4])
+end
+return 1`
+
+func (r *reconciler) Run(interval time.Duration, sample int) {
+	for {
+		time.Sleep(interval)
+		r.round(sample)
+		log.Infof("reconcile: round=%d checked=%d missing=%d mismatch=%d extra=%d repaired=%d skipped=%d failed=%d",
+			r.nround.Get(), r.nchecked.Get(), r.nmissing.Get(), r.nmismatch.Get(), r.nextra.Get(), r.nrepaired.Get(), r.nskipped.Get(), r.nfailed.Get())
+	}
+}
+
+func (r *reconciler) round(sample int) {
+	defer r.nround.Incr()
+	src := openSourceRedisConn(r.from, r.passwd)
+	defer src.Close()
+	dst := openRedisConn(r.target, r.auth)
+	defer dst.Close()
+
+	dbs, err := keyspaceDBs(src)
+	if err != nil {
+		log.WarnErrorf(err, "reconcile: read source keyspace failed")
+		return
+	}
+	for _, db := range dbs {
+		if !acceptDB(db) {
+			continue
+		}
+		if args.cluster != nil && db != 0 {
+			log.Warnf("reconcile: redis cluster only has db 0, db%d is skipped", db)
+			continue
+		}
+		selectDB(src, db)
+		selectDB(dst, db)
+		for _, key := range randomKeys(src, sample) {
+			if r.accept(key) {
+				r.check(src, dst, key)
+			}
+		}
+		for _, key := range r.targetKeys(dst, sample) {
+			if !r.accept(key) {
+				continue
+			}
+			p, err := redigo.Bytes(dst.Do("dump", key))
+			if err != nil {
+				continue
+			}
+			n, err := redigo.Int(src.Do("exists", key))
+			if err != nil || n != 0 {
+				continue
+			}
+			r.nextra.Incr()
+			r.repair(dst, key, p)
+		}
+	}
+}
+
+// targetKeys picks sample keys of the selected db of the target. The keys of
+// a cluster are spread over its masters, RANDOMKEY only sees those of the
+// master it is sent to, every master is asked for its share of the sample.
+func (r *reconciler) targetKeys(dst redigo.Conn, sample int) [][]byte {
+	if args.cluster == nil {
+		return randomKeys(dst, sample)
+	}
+	masters := args.cluster.Masters()
+	var keys [][]byte
+	for i, addr := range masters {
+		n := sample / len(masters)
+		if i < sample%len(masters) {
+			n++
+		}
+		c := args.cluster.dial(addr)
+		keys = append(keys, randomKeys(c, n)...)
+		c.Close()
+	}
+	return keys
+}
+
+// randomKeys sends RANDOMKEY n times, it stops at the first error, e.g. an
+// empty db.
+func randomKeys(c redigo.Conn, n int) [][]byte {
+	var keys [][]byte
+	for i := 0; i < n; i++ {
+		key, err := redigo.Bytes(c.Do("randomkey"))
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (r *reconciler) accept(key []byte) bool {
+	return acceptKey(key) && !skipKey(key) && !aggregateKey(key) && !set2sortedKey(key) && !sorted2setKey(key)
+}
+
+func (r *reconciler) check(src, dst redigo.Conn, key []byte) {
+	r.nchecked.Incr()
+	p1, err := redigo.Bytes(src.Do("dump", key))
+	if err != nil {
+		return
+	}
+	p2, err := redigo.Bytes(dst.Do("dump", key))
+	switch {
+	case err == redigo.ErrNil:
+		r.nmissing.Incr()
+		p2 = []byte{}
+	case err != nil:
+		r.nfailed.Incr()
+		return
+	case !comparableDump(p1):
+		r.nskipped.Incr()
+		return
+	case sameDump(p1, p2):
+		return
+	default:
+		r.nmismatch.Incr()
+	}
+	ttlms, err := redigo.Int64(src.Do("pttl", key))
+	if err != nil || ttlms == -2 {
+		return
+	}
+	if ttlms < 0 {
+		ttlms = 0
+	}
+	// a write of the source after the dump is on its way in the stream.
+	if p, err := redigo.Bytes(src.Do("dump", key)); err != nil || !bytes.Equal(p, p1) {
+		r.nskipped.Incr()
+		return
+	}
+	r.repair(dst, key, p2, restoreCmd, ttlms, p1)
+}
+
+// repair runs repairScript on the target, the key is deleted if there is no
+// restore to run.
+func (r *reconciler) repair(dst redigo.Conn, key, dump []byte, restore ...interface{}) {
+	argv := append([]interface{}{repairScript, 1, key, dump}, restore...)
+	n, err := redigo.Int(dst.Do("eval", argv...))
+	switch {
+	case err != nil:
+		log.WarnErrorf(err, "reconcile: repair key '%s' failed", key)
+		r.nfailed.Incr()
+	case n == 0:
+		r.nskipped.Incr()
+	default:
+		r.nrepaired.Incr()
+	}
+}
+
+// comparableDump reports whether sameDump can compare the payload, streams
+// and modules can't be decoded to values.
+func comparableDump(p []byte) bool {
+	switch rdb.TypeName(p) {
+	case "stream", "module":
+		return false
+	}
+	return true
+}
+
+// sameDump compares two dump payloads logically, hash and set iteration order
+// differs between instances holding the same data.
+func sameDump(p1, p2 []byte) bool {
+	if bytes.Equal(p1, p2) {
+		return true
+	}
+	o1, err := rdb.DecodeDump(p1)
+	if err != nil {
+		return false
+	}
+	o2, err := rdb.DecodeDump(p2)
+	if err != nil {
+		return false
+	}
+	switch x1 := o1.(type) {
+	case rdb.String:
+		x2, ok := o2.(rdb.String)
+		return ok && bytes.Equal(x1, x2)
+	case rdb.List:
+		x2, ok := o2.(rdb.List)
+		return ok && sameBytesList(x1, x2)
+	case rdb.Set:
+		x2, ok := o2.(rdb.Set)
+		if !ok {
+			return false
+		}
+		sortBytesList(x1)
+		sortBytesList(x2)
+		return sameBytesList(x1, x2)
+	case rdb.Hash:
+		x2, ok := o2.(rdb.Hash)
+		if !ok || len(x1) != len(x2) {
+			return false
+		}
+		sort.Sort(rdb.HSortByField{Hash: x1})
+		sort.Sort(rdb.HSortByField{Hash: x2})
+		for i := range x1 {
+			if !bytes.Equal(x1[i].Field, x2[i].Field) || !bytes.Equal(x1[i].Value, x2[i].Value) {
+				return false
+			}
+		}
+		return true
+	case rdb.ZSet:
+		x2, ok := o2.(rdb.ZSet)
+		if !ok || len(x1) != len(x2) {
+			return false
+		}
+		sort.Sort(rdb.ZSortByMember{ZSet: x1})
+		sort.Sort(rdb.ZSortByMember{ZSet: x2})
+		for i := range x1 {
+			if !bytes.Equal(x1[i].Member, x2[i].Member) || x1[i].Score != x2[i].Score {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func sameBytesList(l1, l2 [][]byte) bool {
+	if len(l1) != len(l2) {
+		return false
+	}
+	for i := range l1 {
+		if !bytes.Equal(l1[i], l2[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+type bytesList [][]byte
+
+func (l bytesList) Len() int {
+	return len(l)
+}
+
+func (l bytesList) Less(i, j int) bool {
+	return bytes.Compare(l[i], l[j]) < 0
+}
+
+func (l bytesList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func sortBytesList(l [][]byte) {
+	sort.Sort(bytesList(l))
+}
+
+// keyspaceDBs returns the non-empty dbs listed by INFO keyspace.
+func keyspaceDBs(c redigo.Conn) ([]uint32, error) {
+	s, err := redigo.String(c.Do("info", "keyspace"))
+	if err != nil {
+		return nil, err
+	}
+	var dbs []uint32
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "db") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		n, err := strconv.ParseUint(line[2:i], 10, 32)
+		if err != nil {
+			continue
+		}
+		dbs = append(dbs, uint32(n))
+	}
+	return dbs, nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+)
+
+func TestReconcileTargetKeys(t *testing.T) {
+	nodes := make(map[string]*fakeNode)
+	for port := int64(1); port <= 3; port++ {
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		nodes[addr] = &fakeNode{addr: addr, port: port, owned: make(map[int]bool), nodes: nodes}
+	}
+	for i := 0; i < clusterSlots; i++ {
+		nodes[fmt.Sprintf("127.0.0.1:%d", i%3+1)].owned[i] = true
+	}
+	cl, err := parseCluster("127.0.0.1:1", "")
+	assert.MustNoError(err)
+	cl.dial = func(addr string) redigo.Conn {
+		return &fakeNodeConn{node: nodes[addr]}
+	}
+	assert.MustNoError(cl.Refresh())
+	args.cluster = cl
+	defer func() {
+		args.cluster = nil
+	}()
+
+	// the sample is split over the masters, the first ones get the rest.
+	count := make(map[string]int)
+	for _, key := range (&reconciler{}).targetKeys(nil, 8) {
+		count[string(key)]++
+	}
+	assert.Must(len(count) == 3)
+	assert.Must(count["127.0.0.1:1"] == 3 && count["127.0.0.1:2"] == 3 && count["127.0.0.1:3"] == 2)
+}
@@ -8,12 +8,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"time"
 
 	"github.com/left2right/redis-port/pkg/libs/atomic2"
 	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
 	"github.com/left2right/redis-port/pkg/redis"
 )
 
@@ -21,6 +21,9 @@ type cmdRestore struct {
 	rbytes, ebytes, nentry, ignore atomic2.Int64
 
 	forward, nbypass atomic2.Int64
+
+	atomic *atomicRestorer
+	nodes  *clusterNodes
 }
 
 type cmdRestoreStat struct {
@@ -46,28 +49,79 @@ func (cmd *cmdRestore) Main() {
 	if len(target) == 0 {
 		log.Panic("invalid argument: target")
 	}
-	if len(input) == 0 {
-		input = "/dev/stdin"
+
+	log.Infof("restore from '%s' to '%s'\n", inputName(input), target)
+
+	if args.cluster != nil {
+		initTargetCluster(sampleInputKeys(input))
 	}
 
-	log.Infof("restore from '%s' to '%s'\n", input, target)
+	if maxBulkLen == 0 {
+		maxBulkLen = detectMaxBulkLen(target, args.auth)
+	}
+	log.Infof("target proto-max-bulk-len = %d\n", maxBulkLen)
+	initTargetVersion(target, args.auth)
+	if args.replace {
+		if restoreCmd != "restore" && restoreCmd != "RESTORE" {
+			log.Panicf("--replace needs '--restorecmd=restore', not '%s'", restoreCmd)
+		}
+		if targetVersion.major != 0 && !targetHas("REPLACE") {
+			log.Panicf("--replace needs redis 3.0+, target version is %s", targetVersion)
+		}
+	}
+	if args.extra && args.inputOffset != 0 {
+		log.Panic("--extra can't be used with --input-offset")
+	}
+	initCheckpoint("restore")
+	confirmTarget("restore", inputName(input))
+	if args.flushTarget {
+		flushTarget()
+	}
 
 	var readin io.ReadCloser
 	var nsize int64
-	if input != "/dev/stdin" {
-		readin, nsize = openReadFile(input)
+	if !isStdio(input) {
+		readin, nsize = openInputFile(input)
 		defer readin.Close()
 	} else {
+		if args.inputOffset != 0 {
+			log.Panic("--input-offset needs --input")
+		}
 		readin, nsize = os.Stdin, 0
 	}
 
 	reader := bufio.NewReaderSize(readin, ReaderBufferSize)
 
+	if len(args.metricsAddr) != 0 {
+		cmd.exportMetrics(nsize)
+		serveMetrics(args.metricsAddr)
+	}
+
+	if args.atomicGroup {
+		if restoreCmd == "del" || restoreCmd == "DEL" {
+			log.Panic("--atomic-group can't be used with '--restorecmd=del'")
+		}
+		if args.cluster != nil {
+			log.Panic("--atomic-group can't be used with --target-cluster")
+		}
+		cmd.atomic = newAtomicRestorer()
+	}
+
 	cmd.RestoreRDBFile(reader, target, args.auth, nsize)
+	if writeCheckpoint("restore") {
+		return
+	}
 
 	if !args.extra {
 		return
 	}
+	go func() {
+		// the whole rdb is restored, a signal during the commands ends the
+		// restore there, they are replayed from the first one on resume.
+		<-loaderStop
+		writeCheckpoint("restore")
+		os.Exit(0)
+	}()
 
 	if nsize != 0 && nsize == cmd.rbytes.Get() {
 		return
@@ -76,39 +130,102 @@ func (cmd *cmdRestore) Main() {
 	cmd.RestoreCommand(reader, target, args.auth)
 }
 
+// groupOf returns the --atomic-group of the entry, entries that need to be
+// transformed or chunked are never grouped.
+func (cmd *cmdRestore) groupOf(e *rdb.BinEntry) []byte {
+	if cmd.atomic == nil || aggregateKey(e.Key) || set2sortedKey(e.Key) || sorted2setKey(e.Key) || rebuilt(e.Value) {
+		return nil
+	}
+	return atomicGroup(e.Key)
+}
+
+// pipelined tells whether the entry can be restored by a single RESTORE
+// inside a --pipeline batch.
+func (cmd *cmdRestore) pipelined(e *rdb.BinEntry) bool {
+	if restoreCmd == "del" || restoreCmd == "DEL" {
+		return false
+	}
+	return !aggregateKey(e.Key) && !set2sortedKey(e.Key) && !sorted2setKey(e.Key) && !rebuilt(e.Value)
+}
+
 func (cmd *cmdRestore) RestoreRDBFile(reader *bufio.Reader, target, passwd string, nsize int64) {
+	if args.cluster != nil && pipelineSize > 1 {
+		cmd.nodes = newClusterNodes()
+	}
 	pipe := newRDBLoader(reader, &cmd.rbytes, args.parallel*32)
+	if args.resumeFromKey != nil {
+		pipe = cmd.resumeFrom(pipe, args.resumeFromKey)
+	}
 	wait := make(chan struct{})
 	go func() {
 		defer close(wait)
-		group := make(chan int, args.parallel)
-		for i := 0; i < cap(group); i++ {
-			go func() {
-				defer func() {
-					group <- 0
-				}()
-				c := openRedisConn(target, passwd)
-				defer c.Close()
-				var lastdb uint32 = 0
-				for e := range pipe {
-					if !acceptDB(e.DB) || !acceptKey(e.Key) {
-						cmd.ignore.Incr()
-					} else if skipKey(e.Key) {
-                        			log.Warnf("restore skip key: %s", e.Key)
-                        			cmd.ignore.Incr()
-                    			} else {
-						cmd.nentry.Incr()
-						if e.DB != lastdb {
-							lastdb = e.DB
-							selectDB(c, lastdb)
-						}
-						restoreRdbEntry(c, e)
+		runWorkers(pipe, &cmd.nentry, func(stop <-chan struct{}) {
+			c := openRedisConn(target, passwd)
+			defer c.Close()
+			var lastdb uint32 = baseTargetDB()
+			var pl entryPipeline
+			if cmd.nodes != nil {
+				cb := newClusterBatcher(args.cluster, pipelineSize, pipelineMode, cmd.nodes)
+				defer cb.Close()
+				pl = cb
+			} else if pipelineSize > 1 {
+				pl = newRestorePipeline(c, pipelineSize, pipelineMode)
+			}
+			flush := func() {
+				if pl != nil {
+					pl.Report(pl.Flush())
+				}
+			}
+			defer flush()
+			for e, ok := nextEntry(pipe, stop); ok; e, ok = nextEntry(pipe, stop) {
+				if !acceptDB(e.DB) || !acceptKey(e.Key) {
+					cmd.ignore.Incr()
+					continue
+				}
+				if skipKey(e.Key) {
+					log.Warnf("restore skip key: %s", e.Key)
+					cmd.ignore.Incr()
+					continue
+				}
+				qpsLimit.Wait(1)
+				countEntryType(e)
+				rewriteEntry(e)
+				if rdb.IsEmptyObject(e.Value) {
+					log.Warnf("restore skip empty aggregate key: %s", e.Key)
+					cmd.ignore.Incr()
+				} else if hash, field := collapseKey(e.Key); hash != nil && rdb.TypeName(e.Value) == "string" {
+					cmd.nentry.Incr()
+					flush()
+					if e.DB != lastdb {
+						lastdb = e.DB
+						selectDB(c, lastdb)
+					}
+					restoreCollapsed(c, e, hash, field)
+				} else if g := cmd.groupOf(e); g != nil {
+					cmd.nentry.Incr()
+					cmd.atomic.Add(g, e)
+				} else {
+					cmd.nentry.Incr()
+					if e.DB != lastdb || !cmd.pipelined(e) {
+						flush()
+					}
+					if e.DB != lastdb {
+						lastdb = e.DB
+						selectDB(c, lastdb)
+					}
+					if pl != nil && cmd.pipelined(e) {
+						pl.Report(pl.Restore(e))
+					} else if err := restoreRdbEntry(c, e); err != nil {
+						log.PanicError(err, "restore command error")
 					}
 				}
-			}()
-		}
-		for i := 0; i < cap(group); i++ {
-			<-group
+			}
+		})
+		if cmd.atomic != nil {
+			c := openRedisConn(target, passwd)
+			defer c.Close()
+			ngroup, nfailed := cmd.atomic.Restore(c)
+			log.Infof("restore: %d atomic groups, %d failed", ngroup, nfailed)
 		}
 	}()
 
@@ -119,6 +236,17 @@ func (cmd *cmdRestore) RestoreRDBFile(reader *bufio.Reader, target, passwd strin
 		case <-time.After(time.Second):
 		}
 		stat := cmd.Stat()
+		if statJSON() {
+			fields := map[string]interface{}{
+				"total": nsize, "rbytes": stat.rbytes, "entry": stat.nentry, "ignore": stat.ignore,
+				"throttle": throttleCounts(),
+			}
+			if cmd.nodes != nil {
+				fields["nodes"] = cmd.nodes.Counts()
+			}
+			logStat("restore", fields)
+			continue
+		}
 		var b bytes.Buffer
 		if nsize != 0 {
 			fmt.Fprintf(&b, "total = %d - %12d [%3d%%]", nsize, stat.rbytes, 100*stat.rbytes/nsize)
@@ -129,25 +257,54 @@ func (cmd *cmdRestore) RestoreRDBFile(reader *bufio.Reader, target, passwd strin
 		if stat.ignore != 0 {
 			fmt.Fprintf(&b, "  ignore=%-12d", stat.ignore)
 		}
+		b.WriteString(throttleStat())
+		if cmd.nodes != nil {
+			b.WriteString(cmd.nodes.Stat())
+		}
 		log.Info(b.String())
 	}
-	log.Info("restore: rdb done")
+	if loadersStopped() {
+		log.Infof("restore: rdb stopped after %d entries", loadPos.entries.Get())
+	} else {
+		log.Info("restore: rdb done")
+	}
+	if cmd.nodes != nil {
+		cmd.nodes.Report()
+	}
+}
+
+// resumeFrom drops the entries loaded before the first one named key, in any
+// db, see --resume-from-key. They are counted as ignored.
+func (cmd *cmdRestore) resumeFrom(pipe chan *rdb.BinEntry, key []byte) chan *rdb.BinEntry {
+	resumed := make(chan *rdb.BinEntry, cap(pipe))
+	go func() {
+		defer close(resumed)
+		var found bool
+		for e := range pipe {
+			if !found {
+				if !bytes.Equal(e.Key, key) {
+					cmd.ignore.Incr()
+					continue
+				}
+				found = true
+				log.Infof("restore: resume from key '%s' in db %d, %d entries skipped", key, e.DB, cmd.ignore.Get())
+			}
+			resumed <- e
+		}
+		if !found {
+			log.Warnf("restore: key '%s' of --resume-from-key not found, nothing restored", key)
+		}
+	}()
+	return resumed
 }
 
 func (cmd *cmdRestore) RestoreCommand(reader *bufio.Reader, target, passwd string) {
-	c := openNetConn(target, passwd)
+	c := openTargetStream(target, passwd)
 	defer c.Close()
 
 	writer := bufio.NewWriterSize(c, WriterBufferSize)
 	defer flushWriter(writer)
 
-	go func() {
-		p := make([]byte, ReaderBufferSize)
-		for {
-			iocopy(c, ioutil.Discard, p, len(p))
-		}
-	}()
-
 	go func() {
 		var bypass bool = false
 		for {
@@ -173,7 +330,7 @@ func (cmd *cmdRestore) RestoreCommand(reader *bufio.Reader, target, passwd strin
                     			continue
                 		}
                                
-				if bypass || (len(args) > 0 && !acceptKey(args[0])) {
+				if bypass || !acceptCommand(scmd, args) {
 					cmd.nbypass.Incr()
 					continue
 				}
@@ -189,7 +346,16 @@ func (cmd *cmdRestore) RestoreCommand(reader *bufio.Reader, target, passwd strin
 	                    }
                     }
                 }
+				if l := collapseCommand(scmd, args); l != nil {
+					for _, r := range l[:len(l)-1] {
+						redis.MustEncode(writer, r)
+					}
+					resp = l[len(l)-1]
+				} else {
+					resp = rewriteCommand(resp, scmd, args)
+				}
 			}
+			qpsLimit.Wait(1)
 			cmd.forward.Incr()
 			redis.MustEncode(writer, resp)
 			flushWriter(writer)
@@ -199,10 +365,20 @@ func (cmd *cmdRestore) RestoreCommand(reader *bufio.Reader, target, passwd strin
 	for lstat := cmd.Stat(); ; {
 		time.Sleep(time.Second)
 		nstat := cmd.Stat()
+		if statJSON() {
+			logStat("restore", map[string]interface{}{
+				"forward": nstat.forward, "nbypass": nstat.nbypass,
+				"+forward": nstat.forward - lstat.forward, "+nbypass": nstat.nbypass - lstat.nbypass,
+				"throttle": throttleCounts(),
+			})
+			lstat = nstat
+			continue
+		}
 		var b bytes.Buffer
 		fmt.Fprintf(&b, "restore: ")
 		fmt.Fprintf(&b, " +forward=%-6d", nstat.forward-lstat.forward)
 		fmt.Fprintf(&b, " +nbypass=%-6d", nstat.nbypass-lstat.nbypass)
+		b.WriteString(throttleStat())
 		log.Info(b.String())
 		lstat = nstat
 	}
@@ -0,0 +1,71 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/libs/atomic2"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+func newResumePipe(n int) chan *rdb.BinEntry {
+	pipe := make(chan *rdb.BinEntry, n)
+	for i := 0; i < n; i++ {
+		pipe <- &rdb.BinEntry{DB: uint32(i % 2), Key: []byte(fmt.Sprintf("k%d", i%(n/2)))}
+	}
+	close(pipe)
+	return pipe
+}
+
+func TestRestoreResumeFrom(t *testing.T) {
+	// k3 is in db 1 first, then again in db 0, only the first one resumes.
+	cmd := &cmdRestore{}
+	var keys []string
+	for e := range cmd.resumeFrom(newResumePipe(10), []byte("k3")) {
+		keys = append(keys, fmt.Sprintf("%d:%s", e.DB, e.Key))
+	}
+	assert.Must(fmt.Sprint(keys) == "[1:k3 0:k4 1:k0 0:k1 1:k2 0:k3 1:k4]")
+	assert.Must(cmd.ignore.Get() == 3)
+
+	cmd = &cmdRestore{}
+	for range cmd.resumeFrom(newResumePipe(10), []byte("k5")) {
+		assert.Must(false)
+	}
+	assert.Must(cmd.ignore.Get() == 10)
+}
+
+// TestRestoreResumeFromParallel drains the entries by the --parallel routines,
+// the entries after the key are restored once each whatever routine gets them.
+func TestRestoreResumeFromParallel(t *testing.T) {
+	parallel := args.parallel
+	args.parallel = 4
+	defer func() {
+		args.parallel = parallel
+	}()
+
+	cmd := &cmdRestore{}
+	pipe := cmd.resumeFrom(newResumePipe(200), []byte("k50"))
+	var mu sync.Mutex
+	var keys []string
+	runWorkers(pipe, &atomic2.Int64{}, func(stop <-chan struct{}) {
+		for e := range pipe {
+			mu.Lock()
+			keys = append(keys, fmt.Sprintf("%d:%s", e.DB, e.Key))
+			mu.Unlock()
+		}
+	})
+	var want []string
+	for i := 50; i < 200; i++ {
+		want = append(want, fmt.Sprintf("%d:k%d", i%2, i%100))
+	}
+	sort.Strings(keys)
+	sort.Strings(want)
+	assert.Must(fmt.Sprint(keys) == fmt.Sprint(want))
+	assert.Must(cmd.ignore.Get() == 50)
+}
@@ -0,0 +1,240 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+	"github.com/left2right/redis-port/pkg/redis"
+)
+
+// renamePrefix is --rename-prefix=OLD:NEW, keys starting with OLD get NEW
+// instead, other keys are left as they are.
+type renamePrefix struct {
+	from, to []byte
+}
+
+// parseRenamePrefix splits OLD:NEW at the first ':' that is not escaped as
+// '\:', so prefixes may hold colons, e.g. 'app\:1\::app\:2\:'.
+func parseRenamePrefix(s string) (*renamePrefix, error) {
+	var parts [2][]byte
+	var n int
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && (s[i+1] == ':' || s[i+1] == '\\'):
+			i++
+			parts[n] = append(parts[n], s[i])
+		case c == ':' && n == 0:
+			n++
+		default:
+			parts[n] = append(parts[n], c)
+		}
+	}
+	if n == 0 || len(parts[0]) == 0 {
+		return nil, errors.Errorf("invalid rename prefix '%s', should be OLD:NEW", s)
+	}
+	return &renamePrefix{from: parts[0], to: parts[1]}, nil
+}
+
+func (r *renamePrefix) Rename(key []byte) []byte {
+	if !bytes.HasPrefix(key, r.from) {
+		return key
+	}
+	return append(append([]byte{}, r.to...), key[len(r.from):]...)
+}
+
+// rewriting reports whether keys are renamed or moved to another db on their
+// way to the target, see rewriteEntry and rewriteCommand.
+func rewriting() bool {
+	return args.renamePrefix != nil || args.targetDB >= 0
+}
+
+// rewriteKey renames the key, but for keys of --collapse-pattern,
+// --aggregatekeys, --set2sortedkeys and --sorted2setkeys, which are turned
+// into other keys by their own rules.
+func rewriteKey(key []byte) []byte {
+	if args.renamePrefix == nil {
+		return key
+	}
+	if aggregateKey(key) || set2sortedKey(key) || sorted2setKey(key) {
+		return key
+	}
+	if hash, _ := collapseKey(key); hash != nil {
+		return key
+	}
+	return args.renamePrefix.Rename(key)
+}
+
+func rewriteDB(db uint32) uint32 {
+	if args.targetDB < 0 {
+		return db
+	}
+	return uint32(args.targetDB)
+}
+
+// rewriteEntry applies --rename-prefix and --target-db to an rdb entry that
+// passed the filters, which always see the names of the source.
+func rewriteEntry(e *rdb.BinEntry) {
+	e.Key = rewriteKey(e.Key)
+	e.DB = rewriteDB(e.DB)
+}
+
+// keylessCommands have no key arguments.
+var keylessCommands = map[string]bool{
+	"select": true, "flushall": true, "flushdb": true, "swapdb": true,
+	"multi": true, "exec": true, "discard": true, "ping": true,
+	"publish": true, "script": true, "function": true,
+}
+
+// dbCommands act on whole dbs of the target.
+var dbCommands = map[string]bool{
+	"flushall": true, "flushdb": true, "swapdb": true,
+}
+
+// crossDBCommands act on all the dbs or on the dbs of their arguments, not on
+// the one selected.
+var crossDBCommands = map[string]bool{
+	"flushall": true, "swapdb": true,
+}
+
+// acceptCrossDB reports whether FLUSHALL or SWAPDB of the stream passes the db
+// filter, whatever db is selected: FLUSHALL always does, it empties the dbs
+// synced too, SWAPDB only when both of its dbs are synced, a swap with a db
+// not synced can't be applied to the target.
+func acceptCrossDB(cmd string, args [][]byte) bool {
+	if cmd == "flushall" {
+		return true
+	}
+	if len(args) != 2 {
+		return false
+	}
+	var n int
+	for _, a := range args {
+		db, err := parseInt(string(a), MinDB, MaxDB)
+		if err != nil {
+			return false
+		}
+		if acceptDB(uint32(db)) {
+			n++
+		}
+	}
+	if n == 1 {
+		log.Warnf("bypass swapdb %s %s, only one of the dbs is synced", args[0], args[1])
+	}
+	return n == 2
+}
+
+var scriptCommands = map[string]bool{
+	"eval": true, "evalsha": true, "eval_ro": true, "evalsha_ro": true, "fcall": true, "fcall_ro": true,
+}
+
+// subsetting reports whether the target gets a part of the source only, with
+// --filter-key or --filter-db, or gets it in another db with --target-db.
+func subsetting() bool {
+	return args.filterKeys || args.targetDB >= 0
+}
+
+// acceptCommand reports whether a command of the stream passes acceptKey,
+// every key of commandKeys has to as they are all renamed. When subsetting,
+// FLUSHALL, FLUSHDB and SWAPDB are dropped, they would wipe or swap data of
+// the target outside the part synced, and so are scripts without KEYS, the
+// keys they touch are unknown.
+func acceptCommand(cmd string, args [][]byte) bool {
+	keys := commandKeys(cmd, args)
+	if subsetting() && (dbCommands[cmd] || (scriptCommands[cmd] && len(keys) == 0)) {
+		log.Warnf("bypass %s, it may act outside the keys synced", cmd)
+		return false
+	}
+	for _, i := range keys {
+		if !acceptKey(args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// commandKeys returns the indexes of the key arguments of cmd, commands it
+// doesn't know have their key first, as the filters assume.
+func commandKeys(cmd string, args [][]byte) []int {
+	seq := func(from, to int) []int {
+		var l []int
+		for i := from; i < to && i < len(args); i++ {
+			l = append(l, i)
+		}
+		return l
+	}
+	numkeys := func(at int) int {
+		if at >= len(args) {
+			return 0
+		}
+		n, err := strconv.Atoi(string(args[at]))
+		if err != nil {
+			return 0
+		}
+		return n
+	}
+	switch cmd {
+	case "del", "unlink", "exists", "touch", "mget", "watch", "pfcount", "pfmerge",
+		"sinter", "sunion", "sdiff", "sinterstore", "sunionstore", "sdiffstore":
+		return seq(0, len(args))
+	case "mset", "msetnx":
+		var l []int
+		for i := 0; i < len(args); i += 2 {
+			l = append(l, i)
+		}
+		return l
+	case "rename", "renamenx", "rpoplpush", "brpoplpush", "smove", "lmove", "blmove", "copy":
+		return seq(0, 2)
+	case "blpop", "brpop", "bzpopmin", "bzpopmax":
+		return seq(0, len(args)-1)
+	case "bitop":
+		return seq(1, len(args))
+	case "xgroup", "xinfo", "object":
+		return seq(1, 2)
+	case "zunionstore", "zinterstore", "zdiffstore":
+		return append([]int{0}, seq(2, 2+numkeys(1))...)
+	case "eval", "evalsha", "eval_ro", "evalsha_ro", "fcall", "fcall_ro":
+		return seq(2, 2+numkeys(1))
+	}
+	if keylessCommands[cmd] || len(args) == 0 {
+		return nil
+	}
+	return []int{0}
+}
+
+// rewriteCommand applies --rename-prefix to the keys of a command of the
+// stream, and --target-db to SELECT; resp is returned as it is when nothing
+// changes. Scripts only get their KEYS renamed, keys they build themselves
+// are not.
+func rewriteCommand(resp redis.Resp, cmd string, args [][]byte) redis.Resp {
+	if !rewriting() {
+		return resp
+	}
+	argv := make([]interface{}, len(args))
+	for i, a := range args {
+		argv[i] = a
+	}
+	var changed bool
+	if cmd == "select" {
+		if len(args) == 1 {
+			if n, err := strconv.Atoi(string(args[0])); err == nil && n >= 0 {
+				argv[0], changed = rewriteDB(uint32(n)), rewriteDB(uint32(n)) != uint32(n)
+			}
+		}
+	} else {
+		for _, i := range commandKeys(cmd, args) {
+			if key := rewriteKey(args[i]); !bytes.Equal(key, args[i]) {
+				argv[i], changed = key, true
+			}
+		}
+	}
+	if !changed {
+		return resp
+	}
+	return redis.NewCommand(cmd, argv...)
+}
@@ -0,0 +1,165 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func TestParseRenamePrefix(t *testing.T) {
+	docheck := func(s, from, to string) {
+		r, err := parseRenamePrefix(s)
+		assert.MustNoError(err)
+		assert.Must(string(r.from) == from && string(r.to) == to)
+	}
+	docheck("a:b", "a", "b")
+	docheck("a:", "a", "")
+	docheck("a:b:c", "a", "b:c")
+	docheck(`app\:1\::app\:2\:`, "app:1:", "app:2:")
+	docheck(`a\\:b`, `a\`, "b")
+
+	for _, s := range []string{"", "a", ":b", `a\:b`} {
+		_, err := parseRenamePrefix(s)
+		assert.Must(err != nil)
+	}
+
+	r, err := parseRenamePrefix("t1:t2")
+	assert.MustNoError(err)
+	assert.Must(string(r.Rename([]byte("t1:k"))) == "t2:k")
+	assert.Must(string(r.Rename([]byte("t3:k"))) == "t3:k")
+}
+
+func TestCommandKeys(t *testing.T) {
+	docheck := func(cmd string, argv []string, keys ...int) {
+		var args [][]byte
+		for _, s := range argv {
+			args = append(args, []byte(s))
+		}
+		l := commandKeys(cmd, args)
+		assert.Must(len(l) == len(keys))
+		for i := range l {
+			assert.Must(l[i] == keys[i])
+		}
+	}
+	docheck("set", []string{"k", "v"}, 0)
+	docheck("del", []string{"a", "b", "c"}, 0, 1, 2)
+	docheck("mset", []string{"a", "1", "b", "2"}, 0, 2)
+	docheck("rpoplpush", []string{"a", "b"}, 0, 1)
+	docheck("blpop", []string{"a", "b", "0"}, 0, 1)
+	docheck("bitop", []string{"and", "d", "a", "b"}, 1, 2, 3)
+	docheck("zunionstore", []string{"d", "2", "a", "b", "weights", "1", "2"}, 0, 2, 3)
+	docheck("eval", []string{"return 1", "1", "k", "arg"}, 2)
+	docheck("evalsha", []string{"sha", "x"})
+	docheck("select", []string{"1"})
+	docheck("multi", nil)
+}
+
+func TestRewriteCommand(t *testing.T) {
+	r, err := parseRenamePrefix("t1:t2")
+	assert.MustNoError(err)
+	args.renamePrefix, args.targetDB = r, 3
+	defer func() {
+		args.renamePrefix, args.targetDB = nil, -1
+	}()
+
+	// expect is the rewritten command, or empty if it is left as it is.
+	docheck := func(argv []string, expect string) {
+		var x []interface{}
+		for _, s := range argv[1:] {
+			x = append(x, s)
+		}
+		cmd := redis.NewCommand(argv[0], x...)
+		scmd, args, err := redis.ParseArgs(cmd)
+		assert.MustNoError(err)
+		resp := rewriteCommand(cmd, scmd, args)
+		if expect == "" {
+			assert.Must(resp == cmd)
+			return
+		}
+		scmd, args, err = redis.ParseArgs(resp)
+		assert.MustNoError(err)
+		s := scmd
+		for _, a := range args {
+			s += " " + string(a)
+		}
+		assert.Must(s == expect)
+	}
+	docheck([]string{"set", "t1:k", "v"}, "set t2:k v")
+	docheck([]string{"set", "t3:k", "t1:v"}, "")
+	docheck([]string{"mset", "t1:a", "t1:x", "b", "1"}, "mset t2:a t1:x b 1")
+	docheck([]string{"eval", "return 1", "1", "t1:k", "t1:arg"}, "eval return 1 1 t2:k t1:arg")
+	docheck([]string{"select", "0"}, "select 3")
+	docheck([]string{"select", "3"}, "")
+
+	e := &rdb.BinEntry{DB: 1, Key: []byte("t1:k")}
+	rewriteEntry(e)
+	assert.Must(e.DB == 3 && bytes.Equal(e.Key, []byte("t2:k")))
+
+	args.renamePrefix, args.targetDB = nil, -1
+	assert.Must(!rewriting())
+}
+
+func TestAcceptCommand(t *testing.T) {
+	accept := acceptKey
+	args.filterKeys, args.targetDB = true, -1
+	acceptKey = func(key []byte) bool {
+		return bytes.HasPrefix(key, []byte("t1:"))
+	}
+	defer func() {
+		acceptKey, args.filterKeys = accept, false
+	}()
+
+	docheck := func(ok bool, cmd string, argv ...string) {
+		var l [][]byte
+		for _, s := range argv {
+			l = append(l, []byte(s))
+		}
+		assert.Must(acceptCommand(cmd, l) == ok)
+	}
+	docheck(true, "set", "t1:a", "1")
+	docheck(false, "set", "t2:a", "1")
+	docheck(true, "mset", "t1:a", "1", "t1:b", "2")
+	docheck(false, "mset", "t1:a", "1", "t2:b", "2")
+	docheck(false, "del", "t1:a", "t2:b")
+	docheck(true, "eval", "return redis.call('get', KEYS[1])", "1", "t1:a")
+	docheck(false, "eval", "return redis.call('get', KEYS[1])", "1", "t2:a")
+	docheck(false, "eval", "return 1", "0")
+	docheck(true, "select", "2")
+	docheck(true, "publish", "t2:channel", "x")
+	docheck(false, "flushall")
+	docheck(false, "swapdb", "0", "1")
+
+	args.filterKeys = false
+	acceptKey = accept
+	docheck(true, "flushall")
+	docheck(true, "eval", "return 1", "0")
+}
+
+func TestAcceptCrossDB(t *testing.T) {
+	accept := acceptDB
+	acceptDB = func(db uint32) bool {
+		return db == 0 || db == 2
+	}
+	defer func() {
+		acceptDB = accept
+	}()
+	docheck := func(ok bool, cmd string, argv ...string) {
+		var l [][]byte
+		for _, s := range argv {
+			l = append(l, []byte(s))
+		}
+		assert.Must(acceptCrossDB(cmd, l) == ok)
+	}
+	docheck(true, "flushall")
+	docheck(true, "flushall", "async")
+	docheck(true, "swapdb", "0", "2")
+	docheck(false, "swapdb", "0", "1")
+	docheck(false, "swapdb", "1", "3")
+	docheck(false, "swapdb", "x", "2")
+}
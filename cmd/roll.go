@@ -0,0 +1,99 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/libs/stats"
+)
+
+// rollWriter writes the decode output, optionally gzip compressed, and with a
+// limit starts a new file '<output>.00000[.gz]', '<output>.00001[.gz]', ...
+// once limit bytes have been written to the current one. Roll is only called
+// between records so that every file can be read on its own.
+type rollWriter struct {
+	name     string
+	compress bool
+	limit    int64
+
+	index int
+	size  atomic2.Int64
+	f     io.WriteCloser
+	gz    *gzip.Writer
+	w     io.Writer
+}
+
+func newRollWriter(name string, compress bool, limit int64) *rollWriter {
+	w := &rollWriter{name: name, compress: compress, limit: limit}
+	w.open()
+	return w
+}
+
+func (w *rollWriter) open() {
+	name := w.name
+	if w.limit != 0 {
+		name = fmt.Sprintf("%s.%05d", name, w.index)
+	}
+	if w.compress && !isStdio(w.name) {
+		name += ".gz"
+	}
+	if isStdio(w.name) {
+		w.f = os.Stdout
+	} else {
+		w.f = openWriteFile(name)
+		log.Infof("decode: write to '%s'", name)
+	}
+	w.size.Set(0)
+	w.w = stats.NewCountWriter(w.f, &w.size)
+	if w.compress {
+		w.gz = gzip.NewWriter(w.w)
+		w.w = w.gz
+	}
+}
+
+func (w *rollWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// Due reports whether the current file may reach the limit once the pending
+// bytes, still buffered in front of the writer, are written. Compressed
+// output can't tell before the bytes go through gzip, so it's always due.
+func (w *rollWriter) Due(pending int) bool {
+	if w.limit == 0 {
+		return false
+	}
+	return w.compress || w.size.Get()+int64(pending) >= w.limit
+}
+
+// Roll switches to the next file if the current one reached the limit.
+func (w *rollWriter) Roll() error {
+	if w.limit == 0 || w.size.Get() < w.limit {
+		return nil
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	w.index++
+	w.open()
+	return nil
+}
+
+func (w *rollWriter) Close() error {
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if w.f != os.Stdout {
+		return errors.Trace(w.f.Close())
+	}
+	return nil
+}
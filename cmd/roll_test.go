@@ -0,0 +1,46 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+)
+
+func TestRollOnRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll")
+	assert.MustNoError(err)
+	defer os.RemoveAll(dir)
+
+	cmd := &cmdDecode{roll: newRollWriter(filepath.Join(dir, "out"), false, 10)}
+	writer := bufio.NewWriterSize(cmd.roll, WriterBufferSize)
+	for _, s := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddddddddddd\n", "e\n"} {
+		_, err := writer.WriteString(s)
+		assert.MustNoError(err)
+		cmd.flush(writer)
+	}
+	flushWriter(writer)
+	assert.MustNoError(cmd.roll.Close())
+
+	for i, expect := range []string{"aaaa\nbbbb\n", "cccc\ndddddddddddd\n", "e\n"} {
+		p, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("out.%05d", i)))
+		assert.MustNoError(err)
+		assert.Must(string(p) == expect)
+	}
+
+	// records below the limit stay buffered.
+	cmd = &cmdDecode{roll: newRollWriter(filepath.Join(dir, "big"), false, 1<<20)}
+	writer = bufio.NewWriterSize(cmd.roll, WriterBufferSize)
+	writer.WriteString("aaaa\n")
+	cmd.flush(writer)
+	assert.Must(writer.Buffered() == 5)
+	flushWriter(writer)
+	assert.MustNoError(cmd.roll.Close())
+}
@@ -0,0 +1,242 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+	"github.com/left2right/redis-port/pkg/redis"
+)
+
+// cmdServe pretends to be a master: replicas connecting to it are fully
+// resynchronized from the input rdb file, followed by the commands saved after
+// the rdb (see 'dump --extra') and a PING every second.
+type cmdServe struct {
+	input   string
+	runid   string
+	rdbsize int64
+	nsize   int64
+
+	nconn, nfullsync atomic2.Int64
+}
+
+// serveHandshakeTimeout bounds how long a replica may take to send each
+// command before the fullsync, a silent client is disconnected.
+const serveHandshakeTimeout = time.Second * 30
+
+type serveSession struct {
+	addr     string
+	authed   bool
+	fullsync bool
+}
+
+func (cmd *cmdServe) Main() {
+	input, listen := args.input, args.listen
+	if len(input) == 0 {
+		log.Panic("invalid argument: input")
+	}
+	if len(listen) == 0 {
+		log.Panic("invalid argument: listen")
+	}
+
+	log.Infof("serve '%s' as master on '%s'\n", input, listen)
+
+	cmd.input = input
+	cmd.runid = newRunID()
+	cmd.rdbsize, cmd.nsize = cmd.scanRDBFile(input)
+	log.Infof("serve: runid = %s, rdb = %d, extra = %d\n", cmd.runid, cmd.rdbsize, cmd.nsize-cmd.rdbsize)
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.PanicErrorf(err, "cannot listen on '%s'", listen)
+	}
+	defer l.Close()
+
+	s, err := redis.NewServer(&serveHandler{cmd})
+	if err != nil {
+		log.PanicError(err, "create serve handler failed")
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				log.PanicErrorf(err, "accept on '%s' failed", listen)
+			}
+			go cmd.serveConn(s, c)
+		}
+	}()
+
+	for {
+		time.Sleep(time.Second)
+		log.Infof("serve: conn=%d fullsync=%d", cmd.nconn.Get(), cmd.nfullsync.Get())
+	}
+}
+
+// scanRDBFile parses the input once to validate it and to find where the rdb
+// ends and the extra commands begin.
+func (cmd *cmdServe) scanRDBFile(input string) (int64, int64) {
+	f, nsize := openReadFile(input)
+	defer f.Close()
+	l := rdb.NewLoader(bufio.NewReaderSize(f, ReaderBufferSize))
+	if err := l.Header(); err != nil {
+		log.PanicError(err, "parse rdb header error")
+	}
+	for {
+		e, err := l.NextBinEntry()
+		if err != nil {
+			log.PanicError(err, "parse rdb entry error")
+		}
+		if e == nil {
+			break
+		}
+	}
+	if err := l.Footer(); err != nil {
+		log.PanicError(err, "parse rdb checksum error")
+	}
+	return l.Offset(), nsize
+}
+
+func (cmd *cmdServe) serveConn(s *redis.Server, c net.Conn) {
+	defer c.Close()
+	cmd.nconn.Incr()
+	defer cmd.nconn.Decr()
+
+	session := &serveSession{addr: c.RemoteAddr().String(), authed: len(args.auth) == 0}
+	reader := bufio.NewReaderSize(c, 1024)
+	writer := bufio.NewWriterSize(c, WriterBufferSize)
+	for !session.fullsync {
+		c.SetReadDeadline(time.Now().Add(serveHandshakeTimeout))
+		req, err := redis.Decode(reader)
+		if err != nil {
+			log.InfoErrorf(err, "serve: replica '%s' disconnected", session.addr)
+			return
+		}
+		rsp, err := s.Dispatch(session, req)
+		if err != nil {
+			rsp = redis.NewError(err)
+		}
+		if rsp == nil {
+			continue
+		}
+		if err := redis.Encode(writer, rsp, true); err != nil {
+			log.WarnErrorf(err, "serve: write response to '%s' failed", session.addr)
+			return
+		}
+	}
+
+	c.SetReadDeadline(time.Time{})
+
+	cmd.nfullsync.Incr()
+	log.Infof("serve: fullsync '%s'", session.addr)
+
+	go func() {
+		// REPLCONF ACK from the replica are simply discarded.
+		p := make([]byte, 1024)
+		for {
+			if _, err := reader.Read(p); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}()
+
+	if err := cmd.sendRDBFile(writer); err != nil {
+		log.WarnErrorf(err, "serve: send rdb to '%s' failed", session.addr)
+		return
+	}
+	log.Infof("serve: rdb sent to '%s'", session.addr)
+
+	ping := redis.MustEncodeToBytes(redis.NewCommand("ping"))
+	for {
+		if _, err := c.Write(ping); err != nil {
+			log.Infof("serve: replica '%s' disconnected", session.addr)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (cmd *cmdServe) sendRDBFile(writer *bufio.Writer) error {
+	f, _ := openReadFile(cmd.input)
+	defer f.Close()
+	if _, err := fmt.Fprintf(writer, "$%d\r\n", cmd.rdbsize); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := io.Copy(writer, f); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(writer.Flush())
+}
+
+// serveHandler holds the commands a replica may send before the fullsync.
+type serveHandler struct {
+	cmd *cmdServe
+}
+
+func (h *serveHandler) Ping(arg0 interface{}, args ...[]byte) (redis.Resp, error) {
+	return redis.NewString("PONG"), nil
+}
+
+func (h *serveHandler) Auth(arg0 interface{}, argv ...[]byte) (redis.Resp, error) {
+	session := arg0.(*serveSession)
+	if len(argv) == 0 {
+		return nil, errors.Errorf("wrong number of arguments for 'auth' command")
+	}
+	if len(args.auth) == 0 || string(argv[len(argv)-1]) != args.auth {
+		return nil, errors.Errorf("invalid password")
+	}
+	session.authed = true
+	return redis.NewString("OK"), nil
+}
+
+func (h *serveHandler) Replconf(arg0 interface{}, args ...[]byte) (redis.Resp, error) {
+	session := arg0.(*serveSession)
+	if !session.authed {
+		return nil, errors.Errorf("NOAUTH Authentication required.")
+	}
+	if len(args) != 0 && strings.ToLower(string(args[0])) == "ack" {
+		return nil, nil
+	}
+	return redis.NewString("OK"), nil
+}
+
+// Psync always answers with a full resynchronization, the rdb itself is sent
+// by serveConn once the response is flushed.
+func (h *serveHandler) Psync(arg0 interface{}, args ...[]byte) (redis.Resp, error) {
+	session := arg0.(*serveSession)
+	if !session.authed {
+		return nil, errors.Errorf("NOAUTH Authentication required.")
+	}
+	session.fullsync = true
+	return redis.NewString(fmt.Sprintf("FULLRESYNC %s %d", h.cmd.runid, 0)), nil
+}
+
+func (h *serveHandler) Sync(arg0 interface{}, args ...[]byte) (redis.Resp, error) {
+	session := arg0.(*serveSession)
+	if !session.authed {
+		return nil, errors.Errorf("NOAUTH Authentication required.")
+	}
+	session.fullsync = true
+	return nil, nil
+}
+
+func newRunID() string {
+	b := make([]byte, 20)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		log.PanicError(err, "generate runid failed")
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func TestServeConn(t *testing.T) {
+	auth := args.auth
+	args.auth = "secret"
+	defer func() {
+		args.auth = auth
+	}()
+
+	rdbfile := []byte("REDIS0006\xffchecksum")
+	extra := redis.MustEncodeToBytes(redis.NewCommand("set", "k", "v"))
+	f, err := ioutil.TempFile("", "serve")
+	assert.MustNoError(err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(append([]byte(nil), rdbfile...), extra...))
+	assert.MustNoError(err)
+	assert.MustNoError(f.Close())
+
+	cmd := &cmdServe{input: f.Name(), runid: newRunID(), rdbsize: int64(len(rdbfile))}
+	s, err := redis.NewServer(&serveHandler{cmd})
+	assert.MustNoError(err)
+
+	c, x := net.Pipe()
+	defer c.Close()
+	go cmd.serveConn(s, x)
+
+	r := bufio.NewReader(c)
+	call := func(name string, argv ...interface{}) redis.Resp {
+		_, err := c.Write(redis.MustEncodeToBytes(redis.NewCommand(name, argv...)))
+		assert.MustNoError(err)
+		rsp, err := redis.Decode(r)
+		assert.MustNoError(err)
+		return rsp
+	}
+	isString := func(rsp redis.Resp, s string) bool {
+		x, ok := rsp.(*redis.String)
+		return ok && x.Value == s
+	}
+	isError := func(rsp redis.Resp) bool {
+		_, ok := rsp.(*redis.Error)
+		return ok
+	}
+
+	assert.Must(isError(call("replconf", "listening-port", "6380")))
+	assert.Must(isError(call("psync", "?", "-1")))
+	assert.Must(isError(call("auth", "wrong")))
+	assert.Must(isString(call("auth", "secret"), "OK"))
+	assert.Must(isString(call("replconf", "listening-port", "6380"), "OK"))
+
+	_, err = c.Write(redis.MustEncodeToBytes(redis.NewCommand("replconf", "ack", "0")))
+	assert.MustNoError(err)
+	assert.Must(isString(call("ping"), "PONG"))
+
+	assert.Must(isString(call("psync", "?", "-1"), fmt.Sprintf("FULLRESYNC %s 0", cmd.runid)))
+
+	line, err := r.ReadString('\n')
+	assert.MustNoError(err)
+	assert.Must(line == fmt.Sprintf("$%d\r\n", len(rdbfile)))
+	p := make([]byte, len(rdbfile)+len(extra))
+	_, err = io.ReadFull(r, p)
+	assert.MustNoError(err)
+	assert.Must(bytes.Equal(p[:len(rdbfile)], rdbfile))
+	assert.Must(bytes.Equal(p[len(rdbfile):], extra))
+
+	ping, err := redis.AsArray(redis.Decode(r))
+	assert.MustNoError(err)
+	assert.Must(len(ping) == 1)
+}
@@ -0,0 +1,172 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+)
+
+// socks5Dialer connects through a SOCKS5 proxy (RFC 1928), with the
+// username/password method of RFC 1929 when user is set, see --socks5.
+type socks5Dialer struct {
+	proxy          string
+	user, password string
+}
+
+// parseSocks5 parses [USER:PASSWORD@]HOST:PORT.
+func parseSocks5(s string) (*socks5Dialer, error) {
+	d := &socks5Dialer{proxy: s}
+	if i := strings.LastIndex(s, "@"); i != -1 {
+		auth := s[:i]
+		d.proxy = s[i+1:]
+		j := strings.Index(auth, ":")
+		if j == -1 {
+			return nil, errors.Errorf("invalid socks5 auth '%s', should be USER:PASSWORD", auth)
+		}
+		d.user, d.password = auth[:j], auth[j+1:]
+		if len(d.user) == 0 || len(d.user) > 255 || len(d.password) > 255 {
+			return nil, errors.Errorf("invalid socks5 auth, user and password are 1 to 255 bytes")
+		}
+	}
+	if _, _, err := net.SplitHostPort(d.proxy); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return d, nil
+}
+
+const (
+	socks5Version  = 5
+	socks5NoAuth   = 0
+	socks5UserPass = 2
+	socks5NoMethod = 0xff
+	socks5Connect  = 1
+
+	socks5IPv4   = 1
+	socks5Domain = 3
+	socks5IPv6   = 4
+)
+
+var socks5Replies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// Dial connects to addr through the proxy, the returned connection carries
+// the redis protocol as is.
+func (d *socks5Dialer) Dial(addr string) (net.Conn, error) {
+	c, err := net.Dial("tcp", d.proxy)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := d.connect(c, addr); err != nil {
+		c.Close()
+		return nil, errors.Errorf("socks5 proxy '%s': %s", d.proxy, err)
+	}
+	return c, nil
+}
+
+func (d *socks5Dialer) connect(c net.Conn, addr string) error {
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return errors.Errorf("invalid port '%s'", sport)
+	}
+
+	method := byte(socks5NoAuth)
+	if len(d.user) != 0 {
+		method = socks5UserPass
+	}
+	if _, err := c.Write([]byte{socks5Version, 1, method}); err != nil {
+		return errors.Trace(err)
+	}
+	p := make([]byte, 2)
+	if _, err := io.ReadFull(c, p); err != nil {
+		return errors.Trace(err)
+	}
+	if p[0] != socks5Version {
+		return errors.Errorf("unexpected version %d", p[0])
+	}
+	if p[1] != method {
+		return errors.Errorf("authentication method not accepted")
+	}
+	if method == socks5UserPass {
+		b := []byte{1, byte(len(d.user))}
+		b = append(b, d.user...)
+		b = append(b, byte(len(d.password)))
+		b = append(b, d.password...)
+		if _, err := c.Write(b); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := io.ReadFull(c, p); err != nil {
+			return errors.Trace(err)
+		}
+		if p[1] != 0 {
+			return errors.Errorf("authentication failed")
+		}
+	}
+
+	b := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.Errorf("host name '%s' too long", host)
+		}
+		b = append(b, socks5Domain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5IPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5IPv6)
+		b = append(b, ip.To16()...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	if _, err := c.Write(b); err != nil {
+		return errors.Trace(err)
+	}
+
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	p = make([]byte, 4)
+	if _, err := io.ReadFull(c, p); err != nil {
+		return errors.Trace(err)
+	}
+	if p[1] != 0 {
+		if int(p[1]) < len(socks5Replies) {
+			return errors.Errorf("connect to '%s': %s", addr, socks5Replies[p[1]])
+		}
+		return errors.Errorf("connect to '%s': reply %d", addr, p[1])
+	}
+	var n int
+	switch p[3] {
+	case socks5IPv4:
+		n = net.IPv4len
+	case socks5IPv6:
+		n = net.IPv6len
+	case socks5Domain:
+		if _, err := io.ReadFull(c, p[:1]); err != nil {
+			return errors.Trace(err)
+		}
+		n = int(p[0])
+	default:
+		return errors.Errorf("unknown address type %d", p[3])
+	}
+	if _, err := io.ReadFull(c, make([]byte, n+2)); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
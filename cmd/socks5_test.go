@@ -0,0 +1,92 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+)
+
+// serveSocks5 accepts one connection, checks the handshake and answers the
+// CONNECT with reply rep, then echoes what it reads.
+func serveSocks5(l net.Listener, user, password string, rep byte, requested chan<- string) {
+	c, err := l.Accept()
+	assert.MustNoError(err)
+	defer c.Close()
+	p := make([]byte, 3)
+	_, err = io.ReadFull(c, p)
+	assert.MustNoError(err)
+	if len(user) == 0 {
+		assert.Must(bytes.Equal(p, []byte{5, 1, 0}))
+		c.Write([]byte{5, 0})
+	} else {
+		assert.Must(bytes.Equal(p, []byte{5, 1, 2}))
+		c.Write([]byte{5, 2})
+		auth := make([]byte, 3+len(user)+len(password))
+		_, err = io.ReadFull(c, auth)
+		assert.MustNoError(err)
+		assert.Must(string(auth[2:2+len(user)]) == user && string(auth[3+len(user):]) == password)
+		c.Write([]byte{1, 0})
+	}
+	p = make([]byte, 5)
+	_, err = io.ReadFull(c, p)
+	assert.MustNoError(err)
+	assert.Must(bytes.Equal(p[:4], []byte{5, 1, 0, 3}))
+	host := make([]byte, int(p[4])+2)
+	_, err = io.ReadFull(c, host)
+	assert.MustNoError(err)
+	n := len(host) - 2
+	requested <- net.JoinHostPort(string(host[:n]), strconv.Itoa(int(host[n])<<8|int(host[n+1])))
+	c.Write([]byte{5, rep, 0, 1, 127, 0, 0, 1, 0, 1})
+	if rep == 0 {
+		io.Copy(c, c)
+	}
+}
+
+func TestSocks5(t *testing.T) {
+	docheck := func(auth string, rep byte) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.MustNoError(err)
+		defer l.Close()
+		s := l.Addr().String()
+		if len(auth) != 0 {
+			s = auth + "@" + s
+		}
+		d, err := parseSocks5(s)
+		assert.MustNoError(err)
+		requested := make(chan string, 1)
+		go serveSocks5(l, d.user, d.password, rep, requested)
+
+		c, err := d.Dial("redis.internal:6379")
+		assert.Must(<-requested == "redis.internal:6379")
+		if rep != 0 {
+			assert.Must(err != nil)
+			return
+		}
+		assert.MustNoError(err)
+		defer c.Close()
+		_, err = c.Write([]byte("*1\r\n$4\r\nping\r\n"))
+		assert.MustNoError(err)
+		p := make([]byte, 14)
+		_, err = io.ReadFull(c, p)
+		assert.MustNoError(err)
+		assert.Must(string(p) == "*1\r\n$4\r\nping\r\n")
+	}
+	docheck("", 0)
+	docheck("user:p@ss", 0)
+	docheck("", 5)
+
+	d, err := parseSocks5("user:p:w@proxy:1080")
+	assert.MustNoError(err)
+	assert.Must(d.proxy == "proxy:1080" && d.user == "user" && d.password == "p:w")
+	for _, s := range []string{"proxy", "user@proxy:1080", ":pass@proxy:1080"} {
+		_, err := parseSocks5(s)
+		assert.Must(err != nil)
+	}
+}
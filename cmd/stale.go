@@ -0,0 +1,205 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// staleExtractor finds the timestamp an application embedded in a key, for
+// --stale-extractor; ok is false when the key doesn't carry one.
+type staleExtractor interface {
+	Extract(key []byte, value interface{}) (t time.Time, ok bool)
+}
+
+// staleSources are the kinds of --stale-extractor, new ones register here
+// with a constructor taking what follows the kind, e.g. the field of
+// 'hash:FIELD'.
+var staleSources = map[string]func(r *regexp.Regexp, arg string) (staleExtractor, error){
+	"key": func(r *regexp.Regexp, arg string) (staleExtractor, error) {
+		if r.NumSubexp() != 1 {
+			return nil, errors.Errorf("'key' needs a regexp with 1 submatch, got %d", r.NumSubexp())
+		}
+		return staleKey{r}, nil
+	},
+	"value": func(r *regexp.Regexp, arg string) (staleExtractor, error) {
+		return staleValue{}, nil
+	},
+	"hash": func(r *regexp.Regexp, arg string) (staleExtractor, error) {
+		if arg == "" {
+			return nil, errors.Errorf("'hash' needs a field, e.g. 'hash:updated_at'")
+		}
+		return staleHashField(arg), nil
+	},
+	"json": func(r *regexp.Regexp, arg string) (staleExtractor, error) {
+		if arg == "" {
+			return nil, errors.Errorf("'json' needs a field, e.g. 'json:updated_at'")
+		}
+		return staleJSONField(arg), nil
+	},
+}
+
+// parseTimestamp accepts unix seconds, unix milliseconds (13+ digits) and
+// RFC 3339 times.
+func parseTimestamp(p []byte) (time.Time, bool) {
+	s := strings.TrimSpace(string(p))
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+		if len(s) >= 13 {
+			return time.Unix(0, n*int64(time.Millisecond)), true
+		}
+		return time.Unix(n, 0), true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+type staleKey struct {
+	r *regexp.Regexp
+}
+
+func (x staleKey) Extract(key []byte, value interface{}) (time.Time, bool) {
+	if m := x.r.FindSubmatch(key); m != nil {
+		return parseTimestamp(m[1])
+	}
+	return time.Time{}, false
+}
+
+type staleValue struct{}
+
+func (x staleValue) Extract(key []byte, value interface{}) (time.Time, bool) {
+	if s, ok := value.(rdb.String); ok {
+		return parseTimestamp(s)
+	}
+	return time.Time{}, false
+}
+
+type staleHashField string
+
+func (x staleHashField) Extract(key []byte, value interface{}) (time.Time, bool) {
+	if h, ok := value.(rdb.Hash); ok {
+		for _, e := range h {
+			if string(e.Field) == string(x) {
+				return parseTimestamp(e.Value)
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+type staleJSONField string
+
+func (x staleJSONField) Extract(key []byte, value interface{}) (time.Time, bool) {
+	s, ok := value.(rdb.String)
+	if !ok {
+		return time.Time{}, false
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(s, &m); err != nil {
+		return time.Time{}, false
+	}
+	switch v := m[string(x)].(type) {
+	case string:
+		return parseTimestamp([]byte(v))
+	case float64:
+		return parseTimestamp([]byte(strconv.FormatFloat(v, 'f', -1, 64)))
+	}
+	return time.Time{}, false
+}
+
+// staleCheck flags keys without expire whose embedded timestamp is older than
+// the threshold, and writes them to the report as json lines.
+type staleCheck struct {
+	pattern   *regexp.Regexp
+	extractor staleExtractor
+	threshold time.Duration
+	now       time.Time
+
+	mu     sync.Mutex
+	report io.Writer
+	nflag  int64
+}
+
+// newStaleCheck parses a rule 'SOURCE=REGEXP', e.g. 'hash:updated_at=^session:'.
+func newStaleCheck(rule string, threshold time.Duration) (*staleCheck, error) {
+	i := strings.Index(rule, "=")
+	if i < 0 {
+		return nil, errors.Errorf("invalid rule '%s', should be SOURCE=REGEXP", rule)
+	}
+	r, err := regexp.Compile(rule[i+1:])
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	kind, arg := rule[:i], ""
+	if j := strings.Index(kind, ":"); j >= 0 {
+		kind, arg = kind[:j], kind[j+1:]
+	}
+	f := staleSources[kind]
+	if f == nil {
+		return nil, errors.Errorf("unknown source '%s' in rule '%s'", kind, rule)
+	}
+	x, err := f(r, arg)
+	if err != nil {
+		return nil, err
+	}
+	return &staleCheck{pattern: r, extractor: x, threshold: threshold, now: time.Now()}, nil
+}
+
+// Check reports the entry when it is stale, only keys without expire and
+// matching the pattern are looked at.
+func (s *staleCheck) Check(e *rdb.BinEntry) {
+	if e.ExpireAt != 0 || !s.pattern.Match(e.Key) {
+		return
+	}
+	var value interface{}
+	if _, ok := s.extractor.(staleKey); !ok {
+		o, err := rdb.DecodeDump(e.Value)
+		if err != nil {
+			log.PanicError(err, "decode failed")
+		}
+		value = o
+	}
+	t, ok := s.extractor.Extract(e.Key, value)
+	if !ok || s.now.Sub(t) <= s.threshold {
+		return
+	}
+	b, err := json.Marshal(&struct {
+		DB        uint32 `json:"db"`
+		Type      string `json:"type"`
+		Key       string `json:"key"`
+		Key64     string `json:"key64"`
+		Timestamp int64  `json:"timestamp"`
+		Age       int64  `json:"age"`
+	}{
+		e.DB, rdb.TypeName(e.Value), keyText(e.Key), base64.StdEncoding.EncodeToString(e.Key),
+		t.UnixNano() / int64(time.Millisecond), int64(s.now.Sub(t) / time.Second),
+	})
+	if err != nil {
+		log.PanicError(err, "encode to json failed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nflag++
+	if _, err := s.report.Write(append(b, '\n')); err != nil {
+		log.PanicError(err, "write stale report failed")
+	}
+}
+
+func (s *staleCheck) Flagged() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nflag
+}
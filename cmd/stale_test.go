@@ -0,0 +1,56 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+func TestStaleCheck(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	docheck := func(rule string, e *rdb.BinEntry, stale bool) {
+		s, err := newStaleCheck(rule, time.Hour)
+		assert.MustNoError(err)
+		var b bytes.Buffer
+		s.now, s.report = now, &b
+		s.Check(e)
+		assert.Must((s.Flagged() == 1) == stale)
+		if stale {
+			var o struct {
+				Key string `json:"key"`
+				Age int64  `json:"age"`
+			}
+			assert.MustNoError(json.Unmarshal(b.Bytes(), &o))
+			assert.Must(o.Key == string(e.Key) && o.Age > 3600)
+		}
+	}
+	dump := func(o interface{}) []byte {
+		p, err := rdb.EncodeDump(o)
+		assert.MustNoError(err)
+		return p
+	}
+	old, recent := "1499990000", "1499999000000"
+
+	docheck(`key=^evt:(\d+)$`, &rdb.BinEntry{Key: []byte("evt:" + old), Value: dump(rdb.String("x"))}, true)
+	docheck(`key=^evt:(\d+)$`, &rdb.BinEntry{Key: []byte("evt:" + recent), Value: dump(rdb.String("x"))}, false)
+	docheck(`key=^evt:(\d+)$`, &rdb.BinEntry{Key: []byte("evt:" + old), Value: dump(rdb.String("x")), ExpireAt: 1}, false)
+	docheck(`value=^ts:`, &rdb.BinEntry{Key: []byte("ts:1"), Value: dump(rdb.String("2017-07-14T00:00:00Z"))}, true)
+	docheck(`value=^ts:`, &rdb.BinEntry{Key: []byte("other"), Value: dump(rdb.String(old))}, false)
+	hash := rdb.Hash{&rdb.HashElement{Field: []byte("updated_at"), Value: []byte(old)}}
+	docheck(`hash:updated_at=^session:`, &rdb.BinEntry{Key: []byte("session:1"), Value: dump(hash)}, true)
+	docheck(`hash:created_at=^session:`, &rdb.BinEntry{Key: []byte("session:1"), Value: dump(hash)}, false)
+	docheck(`json:at=^doc:`, &rdb.BinEntry{Key: []byte("doc:1"), Value: dump(rdb.String(`{"at":` + old + `}`))}, true)
+	docheck(`json:at=^doc:`, &rdb.BinEntry{Key: []byte("doc:1"), Value: dump(rdb.String(`{"at":"` + recent + `"}`))}, false)
+
+	for _, rule := range []string{"^evt:", "key=^evt:", "hash=^a", "nope=^a", "value=("} {
+		_, err := newStaleCheck(rule, time.Hour)
+		assert.Must(err != nil)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/redis"
+)
+
+// syncState is what --state-file keeps of a sync to resume it: the
+// replication id of the master, the offset of the last command read from the
+// stream and the db selected by the stream at that offset. The master doesn't
+// repeat SELECT after a partial resync, so the db must be restored.
+type syncState struct {
+	ReplID string `json:"replid"`
+	Offset int64  `json:"offset"`
+	DB     uint32 `json:"db"`
+}
+
+// loadSyncState reads the state file, a missing file is a first sync and
+// returns nil.
+func loadSyncState(name string) (*syncState, error) {
+	p, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	s := &syncState{}
+	if err := json.Unmarshal(p, s); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(s.ReplID) == 0 || s.Offset <= 0 || s.DB > MaxDB {
+		return nil, errors.Errorf("invalid state '%s'", strings.TrimSpace(string(p)))
+	}
+	return s, nil
+}
+
+func writeSyncState(name string, s *syncState) error {
+	p, err := json.Marshal(s)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return writeRenameFile(name, append(p, '\n'))
+}
+
+// streamPos is the position of sync in the stream: the bytes read up to the
+// last command and the db selected then, both change together.
+type streamPos struct {
+	mu     sync.Mutex
+	offset int64
+	db     uint32
+}
+
+func (p *streamPos) Set(offset int64, db uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offset, p.db = offset, db
+}
+
+func (p *streamPos) Get() (int64, uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.offset, p.db
+}
+
+func (p *streamPos) Offset() int64 {
+	offset, _ := p.Get()
+	return offset
+}
+
+// Update moves the position past the command, a SELECT changes the db.
+func (p *streamPos) Update(offset int64, resp redis.Resp) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offset = offset
+	if db, ok := selectedDB(resp); ok {
+		p.db = db
+	}
+}
+
+// selectedDB returns the db of a SELECT command.
+func selectedDB(resp redis.Resp) (uint32, bool) {
+	a, ok := resp.(*redis.Array)
+	if !ok || len(a.Value) != 2 {
+		return 0, false
+	}
+	cmd, ok1 := a.Value[0].(*redis.BulkBytes)
+	arg, ok2 := a.Value[1].(*redis.BulkBytes)
+	if !ok1 || !ok2 || !strings.EqualFold(string(cmd.Value), "select") {
+		return 0, false
+	}
+	n, err := parseInt(string(arg.Value), MinDB, MaxDB)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(n), true
+}
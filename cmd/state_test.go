@@ -0,0 +1,72 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func TestSyncState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.MustNoError(err)
+	defer os.RemoveAll(dir)
+	name := dir + "/state"
+
+	s, err := loadSyncState(name)
+	assert.MustNoError(err)
+	assert.Must(s == nil)
+
+	x := &syncState{ReplID: "8de9a6ad8b6e4d6d0d6e7d3f6d0b6b4c1f6a2e1d", Offset: 1234, DB: 3}
+	assert.MustNoError(writeSyncState(name, x))
+	s, err = loadSyncState(name)
+	assert.MustNoError(err)
+	assert.Must(*s == *x)
+
+	for _, p := range []string{"", "{}", `{"replid":"x","offset":0}`, `{"replid":"x","offset":1,"db":2000}`} {
+		assert.MustNoError(ioutil.WriteFile(name, []byte(p), 0644))
+		_, err := loadSyncState(name)
+		assert.Must(err != nil)
+	}
+}
+
+func TestStreamPos(t *testing.T) {
+	var p streamPos
+	p.Set(10, 2)
+	p.Update(20, redis.NewCommand("set", "k", "v"))
+	n, db := p.Get()
+	assert.Must(n == 20 && db == 2)
+	p.Update(30, redis.NewCommand("SELECT", "5"))
+	n, db = p.Get()
+	assert.Must(n == 30 && db == 5)
+	p.Update(40, redis.NewCommand("select", "x"))
+	n, db = p.Get()
+	assert.Must(n == 40 && db == 5)
+}
+
+func TestSendPSyncResume(t *testing.T) {
+	resume := func(reply string) (string, int64, bool) {
+		var b bytes.Buffer
+		br := bufio.NewReader(strings.NewReader(reply))
+		runid, offset, _, ok := sendPSyncResume(br, bufio.NewWriter(&b), "oldid", 100)
+		return runid, offset, ok
+	}
+	runid, offset, ok := resume("+CONTINUE\r\n")
+	assert.Must(ok && runid == "oldid" && offset == 99)
+	runid, offset, ok = resume("+CONTINUE newid\r\n")
+	assert.Must(ok && runid == "newid" && offset == 99)
+
+	var b bytes.Buffer
+	for reply, id := range map[string]string{"+CONTINUE\r\n": "oldid", "+CONTINUE newid\r\n": "newid"} {
+		br := bufio.NewReader(strings.NewReader(reply))
+		assert.Must(sendPSyncContinue(br, bufio.NewWriter(&b), "oldid", 100) == id)
+	}
+}
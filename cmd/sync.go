@@ -11,13 +11,19 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 	//"strings"
 
 	"github.com/left2right/redis-port/pkg/libs/atomic2"
+	"github.com/left2right/redis-port/pkg/libs/errors"
 	"github.com/left2right/redis-port/pkg/libs/io/pipe"
 	"github.com/left2right/redis-port/pkg/libs/log"
 	"github.com/left2right/redis-port/pkg/libs/stats"
+	"github.com/left2right/redis-port/pkg/rdb"
 	"github.com/left2right/redis-port/pkg/redis"
 )
 
@@ -25,6 +31,29 @@ type cmdSync struct {
 	rbytes, wbytes, nentry, ignore atomic2.Int64
 
 	forward, nbypass atomic2.Int64
+
+	// ibytes counts the bytes read from master, pos is the position of the
+	// last command read from the stream in them.
+	ibytes      atomic2.Int64
+	pos         streamPos
+	psyncOffset int64
+
+	// masterOffset is master_repl_offset of the master, for --metrics-addr.
+	masterOffset atomic2.Int64
+
+	// runid is the replication id of the master with --psync, it changes when
+	// a promoted replica continues the stream. resumed is the --state-file
+	// the master continued the stream of.
+	runid   string
+	runlock sync.Mutex
+	resumed *syncState
+
+	deletes *deleteLog
+
+	// targets are the addresses of --target with more than one, seq counts
+	// the chunks of the stream sent to them.
+	targets []*syncTarget
+	seq     atomic2.Int64
 }
 
 type cmdSyncStat struct {
@@ -54,7 +83,15 @@ func (cmd *cmdSync) Main() {
 		log.Panic("invalid argument: target")
 	}
 
-	log.Infof("sync from '%s' to '%s'\n", from, target)
+	log.Infof("sync from '%s' to '%s'\n", from, targetNames())
+	if args.cluster != nil {
+		initTargetCluster(sampleSourceKeys(from, args.passwd))
+	}
+	if len(args.targets) > 1 {
+		cmd.targets = newSyncTargets(args.targets, args.auth)
+	}
+	initTargetVersion(target, args.auth)
+	confirmTarget("sync", from)
 
 	var sockfile *os.File
 	if len(args.sockfile) != 0 {
@@ -65,7 +102,15 @@ func (cmd *cmdSync) Main() {
 	var input io.ReadCloser
 	var nsize int64
 	if args.psync {
-		input, nsize = cmd.SendPSyncCmd(from, args.passwd)
+		var resume *syncState
+		if len(args.stateFile) != 0 {
+			s, err := loadSyncState(args.stateFile)
+			if err != nil {
+				log.PanicErrorf(err, "load state file '%s' failed", args.stateFile)
+			}
+			resume = s
+		}
+		input, nsize = cmd.SendPSyncCmd(from, args.passwd, resume)
 	} else {
 		input, nsize = cmd.SendSyncCmd(from, args.passwd)
 	}
@@ -86,12 +131,173 @@ func (cmd *cmdSync) Main() {
 		input = r
 	}
 
-	reader := bufio.NewReaderSize(input, ReaderBufferSize)
+	reader := bufio.NewReaderSize(stats.NewCountReader(input, &cmd.ibytes), ReaderBufferSize)
+
+	if len(args.metricsAddr) != 0 {
+		cmd.exportMetrics(nsize, cmd.psyncOffset-nsize)
+		serveMetrics(args.metricsAddr)
+		if args.psync {
+			go cmd.PollMasterOffset(from, args.passwd)
+		}
+	}
+
+	if cmd.resumed == nil {
+		cmd.SyncRDBFile(reader, target, args.auth, nsize)
+		cmd.RDBDone(args.rdbDoneFile)
+		cmd.pos.Set(nsize, 0)
+	} else {
+		log.Infof("sync: resume the command stream at offset = %d, db = %d", cmd.resumed.Offset, cmd.resumed.DB)
+		cmd.pos.Set(0, cmd.resumed.DB)
+	}
+
+	if len(args.offsetFile) != 0 {
+		go cmd.SaveOffset(args.offsetFile, cmd.psyncOffset-nsize)
+	}
+	if len(args.stateFile) != 0 {
+		go cmd.SaveState(args.stateFile, cmd.psyncOffset-nsize)
+	}
+
+	if args.reconcile != 0 && rewriting() {
+		log.Panic("--reconcile-interval can't be used with --rename-prefix or --target-db")
+	}
+	if args.reconcile != 0 {
+		for _, t := range targetAddrs() {
+			r := &reconciler{from: from, passwd: args.passwd, target: t, auth: args.auth}
+			go r.Run(args.reconcile, args.reconcileSample)
+		}
+	}
+
+	if len(args.deleteLog) != 0 {
+		cmd.deletes = openDeleteLog(args.deleteLog)
+	}
+
+	if args.checkpointOnSignal {
+		go cmd.CheckpointOnSignal(args.offsetFile, args.stateFile, cmd.psyncOffset-nsize)
+	}
 
-	cmd.SyncRDBFile(reader, target, args.auth, nsize)
 	cmd.SyncCommand(reader, target, args.auth)
 }
 
+// SaveOffset writes the processed master offset to the file once per second
+// when it moves, through a temporary file and rename so readers never see a
+// partial write. Without --psync the offset counts from 0, with several
+// targets it is the offset of the one furthest behind.
+func (cmd *cmdSync) SaveOffset(name string, base int64) {
+	var last int64
+	for {
+		time.Sleep(time.Second)
+		n, _ := cmd.position()
+		if n == 0 || n == last {
+			continue
+		}
+		if err := writeOffsetFile(name, base+n); err != nil {
+			log.WarnErrorf(err, "write offset file '%s' failed", name)
+			continue
+		}
+		last = n
+	}
+}
+
+// SaveState writes the --state-file once per second when the position moves,
+// as SaveOffset does.
+func (cmd *cmdSync) SaveState(name string, base int64) {
+	var last int64
+	for {
+		time.Sleep(time.Second)
+		n, db := cmd.position()
+		if n == 0 || n == last {
+			continue
+		}
+		if err := writeSyncState(name, &syncState{ReplID: cmd.replID(), Offset: base + n, DB: db}); err != nil {
+			log.WarnErrorf(err, "write state file '%s' failed", name)
+			continue
+		}
+		last = n
+	}
+}
+
+// CheckpointOnSignal waits for SIGINT or SIGTERM, then writes the offset file
+// and the state file and flushes the delete log one last time before exiting,
+// so none lags behind the commands written to the target so far. It exits 0
+// once every checkpoint is written, 1 if one of them failed.
+func (cmd *cmdSync) CheckpointOnSignal(name, state string, base int64) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+	log.Infof("sync: got %s, write checkpoint and exit", sig)
+	code := 0
+	if len(name) != 0 {
+		if n, _ := cmd.position(); n != 0 {
+			if err := writeOffsetFile(name, base+n); err != nil {
+				log.WarnErrorf(err, "write offset file '%s' failed", name)
+				code = 1
+			} else {
+				log.Infof("sync: offset %d written to '%s'", base+n, name)
+			}
+		}
+	}
+	if len(state) != 0 {
+		if n, db := cmd.position(); n != 0 {
+			if err := writeSyncState(state, &syncState{ReplID: cmd.replID(), Offset: base + n, DB: db}); err != nil {
+				log.WarnErrorf(err, "write state file '%s' failed", state)
+				code = 1
+			} else {
+				log.Infof("sync: offset %d and db %d written to '%s'", base+n, db, state)
+			}
+		}
+	}
+	if cmd.deletes != nil {
+		cmd.deletes.Flush()
+	}
+	os.Exit(code)
+}
+
+func (cmd *cmdSync) replID() string {
+	cmd.runlock.Lock()
+	defer cmd.runlock.Unlock()
+	return cmd.runid
+}
+
+func (cmd *cmdSync) setReplID(runid string) {
+	cmd.runlock.Lock()
+	defer cmd.runlock.Unlock()
+	cmd.runid = runid
+}
+
+func writeOffsetFile(name string, offset int64) error {
+	return writeRenameFile(name, []byte(strconv.FormatInt(offset, 10)+"\n"))
+}
+
+// writeRenameFile replaces the file through a temporary file and rename.
+func writeRenameFile(name string, p []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, p, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, name))
+}
+
+// RDBDone marks the end of the rdb phase, every command read from now on
+// belongs to the command stream. The offset is the one of the fullresync,
+// the stream starts right after it; without --psync it is 0. With
+// --rdb-done-file the marker is also written to the file.
+func (cmd *cmdSync) RDBDone(name string) {
+	var offset int64
+	if args.psync {
+		offset = cmd.psyncOffset - 1
+	}
+	stat := cmd.Stat()
+	log.Infof("sync: rdb done, entry = %d, ignore = %d, command stream starts at fullresync offset = %d", stat.nentry, stat.ignore, offset)
+	if len(name) == 0 {
+		return
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	p := fmt.Sprintf(`{"time":%d,"offset":%d,"entry":%d,"ignore":%d}`+"\n", now, offset, stat.nentry, stat.ignore)
+	if err := writeRenameFile(name, []byte(p)); err != nil {
+		log.WarnErrorf(err, "write rdb done file '%s' failed", name)
+	}
+}
+
 func (cmd *cmdSync) SendSyncCmd(master, passwd string) (net.Conn, int64) {
 	c, wait := openSyncConn(master, passwd)
 	for {
@@ -108,16 +314,36 @@ func (cmd *cmdSync) SendSyncCmd(master, passwd string) (net.Conn, int64) {
 	}
 }
 
-func (cmd *cmdSync) SendPSyncCmd(master, passwd string) (pipe.Reader, int64) {
-	c := openNetConn(master, passwd)
+// SendPSyncCmd starts the replication, with a state to resume the master is
+// asked to continue the stream first, nsize is 0 when it does.
+func (cmd *cmdSync) SendPSyncCmd(master, passwd string, resume *syncState) (pipe.Reader, int64) {
+	c := openNetConn(master, passwd, args.sourceConf)
 	br := bufio.NewReaderSize(c, ReaderBufferSize)
 	bw := bufio.NewWriterSize(c, WriterBufferSize)
 
-	runid, offset, wait := sendPSyncFullsync(br, bw)
-	log.Infof("psync runid = %s offset = %d, fullsync", runid, offset)
+	var runid string
+	var offset int64
+	var wait <-chan int64
+	if resume != nil {
+		var ok bool
+		runid, offset, wait, ok = sendPSyncResume(br, bw, resume.ReplID, resume.Offset)
+		if ok {
+			log.Infof("psync runid = %s offset = %d, continue", runid, resume.Offset)
+			cmd.resumed = resume
+		} else {
+			log.Warnf("psync runid = %s offset = %d, partial resync rejected by master", resume.ReplID, resume.Offset)
+		}
+	} else {
+		runid, offset, wait = sendPSyncFullsync(br, bw)
+	}
+	if cmd.resumed == nil {
+		log.Infof("psync runid = %s offset = %d, fullsync", runid, offset)
+	}
+	cmd.setReplID(runid)
+	cmd.psyncOffset = offset + 1
 
 	var nsize int64
-	for nsize == 0 {
+	for nsize == 0 && cmd.resumed == nil {
 		select {
 		case nsize = <-wait:
 			if nsize == 0 {
@@ -144,7 +370,7 @@ func (cmd *cmdSync) SendPSyncCmd(master, passwd string) (pipe.Reader, int64) {
 			offset += n
 			for {
 				time.Sleep(time.Second)
-				c = openNetConnSoft(master, passwd)
+				c = openNetConnSoft(master, passwd, args.sourceConf)
 				if c != nil {
 					log.Infof("psync reopen connection, offset = %d", offset)
 					break
@@ -152,10 +378,14 @@ func (cmd *cmdSync) SendPSyncCmd(master, passwd string) (pipe.Reader, int64) {
 					log.Infof("psync reopen connection, failed")
 				}
 			}
-			authPassword(c, passwd)
+			authPassword(c, args.sourceConf.username(), passwd)
 			br = bufio.NewReaderSize(c, ReaderBufferSize)
 			bw = bufio.NewWriterSize(c, WriterBufferSize)
-			sendPSyncContinue(br, bw, runid, offset)
+			if id := sendPSyncContinue(br, bw, runid, offset); id != runid {
+				log.Infof("psync runid = %s offset = %d, continue with new runid = %s", runid, offset, id)
+				runid = id
+				cmd.setReplID(id)
+			}
 		}
 	}()
 	return piper, nsize
@@ -187,40 +417,56 @@ func (cmd *cmdSync) PSyncPipeCopy(c net.Conn, br *bufio.Reader, bw *bufio.Writer
 	}
 }
 
+// acceptEntry applies the filters and rewrites to an entry of the rdb, it
+// returns false for the entries not to be restored.
+func (cmd *cmdSync) acceptEntry(e *rdb.BinEntry) bool {
+	if !acceptDB(e.DB) || !acceptKey(e.Key) {
+		cmd.ignore.Incr()
+		return false
+	}
+	if skipKey(e.Key) {
+		log.Warnf("sync skip key: %s", e.Key)
+		cmd.ignore.Incr()
+		return false
+	}
+	qpsLimit.Wait(1)
+	countEntryType(e)
+	rewriteEntry(e)
+	if rdb.IsEmptyObject(e.Value) {
+		log.Warnf("sync skip empty aggregate key: %s", e.Key)
+		cmd.ignore.Incr()
+		return false
+	}
+	cmd.nentry.Incr()
+	return true
+}
+
 func (cmd *cmdSync) SyncRDBFile(reader *bufio.Reader, target, passwd string, nsize int64) {
 	pipe := newRDBLoader(reader, &cmd.rbytes, args.parallel*32)
 	wait := make(chan struct{})
 	go func() {
 		defer close(wait)
-		group := make(chan int, args.parallel)
-		for i := 0; i < cap(group); i++ {
-			go func() {
-				defer func() {
-					group <- 0
-				}()
-				c := openRedisConn(target, passwd)
-				defer c.Close()
-				var lastdb uint32 = 0
-				for e := range pipe {
-					if !acceptDB(e.DB) || !acceptKey(e.Key)  {
-						cmd.ignore.Incr()
-					} else if skipKey(e.Key) {
-                        			log.Warnf("sync skip key: %s", e.Key)
-                        			cmd.ignore.Incr()
-                    			} else {
-						cmd.nentry.Incr()
-						if e.DB != lastdb {
-							lastdb = e.DB
-							selectDB(c, lastdb)
-						}
-						restoreRdbEntry(c, e)
-					}
-				}
-			}()
-		}
-		for i := 0; i < cap(group); i++ {
-			<-group
+		if len(cmd.targets) != 0 {
+			cmd.restoreTargets(pipe)
+			return
 		}
+		runWorkers(pipe, &cmd.nentry, func(stop <-chan struct{}) {
+			c := openRedisConn(target, passwd)
+			defer c.Close()
+			var lastdb uint32 = baseTargetDB()
+			for e, ok := nextEntry(pipe, stop); ok; e, ok = nextEntry(pipe, stop) {
+				if !cmd.acceptEntry(e) {
+					continue
+				}
+				if e.DB != lastdb {
+					lastdb = e.DB
+					selectDB(c, lastdb)
+				}
+				if err := restoreRdbEntry(c, e); err != nil {
+					log.PanicError(err, "restore command error")
+				}
+			}
+		})
 	}()
 
 	for done := false; !done; {
@@ -230,38 +476,81 @@ func (cmd *cmdSync) SyncRDBFile(reader *bufio.Reader, target, passwd string, nsi
 		case <-time.After(time.Second):
 		}
 		stat := cmd.Stat()
+		if statJSON() {
+			fields := map[string]interface{}{
+				"total": nsize, "rbytes": stat.rbytes, "entry": stat.nentry, "ignore": stat.ignore,
+				"throttle": throttleCounts(),
+			}
+			if len(cmd.targets) != 0 {
+				fields["targets"] = cmd.targetCounts(false)
+			}
+			logStat("sync-rdb", fields)
+			continue
+		}
 		var b bytes.Buffer
 		fmt.Fprintf(&b, "total=%d - %12d [%3d%%]", nsize, stat.rbytes, 100*stat.rbytes/nsize)
 		fmt.Fprintf(&b, "  entry=%-12d", stat.nentry)
 		if stat.ignore != 0 {
 			fmt.Fprintf(&b, "  ignore=%-12d", stat.ignore)
 		}
+		b.WriteString(cmd.targetStat(false))
+		b.WriteString(throttleStat())
 		log.Info(b.String())
 	}
 	log.Info("sync rdb done")
 }
 
 func (cmd *cmdSync) SyncCommand(reader *bufio.Reader, target, passwd string) {
-	c := openNetConn(target, passwd)
+	var c io.WriteCloser
+	var fan *fanoutWriter
+	if len(cmd.targets) != 0 {
+		fan = cmd.openFanout()
+		c = fan
+	} else {
+		c = openTargetStream(target, passwd)
+	}
 	defer c.Close()
 
         cr := openRedisConn(target, passwd)
         defer cr.Close()
 
-	writer := bufio.NewWriterSize(stats.NewCountWriter(c, &cmd.wbytes), WriterBufferSize)
-	defer flushWriter(writer)
+	// next is the position of the stream after last, the command being
+	// forwarded. The position only moves past a command once it is written
+	// to the target (or dropped), a fan-out hands it to every target along
+	// with the command.
+	var next int64
+	var last redis.Resp
 
-	go func() {
-		p := make([]byte, ReaderBufferSize)
-		for {
-			iocopy(c, ioutil.Discard, p, len(p))
+	writer := bufio.NewWriterSize(stats.NewCountWriter(c, &cmd.wbytes), WriterBufferSize)
+	flush := func(sel bool) {
+		flushWriter(writer)
+		if fan != nil {
+			if last != nil {
+				cmd.pos.Update(next, last)
+			}
+			fan.Flush(sel)
 		}
-	}()
+	}
+	defer flush(false)
 
 	go func() {
 		var bypass bool = false
+		var db uint32 = 0
+		if s := cmd.resumed; s != nil {
+			// the stream goes on in the db it had selected.
+			db, bypass = s.DB, !acceptDB(s.DB)
+			if !bypass {
+				resp := redis.NewCommand("select", int(db))
+				redis.MustEncode(writer, rewriteCommand(resp, "select", [][]byte{[]byte(strconv.Itoa(int(db)))}))
+				flush(true)
+			}
+		}
 		for {
+			if last != nil {
+				cmd.pos.Update(next, last)
+			}
 			resp := redis.MustDecode(reader)
+			next, last = cmd.ibytes.Get()-int64(reader.Buffered()), resp
 			if scmd, args, err := redis.ParseArgs(resp); err != nil {
 				log.PanicError(err, "parse command arguments failed")
 			} else if scmd != "ping" {
@@ -275,20 +564,29 @@ func (cmd *cmdSync) SyncCommand(reader *bufio.Reader, target, passwd string) {
 						log.PanicErrorf(err, "parse db = %s failed", s)
 					}
 					bypass = !acceptDB(uint32(n))
+					db = uint32(n)
 				}
 
-		        if bypass || (len(args) > 0 && !acceptKey(args[0])) {
+				skip := bypass
+				if crossDBCommands[scmd] {
+					skip = !acceptCrossDB(scmd, args)
+				}
+		        if skip || !acceptCommand(scmd, args) {
 					cmd.nbypass.Incr()
 					continue
 		        }
             
-               		 if skipKey(args[0]) {
+               		 if len(args) != 0 && skipKey(args[0]) {
                     		log.Warnf("skip key: %s", args[0])
                     		cmd.ignore.Incr()
                     		continue
                 	}
                 
-                if aggregateKey(args[0]) && ((scmd == "lpush") || (scmd =="LPUSH")) {
+		if cmd.deletes != nil {
+			cmd.deletes.Record(db, scmd, args)
+		}
+
+                if len(args) != 0 && aggregateKey(args[0]) && ((scmd == "lpush") || (scmd =="LPUSH")) {
 		    log.Infof("Aggregate Key %s", args[0])
                     for i := 1; i < len(args); i++{
                         _, err := cr.Do(aggregateCmd, aggregateTarget, args[i])
@@ -300,7 +598,7 @@ func (cmd *cmdSync) SyncCommand(reader *bufio.Reader, target, passwd string) {
                 }
                 
                 // set 2 sorted set in sync command 
-                if set2sortedKey(args[0]) {
+                if len(args) != 0 && set2sortedKey(args[0]) {
                     switch scmd {
                     default:
 	                   log.Panicf("set2sorted operate %s on key %s err", scmd, args[0])    
@@ -327,7 +625,7 @@ func (cmd *cmdSync) SyncCommand(reader *bufio.Reader, target, passwd string) {
                     continue
                 }
 
-                if sorted2setKey(args[0]) {
+                if len(args) != 0 && sorted2setKey(args[0]) {
                     switch scmd {
                     default:
 	                   log.Panicf("sorted2set operate %s on key %s err", scmd, args[0])    
@@ -360,21 +658,41 @@ func (cmd *cmdSync) SyncCommand(reader *bufio.Reader, target, passwd string) {
                                 
                 // Some commands like MSET may have multi keys, but we only use
 				// first for filter              
+				throttleCommand(db, scmd)
+				resp = rewriteCommand(resp, scmd, args)
 		}
+		qpsLimit.Wait(1)
 		cmd.forward.Incr()
 		redis.MustEncode(writer, resp)
-		flushWriter(writer)
+		_, sel := selectedDB(resp)
+		flush(sel)
 	    }
 	}()
 
 	for lstat := cmd.Stat(); ; {
 		time.Sleep(time.Second)
 		nstat := cmd.Stat()
+		if statJSON() {
+			fields := map[string]interface{}{
+				"forward": nstat.forward, "nbypass": nstat.nbypass, "wbytes": nstat.wbytes,
+				"+forward": nstat.forward - lstat.forward, "+nbypass": nstat.nbypass - lstat.nbypass,
+				"+nbytes": nstat.wbytes - lstat.wbytes, "offset": cmd.pos.Offset(),
+				"throttle": throttleCounts(),
+			}
+			if len(cmd.targets) != 0 {
+				fields["targets"] = cmd.targetCounts(true)
+			}
+			logStat("sync", fields)
+			lstat = nstat
+			continue
+		}
 		var b bytes.Buffer
 		fmt.Fprintf(&b, "sync: ")
 		fmt.Fprintf(&b, " +forward=%-6d", nstat.forward-lstat.forward)
 		fmt.Fprintf(&b, " +nbypass=%-6d", nstat.nbypass-lstat.nbypass)
 		fmt.Fprintf(&b, " +nbytes=%d", nstat.wbytes-lstat.wbytes)
+		b.WriteString(cmd.targetStat(true))
+		b.WriteString(throttleStat())
 		log.Info(b.String())
 		lstat = nstat
 	}
@@ -0,0 +1,125 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+)
+
+// connConfig is how connections to the source or to the target are opened:
+// over TLS when --source-tls/--target-tls is set, and as the ACL user of
+// --source-auth/--target-auth.
+type connConfig struct {
+	user string
+
+	tls        bool
+	roots      *x509.CertPool
+	certs      []tls.Certificate
+	skipVerify bool
+}
+
+// parseUserPassword splits USER:PASSWORD at the first ':', without ':' the
+// whole string is the password of the default user.
+func parseUserPassword(s string) (user, passwd string) {
+	if i := strings.Index(s, ":"); i != -1 {
+		return s[:i], s[i+1:]
+	}
+	return "", s
+}
+
+// loadTLS loads --tls-ca, --tls-cert and --tls-key into the config, without
+// --tls-ca the certificates of the system are trusted.
+func (c *connConfig) loadTLS(ca, cert, key string, skipVerify bool) error {
+	c.tls, c.skipVerify = true, skipVerify
+	if len(ca) != 0 {
+		p, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		c.roots = x509.NewCertPool()
+		if !c.roots.AppendCertsFromPEM(p) {
+			return errors.Errorf("no certificate found in '%s'", ca)
+		}
+	}
+	if len(cert) != 0 || len(key) != 0 {
+		if len(cert) == 0 || len(key) == 0 {
+			return errors.Errorf("--tls-cert and --tls-key go together")
+		}
+		x, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		c.certs = []tls.Certificate{x}
+	}
+	return nil
+}
+
+// wrap starts TLS on the connection to addr when the config asks for it, the
+// certificate of the server is verified against the host of addr.
+func (c *connConfig) wrap(conn net.Conn, addr string) (net.Conn, error) {
+	if c == nil || !c.tls {
+		return conn, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tc := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		RootCAs:            c.roots,
+		Certificates:       c.certs,
+		InsecureSkipVerify: c.skipVerify,
+	})
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	return tc, nil
+}
+
+func (c *connConfig) username() string {
+	if c == nil {
+		return ""
+	}
+	return c.user
+}
+
+// parseTLS sets up TLS for the connections of --source-tls and --target-tls,
+// both share --tls-ca, --tls-cert and --tls-key.
+func parseTLS(d map[string]interface{}) error {
+	ca, _ := d["--tls-ca"].(string)
+	cert, _ := d["--tls-cert"].(string)
+	key, _ := d["--tls-key"].(string)
+	skipVerify, _ := d["--tls-skip-verify"].(bool)
+
+	var enabled bool
+	for _, x := range []struct {
+		flag string
+		conf **connConfig
+	}{
+		{"--source-tls", &args.sourceConf},
+		{"--target-tls", &args.targetConf},
+	} {
+		if on, _ := d[x.flag].(bool); !on {
+			continue
+		}
+		if *x.conf == nil {
+			*x.conf = &connConfig{}
+		}
+		if err := (*x.conf).loadTLS(ca, cert, key, skipVerify); err != nil {
+			return err
+		}
+		enabled = true
+	}
+	if !enabled && (len(ca) != 0 || len(cert) != 0 || len(key) != 0 || skipVerify) {
+		return errors.Errorf("--tls-ca, --tls-cert, --tls-key and --tls-skip-verify need --source-tls or --target-tls")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+)
+
+func TestParseUserPassword(t *testing.T) {
+	for _, x := range []struct {
+		s, user, passwd string
+	}{
+		{"default:secret", "default", "secret"},
+		{"app:a:b", "app", "a:b"},
+		{"secret", "", "secret"},
+		{":secret", "", "secret"},
+	} {
+		user, passwd := parseUserPassword(x.s)
+		assert.Must(user == x.user && passwd == x.passwd)
+	}
+}
+
+func TestLoadTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.MustNoError(err)
+	defer os.RemoveAll(dir)
+	bad := dir + "/ca.pem"
+	assert.MustNoError(ioutil.WriteFile(bad, []byte("not a certificate"), 0644))
+
+	c := &connConfig{}
+	assert.MustNoError(c.loadTLS("", "", "", true))
+	assert.Must(c.tls && c.skipVerify && c.roots == nil)
+
+	for _, x := range [][3]string{
+		{dir + "/missing.pem", "", ""},
+		{bad, "", ""},
+		{"", dir + "/cert.pem", ""},
+		{"", "", dir + "/key.pem"},
+		{"", bad, bad},
+	} {
+		assert.Must((&connConfig{}).loadTLS(x[0], x[1], x[2], false) != nil)
+	}
+
+	var n *connConfig
+	assert.Must(n.username() == "")
+	a, b := net.Pipe()
+	defer b.Close()
+	w, err := n.wrap(a, "127.0.0.1:6379")
+	assert.MustNoError(err)
+	assert.Must(w == a)
+}
@@ -0,0 +1,139 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+type typeStatKey struct {
+	db  uint32
+	typ string
+}
+
+// typeStat is a cell of the --type-stats table, bytes counts the key and the
+// dump payload of every key. The cells of --bigkeys count the payload only,
+// and the elements of the keys.
+type typeStat struct {
+	DB       uint32 `json:"db"`
+	Type     string `json:"type"`
+	Keys     int64  `json:"keys"`
+	Bytes    int64  `json:"bytes"`
+	Elements int64  `json:"elements,omitempty"`
+}
+
+// typeStats counts keys per db and type. Every decode worker fills its own
+// and merges it into the shared one when done, so only Merge locks.
+type typeStats struct {
+	mu    sync.Mutex
+	cells map[typeStatKey]*typeStat
+}
+
+func newTypeStats() *typeStats {
+	return &typeStats{cells: make(map[typeStatKey]*typeStat)}
+}
+
+func (s *typeStats) Add(e *rdb.BinEntry) {
+	s.add(typeStatKey{e.DB, rdb.TypeName(e.Value)}, 1, int64(len(e.Key)+len(e.Value)), 0)
+}
+
+func (s *typeStats) add(k typeStatKey, keys, size, elements int64) {
+	c := s.cells[k]
+	if c == nil {
+		c = &typeStat{DB: k.db, Type: k.typ}
+		s.cells[k] = c
+	}
+	c.Keys += keys
+	c.Bytes += size
+	c.Elements += elements
+}
+
+func (s *typeStats) Merge(o *typeStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, x := range o.cells {
+		s.add(k, x.Keys, x.Bytes, x.Elements)
+	}
+}
+
+type sortedTypeStats []*typeStat
+
+func (l sortedTypeStats) Len() int      { return len(l) }
+func (l sortedTypeStats) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l sortedTypeStats) Less(i, j int) bool {
+	if l[i].DB != l[j].DB {
+		return l[i].DB < l[j].DB
+	}
+	return l[i].Type < l[j].Type
+}
+
+// Cells returns the counts ordered by db then type.
+func (s *typeStats) Cells() []*typeStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := make(sortedTypeStats, 0, len(s.cells))
+	for _, c := range s.cells {
+		l = append(l, c)
+	}
+	sort.Sort(l)
+	return l
+}
+
+// Table formats the counts, a line per db and type then the totals.
+func (s *typeStats) Table() string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	s.writeTable(w, false)
+	w.Flush()
+	return b.String()
+}
+
+// writeTable writes the rows of Table, with a column of the elements for
+// --bigkeys.
+func (s *typeStats) writeTable(w io.Writer, elements bool) {
+	row := func(db, typ string, c *typeStat) {
+		if elements {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t\n", db, typ, c.Keys, c.Bytes, c.Elements)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t\n", db, typ, c.Keys, c.Bytes)
+		}
+	}
+	if elements {
+		fmt.Fprintf(w, "db\ttype\tkeys\tbytes\telements\t\n")
+	} else {
+		fmt.Fprintf(w, "db\ttype\tkeys\tbytes\t\n")
+	}
+	total := &typeStat{}
+	for _, c := range s.Cells() {
+		row(fmt.Sprintf("db%d", c.DB), c.Type, c)
+		total.Keys, total.Bytes, total.Elements = total.Keys+c.Keys, total.Bytes+c.Bytes, total.Elements+c.Elements
+	}
+	row("total", "", total)
+}
+
+// WriteSummary writes the decode totals along with the counts as json.
+func (s *typeStats) WriteSummary(w io.Writer, stat *cmdDecodeStat) error {
+	b, err := json.Marshal(&struct {
+		Read    int64       `json:"rbytes"`
+		Write   int64       `json:"wbytes"`
+		Entry   int64       `json:"entry"`
+		Ignore  int64       `json:"ignore"`
+		Skipped int64       `json:"skipped"`
+		Errors  int64       `json:"errors"`
+		Types   []*typeStat `json:"types"`
+	}{stat.rbytes, stat.wbytes, stat.nentry, stat.ignore, stat.skipped, stat.errors, s.Cells()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
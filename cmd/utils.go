@@ -6,6 +6,7 @@ package main
 import (
 	"bufio"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
@@ -23,27 +24,123 @@ import (
 )
 
 func openRedisConn(target, passwd string) redigo.Conn {
-	return redigo.NewConn(openNetConn(target, passwd), 0, 0)
+	if args.cluster != nil {
+		return newClusterConn(args.cluster)
+	}
+	return redigo.NewConn(openTargetConn(target, passwd), 0, 0)
+}
+
+func openSourceRedisConn(master, passwd string) redigo.Conn {
+	return redigo.NewConn(openNetConn(master, passwd, args.sourceConf), 0, 0)
+}
+
+func openTargetConn(target, passwd string) net.Conn {
+	c := countConn(limitConn(openNetConn(target, passwd, args.targetConf)))
+	selectOnConnect(c)
+	return c
+}
+
+// openTargetConnSoft is openTargetConn returning nil when the target can't
+// be reached, for the targets sync connects to again.
+func openTargetConnSoft(target, passwd string) net.Conn {
+	nc := openNetConnSoft(target, passwd, args.targetConf)
+	if nc == nil {
+		return nil
+	}
+	c := countConn(limitConn(nc))
+	selectOnConnect(c)
+	return c
+}
+
+// openTargetStream opens the connection the command stream is written to,
+// the replies of the target are discarded.
+func openTargetStream(target, passwd string) io.WriteCloser {
+	if args.cluster != nil {
+		return openClusterStream(args.cluster)
+	}
+	c := openTargetConn(target, passwd)
+	go func() {
+		p := make([]byte, ReaderBufferSize)
+		for {
+			iocopy(c, ioutil.Discard, p, len(p))
+		}
+	}()
+	return c
+}
+
+// dialNetConn connects to target, through the --socks5 proxy if any, and
+// over TLS if conf asks for it.
+func dialNetConn(target string, conf *connConfig) (net.Conn, error) {
+	var c net.Conn
+	var err error
+	if args.socks5 != nil {
+		c, err = args.socks5.Dial(target)
+	} else {
+		c, err = net.Dial("tcp", target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conf.wrap(c, target)
 }
 
-func openNetConn(target, passwd string) net.Conn {
-	c, err := net.Dial("tcp", target)
+func openNetConn(target, passwd string, conf *connConfig) net.Conn {
+	c, err := dialNetConn(target, conf)
 	if err != nil {
 		log.PanicErrorf(err, "cannot connect to '%s'", target)
 	}
-	authPassword(c, passwd)
+	authPassword(c, conf.username(), passwd)
+	setClientName(c)
 	return c
 }
 
-func openNetConnSoft(target, passwd string) net.Conn {
-	c, err := net.Dial("tcp", target)
+func openNetConnSoft(target, passwd string, conf *connConfig) net.Conn {
+	c, err := dialNetConn(target, conf)
 	if err != nil {
 		return nil
 	}
-	authPassword(c, passwd)
+	authPassword(c, conf.username(), passwd)
+	setClientName(c)
 	return c
 }
 
+// keyText is the key, or an element, as text for json reports, bytes that are
+// not printable or would need escaping are replaced by '.', see key64 for the
+// exact key.
+func keyText(p []byte) string {
+	var b bytes.Buffer
+	for _, c := range p {
+		switch {
+		case c >= '#' && c <= '~':
+			b.WriteByte(c)
+		default:
+			b.WriteByte('.')
+		}
+	}
+	return b.String()
+}
+
+// isStdio reports whether the --input/--output name stands for stdin/stdout,
+// i.e. it is empty or '-'. Unix device paths like /dev/stdin are not used so
+// the same names work on windows.
+func isStdio(name string) bool {
+	return len(name) == 0 || name == "-"
+}
+
+func inputName(name string) string {
+	if isStdio(name) {
+		return "stdin"
+	}
+	return name
+}
+
+func outputName(name string) string {
+	if isStdio(name) {
+		return "stdout"
+	}
+	return name
+}
+
 func openReadFile(name string) (*os.File, int64) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -56,6 +153,31 @@ func openReadFile(name string) (*os.File, int64) {
 	return f, s.Size()
 }
 
+// openInputFile opens --input and seeks to --input-offset. The size, used for
+// progress, is only known for regular files read from the start: devices
+// have none, and an image holding an rdb at an offset usually has more data
+// after it, so both show the total read only.
+func openInputFile(name string) (*os.File, int64) {
+	f, err := os.Open(name)
+	if err != nil {
+		log.PanicErrorf(err, "cannot open file-reader '%s'", name)
+	}
+	s, err := f.Stat()
+	if err != nil {
+		log.PanicErrorf(err, "cannot stat file-reader '%s'", name)
+	}
+	if args.inputOffset != 0 {
+		if _, err := f.Seek(args.inputOffset, 0); err != nil {
+			log.PanicErrorf(err, "cannot seek file-reader '%s' to %d", name, args.inputOffset)
+		}
+		return f, 0
+	}
+	if !s.Mode().IsRegular() {
+		return f, 0
+	}
+	return f, s.Size()
+}
+
 func openWriteFile(name string) *os.File {
 	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
@@ -64,6 +186,14 @@ func openWriteFile(name string) *os.File {
 	return f
 }
 
+func openAppendFile(name string) *os.File {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		log.PanicErrorf(err, "cannot open file-writer '%s'", name)
+	}
+	return f
+}
+
 func openReadWriteFile(name string) *os.File {
 	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
 	if err != nil {
@@ -72,11 +202,16 @@ func openReadWriteFile(name string) *os.File {
 	return f
 }
 
-func authPassword(c net.Conn, passwd string) {
+// authPassword sends AUTH, as the ACL user when there is one (redis 6+).
+func authPassword(c net.Conn, user, passwd string) {
 	if passwd == "" {
 		return
 	}
-	_, err := c.Write(redis.MustEncodeToBytes(redis.NewCommand("auth", passwd)))
+	cmd := redis.NewCommand("auth", passwd)
+	if user != "" {
+		cmd = redis.NewCommand("auth", user, passwd)
+	}
+	_, err := c.Write(redis.MustEncodeToBytes(cmd))
 	if err != nil {
 		log.PanicError(errors.Trace(err), "write auth command failed")
 	}
@@ -89,8 +224,58 @@ func authPassword(c net.Conn, passwd string) {
 	}
 }
 
+// setClientName issues CLIENT SETNAME --client-name, so the connection can
+// be told apart in CLIENT LIST. Servers without CLIENT SETNAME (< 2.6.9) only
+// get a warning.
+func setClientName(c net.Conn) {
+	if args.clientName == "" {
+		return
+	}
+	_, err := c.Write(redis.MustEncodeToBytes(redis.NewCommand("client", "setname", args.clientName)))
+	if err != nil {
+		log.PanicError(errors.Trace(err), "write client setname command failed")
+	}
+	// read byte by byte, the connection is handed over unbuffered.
+	var b bytes.Buffer
+	for p := make([]byte, 1); !bytes.HasSuffix(b.Bytes(), []byte("\r\n")); {
+		if _, err := io.ReadFull(c, p); err != nil {
+			log.PanicError(errors.Trace(err), "read client setname response failed")
+		}
+		b.Write(p)
+	}
+	if s := strings.TrimSpace(b.String()); strings.ToUpper(s) != "+OK" {
+		log.Warnf("client setname '%s' failed: %s", args.clientName, s)
+	}
+}
+
+// selectOnConnect issues SELECT --target-select-on-connect on a freshly opened
+// target connection, so every (re)connect starts from the same baseline db.
+func selectOnConnect(c net.Conn) {
+	if args.selectdb < 0 {
+		return
+	}
+	_, err := c.Write(redis.MustEncodeToBytes(redis.NewCommand("select", args.selectdb)))
+	if err != nil {
+		log.PanicError(errors.Trace(err), "write select command failed")
+	}
+	var b = make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil {
+		log.PanicError(errors.Trace(err), "read select response failed")
+	}
+	if strings.ToUpper(string(b)) != "+OK\r\n" {
+		log.Panicf("select %d on connect failed", args.selectdb)
+	}
+}
+
+func baseTargetDB() uint32 {
+	if args.selectdb < 0 {
+		return 0
+	}
+	return uint32(args.selectdb)
+}
+
 func openSyncConn(target string, passwd string) (net.Conn, <-chan int64) {
-	c := openNetConn(target, passwd)
+	c := openNetConn(target, passwd, args.sourceConf)
 	if _, err := c.Write(redis.MustEncodeToBytes(redis.NewCommand("sync"))); err != nil {
 		log.PanicError(errors.Trace(err), "write sync command failed")
 	}
@@ -155,7 +340,48 @@ func sendPSyncFullsync(br *bufio.Reader, bw *bufio.Writer) (string, int64, <-cha
 	return runid, offset, waitRdbDump(br)
 }
 
-func sendPSyncContinue(br *bufio.Reader, bw *bufio.Writer, runid string, offset int64) {
+// sendPSyncResume asks the master to continue the replication stream of
+// runid at offset+1, the offset of a --state-file. It returns whether the
+// master accepted, otherwise it starts a full resync as sendPSyncFullsync.
+// A replica promoted by a failover continues with a new replication id,
+// which is returned instead of runid.
+func sendPSyncResume(br *bufio.Reader, bw *bufio.Writer, runid string, offset int64) (string, int64, <-chan int64, bool) {
+	cmd := redis.NewCommand("psync", runid, offset+1)
+	if err := redis.Encode(bw, cmd, true); err != nil {
+		log.PanicError(err, "write psync command failed, resume")
+	}
+	r, err := redis.Decode(br)
+	if err != nil {
+		log.PanicError(err, "invalid psync response, resume")
+	}
+	if e, ok := r.(*redis.Error); ok {
+		log.Panicf("invalid psync response, resume, %s", e.Value)
+	}
+	x, err := redis.AsString(r, nil)
+	if err != nil {
+		log.PanicError(err, "invalid psync response, resume")
+	}
+	xx := strings.Split(x, " ")
+	switch {
+	case strings.ToLower(xx[0]) == "continue" && len(xx) <= 2:
+		if len(xx) == 2 {
+			runid = xx[1]
+		}
+		return runid, offset - 1, nil, true
+	case strings.ToLower(xx[0]) == "fullresync" && len(xx) == 3:
+		v, err := strconv.ParseInt(xx[2], 10, 64)
+		if err != nil {
+			log.PanicError(err, "parse psync offset failed")
+		}
+		return xx[1], v - 1, waitRdbDump(br), false
+	}
+	log.Panicf("invalid psync response = '%s', should be continue or fullsync", x)
+	return "", 0, nil, false
+}
+
+// sendPSyncContinue continues the stream of runid after a reconnection, it
+// returns the replication id to go on with, see sendPSyncResume.
+func sendPSyncContinue(br *bufio.Reader, bw *bufio.Writer, runid string, offset int64) string {
 	cmd := redis.NewCommand("psync", runid, offset+2)
 	if err := redis.Encode(bw, cmd, true); err != nil {
 		log.PanicError(err, "write psync command failed, continue")
@@ -172,9 +398,13 @@ func sendPSyncContinue(br *bufio.Reader, bw *bufio.Writer, runid string, offset
 		log.PanicError(err, "invalid psync response, continue")
 	}
 	xx := strings.Split(x, " ")
-	if len(xx) != 1 || strings.ToLower(xx[0]) != "continue" {
+	if len(xx) > 2 || strings.ToLower(xx[0]) != "continue" {
 		log.Panicf("invalid psync response = '%s', should be continue", x)
 	}
+	if len(xx) == 2 {
+		return xx[1]
+	}
+	return runid
 }
 
 func sendPSyncAck(bw *bufio.Writer, offset int64) error {
@@ -192,7 +422,9 @@ func selectDB(c redigo.Conn, db uint32) {
 	}
 }
 
-func restoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
+// restoreTTL returns the ttl in milliseconds to restore the entry with, 0 for
+// keys without expire.
+func restoreTTL(e *rdb.BinEntry) uint64 {
 	var ttlms uint64
 	if e.ExpireAt != 0 {
 		now := uint64(time.Now().Add(args.shift).UnixNano())
@@ -203,19 +435,23 @@ func restoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
 			ttlms = e.ExpireAt - now
 		}
 	}
-    
-	toText := func(p []byte) string {
-		var b bytes.Buffer
-		for _, c := range p {
-			switch {
-			case c >= '#' && c <= '~':
-				b.WriteByte(c)
-			default:
-				b.WriteByte('.')
-			}
-		}
-		return b.String()
-	}
+	return ttlms
+}
+
+// restoreArgs returns the arguments of restoreCmd for the entry, with
+// --replace an existing key is overwritten.
+func restoreArgs(e *rdb.BinEntry) []interface{} {
+	argv := []interface{}{e.Key, restoreTTL(e), e.Value}
+	if args.replace {
+		argv = append(argv, "replace")
+	}
+	return argv
+}
+
+// restoreRdbEntry restores the entry, it only returns the error of a key
+// rebuilt in chunks, see restoreChunked, RESTORE errors are logged.
+func restoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) error {
+	ttlms := restoreTTL(e)
     
     if aggregateKey(e.Key) {
         log.Infof("Aggregate key %s",e.Key)
@@ -228,14 +464,14 @@ func restoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
 	    log.Panicf("unknown object %v", o)
         case rdb.List:
             for _, ele := range obj {
-                _, err := c.Do(aggregateCmd, aggregateTarget, toText(ele))
+                _, err := c.Do(aggregateCmd, aggregateTarget, keyText(ele))
                 if err != nil {
 		    log.PanicError(err, "aggregate error")
 	        }
             }
         case rdb.Set:
             for _, ele := range obj {
-                _, err := c.Do(aggregateCmd, aggregateTarget, toText(ele))
+                _, err := c.Do(aggregateCmd, aggregateTarget, keyText(ele))
                 if err != nil {
 		    log.PanicError(err, "aggregate error")
 	        }
@@ -254,13 +490,13 @@ func restoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
 	    log.Panicf("unknown object %v", o)
         case rdb.Set:
             for _, ele := range obj {
-                _, err := c.Do("zadd", e.Key, 1, toText(ele))
+                _, err := c.Do("zadd", e.Key, 1, keyText(ele))
                 if err != nil {
-                            log.PanicErrorf(err, "set2sorted zadd %s 1 %s", e.Key, toText(ele))
+                            log.PanicErrorf(err, "set2sorted zadd %s 1 %s", e.Key, keyText(ele))
 	            }
             }
         }
-        return
+        return nil
     }
     
     if sorted2setKey(e.Key) {
@@ -273,13 +509,13 @@ func restoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
             log.Panicf("sorted2set key %s type is not sorted set err", e.Key)
         case rdb.ZSet:
             for _, ele := range obj {                
-                _, err := c.Do("sadd", e.Key, toText(ele.Member))
+                _, err := c.Do("sadd", e.Key, keyText(ele.Member))
                 if err != nil {
-                            log.PanicErrorf(err, "sorted2set sadd %s %s", e.Key, toText(ele.Member))
+                            log.PanicErrorf(err, "sorted2set sadd %s %s", e.Key, keyText(ele.Member))
 	            }
             }
         }
-        return
+        return nil
     } 
     
     if (restoreCmd == "del") || (restoreCmd == "DEL") {
@@ -287,8 +523,10 @@ func restoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
 	if err != nil {
         	log.Warnf("delete key: '%s'", e.Key)
 	}
+    } else if rebuilt(e.Value) {
+	return restoreChunked(c, e, ttlms)
     } else {
-    	s, err := redigo.String(c.Do(restoreCmd, e.Key, ttlms, e.Value))
+    	s, err := redigo.String(c.Do(restoreCmd, restoreArgs(e)...))
     
 	if err != nil {
         log.Warnf("restore error, when '%s' '%s'", restoreCmd, e.Key)
@@ -299,6 +537,7 @@ func restoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
 		log.Warnf("restore command response = '%s', should be 'OK'", s)
 	}
     }
+    return nil
 }
 
 func iocopy(r io.Reader, w io.Writer, p []byte, max int) int {
@@ -330,15 +569,35 @@ func newRDBLoader(reader *bufio.Reader, rbytes *atomic2.Int64, size int) chan *r
 	go func() {
 		defer close(pipe)
 		l := rdb.NewLoader(stats.NewCountReader(reader, rbytes))
+		l.SetStrict(args.strict)
 		if err := l.Header(); err != nil {
 			log.PanicError(err, "parse rdb header error")
 		}
+		var n int64
 		for {
 			if entry, err := l.NextBinEntry(); err != nil {
 				log.PanicError(err, "parse rdb entry error")
 			} else {
 				if entry != nil {
-					pipe <- entry
+					if n < resumeEntries {
+						if n++; n == resumeEntries {
+							log.Infof("resume: %d entries skipped", n)
+						}
+						loadPos.entries.Set(n)
+						loadPos.offset.Set(rbytes.Get())
+						continue
+					}
+					if loadersStopped() {
+						return
+					}
+					select {
+					case pipe <- entry:
+					case <-loaderStop:
+						return
+					}
+					n++
+					loadPos.entries.Set(n)
+					loadPos.offset.Set(rbytes.Get())
 				} else {
 					if err := l.Footer(); err != nil {
 						log.PanicError(err, "parse rdb checksum error")
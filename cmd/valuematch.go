@@ -0,0 +1,50 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+)
+
+// valueMatch is the --value-match filter. Values are binary, so both the
+// pattern and the values are matched byte by byte: every byte is read as the
+// character of the same code point (latin-1), '.' matches any single byte and
+// '\xff' matches byte 0xff. UTF-8 text in the pattern still matches the same
+// text in values, but a multi-byte character inside [] stands for its bytes.
+type valueMatch struct {
+	*regexp.Regexp
+}
+
+func newValueMatch(pattern string) (*valueMatch, error) {
+	var b bytes.Buffer
+	for i := 0; i < len(pattern); i++ {
+		b.WriteRune(rune(pattern[i]))
+	}
+	r, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, err
+	}
+	return &valueMatch{r}, nil
+}
+
+func (m *valueMatch) Match(p []byte) bool {
+	return m.MatchReader(&byteRuneReader{p: p})
+}
+
+// byteRuneReader returns every byte of p as a rune, without copying p.
+type byteRuneReader struct {
+	p []byte
+	i int
+}
+
+func (r *byteRuneReader) ReadRune() (rune, int, error) {
+	if r.i == len(r.p) {
+		return 0, 0, io.EOF
+	}
+	c := r.p[r.i]
+	r.i++
+	return rune(c), 1, nil
+}
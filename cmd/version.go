@@ -0,0 +1,165 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
+	"github.com/left2right/redis-port/pkg/rdb"
+)
+
+// redisVersion is a redis_version as reported by INFO, the zero value means
+// the version is unknown.
+type redisVersion struct {
+	major, minor, patch int
+}
+
+func parseRedisVersion(s string) (redisVersion, error) {
+	var v redisVersion
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) > 3 {
+		return v, errors.Errorf("invalid redis version '%s'", s)
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, errors.Errorf("invalid redis version '%s'", s)
+		}
+		switch i {
+		case 0:
+			v.major = n
+		case 1:
+			v.minor = n
+		case 2:
+			v.patch = n
+		}
+	}
+	if v.major == 0 {
+		return v, errors.Errorf("invalid redis version '%s'", s)
+	}
+	return v, nil
+}
+
+func (v redisVersion) String() string {
+	if v.major == 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+func (v redisVersion) atLeast(major, minor int) bool {
+	return v.major > major || (v.major == major && v.minor >= minor)
+}
+
+// targetVersion decides which command variants are sent to the target, it's
+// taken from --target-version, or detected by INFO when the flag is missing.
+var targetVersion redisVersion
+
+// targetVariants are the optional command variants and the first version
+// supporting them.
+var targetVariants = []struct {
+	name         string
+	major, minor int
+}{
+	{"REPLACE", 3, 0},
+	{"UNLINK", 4, 0},
+	{"ABSTTL", 5, 0},
+	{"IDLETIME", 5, 0},
+	{"CREATECONSUMER", 6, 2},
+	{"ENTRIESADDED", 7, 0},
+	{"HEXPIRE", 7, 4},
+}
+
+// targetHas reports whether the target supports the command variant, an
+// unknown target version supports none of them.
+func targetHas(name string) bool {
+	for _, x := range targetVariants {
+		if x.name == name {
+			return targetVersion.atLeast(x.major, x.minor)
+		}
+	}
+	log.Panicf("unknown command variant %s", name)
+	return false
+}
+
+func detectTargetVersion(target, passwd string) redisVersion {
+	c := openRedisConn(target, passwd)
+	defer c.Close()
+	return detectVersion(c, target, ", use --target-version to set it")
+}
+
+func detectSourceVersion(master, passwd string) redisVersion {
+	c := openSourceRedisConn(master, passwd)
+	defer c.Close()
+	return detectVersion(c, master, "")
+}
+
+// detectVersion reads redis_version from INFO, the zero value when it can't,
+// hint is appended to the warning when INFO fails.
+func detectVersion(c redigo.Conn, addr, hint string) redisVersion {
+	info, err := redigo.String(c.Do("info", "server"))
+	if err != nil {
+		log.Warnf("detect version of '%s' failed%s", addr, hint)
+		return redisVersion{}
+	}
+	for _, line := range strings.Split(info, "\n") {
+		if s := strings.TrimPrefix(line, "redis_version:"); s != line {
+			v, err := parseRedisVersion(s)
+			if err != nil {
+				log.Warnf("detect version of '%s' failed: %s", addr, err)
+			}
+			return v
+		}
+	}
+	log.Warnf("detect version of '%s' failed, no redis_version in INFO", addr)
+	return redisVersion{}
+}
+
+// initTargetVersion detects the target version unless --target-version is
+// given, which takes precedence, and logs the variants in use. With several
+// targets the oldest one is used, unknown if any of them is.
+func initTargetVersion(target, passwd string) {
+	source := "--target-version"
+	if targetVersion.major == 0 {
+		targetVersion, source = detectTargetVersion(target, passwd), "INFO"
+		for _, t := range args.targets {
+			if t == target || targetVersion.major == 0 {
+				continue
+			}
+			if v := detectTargetVersion(t, passwd); !v.atLeast(targetVersion.major, targetVersion.minor) {
+				targetVersion = v
+			}
+		}
+	}
+	var names []string
+	for _, x := range targetVariants {
+		if targetHas(x.name) {
+			names = append(names, x.name)
+		}
+	}
+	log.Infof("target version = %s (%s), command variants = [%s]\n", targetVersion, source, strings.Join(names, ","))
+}
+
+// targetRestores reports whether RESTORE on the target understands the
+// encoding of the payload, an unknown target version is assumed to.
+func targetRestores(p []byte) bool {
+	if targetVersion.major == 0 {
+		return true
+	}
+	major, minor := rdb.RestoreVersion(p)
+	return targetVersion.atLeast(major, minor)
+}
+
+// delCmd is the command deleting a key about to be rebuilt.
+func delCmd() string {
+	if targetHas("UNLINK") {
+		return "unlink"
+	}
+	return "del"
+}
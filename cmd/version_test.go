@@ -0,0 +1,36 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+)
+
+func TestParseRedisVersion(t *testing.T) {
+	v, err := parseRedisVersion("7.0")
+	assert.MustNoError(err)
+	assert.Must(v.String() == "7.0.0" && v.atLeast(7, 0) && !v.atLeast(7, 4) && v.atLeast(5, 9))
+	v, err = parseRedisVersion("3.2.12\r")
+	assert.MustNoError(err)
+	assert.Must(v.String() == "3.2.12" && v.atLeast(3, 2) && !v.atLeast(4, 0))
+	for _, s := range []string{"", "seven", "0.1", "7.0.0.1", "7.-1"} {
+		_, err := parseRedisVersion(s)
+		assert.Must(err != nil)
+	}
+}
+
+func TestTargetHas(t *testing.T) {
+	defer func(v redisVersion) {
+		targetVersion = v
+	}(targetVersion)
+
+	targetVersion = redisVersion{}
+	assert.Must(!targetHas("REPLACE") && delCmd() == "del")
+	targetVersion = redisVersion{4, 0, 0}
+	assert.Must(targetHas("REPLACE") && !targetHas("ABSTTL") && delCmd() == "unlink")
+	targetVersion = redisVersion{7, 4, 0}
+	assert.Must(targetHas("HEXPIRE"))
+}
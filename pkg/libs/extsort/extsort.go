@@ -0,0 +1,178 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package extsort
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+)
+
+// LessFunc orders two records.
+type LessFunc func(a, b []byte) bool
+
+// Sorter sorts records that may not fit in memory: records are buffered up to
+// limit bytes, then sorted and spilled to a temporary file, and all runs are
+// merged when iterating. A Sorter is not safe for concurrent use.
+type Sorter struct {
+	dir   string
+	limit int64
+	less  LessFunc
+
+	buf  [][]byte
+	size int64
+	runs []*os.File
+}
+
+// New creates a Sorter spilling to dir (os.TempDir() if empty) whenever more
+// than limit bytes are buffered.
+func New(dir string, limit int64, less LessFunc) *Sorter {
+	return &Sorter{dir: dir, limit: limit, less: less}
+}
+
+// Add buffers a copy of p.
+func (s *Sorter) Add(p []byte) error {
+	s.buf = append(s.buf, append([]byte(nil), p...))
+	s.size += int64(len(p))
+	if s.size >= s.limit {
+		return s.spill()
+	}
+	return nil
+}
+
+// Runs returns the number of runs spilled to disk so far.
+func (s *Sorter) Runs() int {
+	return len(s.runs)
+}
+
+type records struct {
+	p    [][]byte
+	less LessFunc
+}
+
+func (r *records) Len() int           { return len(r.p) }
+func (r *records) Less(i, j int) bool { return r.less(r.p[i], r.p[j]) }
+func (r *records) Swap(i, j int)      { r.p[i], r.p[j] = r.p[j], r.p[i] }
+
+func (s *Sorter) spill() error {
+	sort.Stable(&records{s.buf, s.less})
+	f, err := ioutil.TempFile(s.dir, "extsort")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.runs = append(s.runs, f)
+	w := bufio.NewWriter(f)
+	var n [binary.MaxVarintLen64]byte
+	for _, p := range s.buf {
+		if _, err := w.Write(n[:binary.PutUvarint(n[:], uint64(len(p)))]); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := w.Write(p); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return errors.Trace(err)
+	}
+	s.buf, s.size = nil, 0
+	return nil
+}
+
+// run is a sorted sequence of records, either on disk or in memory.
+type run struct {
+	r    *bufio.Reader
+	p    [][]byte
+	head []byte
+}
+
+func (r *run) next() (bool, error) {
+	if r.r == nil {
+		if len(r.p) == 0 {
+			return false, nil
+		}
+		r.head, r.p = r.p[0], r.p[1:]
+		return true, nil
+	}
+	n, err := binary.ReadUvarint(r.r)
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Trace(err)
+	}
+	r.head = make([]byte, n)
+	if _, err := io.ReadFull(r.r, r.head); err != nil {
+		return false, errors.Trace(err)
+	}
+	return true, nil
+}
+
+type runHeap struct {
+	runs []*run
+	less LessFunc
+}
+
+func (h *runHeap) Len() int           { return len(h.runs) }
+func (h *runHeap) Less(i, j int) bool { return h.less(h.runs[i].head, h.runs[j].head) }
+func (h *runHeap) Swap(i, j int)      { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+func (h *runHeap) Push(x interface{}) { h.runs = append(h.runs, x.(*run)) }
+func (h *runHeap) Pop() interface{} {
+	r := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return r
+}
+
+// Sort calls fn with every record in order, the slice is only valid during the
+// call. Temporary files are removed before Sort returns and the Sorter must
+// not be used afterwards.
+func (s *Sorter) Sort(fn func(p []byte) error) error {
+	defer s.Close()
+	sort.Stable(&records{s.buf, s.less})
+
+	h := &runHeap{less: s.less}
+	for _, f := range s.runs {
+		h.runs = append(h.runs, &run{r: bufio.NewReader(f)})
+	}
+	h.runs = append(h.runs, &run{p: s.buf})
+	for i := len(h.runs) - 1; i >= 0; i-- {
+		if ok, err := h.runs[i].next(); err != nil {
+			return err
+		} else if !ok {
+			h.runs = append(h.runs[:i], h.runs[i+1:]...)
+		}
+	}
+	heap.Init(h)
+	for h.Len() != 0 {
+		r := h.runs[0]
+		if err := fn(r.head); err != nil {
+			return err
+		}
+		if ok, err := r.next(); err != nil {
+			return err
+		} else if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+// Close removes the temporary files.
+func (s *Sorter) Close() error {
+	for _, f := range s.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.runs, s.buf = nil, nil
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package extsort
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+)
+
+func testSort(t *testing.T, n int, limit int64) {
+	less := func(a, b []byte) bool {
+		return bytes.Compare(a, b) < 0
+	}
+	s := New("", limit, less)
+	r := rand.New(rand.NewSource(int64(n)))
+	for i := 0; i < n; i++ {
+		assert.MustNoError(s.Add([]byte(strconv.Itoa(r.Intn(n)))))
+	}
+	var files []string
+	for _, f := range s.runs {
+		files = append(files, f.Name())
+	}
+	var last []byte
+	var count int
+	assert.MustNoError(s.Sort(func(p []byte) error {
+		assert.Must(last == nil || !less(p, last))
+		last = append(last[:0], p...)
+		count++
+		return nil
+	}))
+	assert.Must(count == n)
+	for _, name := range files {
+		_, err := os.Stat(name)
+		assert.Must(os.IsNotExist(err))
+	}
+}
+
+func TestSortInMemory(t *testing.T) {
+	testSort(t, 0, 1024)
+	testSort(t, 1000, 1<<20)
+}
+
+func TestSortSpill(t *testing.T) {
+	testSort(t, 10000, 1024)
+	s := New("", 16, func(a, b []byte) bool { return false })
+	for i := 0; i < 64; i++ {
+		assert.MustNoError(s.Add([]byte("0123456789")))
+	}
+	assert.Must(s.Runs() == 32)
+	s.Close()
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package limiter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/left2right/redis-port/pkg/libs/atomic2"
+)
+
+// Limiter is a token bucket refilled at rate tokens per second, holding at
+// most one second worth of tokens. Requests larger than the bucket are allowed
+// to go into debt, so callers are never starved.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	nthrottle atomic2.Int64
+}
+
+func New(rate int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return int64(l.rate)
+}
+
+// Reserve takes n tokens and returns how long the caller should wait before
+// using them.
+func (l *Limiter) Reserve(n int64) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait blocks until n tokens are available, it returns true if the caller
+// has been throttled.
+func (l *Limiter) Wait(n int64) bool {
+	d := l.Reserve(n)
+	if d <= 0 {
+		return false
+	}
+	l.nthrottle.Incr()
+	time.Sleep(d)
+	return true
+}
+
+// Throttled returns the number of Wait calls that had to sleep.
+func (l *Limiter) Throttled() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.nthrottle.Get()
+}
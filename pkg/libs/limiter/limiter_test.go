@@ -0,0 +1,39 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+)
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter = New(0)
+	assert.Must(l == nil)
+	assert.Must(!l.Wait(1 << 30))
+	assert.Must(l.Throttled() == 0)
+}
+
+func TestLimiter(t *testing.T) {
+	l := New(100)
+	for i := 0; i < 100; i++ {
+		assert.Must(!l.Wait(1))
+	}
+	assert.Must(l.Throttled() == 0)
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		l.Wait(1)
+	}
+	d := time.Since(start)
+	assert.Must(d >= time.Millisecond*150 && d < time.Second)
+	assert.Must(l.Throttled() != 0)
+}
+
+func TestLimiterDebt(t *testing.T) {
+	l := New(1000)
+	assert.Must(l.Reserve(3000) > time.Second)
+}
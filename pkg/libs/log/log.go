@@ -86,6 +86,9 @@ func NopCloser(w io.Writer) io.WriteCloser {
 }
 
 type Logger struct {
+	// nerror and nwarn come first, 64-bit aligned for sync/atomic.
+	nerror, nwarn int64
+
 	mu    sync.Mutex
 	out   io.WriteCloser
 	log   *log.Logger
@@ -358,7 +361,25 @@ func (l *Logger) Println(v ...interface{}) {
 	l.output(1, nil, 0, s)
 }
 
+// Count returns the number of messages of type error or warn written so far.
+func (l *Logger) Count(t LogType) int64 {
+	switch t {
+	case TYPE_ERROR:
+		return atomic.LoadInt64(&l.nerror)
+	case TYPE_WARN:
+		return atomic.LoadInt64(&l.nwarn)
+	}
+	return 0
+}
+
 func (l *Logger) output(traceskip int, err error, t LogType, s string) error {
+	switch t {
+	case TYPE_ERROR:
+		atomic.AddInt64(&l.nerror, 1)
+	case TYPE_WARN:
+		atomic.AddInt64(&l.nwarn, 1)
+	}
+
 	var stack trace.Stack
 	if l.isTraceEnabled(t) {
 		stack = trace.TraceN(traceskip+1, 32)
@@ -391,6 +412,10 @@ func (l *Logger) output(traceskip int, err error, t LogType, s string) error {
 	return l.log.Output(traceskip+2, s)
 }
 
+func Count(t LogType) int64 {
+	return StdLog.Count(t)
+}
+
 func Flags() int {
 	return StdLog.log.Flags()
 }
@@ -0,0 +1,330 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+// Package parquet writes Apache Parquet files with a flat schema of required
+// and optional columns. Values are plain encoded and uncompressed, a column
+// starts a new data page every PageSize bytes and the file a new row group
+// every RowGroupSize bytes.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/left2right/redis-port/pkg/libs/bytesize"
+	"github.com/left2right/redis-port/pkg/libs/errors"
+)
+
+// Type is the physical type of a column.
+type Type int32
+
+const (
+	Int32     Type = 1
+	Int64     Type = 2
+	Double    Type = 5
+	ByteArray Type = 6
+)
+
+const (
+	PageSize     = bytesize.MB
+	RowGroupSize = bytesize.MB * 64
+)
+
+const (
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	convertedUTF8 = 0
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	pageTypeData = 0
+
+	codecUncompressed = 0
+)
+
+var magic = []byte("PAR1")
+
+// Column describes a column, Optional columns accept nil values. UTF8
+// annotates a ByteArray column as text, otherwise it holds raw bytes.
+type Column struct {
+	Name     string
+	Type     Type
+	Optional bool
+	UTF8     bool
+}
+
+type column struct {
+	Column
+
+	// the page being filled: plain encoded values and definition levels.
+	values  bytes.Buffer
+	defs    []byte
+	nvalues int
+
+	// the encoded pages of the current row group.
+	chunk  bytes.Buffer
+	nchunk int64
+}
+
+type chunkMeta struct {
+	offset, size, nvalues int64
+}
+
+type rowGroup struct {
+	chunks []chunkMeta
+	size   int64
+	nrows  int64
+}
+
+// Writer writes rows to a parquet file, Close must be called to write the
+// file metadata. A Writer is not safe for concurrent use.
+type Writer struct {
+	w      io.Writer
+	offset int64
+	cols   []*column
+
+	nrows  int64
+	size   int64
+	total  int64
+	groups []*rowGroup
+}
+
+func NewWriter(w io.Writer, cols []Column) (*Writer, error) {
+	p := &Writer{w: w}
+	for _, c := range cols {
+		switch c.Type {
+		default:
+			return nil, errors.Errorf("column %s: unknown type %d", c.Name, c.Type)
+		case Int32, Int64, Double, ByteArray:
+		}
+		p.cols = append(p.cols, &column{Column: c})
+	}
+	if err := p.write(magic); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Offset returns the number of bytes written to the underlying writer.
+func (w *Writer) Offset() int64 {
+	return w.offset
+}
+
+func (w *Writer) write(p []byte) error {
+	n, err := w.w.Write(p)
+	w.offset += int64(n)
+	return errors.Trace(err)
+}
+
+// Write appends a row, one value per column: int32, int64, float64, []byte or
+// string (for ByteArray) or nil for a null.
+func (w *Writer) Write(row ...interface{}) error {
+	if len(row) != len(w.cols) {
+		return errors.Errorf("row has %d values, expect %d", len(row), len(w.cols))
+	}
+	for i, c := range w.cols {
+		if !c.accept(row[i]) {
+			return errors.Errorf("column %s: unexpected value %T", c.Name, row[i])
+		}
+	}
+	for i, c := range w.cols {
+		n := c.values.Len()
+		c.append(row[i])
+		w.size += int64(c.values.Len() - n)
+		if c.values.Len() >= PageSize {
+			c.flushPage()
+		}
+	}
+	w.nrows++
+	if w.size >= RowGroupSize {
+		return w.flushGroup()
+	}
+	return nil
+}
+
+func (c *column) accept(v interface{}) bool {
+	switch v.(type) {
+	case nil:
+		return c.Optional
+	case int32:
+		return c.Type == Int32
+	case int64:
+		return c.Type == Int64
+	case float64:
+		return c.Type == Double
+	case []byte, string:
+		return c.Type == ByteArray
+	}
+	return false
+}
+
+func (c *column) append(v interface{}) {
+	c.nvalues++
+	if v == nil {
+		c.defs = append(c.defs, 0)
+		return
+	}
+	if c.Optional {
+		c.defs = append(c.defs, 1)
+	}
+	switch x := v.(type) {
+	case int32:
+		binary.Write(&c.values, binary.LittleEndian, x)
+	case int64:
+		binary.Write(&c.values, binary.LittleEndian, x)
+	case float64:
+		binary.Write(&c.values, binary.LittleEndian, x)
+	case []byte:
+		binary.Write(&c.values, binary.LittleEndian, uint32(len(x)))
+		c.values.Write(x)
+	case string:
+		binary.Write(&c.values, binary.LittleEndian, uint32(len(x)))
+		c.values.WriteString(x)
+	}
+}
+
+// encodeLevels encodes definition levels of bit width 1 with the rle/bit
+// packing hybrid, using rle runs only.
+func encodeLevels(defs []byte) []byte {
+	var b bytes.Buffer
+	var p [binary.MaxVarintLen64]byte
+	for i := 0; i < len(defs); {
+		j := i + 1
+		for j < len(defs) && defs[j] == defs[i] {
+			j++
+		}
+		b.Write(p[:binary.PutUvarint(p[:], uint64(j-i)<<1)])
+		b.WriteByte(defs[i])
+		i = j
+	}
+	return b.Bytes()
+}
+
+func (c *column) flushPage() {
+	if c.nvalues == 0 {
+		return
+	}
+	var body bytes.Buffer
+	if c.Optional {
+		levels := encodeLevels(c.defs)
+		binary.Write(&body, binary.LittleEndian, uint32(len(levels)))
+		body.Write(levels)
+	}
+	body.Write(c.values.Bytes())
+
+	var h compactWriter
+	h.BeginStruct()
+	h.I32(1, pageTypeData)
+	h.I32(2, int32(body.Len()))
+	h.I32(3, int32(body.Len()))
+	h.Struct(5)
+	h.I32(1, int32(c.nvalues))
+	h.I32(2, encodingPlain)
+	h.I32(3, encodingRLE)
+	h.I32(4, encodingRLE)
+	h.EndStruct()
+	h.EndStruct()
+
+	c.chunk.Write(h.Bytes())
+	c.chunk.Write(body.Bytes())
+	c.nchunk += int64(c.nvalues)
+	c.values.Reset()
+	c.defs = c.defs[:0]
+	c.nvalues = 0
+}
+
+func (w *Writer) flushGroup() error {
+	if w.nrows == 0 {
+		return nil
+	}
+	g := &rowGroup{nrows: w.nrows}
+	for _, c := range w.cols {
+		c.flushPage()
+		m := chunkMeta{offset: w.offset, size: int64(c.chunk.Len()), nvalues: c.nchunk}
+		if err := w.write(c.chunk.Bytes()); err != nil {
+			return err
+		}
+		g.chunks = append(g.chunks, m)
+		g.size += m.size
+		c.chunk.Reset()
+		c.nchunk = 0
+	}
+	w.groups = append(w.groups, g)
+	w.total += w.nrows
+	w.nrows, w.size = 0, 0
+	return nil
+}
+
+// Close flushes the last row group and writes the file metadata, it doesn't
+// close the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.flushGroup(); err != nil {
+		return err
+	}
+	var f compactWriter
+	f.BeginStruct()
+	f.I32(1, 1)
+	f.List(2, ctStruct, len(w.cols)+1)
+	f.BeginStruct()
+	f.String(4, "schema")
+	f.I32(5, int32(len(w.cols)))
+	f.EndStruct()
+	for _, c := range w.cols {
+		f.BeginStruct()
+		f.I32(1, int32(c.Type))
+		if c.Optional {
+			f.I32(3, repetitionOptional)
+		} else {
+			f.I32(3, repetitionRequired)
+		}
+		f.String(4, c.Name)
+		if c.UTF8 {
+			f.I32(6, convertedUTF8)
+		}
+		f.EndStruct()
+	}
+	f.I64(3, w.total)
+	f.List(4, ctStruct, len(w.groups))
+	for _, g := range w.groups {
+		f.BeginStruct()
+		f.List(1, ctStruct, len(g.chunks))
+		for i, m := range g.chunks {
+			c := w.cols[i]
+			f.BeginStruct()
+			f.I64(2, m.offset)
+			f.Struct(3)
+			f.I32(1, int32(c.Type))
+			f.List(2, ctI32, 2)
+			f.ListI32(encodingPlain)
+			f.ListI32(encodingRLE)
+			f.List(3, ctBinary, 1)
+			f.ListString(c.Name)
+			f.I32(4, codecUncompressed)
+			f.I64(5, m.nvalues)
+			f.I64(6, m.size)
+			f.I64(7, m.size)
+			f.I64(9, m.offset)
+			f.EndStruct()
+			f.EndStruct()
+		}
+		f.I64(2, g.size)
+		f.I64(3, g.nrows)
+		f.EndStruct()
+	}
+	f.String(6, "redis-port")
+	f.EndStruct()
+
+	footer := f.Bytes()
+	if err := w.write(footer); err != nil {
+		return err
+	}
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(footer)))
+	if err := w.write(n[:]); err != nil {
+		return err
+	}
+	return w.write(magic)
+}
@@ -0,0 +1,215 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+)
+
+// compactReader decodes what compactWriter encodes, structs are returned as
+// maps from field id to value.
+type compactReader struct {
+	*bytes.Reader
+}
+
+func (r *compactReader) varint() uint64 {
+	v, err := binary.ReadUvarint(r)
+	assert.MustNoError(err)
+	return v
+}
+
+func (r *compactReader) zigzag() int64 {
+	v := r.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *compactReader) value(t byte) interface{} {
+	switch t {
+	case ctI32, ctI64:
+		return r.zigzag()
+	case ctBinary:
+		p := make([]byte, r.varint())
+		_, err := r.Read(p)
+		assert.MustNoError(err)
+		return string(p)
+	case ctList:
+		h, err := r.ReadByte()
+		assert.MustNoError(err)
+		n := uint64(h >> 4)
+		if n == 15 {
+			n = r.varint()
+		}
+		var l []interface{}
+		for i := uint64(0); i < n; i++ {
+			l = append(l, r.value(h&0xf))
+		}
+		return l
+	case ctStruct:
+		return r.Struct()
+	}
+	assert.Must(false)
+	return nil
+}
+
+func (r *compactReader) Struct() map[int16]interface{} {
+	m := make(map[int16]interface{})
+	var id int16
+	for {
+		h, err := r.ReadByte()
+		assert.MustNoError(err)
+		if h == 0 {
+			return m
+		}
+		if h>>4 != 0 {
+			id += int16(h >> 4)
+		} else {
+			id = int16(r.zigzag())
+		}
+		m[id] = r.value(h & 0xf)
+	}
+}
+
+// readColumn decodes the values of a column chunk, nulls are nil.
+func readColumn(p []byte, c Column, nvalues int64) []interface{} {
+	var values []interface{}
+	r := &compactReader{bytes.NewReader(p)}
+	for int64(len(values)) < nvalues {
+		h := r.Struct()
+		assert.Must(h[1].(int64) == pageTypeData)
+		d := h[5].(map[int16]interface{})
+		n := int(d[1].(int64))
+		body := make([]byte, h[3].(int64))
+		_, err := r.Read(body)
+		assert.MustNoError(err)
+
+		defs := make([]byte, n)
+		for i := range defs {
+			defs[i] = 1
+		}
+		if c.Optional {
+			size := binary.LittleEndian.Uint32(body)
+			l := &compactReader{bytes.NewReader(body[4 : 4+size])}
+			for i := 0; i < n; {
+				run := int(l.varint() >> 1)
+				v, err := l.ReadByte()
+				assert.MustNoError(err)
+				for ; run != 0; run-- {
+					defs[i] = v
+					i++
+				}
+			}
+			body = body[4+size:]
+		}
+		for _, def := range defs {
+			if def == 0 {
+				values = append(values, nil)
+				continue
+			}
+			switch c.Type {
+			case Int32:
+				values = append(values, int32(binary.LittleEndian.Uint32(body)))
+				body = body[4:]
+			case Int64:
+				values = append(values, int64(binary.LittleEndian.Uint64(body)))
+				body = body[8:]
+			case Double:
+				values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(body)))
+				body = body[8:]
+			case ByteArray:
+				size := binary.LittleEndian.Uint32(body)
+				values = append(values, string(body[4:4+size]))
+				body = body[4+size:]
+			}
+		}
+		assert.Must(len(body) == 0)
+	}
+	return values
+}
+
+func TestWriter(t *testing.T) {
+	cols := []Column{
+		{Name: "id", Type: Int64},
+		{Name: "name", Type: ByteArray, UTF8: true},
+		{Name: "score", Type: Double, Optional: true},
+		{Name: "tag", Type: Int32, Optional: true},
+	}
+	row := func(i int) []interface{} {
+		r := []interface{}{int64(i), strconv.Itoa(i), nil, nil}
+		if i%3 == 0 {
+			r[2] = float64(i) / 2
+		}
+		if i%1000 < 10 {
+			r[3] = int32(i)
+		}
+		return r
+	}
+
+	var b bytes.Buffer
+	w, err := NewWriter(&b, cols)
+	assert.MustNoError(err)
+	// enough rows for several pages and two row groups.
+	const n = 4000000
+	for i := 0; i < n; i++ {
+		assert.MustNoError(w.Write(row(i)...))
+	}
+	assert.Must(w.Write(int64(0), "x", nil) != nil)
+	assert.Must(w.Write(nil, "x", nil, nil) != nil)
+	assert.Must(w.Write(int64(0), 1, nil, nil) != nil)
+	assert.MustNoError(w.Close())
+	assert.Must(w.Offset() == int64(b.Len()))
+
+	p := b.Bytes()
+	assert.Must(bytes.Equal(p[:4], magic) && bytes.Equal(p[len(p)-4:], magic))
+	size := binary.LittleEndian.Uint32(p[len(p)-8:])
+	r := &compactReader{bytes.NewReader(p[len(p)-8-int(size) : len(p)-8])}
+	meta := r.Struct()
+	assert.Must(r.Len() == 0)
+	assert.Must(meta[3].(int64) == n)
+
+	schema := meta[2].([]interface{})
+	assert.Must(len(schema) == len(cols)+1)
+	assert.Must(schema[0].(map[int16]interface{})[5].(int64) == int64(len(cols)))
+	for i, c := range cols {
+		s := schema[i+1].(map[int16]interface{})
+		assert.Must(s[4].(string) == c.Name && s[1].(int64) == int64(c.Type))
+		_, utf8 := s[6]
+		assert.Must((s[3].(int64) == repetitionOptional) == c.Optional && utf8 == c.UTF8)
+	}
+
+	groups := meta[4].([]interface{})
+	assert.Must(len(groups) >= 2)
+	var next int
+	for _, x := range groups {
+		g := x.(map[int16]interface{})
+		nrows := g[3].(int64)
+		var rows [][]interface{}
+		for i, y := range g[1].([]interface{}) {
+			m := y.(map[int16]interface{})[3].(map[int16]interface{})
+			assert.Must(m[3].([]interface{})[0].(string) == cols[i].Name)
+			assert.Must(m[5].(int64) == nrows)
+			off, size := m[9].(int64), m[7].(int64)
+			values := readColumn(p[off:off+size], cols[i], nrows)
+			for j, v := range values {
+				if i == 0 {
+					rows = append(rows, make([]interface{}, len(cols)))
+				}
+				rows[j][i] = v
+			}
+		}
+		for _, got := range rows {
+			want := row(next)
+			for i := range want {
+				assert.Must(got[i] == want[i])
+			}
+			next++
+		}
+	}
+	assert.Must(next == n)
+}
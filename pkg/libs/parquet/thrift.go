@@ -0,0 +1,101 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// thrift compact protocol types, just what the file metadata needs.
+const (
+	ctI32    = 5
+	ctI64    = 6
+	ctBinary = 8
+	ctList   = 9
+	ctStruct = 12
+)
+
+// compactWriter encodes a thrift struct with the compact protocol. Fields of
+// every struct must be written in increasing id order.
+type compactWriter struct {
+	b    bytes.Buffer
+	last []int16
+}
+
+func (w *compactWriter) varint(v uint64) {
+	var p [binary.MaxVarintLen64]byte
+	w.b.Write(p[:binary.PutUvarint(p[:], v)])
+}
+
+func (w *compactWriter) zigzag(v int64) {
+	w.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (w *compactWriter) field(id int16, t byte) {
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.b.WriteByte(byte(delta)<<4 | t)
+	} else {
+		w.b.WriteByte(t)
+		w.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (w *compactWriter) BeginStruct() {
+	w.last = append(w.last, 0)
+}
+
+func (w *compactWriter) EndStruct() {
+	w.b.WriteByte(0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+func (w *compactWriter) I32(id int16, v int32) {
+	w.field(id, ctI32)
+	w.zigzag(int64(v))
+}
+
+func (w *compactWriter) I64(id int16, v int64) {
+	w.field(id, ctI64)
+	w.zigzag(v)
+}
+
+func (w *compactWriter) String(id int16, s string) {
+	w.field(id, ctBinary)
+	w.varint(uint64(len(s)))
+	w.b.WriteString(s)
+}
+
+// List starts a list of n elements of type t, the elements follow without
+// field headers.
+func (w *compactWriter) List(id int16, t byte, n int) {
+	w.field(id, ctList)
+	if n < 15 {
+		w.b.WriteByte(byte(n)<<4 | t)
+	} else {
+		w.b.WriteByte(0xf0 | t)
+		w.varint(uint64(n))
+	}
+}
+
+// Struct starts a struct field, to be closed by EndStruct.
+func (w *compactWriter) Struct(id int16) {
+	w.field(id, ctStruct)
+	w.BeginStruct()
+}
+
+func (w *compactWriter) ListI32(v int32) {
+	w.zigzag(int64(v))
+}
+
+func (w *compactWriter) ListString(s string) {
+	w.varint(uint64(len(s)))
+	w.b.WriteString(s)
+}
+
+func (w *compactWriter) Bytes() []byte {
+	return w.b.Bytes()
+}
@@ -5,13 +5,38 @@ package rdb
 
 import (
 	"bytes"
+	"encoding/binary"
+	"math"
 
 	"github.com/cupcake/rdb"
 	"github.com/cupcake/rdb/nopdecoder"
 	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/rdb/digest"
 )
 
 func DecodeDump(p []byte) (interface{}, error) {
+	if len(p) != 0 {
+		switch p[0] {
+		case rdbTypeString:
+			return decodeStringDump(p)
+		case rdbTypeModule2:
+			return decodeModuleDump(p)
+		case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+			return decodeQuicklistDump(p)
+		case rdbTypeZSet2:
+			return decodeZSet2Dump(p)
+		case rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack:
+			return decodeListpackDump(p)
+		case rdbTypeHashMetadataPreGA, rdbTypeHashMetadata:
+			return decodeHashMetadataDump(p)
+		case rdbTypeHashListpackExPreGA, rdbTypeHashListpackEx:
+			return decodeHashListpackExDump(p)
+		case rdbTypeHashZipmap:
+			return decodeZipmapDump(p)
+		case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+			return decodeStreamDump(p)
+		}
+	}
 	d := &decoder{}
 	if err := rdb.DecodeDump(p, 0, nil, 0, d); err != nil {
 		return nil, errors.Trace(err)
@@ -19,6 +44,89 @@ func DecodeDump(p []byte) (interface{}, error) {
 	return d.obj, d.err
 }
 
+// splitDump verifies the checksum of a dump payload and returns the object
+// type and the serialized value between the type byte and the footer.
+func splitDump(p []byte) (byte, []byte, error) {
+	if len(p) < 11 {
+		return 0, nil, errors.Errorf("invalid dump payload, len = %d", len(p))
+	}
+	n := len(p) - 8
+	c := digest.New()
+	c.Write(p[:n])
+	if c.Sum64() != binary.LittleEndian.Uint64(p[n:]) {
+		return 0, nil, errors.Errorf("dump payload checksum validation failed")
+	}
+	return p[0], p[1 : n-2], nil
+}
+
+// decodeStringDump decodes string values with the package's own reader, which
+// understands 64-bit lengths, so values larger than 4GB are not truncated.
+func decodeStringDump(p []byte) (interface{}, error) {
+	_, val, err := splitDump(p)
+	if err != nil {
+		return nil, err
+	}
+	r := newRdbReader(bytes.NewReader(val))
+	s, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	return String(s), nil
+}
+
+// decodeZSet2Dump decodes a zset with binary scores (redis 4.0+).
+func decodeZSet2Dump(p []byte) (interface{}, error) {
+	_, val, err := splitDump(p)
+	if err != nil {
+		return nil, err
+	}
+	r := newRdbReader(bytes.NewReader(val))
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	zset := ZSet{}
+	for i := uint64(0); i < n; i++ {
+		member, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		bits, err := r.readUint64()
+		if err != nil {
+			return nil, err
+		}
+		zset = append(zset, &ZSetElement{Member: member, Score: math.Float64frombits(bits)})
+	}
+	return zset, nil
+}
+
+// decodeModuleDump only decodes the module type id, the value itself is opaque
+// without the module.
+func decodeModuleDump(p []byte) (interface{}, error) {
+	_, val, err := splitDump(p)
+	if err != nil {
+		return nil, err
+	}
+	r := newRdbReader(bytes.NewReader(val))
+	id, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	return newModule(id), nil
+}
+
+const moduleCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// newModule splits a 64-bit module type id into the 9 characters name (6 bits
+// each) and the 10 bits encoding version.
+func newModule(id uint64) Module {
+	var name [9]byte
+	for i := range name {
+		name[i] = moduleCharset[(id>>uint(64-6*(i+1)))&63]
+	}
+	return Module{Name: string(name[:]), Version: int(id & 1023)}
+}
+
 type decoder struct {
 	nopdecoder.NopDecoder
 	obj interface{}
@@ -112,8 +220,18 @@ type Hash []*HashElement
 type ZSet []*ZSetElement
 type Set [][]byte
 
+// Module is a value of a module type, only the type is known.
+type Module struct {
+	Name    string
+	Version int
+}
+
 type HashElement struct {
 	Field, Value []byte
+
+	// ExpireAt is the unix time in ms the field expires at, 0 means it
+	// doesn't expire; only hashes of redis 7.4+ have field expires.
+	ExpireAt uint64
 }
 
 type ZSetElement struct {
@@ -5,10 +5,14 @@ package rdb
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
 	"io"
 
 	"github.com/cupcake/rdb"
 	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/rdb/digest"
 )
 
 type objectEncoder interface {
@@ -102,7 +106,12 @@ func (o Set) encodeValue(enc *rdb.Encoder) error {
 	return nil
 }
 
+// EncodeDump encodes obj as a dump payload, streams are written with the
+// package's own encoder, lengths of stream IDs don't fit in 32 bits.
 func EncodeDump(obj interface{}) ([]byte, error) {
+	if s, ok := obj.(Stream); ok {
+		return s.encodeDump()
+	}
 	o, ok := obj.(objectEncoder)
 	if !ok {
 		return nil, errors.Errorf("unsupported object type")
@@ -168,3 +177,122 @@ func (e *Encoder) EncodeObject(db uint32, key []byte, expireat uint64, obj inter
 	}
 	return nil
 }
+
+// Writer builds a whole rdb file, keys are written to the db selected last.
+// The file is tagged with rdb version 6 and only uses its plain encodings, so
+// it loads in every redis since 2.6.
+type Writer struct {
+	enc *Encoder
+	db  uint32
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: NewEncoder(w)}
+}
+
+func (w *Writer) WriteHeader() error {
+	return w.enc.EncodeHeader()
+}
+
+// WriteFooter writes the EOF opcode and the CRC64 of the whole file.
+func (w *Writer) WriteFooter() error {
+	return w.enc.EncodeFooter()
+}
+
+// SelectDB sets the db of the following keys, SELECTDB is only written
+// before the next key when the db changes.
+func (w *Writer) SelectDB(db uint32) {
+	w.db = db
+}
+
+// WriteString writes a string key, expireat is the unix time in milliseconds
+// the key expires at, or 0 for a key without expire; the same goes for the
+// other types.
+func (w *Writer) WriteString(key, value []byte, expireat uint64) error {
+	return w.enc.EncodeObject(w.db, key, expireat, String(value))
+}
+
+func (w *Writer) WriteList(key []byte, list [][]byte, expireat uint64) error {
+	if len(list) == 0 {
+		return errors.Errorf("empty list '%s'", key)
+	}
+	return w.enc.EncodeObject(w.db, key, expireat, List(list))
+}
+
+func (w *Writer) WriteHash(key []byte, hash Hash, expireat uint64) error {
+	if len(hash) == 0 {
+		return errors.Errorf("empty hash '%s'", key)
+	}
+	return w.enc.EncodeObject(w.db, key, expireat, hash)
+}
+
+func (w *Writer) WriteSet(key []byte, set [][]byte, expireat uint64) error {
+	if len(set) == 0 {
+		return errors.Errorf("empty set '%s'", key)
+	}
+	return w.enc.EncodeObject(w.db, key, expireat, Set(set))
+}
+
+func (w *Writer) WriteZSet(key []byte, zset ZSet, expireat uint64) error {
+	if len(zset) == 0 {
+		return errors.Errorf("empty zset '%s'", key)
+	}
+	return w.enc.EncodeObject(w.db, key, expireat, zset)
+}
+
+// BinWriter builds an rdb file from the entries of a Loader, their payloads
+// are copied as they are. The file keeps the version of the source, so it only
+// loads in redis versions that understand the encodings of the source.
+type BinWriter struct {
+	w   io.Writer
+	crc hash.Hash64
+	db  int64
+}
+
+func NewBinWriter(w io.Writer) *BinWriter {
+	c := digest.New()
+	return &BinWriter{w: io.MultiWriter(w, c), crc: c, db: -1}
+}
+
+func (w *BinWriter) WriteHeader(version int) error {
+	_, err := fmt.Fprintf(w.w, "REDIS%04d", version)
+	return errors.Trace(err)
+}
+
+// WriteEntry writes SELECTDB when the db changes, the expire and the entry.
+func (w *BinWriter) WriteEntry(e *BinEntry) error {
+	if len(e.Value) < 11 {
+		return errors.Errorf("invalid payload of key '%s'", e.Key)
+	}
+	var b []byte
+	if w.db != int64(e.DB) {
+		w.db = int64(e.DB)
+		b = appendLength(append(b, rdbFlagSelectDB), uint64(e.DB))
+	}
+	if e.ExpireAt != 0 {
+		b = appendUint64(append(b, rdbFlagExpiryMS), e.ExpireAt)
+	}
+	b = appendRawString(append(b, e.Value[0]), e.Key)
+	// the dump payload ends with the rdb version and its checksum.
+	b = append(b, e.Value[1:len(e.Value)-10]...)
+	_, err := w.w.Write(b)
+	return errors.Trace(err)
+}
+
+// WriteSection writes a function library or a module aux section, as handed
+// to a SectionFunc.
+func (w *BinWriter) WriteSection(raw []byte) error {
+	if len(raw) == 0 || (raw[0] != rdbFlagFunction2 && raw[0] != rdbFlagModuleAux) {
+		return errors.Errorf("invalid rdb section")
+	}
+	_, err := w.w.Write(raw)
+	return errors.Trace(err)
+}
+
+// WriteFooter writes the EOF opcode and the CRC64 of the whole file.
+func (w *BinWriter) WriteFooter() error {
+	if _, err := w.w.Write([]byte{rdbFlagEOF}); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(binary.Write(w.w, binary.LittleEndian, w.crc.Sum64()))
+}
@@ -45,6 +45,60 @@ func TestEncodeString(t *testing.T) {
 	docheck(b.String())
 }
 
+// TestEncodeIntString checks integer-like strings, counters and the values
+// redis shares, survive encoding: only canonical 32-bit integers are int
+// encoded, anything else such as "007", "+1" or "-0" stays a raw string, so a
+// RESTORE of the payload brings back exactly the same bytes.
+func TestEncodeIntString(t *testing.T) {
+	const raw = -1
+	docheck := func(text string, enc int) {
+		p, err := EncodeDump(toString(text))
+		assert.MustNoError(err)
+		assert.Must(p[0] == rdbTypeString)
+		if enc != raw {
+			assert.Must(p[1] == rdbEncVal<<6|byte(enc))
+		} else {
+			assert.Must(p[1]>>6 == rdb6bitLen && int(p[1]) == len(text))
+			assert.Must(string(p[2:2+len(text)]) == text)
+		}
+		o, err := DecodeDump(p)
+		assert.MustNoError(err)
+		checkString(t, o, text)
+	}
+	for i := -128; i <= 10000; i++ {
+		switch {
+		case i <= 127:
+			docheck(strconv.Itoa(i), rdbEncInt8)
+		case i <= 32767:
+			docheck(strconv.Itoa(i), rdbEncInt16)
+		}
+	}
+	docheck("-129", rdbEncInt16)
+	docheck("32768", rdbEncInt32)
+	docheck("-32769", rdbEncInt32)
+	docheck("2147483647", rdbEncInt32)
+	docheck("-2147483648", rdbEncInt32)
+	for _, s := range []string{"2147483648", "-2147483649", "9223372036854775807",
+		"007", "00", "+1", "-0", " 1", "1 ", "0x10", "1e3", "1.0", "１"} {
+		docheck(s, raw)
+	}
+
+	// elements of aggregates go through the same string encoding.
+	var hash Hash
+	for _, s := range []string{"0", "1", "9999", "10000", "007", "-0", "+1", "2147483648"} {
+		hash = append(hash, &HashElement{Field: []byte(s), Value: []byte(s)})
+	}
+	p, err := EncodeDump(hash)
+	assert.MustNoError(err)
+	o, err := DecodeDump(p)
+	assert.MustNoError(err)
+	x := o.(Hash)
+	assert.Must(len(x) == len(hash))
+	for i := range x {
+		assert.Must(bytes.Equal(x[i].Field, hash[i].Field) && bytes.Equal(x[i].Value, hash[i].Value))
+	}
+}
+
 func toList(list ...string) List {
 	o := List{}
 	for _, e := range list {
@@ -291,3 +345,142 @@ func TestEncodeRdb(t *testing.T) {
 	assert.MustNoError(l.Footer())
 	assert.Must(c.Get() == int64(len(rdb)))
 }
+
+func TestWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	assert.MustNoError(w.WriteHeader())
+	assert.MustNoError(w.WriteString([]byte("string"), []byte("hello"), 0))
+	w.SelectDB(3)
+	assert.MustNoError(w.WriteList([]byte("list"), [][]byte{[]byte("a"), []byte("1")}, 1500000000000))
+	assert.MustNoError(w.WriteHash([]byte("hash"), toHash(map[string]string{"f": "v"}), 0))
+	w.SelectDB(0)
+	assert.MustNoError(w.WriteSet([]byte("set"), [][]byte{[]byte("m")}, 0))
+	assert.MustNoError(w.WriteZSet([]byte("zset"), toZSet(map[string]float64{"m": 1.5}), 1500000000001))
+	assert.Must(w.WriteList([]byte("empty"), nil, 0) != nil)
+	assert.Must(w.WriteZSet([]byte("empty"), ZSet{}, 0) != nil)
+	assert.MustNoError(w.WriteFooter())
+
+	l := NewLoader(bytes.NewReader(b.Bytes()))
+	assert.MustNoError(l.Header())
+	expect := []struct {
+		db       uint32
+		key      string
+		expireat uint64
+	}{
+		{0, "string", 0}, {3, "list", 1500000000000}, {3, "hash", 0}, {0, "set", 0}, {0, "zset", 1500000000001},
+	}
+	for _, x := range expect {
+		e, err := l.NextBinEntry()
+		assert.MustNoError(err)
+		assert.Must(e.DB == x.db && string(e.Key) == x.key && e.ExpireAt == x.expireat)
+		o, err := DecodeDump(e.Value)
+		assert.MustNoError(err)
+		switch x.key {
+		case "string":
+			checkString(t, o, "hello")
+		case "list":
+			checkList(t, o, []string{"a", "1"})
+		case "hash":
+			checkHash(t, o, map[string]string{"f": "v"})
+		case "set":
+			checkSet(t, o, []string{"m"})
+		case "zset":
+			checkZSet(t, o, map[string]float64{"m": 1.5})
+		}
+	}
+	e, err := l.NextBinEntry()
+	assert.MustNoError(err)
+	assert.Must(e == nil)
+	assert.MustNoError(l.Footer())
+}
+
+func TestBinWriter(t *testing.T) {
+	entries := []*BinEntry{
+		{DB: 0, Key: []byte("string"), Value: createValueDump(rdbTypeString, appendRawString(nil, []byte("hello")))},
+		{DB: 3, Key: []byte("set"), Value: createValueDump(rdbTypeSetListpack, appendRawString(nil, newListpack("a", "b"))), ExpireAt: 1500000000000},
+		{DB: 3, Key: []byte("list"), Value: createValueDump(rdbTypeList, appendRawString(appendLength(nil, 1), []byte("x")))},
+		{DB: 0, Key: []byte("empty"), Value: createValueDump(rdbTypeSet, appendLength(nil, 0))},
+	}
+	var b bytes.Buffer
+	w := NewBinWriter(&b)
+	assert.MustNoError(w.WriteHeader(11))
+	for _, e := range entries {
+		assert.MustNoError(w.WriteEntry(e))
+	}
+	assert.Must(w.WriteEntry(&BinEntry{Key: []byte("k"), Value: []byte{0}}) != nil)
+	assert.MustNoError(w.WriteFooter())
+
+	l := NewLoader(bytes.NewReader(b.Bytes()))
+	assert.MustNoError(l.Header())
+	assert.Must(l.Version() == 11)
+	for _, x := range entries {
+		e, err := l.NextBinEntry()
+		assert.MustNoError(err)
+		assert.Must(e.DB == x.DB && bytes.Equal(e.Key, x.Key) && e.ExpireAt == x.ExpireAt && bytes.Equal(e.Value, x.Value))
+	}
+	e, err := l.NextBinEntry()
+	assert.MustNoError(err)
+	assert.Must(e == nil)
+	assert.MustNoError(l.Footer())
+}
+
+func TestBinWriterSections(t *testing.T) {
+	var raw bytes.Buffer
+	raw.WriteByte(rdbFlagModuleAux)
+	raw.Write(appendLength(nil, 1<<10|1))
+	raw.Write([]byte{rdbModuleOpcodeUInt, 2, rdbModuleOpcodeEOF})
+	aux := raw.Bytes()
+	function := appendRawString([]byte{rdbFlagFunction2}, []byte("#!lua name=lib\nredis.register_function('f', function() return 1 end)"))
+	entry := &BinEntry{Key: []byte("string"), Value: createValueDump(rdbTypeString, appendRawString(nil, []byte("hello")))}
+
+	var b bytes.Buffer
+	w := NewBinWriter(&b)
+	assert.MustNoError(w.WriteHeader(10))
+	assert.MustNoError(w.WriteSection(function))
+	assert.MustNoError(w.WriteEntry(entry))
+	assert.MustNoError(w.WriteSection(aux))
+	assert.Must(w.WriteSection([]byte{rdbFlagAux}) != nil)
+	assert.MustNoError(w.WriteFooter())
+
+	// rewrite drops the sections not kept, the output loads as the source does.
+	rewrite := func(p []byte, keep func(kind string) bool) ([]byte, []string) {
+		var out bytes.Buffer
+		var kinds []string
+		l := NewLoader(bytes.NewReader(p))
+		assert.MustNoError(l.Header())
+		w := NewBinWriter(&out)
+		assert.MustNoError(w.WriteHeader(l.Version()))
+		l.SetSection(func(kind string, raw []byte) {
+			kinds = append(kinds, kind)
+			switch kind {
+			case SectionFunction:
+				assert.Must(bytes.Equal(raw, function))
+			case SectionModuleAux:
+				assert.Must(bytes.Equal(raw, aux))
+			}
+			if keep(kind) {
+				assert.MustNoError(w.WriteSection(raw))
+			}
+		})
+		for {
+			e, err := l.NextBinEntry()
+			assert.MustNoError(err)
+			if e == nil {
+				break
+			}
+			assert.Must(bytes.Equal(e.Key, entry.Key) && bytes.Equal(e.Value, entry.Value))
+			assert.MustNoError(w.WriteEntry(e))
+		}
+		assert.MustNoError(l.Footer())
+		assert.MustNoError(w.WriteFooter())
+		return out.Bytes(), kinds
+	}
+	p, kinds := rewrite(b.Bytes(), func(string) bool { return true })
+	assert.Must(bytes.Equal(p, b.Bytes()))
+	assert.Must(len(kinds) == 2 && kinds[0] == SectionFunction && kinds[1] == SectionModuleAux)
+
+	p, _ = rewrite(b.Bytes(), func(kind string) bool { return kind != SectionFunction })
+	_, kinds = rewrite(p, func(string) bool { return true })
+	assert.Must(len(kinds) == 1 && kinds[0] == SectionModuleAux)
+}
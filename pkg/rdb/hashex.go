@@ -0,0 +1,111 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rdb
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+)
+
+// readHashMetadata reads a hashtable hash with field expires (redis 7.4+):
+// the soonest expire, then the length and ttl, field, value of every field.
+// The ttl is 0 for fields without expire, otherwise it's the expire relative
+// to the soonest one plus 1; the pre-GA type has no soonest expire and saves
+// absolute expires.
+func (r *rdbReader) readHashMetadata(t byte) (Hash, error) {
+	var min uint64
+	if t == rdbTypeHashMetadata {
+		n, err := r.readUint64()
+		if err != nil {
+			return nil, err
+		}
+		min = n
+	}
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var hash Hash
+	for i := uint64(0); i < n; i++ {
+		ttl, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		if t == rdbTypeHashMetadata && ttl != 0 {
+			ttl += min - 1
+		}
+		field, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		hash = append(hash, &HashElement{Field: field, Value: value, ExpireAt: ttl})
+	}
+	return hash, nil
+}
+
+// decodeHashMetadataDump decodes a hashtable hash with field expires.
+func decodeHashMetadataDump(p []byte) (interface{}, error) {
+	t, val, err := splitDump(p)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := newRdbReader(bytes.NewReader(val)).readHashMetadata(t)
+	if err != nil {
+		return nil, err
+	}
+	if hash == nil {
+		hash = Hash{}
+	}
+	return hash, nil
+}
+
+// decodeHashListpackExDump decodes a listpack hash with field expires, the
+// listpack holds field, value and expire of every field, the expire is 0 for
+// fields without one. The GA type saves the soonest expire first.
+func decodeHashListpackExDump(p []byte) (interface{}, error) {
+	t, val, err := splitDump(p)
+	if err != nil {
+		return nil, err
+	}
+	r := newRdbReader(bytes.NewReader(val))
+	if t == rdbTypeHashListpackEx {
+		if _, err := r.readUint64(); err != nil {
+			return nil, err
+		}
+	}
+	lp, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	hash := Hash{}
+	var i int
+	err = listpackForEach(lp, func(ele []byte) error {
+		switch i++; i % 3 {
+		case 1:
+			hash = append(hash, &HashElement{Field: ele})
+		case 2:
+			hash[len(hash)-1].Value = ele
+		case 0:
+			ttl, err := strconv.ParseUint(string(ele), 10, 64)
+			if err != nil {
+				return errors.Errorf("invalid field expire '%s'", ele)
+			}
+			hash[len(hash)-1].ExpireAt = ttl
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if i%3 != 0 {
+		return nil, errors.Errorf("invalid listpack length %d", i)
+	}
+	return hash, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb/digest"
+)
+
+func newListpack(eles ...string) []byte {
+	lp := &listpack{}
+	for _, s := range eles {
+		lp.appendString([]byte(s))
+	}
+	return lp.Bytes()
+}
+
+// newRdb74 writes the objects as a REDIS0012 file, preceded by the aux fields,
+// the slot info and a function library a redis 7.4 cluster node saves.
+func newRdb74(objects func(b *bytes.Buffer)) string {
+	var b bytes.Buffer
+	b.WriteString("REDIS0012")
+	b.WriteByte(rdbFlagAux)
+	b.Write(appendRawString(appendRawString(nil, []byte("redis-ver")), []byte("7.4.0")))
+	b.WriteByte(rdbFlagFunction2)
+	b.Write(appendRawString(nil, []byte("#!lua name=lib\nredis.register_function('f', function() return 1 end)")))
+	b.WriteByte(rdbFlagSelectDB)
+	b.WriteByte(0)
+	b.WriteByte(rdbFlagResizeDB)
+	b.Write([]byte{8, 2})
+	b.WriteByte(rdbFlagSlotInfo)
+	b.Write(appendLength(appendLength(appendLength(nil, 12539), 8), 2))
+	objects(&b)
+	b.WriteByte(rdbFlagEOF)
+	c := digest.New()
+	c.Write(b.Bytes())
+	binary.Write(&b, binary.LittleEndian, c.Sum64())
+	return hex.EncodeToString(b.Bytes())
+}
+
+func writeObject(b *bytes.Buffer, t byte, key string, val []byte) {
+	b.WriteByte(t)
+	b.Write(appendRawString(nil, []byte(key)))
+	b.Write(val)
+}
+
+func TestLoadRedis74(t *testing.T) {
+	s := newRdb74(func(b *bytes.Buffer) {
+		writeObject(b, rdbTypeHashListpack, "hash", appendRawString(nil, newListpack("a", "1", "b", "x")))
+		writeObject(b, rdbTypeZSetListpack, "zset", appendRawString(nil, newListpack("m", "1.5", "n", "-2")))
+		writeObject(b, rdbTypeSetListpack, "set", appendRawString(nil, newListpack("x", "y", "7")))
+
+		big := bytes.Repeat([]byte("p"), 100)
+		var v []byte
+		v = appendLength(v, 3)
+		v = appendRawString(appendLength(v, quicklistNodePacked), newListpack("a", "b"))
+		v = appendRawString(appendLength(v, quicklistNodePlain), big)
+		v = appendRawString(appendLength(v, quicklistNodePacked), newListpack("9"))
+		writeObject(b, rdbTypeListQuicklist2, "list", v)
+
+		v = appendLength(nil, 2)
+		v = appendUint64(appendRawString(v, []byte("m")), math.Float64bits(0.1))
+		v = appendUint64(appendRawString(v, []byte("n")), math.Float64bits(math.Inf(-1)))
+		writeObject(b, rdbTypeZSet2, "zset2", v)
+
+		// f1 expires at the soonest expire, f3 2s later and f2 never.
+		v = appendUint64(nil, 1720000000000)
+		v = appendLength(v, 3)
+		v = appendRawString(appendRawString(appendLength(v, 1), []byte("f1")), []byte("v1"))
+		v = appendRawString(appendRawString(appendLength(v, 0), []byte("f2")), []byte("v2"))
+		v = appendRawString(appendRawString(appendLength(v, 2001), []byte("f3")), []byte("v3"))
+		writeObject(b, rdbTypeHashMetadata, "hashex", v)
+
+		v = appendLength(nil, 1)
+		v = appendRawString(appendRawString(appendLength(v, 1720000000000), []byte("f")), []byte("v"))
+		writeObject(b, rdbTypeHashMetadataPreGA, "hashex-rc", v)
+
+		v = appendUint64(nil, 1720000005000)
+		v = appendRawString(v, newListpack("f1", "v1", "0", "f2", "v2", "1720000005000"))
+		writeObject(b, rdbTypeHashListpackEx, "lpex", v)
+	})
+	entries := DecodeHexRdb(t, s, 8)
+
+	docheck := func(key, typ, encoding string, major, minor int) interface{} {
+		e, o := getobj(t, entries, key)
+		assert.Must(TypeName(e.Value) == typ && EncodingName(e.Value) == encoding && !IsEmptyObject(e.Value))
+		x, y := RestoreVersion(e.Value)
+		assert.Must(x == major && y == minor)
+		return o
+	}
+	hash := docheck("hash", "hash", "listpack", 7, 0).(Hash)
+	assert.Must(len(hash) == 2 && string(hash[1].Field) == "b" && string(hash[1].Value) == "x" && hash[1].ExpireAt == 0)
+	zset := docheck("zset", "zset", "listpack", 7, 0).(ZSet)
+	assert.Must(len(zset) == 2 && zset[0].Score == 1.5 && string(zset[1].Member) == "n" && zset[1].Score == -2)
+	set := docheck("set", "set", "listpack", 7, 2).(Set)
+	assert.Must(len(set) == 3 && string(set[2]) == "7")
+	list := docheck("list", "list", "quicklist", 7, 0).(List)
+	assert.Must(len(list) == 4 && string(list[1]) == "b" && len(list[2]) == 100 && string(list[3]) == "9")
+	zset = docheck("zset2", "zset", "skiplist", 4, 0).(ZSet)
+	assert.Must(len(zset) == 2 && zset[0].Score == 0.1 && math.IsInf(zset[1].Score, -1))
+
+	hash = docheck("hashex", "hash", "hashtable", 7, 4).(Hash)
+	assert.Must(len(hash) == 3)
+	assert.Must(hash[0].ExpireAt == 1720000000000 && hash[1].ExpireAt == 0 && hash[2].ExpireAt == 1720000002000)
+	assert.Must(string(hash[2].Field) == "f3" && string(hash[2].Value) == "v3")
+	hash = docheck("hashex-rc", "hash", "hashtable", 7, 4).(Hash)
+	assert.Must(len(hash) == 1 && hash[0].ExpireAt == 1720000000000)
+	hash = docheck("lpex", "hash", "listpackex", 7, 4).(Hash)
+	assert.Must(len(hash) == 2 && hash[0].ExpireAt == 0 && hash[1].ExpireAt == 1720000005000 && string(hash[1].Value) == "v2")
+
+	var eles []string
+	assert.MustNoError(ForEachListElement(entries["list"].Value, func(ele []byte) error {
+		eles = append(eles, string(ele))
+		return nil
+	}))
+	assert.Must(len(eles) == 4 && eles[0] == "a")
+}
+
+func TestLoadRedis74Empty(t *testing.T) {
+	s := newRdb74(func(b *bytes.Buffer) {
+		writeObject(b, rdbTypeSetListpack, "set", appendRawString(nil, newListpack()))
+		writeObject(b, rdbTypeHashMetadata, "hashex", appendLength(appendUint64(nil, 0), 0))
+	})
+	entries := DecodeHexRdb(t, s, 2)
+	for _, key := range []string{"set", "hashex"} {
+		assert.Must(IsEmptyObject(entries[key].Value))
+	}
+
+	// the listpack of a listpackex hash must hold whole fields.
+	v := appendUint64(nil, 0)
+	v = appendRawString(v, newListpack("f1", "v1"))
+	_, err := DecodeDump(createValueDump(rdbTypeHashListpackEx, v))
+	assert.Must(err != nil)
+}
@@ -0,0 +1,279 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+)
+
+const (
+	lpHeaderSize = 6
+	lpUnknownLen = 65535
+
+	lpEncoding7bitUint = 0x00
+	lpEncoding6bitStr  = 0x80
+	lpEncoding13bitInt = 0xc0
+	lpEncoding12bitStr = 0xe0
+	lpEncoding32bitStr = 0xf0
+	lpEncoding16bitInt = 0xf1
+	lpEncoding24bitInt = 0xf2
+	lpEncoding32bitInt = 0xf3
+	lpEncoding64bitInt = 0xf4
+	lpEOF              = 0xff
+)
+
+// listpackForEach calls fn with every entry of a listpack (redis 5+), integer
+// entries are formatted as decimal strings.
+func listpackForEach(p []byte, fn func(ele []byte) error) error {
+	if len(p) < lpHeaderSize+1 {
+		return errors.Errorf("invalid listpack, len = %d", len(p))
+	}
+	if n := binary.LittleEndian.Uint32(p[0:4]); uint64(n) != uint64(len(p)) {
+		return errors.Errorf("invalid listpack, total bytes = %d, len = %d", n, len(p))
+	}
+	var count int
+	i := lpHeaderSize
+	for {
+		if i >= len(p) {
+			return errors.Errorf("invalid listpack, missing end byte")
+		}
+		if p[i] == lpEOF {
+			break
+		}
+		ele, n, err := listpackEntry(p[i:])
+		if err != nil {
+			return err
+		}
+		// skip the entry and its backlen, which is only used to iterate
+		// backwards.
+		if i += n + lpBacklenSize(n); i > len(p) {
+			return errors.Errorf("invalid listpack, truncated entry")
+		}
+		if err := fn(ele); err != nil {
+			return err
+		}
+		count++
+	}
+	if i != len(p)-1 {
+		return errors.Errorf("invalid listpack, %d bytes after end byte", len(p)-1-i)
+	}
+	if n := int(binary.LittleEndian.Uint16(p[4:6])); n != lpUnknownLen && n != count {
+		return errors.Errorf("invalid listpack, num elements = %d, has %d", n, count)
+	}
+	return nil
+}
+
+// decodeListpackDump decodes a hash, zset or set saved as a single listpack
+// (redis 7.0+): field and value, member and score, or the members.
+func decodeListpackDump(p []byte) (interface{}, error) {
+	t, val, err := splitDump(p)
+	if err != nil {
+		return nil, err
+	}
+	lp, err := newRdbReader(bytes.NewReader(val)).readString()
+	if err != nil {
+		return nil, err
+	}
+	var eles [][]byte
+	if err := listpackForEach(lp, func(ele []byte) error {
+		eles = append(eles, ele)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	switch t {
+	case rdbTypeSetListpack:
+		return Set(eles), nil
+	case rdbTypeHashListpack:
+		if len(eles)%2 != 0 {
+			return nil, errors.Errorf("invalid hash listpack length %d", len(eles))
+		}
+		hash := Hash{}
+		for i := 0; i < len(eles); i += 2 {
+			hash = append(hash, &HashElement{Field: eles[i], Value: eles[i+1]})
+		}
+		return hash, nil
+	default:
+		if len(eles)%2 != 0 {
+			return nil, errors.Errorf("invalid zset listpack length %d", len(eles))
+		}
+		zset := ZSet{}
+		for i := 0; i < len(eles); i += 2 {
+			score, err := strconv.ParseFloat(string(eles[i+1]), 64)
+			if err != nil {
+				return nil, errors.Errorf("invalid zset score '%s'", eles[i+1])
+			}
+			zset = append(zset, &ZSetElement{Member: eles[i], Score: score})
+		}
+		return zset, nil
+	}
+}
+
+// listpackEntry parses the entry at the beginning of p, it returns the value
+// and the size of the encoding and the data, without the backlen.
+func listpackEntry(p []byte) ([]byte, int, error) {
+	need := func(n int) error {
+		if len(p) < n {
+			return errors.Errorf("invalid listpack, truncated entry")
+		}
+		return nil
+	}
+	var hdr, size int
+	switch c := p[0]; {
+	case c&0x80 == lpEncoding7bitUint:
+		return []byte(strconv.FormatInt(int64(c), 10)), 1, nil
+	case c&0xc0 == lpEncoding6bitStr:
+		hdr, size = 1, int(c&0x3f)
+	case c&0xe0 == lpEncoding13bitInt:
+		if err := need(2); err != nil {
+			return nil, 0, err
+		}
+		v := int64(int16(uint16(c&0x1f)<<11|uint16(p[1])<<3) >> 3)
+		return []byte(strconv.FormatInt(v, 10)), 2, nil
+	case c&0xf0 == lpEncoding12bitStr:
+		if err := need(2); err != nil {
+			return nil, 0, err
+		}
+		hdr, size = 2, int(c&0x0f)<<8|int(p[1])
+	case c == lpEncoding32bitStr:
+		if err := need(5); err != nil {
+			return nil, 0, err
+		}
+		n, err := lengthToInt(uint64(binary.LittleEndian.Uint32(p[1:5])))
+		if err != nil {
+			return nil, 0, err
+		}
+		hdr, size = 5, n
+	default:
+		switch c {
+		case lpEncoding16bitInt:
+			hdr = 3
+		case lpEncoding24bitInt:
+			hdr = 4
+		case lpEncoding32bitInt:
+			hdr = 5
+		case lpEncoding64bitInt:
+			hdr = 9
+		default:
+			return nil, 0, errors.Errorf("invalid listpack entry encoding %02x", c)
+		}
+		if err := need(hdr); err != nil {
+			return nil, 0, err
+		}
+		var v int64
+		switch b := p[1:hdr]; len(b) {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(b)))
+		case 3:
+			v = int64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8)
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(b)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(b))
+		}
+		return []byte(strconv.FormatInt(v, 10)), hdr, nil
+	}
+	if size > len(p)-hdr {
+		return nil, 0, errors.Errorf("invalid listpack, truncated entry")
+	}
+	return p[hdr : hdr+size], hdr + size, nil
+}
+
+// lpBacklenSize returns the size of the backlen of an entry of n bytes.
+func lpBacklenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// listpack builds a listpack the way redis does, strings holding a canonical
+// int64 are stored int-encoded.
+type listpack struct {
+	buf []byte
+	n   int
+}
+
+func (lp *listpack) appendInt(v int64) {
+	var b [9]byte
+	var n int
+	switch {
+	case v >= 0 && v <= 127:
+		b[0], n = byte(v), 1
+	case v >= -4096 && v <= 4095:
+		b[0], b[1], n = lpEncoding13bitInt|byte(v>>8)&0x1f, byte(v), 2
+	case v >= -32768 && v <= 32767:
+		b[0], n = lpEncoding16bitInt, 3
+		binary.LittleEndian.PutUint16(b[1:], uint16(v))
+	case v >= -8388608 && v <= 8388607:
+		b[0], b[1], b[2], b[3], n = lpEncoding24bitInt, byte(v), byte(v>>8), byte(v>>16), 4
+	case v >= -2147483648 && v <= 2147483647:
+		b[0], n = lpEncoding32bitInt, 5
+		binary.LittleEndian.PutUint32(b[1:], uint32(v))
+	default:
+		b[0], n = lpEncoding64bitInt, 9
+		binary.LittleEndian.PutUint64(b[1:], uint64(v))
+	}
+	lp.appendEntry(b[:n])
+}
+
+func (lp *listpack) appendString(s []byte) {
+	if len(s) != 0 && len(s) <= 20 {
+		if v, err := strconv.ParseInt(string(s), 10, 64); err == nil && strconv.FormatInt(v, 10) == string(s) {
+			lp.appendInt(v)
+			return
+		}
+	}
+	var hdr []byte
+	switch n := len(s); {
+	case n < 64:
+		hdr = []byte{lpEncoding6bitStr | byte(n)}
+	case n < 4096:
+		hdr = []byte{lpEncoding12bitStr | byte(n>>8), byte(n)}
+	default:
+		hdr = []byte{lpEncoding32bitStr, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(hdr[1:], uint32(n))
+	}
+	lp.appendEntry(append(hdr, s...))
+}
+
+// appendEntry appends an encoded entry followed by its backlen, the length
+// in big endian groups of 7 bits, every byte but the first has the high bit
+// set.
+func (lp *listpack) appendEntry(p []byte) {
+	lp.buf = append(lp.buf, p...)
+	l := uint64(len(p))
+	for i := lpBacklenSize(len(p)) - 1; i >= 0; i-- {
+		b := byte(l>>uint(7*i)) & 127
+		if i != lpBacklenSize(len(p))-1 {
+			b |= 128
+		}
+		lp.buf = append(lp.buf, b)
+	}
+	lp.n++
+}
+
+// Bytes returns the listpack with its header and end byte.
+func (lp *listpack) Bytes() []byte {
+	p := make([]byte, lpHeaderSize, lpHeaderSize+len(lp.buf)+1)
+	p = append(append(p, lp.buf...), lpEOF)
+	binary.LittleEndian.PutUint32(p[0:4], uint32(len(p)))
+	n := lp.n
+	if n >= lpUnknownLen {
+		n = lpUnknownLen
+	}
+	binary.LittleEndian.PutUint16(p[4:6], uint16(n))
+	return p
+}
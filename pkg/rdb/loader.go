@@ -8,9 +8,12 @@ import (
 	"encoding/binary"
 	"hash"
 	"io"
+	"math"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/left2right/redis-port/pkg/libs/errors"
+	"github.com/left2right/redis-port/pkg/libs/log"
 	"github.com/left2right/redis-port/pkg/rdb/digest"
 )
 
@@ -18,8 +21,35 @@ type Loader struct {
 	*rdbReader
 	crc hash.Hash64
 	db  uint32
+
+	// rdb files before version 5 (redis 2.6) end without checksum.
+	nocrc   bool
+	version int
+
+	nentry   int64
+	progress ProgressFunc
+	busy     int32
+
+	aux     func(key, value []byte)
+	section SectionFunc
+
+	strict bool
 }
 
+// The kinds of the sections handed to a SectionFunc.
+const (
+	SectionFunction  = "function"
+	SectionModuleAux = "module-aux"
+)
+
+// SectionFunc receives a section of the rdb that holds no key, a function
+// library or a module aux section, as the bytes of the rdb, opcode included,
+// for BinWriter.WriteSection.
+type SectionFunc func(kind string, raw []byte)
+
+// ProgressFunc receives the number of bytes read and entries parsed so far.
+type ProgressFunc func(nread, nentry int64)
+
 func NewLoader(r io.Reader) *Loader {
 	l := &Loader{}
 	l.crc = digest.New()
@@ -37,13 +67,100 @@ func (l *Loader) Header() error {
 	}
 	if version, err := strconv.ParseInt(string(header[5:]), 10, 64); err != nil {
 		return errors.Trace(err)
-	} else if version <= 0 || version > Version {
+	} else if version <= 0 || version > MaxVersion {
 		return errors.Errorf("verify version, invalid RDB version number %d", version)
+	} else {
+		l.nocrc = version < 5
+		l.version = int(version)
 	}
 	return nil
 }
 
+// Version returns the rdb version of the header.
+func (l *Loader) Version() int {
+	return l.version
+}
+
+// Offset returns the number of bytes consumed from the underlying reader.
+func (l *Loader) Offset() int64 {
+	return l.offset()
+}
+
+// Entries returns the number of entries returned by NextBinEntry so far.
+func (l *Loader) Entries() int64 {
+	return l.nentry
+}
+
+// SetProgress registers f to be told about progress after every entry.
+//
+// f runs on its own goroutine so a slow callback never stalls the parser: while
+// a previous call is still running, newer updates are dropped rather than
+// queued, so f sees a monotonic but possibly sparse sequence. Calls never
+// overlap. Use Offset and Entries for the exact totals once loading is done.
+func (l *Loader) SetProgress(f ProgressFunc) {
+	l.progress = f
+}
+
+// SetAux registers f to be called with every aux field (e.g. redis-ver, lua)
+// of the rdb, on the goroutine calling NextBinEntry.
+func (l *Loader) SetAux(f func(key, value []byte)) {
+	l.aux = f
+}
+
+// SetSection registers f to be called with every function library and module
+// aux section, they are skipped otherwise.
+func (l *Loader) SetSection(f SectionFunc) {
+	l.section = f
+}
+
+// record runs read, and hands the bytes it read to the SectionFunc, preceded
+// by the opcode t.
+func (l *Loader) record(kind string, t byte, read func() error) error {
+	if l.section == nil {
+		return read()
+	}
+	b := &bytes.Buffer{}
+	b.WriteByte(t)
+	l.rec = b
+	err := read()
+	l.rec = nil
+	if err != nil {
+		return err
+	}
+	l.section(kind, b.Bytes())
+	return nil
+}
+
+// SetStrict makes the loader fail on anything it otherwise tolerates: aux
+// fields it doesn't know and module aux sections with a malformed 'when'.
+// Unknown opcodes and object types are always errors, in strict mode the
+// error tells the offset and the opcode byte.
+func (l *Loader) SetStrict(strict bool) {
+	l.strict = strict
+}
+
+// knownAux are the aux fields written by redis up to 7.x.
+var knownAux = map[string]bool{
+	"redis-ver": true, "redis-bits": true, "ctime": true, "used-mem": true,
+	"aof-preamble": true, "aof-base": true, "lua": true,
+	"repl-stream-db": true, "repl-id": true, "repl-offset": true,
+}
+
+func (l *Loader) report() {
+	if l.progress == nil || !atomic.CompareAndSwapInt32(&l.busy, 0, 1) {
+		return
+	}
+	f, nread, nentry := l.progress, l.offset(), l.nentry
+	go func() {
+		defer atomic.StoreInt32(&l.busy, 0)
+		f(nread, nentry)
+	}()
+}
+
 func (l *Loader) Footer() error {
+	if l.nocrc {
+		return nil
+	}
 	crc1 := l.crc.Sum64()
 	if crc2, err := l.readUint64(); err != nil {
 		return err
@@ -93,51 +210,294 @@ func (e *ObjEntry) BinEntry() (*BinEntry, error) {
 	}, nil
 }
 
+// opcodeHandler reads the opcode t found at offset off, anything but an
+// object or the end of the rdb; entry is the one being read, which an opcode
+// like the expires applies to.
+type opcodeHandler func(l *Loader, t byte, entry *BinEntry, off int64) error
+
+// opcodes are the handlers of the opcodes read before the next object. The
+// rdb has no generic framing, so an opcode can only be read or skipped when
+// its handler knows how long its body is; supporting a new one only needs an
+// entry here.
+var opcodes = map[byte]opcodeHandler{
+	rdbFlagExpiryMS: func(l *Loader, t byte, entry *BinEntry, off int64) error {
+		ttlms, err := l.readUint64()
+		if err != nil {
+			return err
+		}
+		entry.ExpireAt = ttlms
+		return nil
+	},
+	rdbFlagExpiry: func(l *Loader, t byte, entry *BinEntry, off int64) error {
+		ttls, err := l.readUint32()
+		if err != nil {
+			return err
+		}
+		entry.ExpireAt = uint64(ttls) * 1000
+		return nil
+	},
+	rdbFlagSelectDB: func(l *Loader, t byte, entry *BinEntry, off int64) error {
+		dbnum, err := l.readLength()
+		if err != nil {
+			return err
+		}
+		if dbnum > math.MaxUint32 {
+			return errors.Errorf("invalid db number %d", dbnum)
+		}
+		l.db = uint32(dbnum)
+		return nil
+	},
+	rdbFlagResizeDB: func(l *Loader, t byte, entry *BinEntry, off int64) error {
+		return l.skipLengths(2)
+	},
+	// slot info of redis 7.4 cluster nodes: slot, its size and the number
+	// of its keys with an expire, hints only used to resize the dicts.
+	rdbFlagSlotInfo: func(l *Loader, t byte, entry *BinEntry, off int64) error {
+		return l.skipLengths(3)
+	},
+	rdbFlagAux: func(l *Loader, t byte, entry *BinEntry, off int64) error {
+		key, err := l.readString()
+		if err != nil {
+			return err
+		}
+		value, err := l.readString()
+		if err != nil {
+			return err
+		}
+		if l.strict && !knownAux[string(key)] {
+			return errors.Errorf("rdb: unknown aux field '%s' at offset %d", key, off)
+		}
+		if l.aux != nil {
+			l.aux(key, value)
+		}
+		return nil
+	},
+	rdbFlagIdle: func(l *Loader, t byte, entry *BinEntry, off int64) error {
+		return l.skipLengths(1)
+	},
+	rdbFlagFreq: func(l *Loader, t byte, entry *BinEntry, off int64) error {
+		_, err := l.readUint8()
+		return err
+	},
+	rdbFlagModuleAux: func(l *Loader, t byte, entry *BinEntry, off int64) error {
+		return l.record(SectionModuleAux, t, func() error {
+			_, warn, err := l.skipModuleAux()
+			if err != nil {
+				return err
+			}
+			if len(warn) != 0 {
+				if l.strict {
+					return errors.Errorf("rdb: %s, opcode %02x at offset %d", warn, t, off)
+				}
+				log.Warnf("rdb: %s", warn)
+			}
+			return nil
+		})
+	},
+	// a function library of redis 7.0+, its code is skipped since it can't
+	// be restored key by key, unless a SectionFunc copies it.
+	rdbFlagFunction2: func(l *Loader, t byte, entry *BinEntry, off int64) error {
+		return l.record(SectionFunction, t, func() error {
+			code, err := l.readString()
+			if err != nil {
+				return err
+			}
+			if l.section == nil {
+				log.Warnf("rdb: function library of %d bytes at offset %d skipped, FUNCTION LOAD it on the target", len(code), off)
+			}
+			return nil
+		})
+	},
+	rdbFlagFunctionPreGA: func(l *Loader, t byte, entry *BinEntry, off int64) error {
+		return errors.Errorf("rdb: pre-release function format at offset %d is not supported", off)
+	},
+}
+
+func (l *Loader) skipLengths(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := l.readLength(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (l *Loader) NextBinEntry() (*BinEntry, error) {
 	var entry = &BinEntry{}
 	for {
+		off := l.offset()
 		t, err := l.readByte()
 		if err != nil {
 			return nil, err
 		}
-		switch t {
-		case rdbFlagExpiryMS:
-			ttlms, err := l.readUint64()
-			if err != nil {
-				return nil, err
-			}
-			entry.ExpireAt = ttlms
-		case rdbFlagExpiry:
-			ttls, err := l.readUint32()
-			if err != nil {
-				return nil, err
-			}
-			entry.ExpireAt = uint64(ttls) * 1000
-		case rdbFlagSelectDB:
-			dbnum, err := l.readLength()
-			if err != nil {
+		if h := opcodes[t]; h != nil {
+			if err := h(l, t, entry, off); err != nil {
 				return nil, err
 			}
-			l.db = dbnum
+			continue
+		}
+		switch t {
 		case rdbFlagEOF:
 			return nil, nil
 		default:
+			if l.strict && !isObjectType(t) {
+				return nil, errors.Errorf("rdb: unknown opcode %02x at offset %d", t, off)
+			}
 			key, err := l.readString()
 			if err != nil {
 				return nil, err
 			}
 			val, err := l.readObjectValue(t)
 			if err != nil {
+				if l.strict {
+					return nil, errors.Errorf("rdb: %s, opcode %02x at offset %d", err, t, off)
+				}
 				return nil, err
 			}
 			entry.DB = l.db
 			entry.Key = key
 			entry.Value = createValueDump(t, val)
+			l.nentry++
+			l.report()
 			return entry, nil
 		}
 	}
 }
 
+// IsEmptyObject reports whether the dump payload holds a list, set, zset or
+// hash without any element. Redis never saves such keys, but corrupt dumps may
+// contain them and RESTORE rejects them. Only the object header is parsed.
+func IsEmptyObject(p []byte) bool {
+	if len(p) == 0 {
+		return false
+	}
+	r := newRdbReader(bytes.NewReader(p[1:]))
+	switch p[0] {
+	case rdbTypeList, rdbTypeSet, rdbTypeZSet, rdbTypeHash, rdbTypeListQuicklist:
+		n, err := r.readLength()
+		return err == nil && n == 0
+	case rdbTypeListZiplist, rdbTypeZSetZiplist, rdbTypeHashZiplist:
+		b, err := r.readString()
+		return err == nil && len(b) >= 10 && binary.LittleEndian.Uint16(b[8:10]) == 0
+	case rdbTypeSetIntset:
+		b, err := r.readString()
+		return err == nil && len(b) >= 8 && binary.LittleEndian.Uint32(b[4:8]) == 0
+	case rdbTypeHashZipmap:
+		b, err := r.readString()
+		return err == nil && len(b) != 0 && b[0] == 0
+	case rdbTypeZSet2, rdbTypeListQuicklist2, rdbTypeHashMetadataPreGA:
+		n, err := r.readLength()
+		return err == nil && n == 0
+	case rdbTypeHashMetadata:
+		if _, err := r.readUint64(); err != nil {
+			return false
+		}
+		n, err := r.readLength()
+		return err == nil && n == 0
+	case rdbTypeHashListpackEx:
+		if _, err := r.readUint64(); err != nil {
+			return false
+		}
+		fallthrough
+	case rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack, rdbTypeHashListpackExPreGA:
+		b, err := r.readString()
+		return err == nil && len(b) >= lpHeaderSize && binary.LittleEndian.Uint16(b[4:6]) == 0
+	}
+	return false
+}
+
+// TypeName returns the redis type of a dump payload, as reported by TYPE.
+func TypeName(p []byte) string {
+	if len(p) == 0 {
+		return "none"
+	}
+	switch p[0] {
+	case rdbTypeString:
+		return "string"
+	case rdbTypeList, rdbTypeListZiplist, rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return "list"
+	case rdbTypeSet, rdbTypeSetIntset, rdbTypeSetListpack:
+		return "set"
+	case rdbTypeZSet, rdbTypeZSet2, rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		return "zset"
+	case rdbTypeHash, rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack:
+		return "hash"
+	case rdbTypeHashMetadataPreGA, rdbTypeHashListpackExPreGA, rdbTypeHashMetadata, rdbTypeHashListpackEx:
+		return "hash"
+	case rdbTypeModule, rdbTypeModule2:
+		return "module"
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return "stream"
+	}
+	return "unknown"
+}
+
+// EncodingName returns the encoding of a dump payload as saved in the rdb,
+// taken from its type opcode and, for strings, the length prefix: int and
+// lzf strings are raw once loaded, the others match OBJECT ENCODING.
+func EncodingName(p []byte) string {
+	if len(p) == 0 {
+		return "none"
+	}
+	switch p[0] {
+	case rdbTypeString:
+		if len(p) >= 2 && p[1]>>6 == rdbEncVal {
+			switch p[1] & 0x3f {
+			case rdbEncInt8, rdbEncInt16, rdbEncInt32:
+				return "int"
+			case rdbEncLZF:
+				return "lzf"
+			}
+		}
+		return "raw"
+	case rdbTypeList:
+		return "linkedlist"
+	case rdbTypeSet, rdbTypeHash, rdbTypeHashMetadataPreGA, rdbTypeHashMetadata:
+		return "hashtable"
+	case rdbTypeZSet, rdbTypeZSet2:
+		return "skiplist"
+	case rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack:
+		return "listpack"
+	case rdbTypeHashListpackExPreGA, rdbTypeHashListpackEx:
+		return "listpackex"
+	case rdbTypeHashZipmap:
+		return "zipmap"
+	case rdbTypeListZiplist, rdbTypeZSetZiplist, rdbTypeHashZiplist:
+		return "ziplist"
+	case rdbTypeSetIntset:
+		return "intset"
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return "quicklist"
+	case rdbTypeModule, rdbTypeModule2:
+		return "module"
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return "stream"
+	}
+	return "unknown"
+}
+
+// RestoreVersion returns the oldest redis version whose RESTORE understands
+// the encoding of a dump payload.
+func RestoreVersion(p []byte) (major, minor int) {
+	if len(p) != 0 {
+		switch p[0] {
+		case rdbTypeListQuicklist:
+			return 3, 2
+		case rdbTypeModule, rdbTypeModule2, rdbTypeZSet2:
+			return 4, 0
+		case rdbTypeStreamListpacks:
+			return 5, 0
+		case rdbTypeStreamListpacks2, rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeListQuicklist2:
+			return 7, 0
+		case rdbTypeStreamListpacks3, rdbTypeSetListpack:
+			return 7, 2
+		case rdbTypeHashMetadataPreGA, rdbTypeHashListpackExPreGA, rdbTypeHashMetadata, rdbTypeHashListpackEx:
+			return 7, 4
+		}
+	}
+	return 2, 6
+}
+
 func createValueDump(t byte, val []byte) []byte {
 	var b bytes.Buffer
 	c := digest.New()
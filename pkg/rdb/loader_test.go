@@ -5,6 +5,7 @@ package rdb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"math"
@@ -13,6 +14,7 @@ import (
 	"testing"
 
 	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb/digest"
 )
 
 func DecodeHexRdb(t *testing.T, s string, n int) map[string]*BinEntry {
@@ -74,6 +76,10 @@ func TestLoadIntString(t *testing.T) {
 		val := obj.(String)
 		assert.Must(bytes.Equal([]byte(val), []byte(strconv.Itoa(value))))
 	}
+	e, _ := getobj(t, entries, "string_1")
+	assert.Must(EncodingName(e.Value) == "int")
+	e, _ = getobj(t, entries, "string_4294967296")
+	assert.Must(EncodingName(e.Value) == "raw")
 }
 
 /*
@@ -141,7 +147,8 @@ func TestLoadLongString(t *testing.T) {
 		e0ff01e0ff01e0ff01e0ff01e03201013031ffdfdb02bd6d5da5e6
 	`
 	entries := DecodeHexRdb(t, s, 1)
-	_, obj := getobj(t, entries, "string_long")
+	e, obj := getobj(t, entries, "string_long")
+	assert.Must(EncodingName(e.Value) == "lzf")
 	val := []byte(obj.(String))
 	for i := 0; i < (1 << 15); i++ {
 		var c uint8 = '0'
@@ -224,7 +231,8 @@ func TestLoadSetAndSetIntset(t *testing.T) {
 	`
 	entries := DecodeHexRdb(t, s, 2)
 
-	_, obj1 := getobj(t, entries, "set1")
+	e1, obj1 := getobj(t, entries, "set1")
+	assert.Must(EncodingName(e1.Value) == "intset")
 	val1 := obj1.(Set)
 	set1 := make(map[string]bool)
 	for _, mem := range val1 {
@@ -237,7 +245,8 @@ func TestLoadSetAndSetIntset(t *testing.T) {
 		assert.Must(ok)
 	}
 
-	_, obj2 := getobj(t, entries, "set2")
+	e2, obj2 := getobj(t, entries, "set2")
+	assert.Must(EncodingName(e2.Value) == "hashtable")
 	val2 := obj2.(Set)
 	set2 := make(map[string]bool)
 	for _, mem := range val2 {
@@ -358,3 +367,272 @@ func TestLoadZSetAndZSetZiplist(t *testing.T) {
 		assert.Must(math.Abs(score+float64(i)) < 1e-10)
 	}
 }
+
+func TestLoadLengthEncoding(t *testing.T) {
+	values := map[string]string{
+		"00":                 "",
+		"05":                 "hello",
+		"4005":               "hello",
+		"8000000005":         "hello",
+		"810000000000000005": "hello",
+	}
+	for prefix, value := range values {
+		p, err := hex.DecodeString(prefix)
+		assert.MustNoError(err)
+		r := newRdbReader(bytes.NewReader(append(p, value...)))
+		b, err := r.readString()
+		assert.MustNoError(err)
+		assert.Must(string(b) == value)
+
+		o, err := DecodeDump(createValueDump(rdbTypeString, append(p, value...)))
+		assert.MustNoError(err)
+		checkString(t, o, value)
+	}
+
+	p, err := hex.DecodeString("82")
+	assert.MustNoError(err)
+	_, err = newRdbReader(bytes.NewReader(p)).readString()
+	assert.Must(err != nil)
+
+	_, err = lengthToInt(uint64(maxInt) + 1)
+	assert.Must(err != nil)
+}
+
+func TestLoadEmptyAggregate(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	assert.MustNoError(enc.EncodeHeader())
+	assert.MustNoError(enc.EncodeObject(0, []byte("list"), 0, List{}))
+	assert.MustNoError(enc.EncodeObject(0, []byte("list1"), 0, toList("a")))
+	assert.MustNoError(enc.EncodeObject(0, []byte("hash"), 0, Hash{}))
+	assert.MustNoError(enc.EncodeObject(0, []byte("string"), 0, toString("")))
+	assert.MustNoError(enc.EncodeFooter())
+
+	l := NewLoader(bytes.NewReader(b.Bytes()))
+	assert.MustNoError(l.Header())
+	empty := make(map[string]bool)
+	for {
+		e, err := l.NextBinEntry()
+		assert.MustNoError(err)
+		if e == nil {
+			break
+		}
+		empty[string(e.Key)] = IsEmptyObject(e.Value)
+	}
+	assert.MustNoError(l.Footer())
+	assert.Must(len(empty) == 4)
+	assert.Must(empty["list"] && empty["hash"])
+	assert.Must(!empty["list1"] && !empty["string"])
+
+	_, obj := getobj(t, map[string]*BinEntry{"list": &BinEntry{Value: createValueDump(rdbTypeList, []byte{0})}}, "list")
+	assert.Must(len(obj.(List)) == 0)
+
+	ziplist, err := hex.DecodeString("0b0000000a000000" + "0000" + "ff")
+	assert.MustNoError(err)
+	assert.Must(IsEmptyObject(createValueDump(rdbTypeListZiplist, append([]byte{byte(len(ziplist))}, ziplist...))))
+}
+
+func TestLoadProgress(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	assert.MustNoError(enc.EncodeHeader())
+	for i := 0; i < 100; i++ {
+		assert.MustNoError(enc.EncodeObject(0, []byte(strconv.Itoa(i)), 0, toString("v")))
+	}
+	assert.MustNoError(enc.EncodeFooter())
+
+	type update struct {
+		nread, nentry int64
+	}
+	updates := make(chan update, 128)
+	block := make(chan struct{})
+
+	l := NewLoader(bytes.NewReader(b.Bytes()))
+	l.SetProgress(func(nread, nentry int64) {
+		updates <- update{nread, nentry}
+		<-block
+	})
+	assert.MustNoError(l.Header())
+	for {
+		e, err := l.NextBinEntry()
+		assert.MustNoError(err)
+		if e == nil {
+			break
+		}
+	}
+	assert.MustNoError(l.Footer())
+	assert.Must(l.Entries() == 100)
+	assert.Must(l.Offset() == int64(b.Len()))
+
+	// the callback is still blocked, so the parser went on without it
+	u := <-updates
+	assert.Must(u.nentry == 1 && u.nread > 0)
+	close(block)
+}
+
+func TestLoadModule(t *testing.T) {
+	// module type id of "ReJSON-RL" with encoding version 3
+	var id uint64
+	for _, c := range "ReJSON-RL" {
+		id = id<<6 | uint64(strings.IndexRune(moduleCharset, c))
+	}
+	id = id<<10 | 3
+
+	var b bytes.Buffer
+	writeLength := func(n uint64) {
+		b.WriteByte(rdb64bitLenByte)
+		binary.Write(&b, binary.BigEndian, n)
+	}
+	writeString := func(s string) {
+		b.WriteByte(byte(len(s)))
+		b.WriteString(s)
+	}
+	b.WriteString("REDIS0009")
+	b.WriteByte(rdbFlagAux)
+	writeString("redis-ver")
+	writeString("5.0.0")
+	b.WriteByte(rdbFlagSelectDB)
+	b.WriteByte(0)
+	b.WriteByte(rdbFlagResizeDB)
+	b.WriteByte(2)
+	b.WriteByte(0)
+	b.WriteByte(rdbFlagModuleAux)
+	writeLength(id)
+	b.WriteByte(rdbModuleOpcodeUInt)
+	b.WriteByte(2)
+	b.WriteByte(rdbModuleOpcodeEOF)
+	b.WriteByte(rdbFlagIdle)
+	b.WriteByte(10)
+	b.WriteByte(rdbTypeModule2)
+	writeString("json")
+	writeLength(id)
+	b.WriteByte(rdbModuleOpcodeString)
+	writeString(`{"a":1}`)
+	b.WriteByte(rdbModuleOpcodeDouble)
+	b.Write(make([]byte, 8))
+	b.WriteByte(rdbModuleOpcodeEOF)
+	b.WriteByte(rdbFlagFreq)
+	b.WriteByte(5)
+	b.WriteByte(rdbTypeString)
+	writeString("string")
+	writeString("v")
+	b.WriteByte(rdbFlagEOF)
+	c := digest.New()
+	c.Write(b.Bytes())
+	binary.Write(&b, binary.LittleEndian, c.Sum64())
+
+	entries := DecodeHexRdb(t, hex.EncodeToString(b.Bytes()), 2)
+	_, obj := getobj(t, entries, "json")
+	m := obj.(Module)
+	assert.Must(m.Name == "ReJSON-RL" && m.Version == 3)
+	_, obj = getobj(t, entries, "string")
+	checkString(t, obj, "v")
+}
+
+func TestLoadModuleAux(t *testing.T) {
+	var id uint64
+	for _, c := range "graphdata" {
+		id = id<<6 | uint64(strings.IndexRune(moduleCharset, c))
+	}
+	id = id<<10 | 1
+	aux := func(p ...byte) []byte {
+		var b bytes.Buffer
+		b.WriteByte(rdb64bitLenByte)
+		binary.Write(&b, binary.BigEndian, id)
+		b.Write(p)
+		return b.Bytes()
+	}
+
+	docheck := func(p []byte, warn bool) {
+		m, w, err := newRdbReader(bytes.NewReader(p)).skipModuleAux()
+		assert.MustNoError(err)
+		assert.Must(m.Name == "graphdata" && m.Version == 1)
+		assert.Must((len(w) != 0) == warn)
+	}
+	docheck(aux(rdbModuleOpcodeUInt, 2, rdbModuleOpcodeString, 1, 'x', rdbModuleOpcodeEOF), false)
+	docheck(aux(rdbModuleOpcodeString, 1, 'x', rdbModuleOpcodeEOF), true)
+	docheck(aux(rdbModuleOpcodeEOF), true)
+
+	_, _, err := newRdbReader(bytes.NewReader(aux(rdbModuleOpcodeUInt, 2, 9))).skipModuleAux()
+	assert.Must(err != nil && strings.Contains(err.Error(), "graphdata"))
+}
+
+func TestLoadStrict(t *testing.T) {
+	writeString := func(b *bytes.Buffer, s string) {
+		b.WriteByte(byte(len(s)))
+		b.WriteString(s)
+	}
+	docheck := func(body func(b *bytes.Buffer), tolerated bool, msg string) {
+		var b bytes.Buffer
+		b.WriteString("REDIS0009")
+		body(&b)
+		b.WriteByte(rdbTypeString)
+		writeString(&b, "k")
+		writeString(&b, "v")
+		b.WriteByte(rdbFlagEOF)
+		for _, strict := range []bool{false, true} {
+			l := NewLoader(bytes.NewReader(b.Bytes()))
+			l.SetStrict(strict)
+			assert.MustNoError(l.Header())
+			e, err := l.NextBinEntry()
+			if len(msg) == 0 || (!strict && tolerated) {
+				assert.MustNoError(err)
+				assert.Must(string(e.Key) == "k")
+			} else {
+				assert.Must(err != nil)
+				if strict {
+					assert.Must(strings.Contains(err.Error(), msg))
+				}
+			}
+		}
+	}
+	docheck(func(b *bytes.Buffer) {
+		b.WriteByte(rdbFlagAux)
+		writeString(b, "redis-ver")
+		writeString(b, "5.0.0")
+	}, true, "")
+	docheck(func(b *bytes.Buffer) {
+		b.WriteByte(rdbFlagAux)
+		writeString(b, "redis-ver")
+		writeString(b, "5.0.0")
+		b.WriteByte(rdbFlagAux)
+		writeString(b, "x-custom")
+		writeString(b, "1")
+	}, true, "unknown aux field 'x-custom' at offset 26")
+	docheck(func(b *bytes.Buffer) {
+		b.WriteByte(rdbFlagModuleAux)
+		b.WriteByte(1)
+		b.WriteByte(rdbModuleOpcodeEOF)
+	}, true, "opcode f7 at offset 9")
+	docheck(func(b *bytes.Buffer) {
+		b.WriteByte(0xf3)
+	}, false, "unknown opcode f3 at offset 9")
+	docheck(func(b *bytes.Buffer) {
+		b.WriteByte(rdbFlagSlotInfo)
+		b.Write([]byte{0x40, 0x10, 3, 1})
+	}, true, "")
+	docheck(func(b *bytes.Buffer) {
+		b.WriteByte(rdbFlagFunctionPreGA)
+	}, false, "pre-release function format at offset 9")
+}
+
+func TestLoadOversizedLength(t *testing.T) {
+	for _, prefix := range []string{"81ffffffffffffff00", "817fffffffffffffff", "8000100000", "c381ffffffffffffff0001"} {
+		p, err := hex.DecodeString(prefix)
+		assert.MustNoError(err)
+		p = append(p, "hello"...)
+		_, err = newRdbReader(bytes.NewReader(p)).readString()
+		assert.Must(err != nil)
+
+		var b bytes.Buffer
+		b.WriteString("REDIS0009")
+		b.WriteByte(rdbTypeString)
+		b.WriteByte(1)
+		b.WriteString("k")
+		b.Write(p)
+		l := NewLoader(bytes.NewReader(b.Bytes()))
+		assert.MustNoError(l.Header())
+		_, err = l.NextBinEntry()
+		assert.Must(err != nil)
+	}
+}
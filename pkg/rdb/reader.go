@@ -6,6 +6,7 @@ package rdb
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"math"
 	"strconv"
@@ -15,6 +16,10 @@ import (
 
 const (
 	Version = 6
+
+	// MaxVersion is the newest rdb file version the loader accepts, dumps
+	// created by the loader are still tagged with Version.
+	MaxVersion = 12
 )
 
 const (
@@ -23,6 +28,10 @@ const (
 	rdbTypeSet    = 2
 	rdbTypeZSet   = 3
 	rdbTypeHash   = 4
+	rdbTypeZSet2  = 5
+
+	rdbTypeModule  = 6
+	rdbTypeModule2 = 7
 
 	rdbTypeHashZipmap  = 9
 	rdbTypeListZiplist = 10
@@ -30,10 +39,37 @@ const (
 	rdbTypeZSetZiplist = 12
 	rdbTypeHashZiplist = 13
 
-	rdbFlagExpiryMS = 0xfc
-	rdbFlagExpiry   = 0xfd
-	rdbFlagSelectDB = 0xfe
-	rdbFlagEOF      = 0xff
+	rdbTypeListQuicklist = 14
+
+	rdbTypeStreamListpacks  = 15
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeStreamListpacks3 = 21
+
+	rdbTypeHashListpack   = 16
+	rdbTypeZSetListpack   = 17
+	rdbTypeListQuicklist2 = 18
+	rdbTypeSetListpack    = 20
+
+	// hashes with field expires of redis 7.4, the pre-GA types were written
+	// by its release candidates with absolute expires only.
+	rdbTypeHashMetadataPreGA   = 22
+	rdbTypeHashListpackExPreGA = 23
+	rdbTypeHashMetadata        = 24
+	rdbTypeHashListpackEx      = 25
+
+	rdbFlagSlotInfo      = 0xf4
+	rdbFlagFunction2     = 0xf5
+	rdbFlagFunctionPreGA = 0xf6
+
+	rdbFlagModuleAux = 0xf7
+	rdbFlagIdle      = 0xf8
+	rdbFlagFreq      = 0xf9
+	rdbFlagAux       = 0xfa
+	rdbFlagResizeDB  = 0xfb
+	rdbFlagExpiryMS  = 0xfc
+	rdbFlagExpiry    = 0xfd
+	rdbFlagSelectDB  = 0xfe
+	rdbFlagEOF       = 0xff
 )
 
 const (
@@ -42,6 +78,9 @@ const (
 	rdb32bitLen = 2
 	rdbEncVal   = 3
 
+	rdb32bitLenByte = 0x80
+	rdb64bitLenByte = 0x81
+
 	rdbEncInt8  = 0
 	rdbEncInt16 = 1
 	rdbEncInt32 = 2
@@ -57,12 +96,24 @@ const (
 	rdbZiplistInt24 = 0xf0
 	rdbZiplistInt8  = 0xfe
 	rdbZiplistInt4  = 15
+
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeSInt   = 1
+	rdbModuleOpcodeUInt   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
 )
 
+const maxInt = int(^uint(0) >> 1)
+
 type rdbReader struct {
 	raw   io.Reader
 	buf   [8]byte
 	nread int64
+
+	// rec records the bytes read while it is set.
+	rec *bytes.Buffer
 }
 
 func newRdbReader(r io.Reader) *rdbReader {
@@ -72,6 +123,9 @@ func newRdbReader(r io.Reader) *rdbReader {
 func (r *rdbReader) Read(p []byte) (int, error) {
 	n, err := r.raw.Read(p)
 	r.nread += int64(n)
+	if r.rec != nil {
+		r.rec.Write(p[:n])
+	}
 	return n, errors.Trace(err)
 }
 
@@ -79,6 +133,27 @@ func (r *rdbReader) offset() int64 {
 	return r.nread
 }
 
+// isObjectType reports whether readObjectValue knows how to read type t.
+func isObjectType(t byte) bool {
+	switch t {
+	case rdbTypeString, rdbTypeList, rdbTypeSet, rdbTypeZSet, rdbTypeHash:
+		return true
+	case rdbTypeModule, rdbTypeModule2:
+		return true
+	case rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZSetZiplist, rdbTypeHashZiplist:
+		return true
+	case rdbTypeListQuicklist:
+		return true
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return true
+	case rdbTypeZSet2, rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeListQuicklist2, rdbTypeSetListpack:
+		return true
+	case rdbTypeHashMetadataPreGA, rdbTypeHashListpackExPreGA, rdbTypeHashMetadata, rdbTypeHashListpackEx:
+		return true
+	}
+	return false
+}
+
 func (r *rdbReader) readObjectValue(t byte) ([]byte, error) {
 	var b bytes.Buffer
 	r = newRdbReader(io.TeeReader(r, &b))
@@ -95,15 +170,17 @@ func (r *rdbReader) readObjectValue(t byte) ([]byte, error) {
 		fallthrough
 	case rdbTypeHashZiplist:
 		fallthrough
+	case rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack, rdbTypeHashListpackExPreGA:
+		fallthrough
 	case rdbTypeString:
 		if _, err := r.readString(); err != nil {
 			return nil, err
 		}
-	case rdbTypeList, rdbTypeSet:
+	case rdbTypeList, rdbTypeSet, rdbTypeListQuicklist:
 		if n, err := r.readLength(); err != nil {
 			return nil, err
 		} else {
-			for i := 0; i < int(n); i++ {
+			for i := uint64(0); i < n; i++ {
 				if _, err := r.readString(); err != nil {
 					return nil, err
 				}
@@ -113,7 +190,7 @@ func (r *rdbReader) readObjectValue(t byte) ([]byte, error) {
 		if n, err := r.readLength(); err != nil {
 			return nil, err
 		} else {
-			for i := 0; i < int(n); i++ {
+			for i := uint64(0); i < n; i++ {
 				if _, err := r.readString(); err != nil {
 					return nil, err
 				}
@@ -122,11 +199,59 @@ func (r *rdbReader) readObjectValue(t byte) ([]byte, error) {
 				}
 			}
 		}
+	case rdbTypeZSet2:
+		if n, err := r.readLength(); err != nil {
+			return nil, err
+		} else {
+			for i := uint64(0); i < n; i++ {
+				if _, err := r.readString(); err != nil {
+					return nil, err
+				}
+				if _, err := r.readUint64(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case rdbTypeListQuicklist2:
+		if n, err := r.readLength(); err != nil {
+			return nil, err
+		} else {
+			for i := uint64(0); i < n; i++ {
+				if _, err := r.readLength(); err != nil {
+					return nil, err
+				}
+				if _, err := r.readString(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case rdbTypeHashListpackEx:
+		if _, err := r.readUint64(); err != nil {
+			return nil, err
+		}
+		if _, err := r.readString(); err != nil {
+			return nil, err
+		}
+	case rdbTypeHashMetadataPreGA, rdbTypeHashMetadata:
+		if _, err := r.readHashMetadata(t); err != nil {
+			return nil, err
+		}
+	case rdbTypeModule:
+		return nil, errors.Errorf("module object-type %02x can't be skipped without the module", t)
+	case rdbTypeModule2:
+		id, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		if err := r.skipModuleValue(); err != nil {
+			m := newModule(id)
+			return nil, errors.Errorf("module value of %s ver %d: %s", m.Name, m.Version, err)
+		}
 	case rdbTypeHash:
 		if n, err := r.readLength(); err != nil {
 			return nil, err
 		} else {
-			for i := 0; i < int(n); i++ {
+			for i := uint64(0); i < n; i++ {
 				if _, err := r.readString(); err != nil {
 					return nil, err
 				}
@@ -135,17 +260,93 @@ func (r *rdbReader) readObjectValue(t byte) ([]byte, error) {
 				}
 			}
 		}
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		if _, err := r.readStream(t); err != nil {
+			return nil, err
+		}
 	}
 	return b.Bytes(), nil
 }
 
+// skipModuleValue skips a module value serialized with opcodes (module type 2
+// and module aux), which is self-describing up to the EOF opcode.
+func (r *rdbReader) skipModuleValue() error {
+	for {
+		op, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		if eof, err := r.skipModuleOpcode(op); err != nil || eof {
+			return err
+		}
+	}
+}
+
+// skipModuleOpcode skips the value following op, an unknown opcode means the
+// framing itself is broken since its length can't be known.
+func (r *rdbReader) skipModuleOpcode(op uint64) (bool, error) {
+	var err error
+	switch op {
+	default:
+		return false, errors.Errorf("unknown module opcode %d", op)
+	case rdbModuleOpcodeEOF:
+		return true, nil
+	case rdbModuleOpcodeSInt, rdbModuleOpcodeUInt:
+		_, err = r.readLength()
+	case rdbModuleOpcodeFloat:
+		_, err = r.readUint32()
+	case rdbModuleOpcodeDouble:
+		_, err = r.readUint64()
+	case rdbModuleOpcodeString:
+		_, err = r.readString()
+	}
+	return false, err
+}
+
+// skipModuleAux skips a module aux section: the module type id, the 'when'
+// as an uint opcode and the module data up to the EOF opcode. Sections whose
+// 'when' isn't framed as expected (written by modules built against pre-GA
+// module apis) are still skipped as long as every opcode is known, the
+// returned warning describes what was tolerated.
+func (r *rdbReader) skipModuleAux() (Module, string, error) {
+	id, err := r.readLength()
+	if err != nil {
+		return Module{}, "", err
+	}
+	m := newModule(id)
+	op, err := r.readLength()
+	if err != nil {
+		return m, "", err
+	}
+	var warn string
+	switch op {
+	case rdbModuleOpcodeUInt:
+		if _, err := r.readLength(); err != nil {
+			return m, "", err
+		}
+	case rdbModuleOpcodeEOF:
+		return m, fmt.Sprintf("module aux of %s ver %d has no 'when'", m.Name, m.Version), nil
+	default:
+		warn = fmt.Sprintf("module aux of %s ver %d has 'when' opcode %d, skip it as module data", m.Name, m.Version, op)
+		if eof, err := r.skipModuleOpcode(op); err != nil {
+			return m, "", errors.Errorf("module aux of %s ver %d: %s", m.Name, m.Version, err)
+		} else if eof {
+			return m, warn, nil
+		}
+	}
+	if err := r.skipModuleValue(); err != nil {
+		return m, "", errors.Errorf("module aux of %s ver %d: %s", m.Name, m.Version, err)
+	}
+	return m, warn, nil
+}
+
 func (r *rdbReader) readString() ([]byte, error) {
 	length, encoded, err := r.readEncodedLength()
 	if err != nil {
 		return nil, err
 	}
 	if !encoded {
-		return r.readBytes(int(length))
+		return r.readLengthBytes(length)
 	}
 	switch t := uint8(length); t {
 	default:
@@ -160,41 +361,56 @@ func (r *rdbReader) readString() ([]byte, error) {
 		i, err := r.readInt32()
 		return []byte(strconv.FormatInt(int64(i), 10)), err
 	case rdbEncLZF:
-		var inlen, outlen uint32
+		var inlen, outlen uint64
 		if inlen, err = r.readLength(); err != nil {
 			return nil, err
 		}
 		if outlen, err = r.readLength(); err != nil {
 			return nil, err
 		}
-		if in, err := r.readBytes(int(inlen)); err != nil {
+		n, err := lengthToInt(outlen)
+		if err != nil {
 			return nil, err
+		}
+		if in, err := r.readLengthBytes(inlen); err != nil {
+			return nil, err
+		} else if uint64(n) > uint64(len(in))*lzfMaxExpansion {
+			return nil, errors.Errorf("lzf length %d is out of range for %d bytes compressed", n, len(in))
 		} else {
-			return lzfDecompress(in, int(outlen))
+			return lzfDecompress(in, n)
 		}
 	}
 }
 
-func (r *rdbReader) readEncodedLength() (length uint32, encoded bool, err error) {
+func (r *rdbReader) readEncodedLength() (length uint64, encoded bool, err error) {
 	u, err := r.readUint8()
 	if err != nil {
 		return
 	}
-	length = uint32(u & 0x3f)
+	length = uint64(u & 0x3f)
 	switch u >> 6 {
 	case rdb6bitLen:
 	case rdb14bitLen:
 		u, err = r.readUint8()
-		length = (length << 8) + uint32(u)
+		length = (length << 8) + uint64(u)
 	case rdbEncVal:
 		encoded = true
 	default:
-		length, err = r.readUint32BigEndian()
+		switch u {
+		case rdb32bitLenByte:
+			var v uint32
+			v, err = r.readUint32BigEndian()
+			length = uint64(v)
+		case rdb64bitLenByte:
+			length, err = r.readUint64BigEndian()
+		default:
+			err = errors.Errorf("unknown length encoding %02x", u)
+		}
 	}
 	return
 }
 
-func (r *rdbReader) readLength() (uint32, error) {
+func (r *rdbReader) readLength() (uint64, error) {
 	length, encoded, err := r.readEncodedLength()
 	if err == nil && encoded {
 		err = errors.Errorf("encoded-length")
@@ -235,9 +451,42 @@ func (r *rdbReader) readFull(p []byte) error {
 	return errors.Trace(err)
 }
 
+// readChunk bounds the memory allocated ahead of the bytes read, a corrupt
+// length then ends in a short read instead of a huge allocation.
+const readChunk = 1 << 20
+
 func (r *rdbReader) readBytes(n int) ([]byte, error) {
-	p := make([]byte, n)
-	return p, r.readFull(p)
+	if n <= readChunk {
+		p := make([]byte, n)
+		return p, r.readFull(p)
+	}
+	var b bytes.Buffer
+	b.Grow(readChunk)
+	if _, err := io.CopyN(&b, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Trace(err)
+	}
+	return b.Bytes(), nil
+}
+
+func (r *rdbReader) readLengthBytes(length uint64) ([]byte, error) {
+	n, err := lengthToInt(length)
+	if err != nil {
+		return nil, err
+	}
+	return r.readBytes(n)
+}
+
+// lengthToInt converts an on-disk length to a slice length, lengths beyond the
+// platform's int (e.g. >2GB values on 32-bit builds) are rejected explicitly
+// instead of being truncated.
+func lengthToInt(length uint64) (int, error) {
+	if length > uint64(maxInt) {
+		return 0, errors.Errorf("length %d exceeds the max slice length %d", length, maxInt)
+	}
+	return int(length), nil
 }
 
 func (r *rdbReader) readUint8() (uint8, error) {
@@ -269,6 +518,12 @@ func (r *rdbReader) readUint32BigEndian() (uint32, error) {
 	return binary.BigEndian.Uint32(b), err
 }
 
+func (r *rdbReader) readUint64BigEndian() (uint64, error) {
+	b := r.buf[:8]
+	err := r.readFull(b)
+	return binary.BigEndian.Uint64(b), err
+}
+
 func (r *rdbReader) readInt8() (int8, error) {
 	u, err := r.readUint8()
 	return int8(u), err
@@ -294,6 +549,10 @@ func (r *rdbReader) readInt32BigEndian() (int32, error) {
 	return int32(u), err
 }
 
+// lzfMaxExpansion is the most lzf expands its input, a back reference of 3
+// bytes stands for up to 264.
+const lzfMaxExpansion = 88
+
 func lzfDecompress(in []byte, outlen int) (out []byte, err error) {
 	defer func() {
 		if x := recover(); x != nil {
@@ -0,0 +1,551 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+)
+
+// Stream is a stream (redis 5+), Entries are in ID order and deleted entries
+// are dropped. FirstID, MaxDeletedID, EntriesAdded and EntriesRead of the
+// groups are saved since redis 7.0, ActiveTime of the consumers since 7.2.
+type Stream struct {
+	Entries []*StreamEntry
+	LastID  StreamID
+
+	FirstID      StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+
+	Groups []*StreamGroup
+}
+
+type StreamID struct {
+	Ms, Seq uint64
+}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// ParseStreamID parses an ID written by String, "<ms>-<seq>".
+func ParseStreamID(s string) (StreamID, error) {
+	var id StreamID
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return id, errors.Errorf("invalid stream ID '%s'", s)
+	}
+	ms, err := strconv.ParseUint(s[:i], 10, 64)
+	if err != nil {
+		return id, errors.Errorf("invalid stream ID '%s'", s)
+	}
+	seq, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return id, errors.Errorf("invalid stream ID '%s'", s)
+	}
+	return StreamID{ms, seq}, nil
+}
+
+func (id StreamID) Less(o StreamID) bool {
+	return id.Ms < o.Ms || (id.Ms == o.Ms && id.Seq < o.Seq)
+}
+
+type StreamEntry struct {
+	ID     StreamID
+	Fields []*HashElement
+}
+
+// StreamGroup is a consumer group, Pending is its PEL.
+type StreamGroup struct {
+	Name        []byte
+	LastID      StreamID
+	EntriesRead int64
+
+	Pending   []*StreamPending
+	Consumers []*StreamConsumer
+}
+
+// StreamPending is a delivered but not yet acknowledged entry, DeliveryTime
+// is the unix time in milliseconds of the last delivery.
+type StreamPending struct {
+	ID            StreamID
+	DeliveryTime  uint64
+	DeliveryCount uint64
+}
+
+// StreamConsumer lists the IDs of the group's PEL owned by the consumer.
+type StreamConsumer struct {
+	Name       []byte
+	SeenTime   uint64
+	ActiveTime uint64
+	Pending    []StreamID
+}
+
+const (
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+
+	// streamNodeMaxEntries and streamNodeMaxBytes are the defaults of
+	// stream-node-max-entries and stream-node-max-bytes.
+	streamNodeMaxEntries = 100
+	streamNodeMaxBytes   = 4096
+)
+
+func decodeStreamDump(p []byte) (interface{}, error) {
+	t, val, err := splitDump(p)
+	if err != nil {
+		return nil, err
+	}
+	r := newRdbReader(bytes.NewReader(val))
+	return r.readStream(t)
+}
+
+// readStream reads the listpack nodes, each keyed by its master ID, followed
+// by the stream metadata and the consumer groups.
+func (r *rdbReader) readStream(t byte) (Stream, error) {
+	var s Stream
+	n, err := r.readLength()
+	if err != nil {
+		return s, err
+	}
+	for i := uint64(0); i < n; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return s, err
+		}
+		if len(key) != 16 {
+			return s, errors.Errorf("invalid stream node key, len = %d", len(key))
+		}
+		lp, err := r.readString()
+		if err != nil {
+			return s, err
+		}
+		master := decodeStreamID(key)
+		if s.Entries, err = streamNodeEntries(s.Entries, master, lp); err != nil {
+			return s, errors.Errorf("stream node %s: %s", master, err)
+		}
+	}
+	length, err := r.readLength()
+	if err != nil {
+		return s, err
+	}
+	if length != uint64(len(s.Entries)) {
+		return s, errors.Errorf("invalid stream, length = %d, has %d entries", length, len(s.Entries))
+	}
+	if s.LastID, err = r.readStreamID(); err != nil {
+		return s, err
+	}
+	if t != rdbTypeStreamListpacks {
+		if s.FirstID, err = r.readStreamID(); err != nil {
+			return s, err
+		}
+		if s.MaxDeletedID, err = r.readStreamID(); err != nil {
+			return s, err
+		}
+		if s.EntriesAdded, err = r.readLength(); err != nil {
+			return s, err
+		}
+	}
+	ngroups, err := r.readLength()
+	if err != nil {
+		return s, err
+	}
+	for i := uint64(0); i < ngroups; i++ {
+		g, err := r.readStreamGroup(t)
+		if err != nil {
+			return s, err
+		}
+		s.Groups = append(s.Groups, g)
+	}
+	return s, nil
+}
+
+func (r *rdbReader) readStreamGroup(t byte) (*StreamGroup, error) {
+	g := &StreamGroup{}
+	var err error
+	if g.Name, err = r.readString(); err != nil {
+		return nil, err
+	}
+	if g.LastID, err = r.readStreamID(); err != nil {
+		return nil, err
+	}
+	if t != rdbTypeStreamListpacks {
+		// -1 (unknown) is saved as a 64-bit length.
+		v, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		g.EntriesRead = int64(v)
+	}
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		p := &StreamPending{}
+		if p.ID, err = r.readRawStreamID(); err != nil {
+			return nil, err
+		}
+		if p.DeliveryTime, err = r.readUint64(); err != nil {
+			return nil, err
+		}
+		if p.DeliveryCount, err = r.readLength(); err != nil {
+			return nil, err
+		}
+		g.Pending = append(g.Pending, p)
+	}
+	if n, err = r.readLength(); err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		c := &StreamConsumer{}
+		if c.Name, err = r.readString(); err != nil {
+			return nil, err
+		}
+		if c.SeenTime, err = r.readUint64(); err != nil {
+			return nil, err
+		}
+		if t == rdbTypeStreamListpacks3 {
+			if c.ActiveTime, err = r.readUint64(); err != nil {
+				return nil, err
+			}
+		}
+		npel, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < npel; j++ {
+			id, err := r.readRawStreamID()
+			if err != nil {
+				return nil, err
+			}
+			c.Pending = append(c.Pending, id)
+		}
+		g.Consumers = append(g.Consumers, c)
+	}
+	return g, nil
+}
+
+func (r *rdbReader) readStreamID() (StreamID, error) {
+	ms, err := r.readLength()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := r.readLength()
+	return StreamID{Ms: ms, Seq: seq}, err
+}
+
+// readRawStreamID reads an ID of a PEL, saved as is without a length.
+func (r *rdbReader) readRawStreamID() (StreamID, error) {
+	var b [16]byte
+	if err := r.readFull(b[:]); err != nil {
+		return StreamID{}, err
+	}
+	return decodeStreamID(b[:]), nil
+}
+
+// decodeStreamID decodes the 128-bit big endian form of rax keys.
+func decodeStreamID(p []byte) StreamID {
+	return StreamID{binary.BigEndian.Uint64(p[0:8]), binary.BigEndian.Uint64(p[8:16])}
+}
+
+func encodeStreamID(id StreamID) []byte {
+	p := make([]byte, 16)
+	binary.BigEndian.PutUint64(p[0:8], id.Ms)
+	binary.BigEndian.PutUint64(p[8:16], id.Seq)
+	return p
+}
+
+// streamNodeEntries appends the live entries of a listpack node to entries.
+// The node starts with the master entry:
+//
+//	count, deleted, num-fields, field_1 ... field_N, 0
+//
+// then every entry, IDs are relative to the master ID and entries flagged
+// with same-fields only hold the values of the master fields:
+//
+//	flags, ms-diff, seq-diff, [num-fields, field_1, value_1 ...] or
+//	[value_1 ...], lp-count
+func streamNodeEntries(entries []*StreamEntry, master StreamID, lp []byte) ([]*StreamEntry, error) {
+	var eles [][]byte
+	err := listpackForEach(lp, func(ele []byte) error {
+		eles = append(eles, ele)
+		return nil
+	})
+	if err != nil {
+		return entries, err
+	}
+	var i int
+	next := func() ([]byte, error) {
+		if i >= len(eles) {
+			return nil, errors.Errorf("truncated node, %d listpack entries", len(eles))
+		}
+		i++
+		return eles[i-1], nil
+	}
+	nextInt := func() (int64, error) {
+		b, err := next()
+		if err != nil {
+			return 0, err
+		}
+		v, err := strconv.ParseInt(string(b), 10, 64)
+		if err != nil {
+			return 0, errors.Errorf("invalid integer '%s' at listpack entry %d", b, i-1)
+		}
+		return v, nil
+	}
+	nextN := func() (int, error) {
+		v, err := nextInt()
+		if err == nil && (v < 0 || v > int64(len(eles))) {
+			err = errors.Errorf("invalid count %d at listpack entry %d", v, i-1)
+		}
+		return int(v), err
+	}
+
+	count, err := nextN()
+	if err != nil {
+		return entries, err
+	}
+	deleted, err := nextN()
+	if err != nil {
+		return entries, err
+	}
+	nfields, err := nextN()
+	if err != nil {
+		return entries, err
+	}
+	fields := make([][]byte, nfields)
+	for k := range fields {
+		if fields[k], err = next(); err != nil {
+			return entries, err
+		}
+	}
+	if v, err := nextInt(); err != nil {
+		return entries, err
+	} else if v != 0 {
+		return entries, errors.Errorf("invalid master entry terminator %d", v)
+	}
+
+	for k := 0; k < count+deleted; k++ {
+		flags, err := nextInt()
+		if err != nil {
+			return entries, err
+		}
+		ms, err := nextInt()
+		if err != nil {
+			return entries, err
+		}
+		seq, err := nextInt()
+		if err != nil {
+			return entries, err
+		}
+		e := &StreamEntry{ID: StreamID{master.Ms + uint64(ms), master.Seq + uint64(seq)}}
+		if flags&streamItemFlagSameFields != 0 {
+			for _, f := range fields {
+				v, err := next()
+				if err != nil {
+					return entries, err
+				}
+				e.Fields = append(e.Fields, &HashElement{Field: f, Value: v})
+			}
+		} else {
+			n, err := nextN()
+			if err != nil {
+				return entries, err
+			}
+			for j := 0; j < n; j++ {
+				f, err := next()
+				if err != nil {
+					return entries, err
+				}
+				v, err := next()
+				if err != nil {
+					return entries, err
+				}
+				e.Fields = append(e.Fields, &HashElement{Field: f, Value: v})
+			}
+		}
+		if _, err := nextInt(); err != nil {
+			return entries, err
+		}
+		if flags&streamItemFlagDeleted == 0 {
+			entries = append(entries, e)
+		}
+	}
+	if i != len(eles) {
+		return entries, errors.Errorf("%d trailing listpack entries", len(eles)-i)
+	}
+	return entries, nil
+}
+
+// encodingType returns the oldest stream type holding all of the fields set,
+// so streams decoded from older servers restore there again.
+func (o Stream) encodingType() byte {
+	t := byte(rdbTypeStreamListpacks)
+	if o.FirstID != (StreamID{}) || o.MaxDeletedID != (StreamID{}) || o.EntriesAdded != 0 {
+		t = rdbTypeStreamListpacks2
+	}
+	for _, g := range o.Groups {
+		if g.EntriesRead != 0 && t == rdbTypeStreamListpacks {
+			t = rdbTypeStreamListpacks2
+		}
+		for _, c := range g.Consumers {
+			if c.ActiveTime != 0 {
+				return rdbTypeStreamListpacks3
+			}
+		}
+	}
+	return t
+}
+
+func (o Stream) encodeDump() ([]byte, error) {
+	nodes, err := o.listpackNodes()
+	if err != nil {
+		return nil, err
+	}
+	t := o.encodingType()
+	var b []byte
+	b = appendLength(b, uint64(len(nodes)))
+	for _, n := range nodes {
+		b = appendRawString(b, encodeStreamID(n.master))
+		b = appendRawString(b, n.lp)
+	}
+	b = appendLength(b, uint64(len(o.Entries)))
+	b = appendStreamID(b, o.LastID)
+	if t != rdbTypeStreamListpacks {
+		b = appendStreamID(b, o.FirstID)
+		b = appendStreamID(b, o.MaxDeletedID)
+		b = appendLength(b, o.EntriesAdded)
+	}
+	b = appendLength(b, uint64(len(o.Groups)))
+	for _, g := range o.Groups {
+		b = appendRawString(b, g.Name)
+		b = appendStreamID(b, g.LastID)
+		if t != rdbTypeStreamListpacks {
+			b = appendLength(b, uint64(g.EntriesRead))
+		}
+		b = appendLength(b, uint64(len(g.Pending)))
+		for _, p := range g.Pending {
+			b = append(b, encodeStreamID(p.ID)...)
+			b = appendUint64(b, p.DeliveryTime)
+			b = appendLength(b, p.DeliveryCount)
+		}
+		b = appendLength(b, uint64(len(g.Consumers)))
+		for _, c := range g.Consumers {
+			b = appendRawString(b, c.Name)
+			b = appendUint64(b, c.SeenTime)
+			if t == rdbTypeStreamListpacks3 {
+				b = appendUint64(b, c.ActiveTime)
+			}
+			b = appendLength(b, uint64(len(c.Pending)))
+			for _, id := range c.Pending {
+				b = append(b, encodeStreamID(id)...)
+			}
+		}
+	}
+	return createValueDump(t, b), nil
+}
+
+type streamNode struct {
+	master StreamID
+	lp     []byte
+}
+
+// listpackNodes packs the entries into nodes as XADD does, a node is closed
+// once it holds streamNodeMaxEntries entries or streamNodeMaxBytes bytes.
+func (o Stream) listpackNodes() ([]*streamNode, error) {
+	var nodes []*streamNode
+	var master *StreamEntry
+	var body listpack
+	var count int
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		lp := &listpack{}
+		lp.appendInt(int64(count))
+		lp.appendInt(0)
+		lp.appendInt(int64(len(master.Fields)))
+		for _, f := range master.Fields {
+			lp.appendString(f.Field)
+		}
+		lp.appendInt(0)
+		lp.buf, lp.n = append(lp.buf, body.buf...), lp.n+body.n
+		nodes = append(nodes, &streamNode{master.ID, lp.Bytes()})
+		body, count = listpack{}, 0
+	}
+	for i, e := range o.Entries {
+		if i != 0 && !o.Entries[i-1].ID.Less(e.ID) {
+			return nil, errors.Errorf("stream entry %s is not greater than %s", e.ID, o.Entries[i-1].ID)
+		}
+		if count == 0 {
+			master = e
+		}
+		same := len(e.Fields) == len(master.Fields)
+		for j := 0; same && j < len(e.Fields); j++ {
+			same = bytes.Equal(e.Fields[j].Field, master.Fields[j].Field)
+		}
+		flags := int64(0)
+		if same {
+			flags = streamItemFlagSameFields
+		}
+		body.appendInt(flags)
+		body.appendInt(int64(e.ID.Ms - master.ID.Ms))
+		body.appendInt(int64(e.ID.Seq - master.ID.Seq))
+		if same {
+			for _, f := range e.Fields {
+				body.appendString(f.Value)
+			}
+			body.appendInt(int64(len(e.Fields) + 3))
+		} else {
+			body.appendInt(int64(len(e.Fields)))
+			for _, f := range e.Fields {
+				body.appendString(f.Field)
+				body.appendString(f.Value)
+			}
+			body.appendInt(int64(len(e.Fields)*2 + 4))
+		}
+		if count++; count >= streamNodeMaxEntries || len(body.buf) >= streamNodeMaxBytes {
+			flush()
+		}
+	}
+	flush()
+	return nodes, nil
+}
+
+func appendLength(b []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(b, byte(n))
+	case n < 1<<14:
+		return append(b, byte(n>>8)|rdb14bitLen<<6, byte(n))
+	case n <= 0xffffffff:
+		b = append(b, rdb32bitLenByte, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], uint32(n))
+		return b
+	}
+	b = append(b, rdb64bitLenByte, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(b[len(b)-8:], n)
+	return b
+}
+
+func appendRawString(b []byte, s []byte) []byte {
+	return append(appendLength(b, uint64(len(s))), s...)
+}
+
+func appendStreamID(b []byte, id StreamID) []byte {
+	return appendLength(appendLength(b, id.Ms), id.Seq)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(b[len(b)-8:], v)
+	return b
+}
@@ -0,0 +1,197 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb/digest"
+)
+
+func TestListpackEntries(t *testing.T) {
+	values := []string{"", "a", "0", "127", "128", "-1", "-4096", "4095", "4096", "-32768", "32768",
+		"-8388608", "8388608", "2147483647", "-2147483649", "9223372036854775807", "-9223372036854775808",
+		"9223372036854775808", "007", "-0", "+1",
+		string(bytes.Repeat([]byte("x"), 63)), string(bytes.Repeat([]byte("x"), 64)),
+		string(bytes.Repeat([]byte("x"), 4095)), string(bytes.Repeat([]byte("x"), 4096)),
+		string(bytes.Repeat([]byte("x"), 20000))}
+	lp := &listpack{}
+	for _, v := range values {
+		lp.appendString([]byte(v))
+	}
+	var i int
+	assert.MustNoError(listpackForEach(lp.Bytes(), func(ele []byte) error {
+		assert.Must(string(ele) == values[i])
+		i++
+		return nil
+	}))
+	assert.Must(i == len(values))
+
+	// "a", 1 and -1 as saved by redis.
+	p, err := hex.DecodeString("0f00000003008161020101dfff02ff")
+	assert.MustNoError(err)
+	var eles []string
+	assert.MustNoError(listpackForEach(p, func(ele []byte) error {
+		eles = append(eles, string(ele))
+		return nil
+	}))
+	assert.Must(len(eles) == 3 && eles[0] == "a" && eles[1] == "1" && eles[2] == "-1")
+
+	lp = &listpack{}
+	lp.appendString([]byte("a"))
+	lp.appendInt(1)
+	lp.appendInt(-1)
+	assert.Must(bytes.Equal(lp.Bytes(), p))
+
+	for _, b := range [][]byte{nil, p[:len(p)-1], p[:8], append(append([]byte{}, p...), 0)} {
+		assert.Must(listpackForEach(b, func([]byte) error { return nil }) != nil)
+	}
+}
+
+func newStreamEntry(ms, seq uint64, pairs ...string) *StreamEntry {
+	e := &StreamEntry{ID: StreamID{ms, seq}}
+	for i := 0; i < len(pairs); i += 2 {
+		e.Fields = append(e.Fields, &HashElement{Field: []byte(pairs[i]), Value: []byte(pairs[i+1])})
+	}
+	return e
+}
+
+func newStreamGroups() []*StreamGroup {
+	return []*StreamGroup{
+		{
+			Name:   []byte("g1"),
+			LastID: StreamID{1526919030474, 55},
+			Pending: []*StreamPending{
+				{ID: StreamID{1526919030474, 1}, DeliveryTime: 1526919030500, DeliveryCount: 1},
+				{ID: StreamID{1526919030474, 2}, DeliveryTime: 1526919030600, DeliveryCount: 3},
+			},
+			Consumers: []*StreamConsumer{
+				{Name: []byte("alice"), SeenTime: 1526919030600, Pending: []StreamID{{1526919030474, 1}, {1526919030474, 2}}},
+				{Name: []byte("bob"), SeenTime: 1526919030700},
+			},
+		},
+		{Name: []byte("g2")},
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	s := Stream{LastID: StreamID{1526919030474, 1000}, Groups: newStreamGroups()}
+	for i := 0; i < 250; i++ {
+		if i%7 == 0 {
+			s.Entries = append(s.Entries, newStreamEntry(1526919030474+uint64(i/10), uint64(i), "other", strconv.Itoa(i)))
+		} else {
+			s.Entries = append(s.Entries, newStreamEntry(1526919030474+uint64(i/10), uint64(i), "sensor", "a", "temp", strconv.Itoa(i*10-500)))
+		}
+	}
+	s.Entries = append(s.Entries, newStreamEntry(1526919099999, 0, "big", string(bytes.Repeat([]byte("v"), 5000))))
+	roundTrip(t, s)
+
+	p, err := EncodeDump(s)
+	assert.MustNoError(err)
+	assert.Must(p[0] == rdbTypeStreamListpacks && TypeName(p) == "stream" && !IsEmptyObject(p))
+	o, err := DecodeDump(p)
+	assert.MustNoError(err)
+	x := o.(Stream)
+	assert.Must(len(x.Entries) == 251 && x.LastID == s.LastID && len(x.Groups) == 2)
+	assert.Must(x.Entries[8].ID.String() == "1526919030474-8" && string(x.Entries[8].Fields[1].Value) == "-420")
+	assert.Must(len(x.Groups[0].Consumers[0].Pending) == 2 && x.Groups[0].Pending[1].DeliveryCount == 3)
+
+	s.Entries[1], s.Entries[2] = s.Entries[2], s.Entries[1]
+	_, err = EncodeDump(s)
+	assert.Must(err != nil)
+}
+
+func TestStreamEmptyWithGroups(t *testing.T) {
+	for _, typ := range []byte{rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3} {
+		s := Stream{LastID: StreamID{1526919030474, 55}, Groups: newStreamGroups()}
+		switch typ {
+		case rdbTypeStreamListpacks3:
+			s.Groups[0].Consumers[1].ActiveTime = 1526919030700
+			fallthrough
+		case rdbTypeStreamListpacks2:
+			s.MaxDeletedID = StreamID{1526919030474, 55}
+			s.EntriesAdded = 56
+			s.Groups[0].EntriesRead = 56
+			s.Groups[1].EntriesRead = -1
+		}
+		roundTrip(t, s)
+		p, err := EncodeDump(s)
+		assert.MustNoError(err)
+		assert.Must(p[0] == typ && TypeName(p) == "stream")
+		o, err := DecodeDump(p)
+		assert.MustNoError(err)
+		x := o.(Stream)
+		assert.Must(len(x.Entries) == 0 && len(x.Groups) == 2 && x.Groups[1].EntriesRead == s.Groups[1].EntriesRead)
+	}
+}
+
+// TestLoadStream loads a node with a deleted entry and an entry with fields
+// other than the master fields, written the way XADD and XDEL leave them.
+func TestLoadStream(t *testing.T) {
+	lp := &listpack{}
+	for _, v := range []int64{2, 1, 1} {
+		lp.appendInt(v)
+	}
+	lp.appendString([]byte("f"))
+	lp.appendInt(0)
+	// 100-0 f=1, deleted
+	for _, v := range []int64{streamItemFlagSameFields | streamItemFlagDeleted, 0, 0, 1, 4} {
+		lp.appendInt(v)
+	}
+	// 100-1 f=2
+	for _, v := range []int64{streamItemFlagSameFields, 0, 1, 2, 4} {
+		lp.appendInt(v)
+	}
+	// 105-0 x=y, z=
+	for _, v := range []int64{0, 5, 0, 2} {
+		lp.appendInt(v)
+	}
+	for _, v := range []string{"x", "y", "z", ""} {
+		lp.appendString([]byte(v))
+	}
+	lp.appendInt(8)
+
+	var v []byte
+	v = appendLength(v, 1)
+	v = appendRawString(v, encodeStreamID(StreamID{100, 0}))
+	v = appendRawString(v, lp.Bytes())
+	nodes := len(v)
+	v = appendLength(v, 2)
+	v = appendStreamID(v, StreamID{105, 0})
+	v = appendLength(v, 0)
+
+	var b bytes.Buffer
+	b.WriteString("REDIS0009")
+	b.WriteByte(rdbFlagSelectDB)
+	b.WriteByte(0)
+	b.WriteByte(rdbTypeStreamListpacks)
+	b.WriteByte(6)
+	b.WriteString("stream")
+	b.Write(v)
+	b.WriteByte(rdbFlagEOF)
+	c := digest.New()
+	c.Write(b.Bytes())
+	binary.Write(&b, binary.LittleEndian, c.Sum64())
+
+	entries := DecodeHexRdb(t, hex.EncodeToString(b.Bytes()), 1)
+	e, obj := getobj(t, entries, "stream")
+	assert.Must(TypeName(e.Value) == "stream")
+	s := obj.(Stream)
+	assert.Must(len(s.Entries) == 2 && s.LastID == StreamID{105, 0})
+	assert.Must(s.Entries[0].ID == StreamID{100, 1} && len(s.Entries[0].Fields) == 1)
+	assert.Must(string(s.Entries[0].Fields[0].Field) == "f" && string(s.Entries[0].Fields[0].Value) == "2")
+	assert.Must(s.Entries[1].ID == StreamID{105, 0} && len(s.Entries[1].Fields) == 2)
+	assert.Must(string(s.Entries[1].Fields[1].Field) == "z" && len(s.Entries[1].Fields[1].Value) == 0)
+
+	// the length must match the live entries.
+	bad := appendLength(append([]byte{}, v[:nodes]...), 3)
+	bad = appendLength(appendStreamID(bad, StreamID{105, 0}), 0)
+	_, err := DecodeDump(createValueDump(rdbTypeStreamListpacks, bad))
+	assert.Must(err != nil)
+}
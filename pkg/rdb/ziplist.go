@@ -0,0 +1,305 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+
+	"github.com/left2right/redis-port/pkg/libs/errors"
+)
+
+// ForEachListElement calls fn with every element of a list dump payload, in
+// order. Quicklist nodes are decompressed and parsed one at a time, so besides
+// the payload itself a huge list never needs more memory than its largest
+// node; other list encodings are decoded as a whole.
+func ForEachListElement(p []byte, fn func(ele []byte) error) error {
+	if len(p) != 0 && p[0] == rdbTypeListQuicklist2 {
+		return quicklist2ForEach(p, fn)
+	}
+	if len(p) == 0 || p[0] != rdbTypeListQuicklist {
+		o, err := DecodeDump(p)
+		if err != nil {
+			return err
+		}
+		list, ok := o.(List)
+		if !ok {
+			return errors.Errorf("not a list dump payload")
+		}
+		for _, ele := range list {
+			if err := fn(ele); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	_, val, err := splitDump(p)
+	if err != nil {
+		return err
+	}
+	r := newRdbReader(bytes.NewReader(val))
+	n, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		node, err := r.readString()
+		if err != nil {
+			return err
+		}
+		if err := ziplistForEach(node, fn); err != nil {
+			return errors.Errorf("quicklist node %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// quicklist2ForEach walks a quicklist of redis 7.0+, its nodes are either a
+// listpack or, for large elements, a single plain element.
+func quicklist2ForEach(p []byte, fn func(ele []byte) error) error {
+	_, val, err := splitDump(p)
+	if err != nil {
+		return err
+	}
+	r := newRdbReader(bytes.NewReader(val))
+	n, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		container, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		node, err := r.readString()
+		if err != nil {
+			return err
+		}
+		switch container {
+		case quicklistNodePlain:
+			err = fn(node)
+		case quicklistNodePacked:
+			if err = listpackForEach(node, fn); err != nil {
+				err = errors.Errorf("quicklist node %d: %s", i, err)
+			}
+		default:
+			err = errors.Errorf("quicklist node %d: unknown container %d", i, container)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// decodeQuicklistDump decodes a quicklist (redis 3.2+, or its listpack
+// variant of 7.0+) into a List.
+func decodeQuicklistDump(p []byte) (interface{}, error) {
+	list := List{}
+	err := ForEachListElement(p, func(ele []byte) error {
+		list = append(list, ele)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ziplistForEach calls fn with every entry of a ziplist, integer entries are
+// formatted as decimal strings.
+func ziplistForEach(p []byte, fn func(ele []byte) error) error {
+	if len(p) < 11 {
+		return errors.Errorf("invalid ziplist, len = %d", len(p))
+	}
+	for i := 10; ; {
+		if i >= len(p) {
+			return errors.Errorf("invalid ziplist, missing end byte")
+		}
+		if p[i] == 0xff {
+			return nil
+		}
+		// skip the length of the previous entry.
+		if p[i] == 0xfe {
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(p) {
+			return errors.Errorf("invalid ziplist, truncated entry")
+		}
+		ele, n, err := ziplistEntry(p[i:])
+		if err != nil {
+			return err
+		}
+		if err := fn(ele); err != nil {
+			return err
+		}
+		i += n
+	}
+}
+
+// ziplistEntry parses the entry at the beginning of p, it returns the value
+// and the size of the entry after its previous entry length.
+func ziplistEntry(p []byte) ([]byte, int, error) {
+	need := func(n int) error {
+		if len(p) < n {
+			return errors.Errorf("invalid ziplist, truncated entry")
+		}
+		return nil
+	}
+	var hdr, size int
+	switch c := p[0]; c >> 6 {
+	case rdbZiplist6bitlenString:
+		hdr, size = 1, int(c&0x3f)
+	case rdbZiplist14bitlenString:
+		if err := need(2); err != nil {
+			return nil, 0, err
+		}
+		hdr, size = 2, int(c&0x3f)<<8|int(p[1])
+	case rdbZiplist32bitlenString:
+		if err := need(5); err != nil {
+			return nil, 0, err
+		}
+		n, err := lengthToInt(uint64(binary.BigEndian.Uint32(p[1:5])))
+		if err != nil {
+			return nil, 0, err
+		}
+		hdr, size = 5, n
+	default:
+		var v int64
+		switch {
+		case c == rdbZiplistInt8:
+			hdr = 2
+		case c == rdbZiplistInt16:
+			hdr = 3
+		case c == rdbZiplistInt24:
+			hdr = 4
+		case c == rdbZiplistInt32:
+			hdr = 5
+		case c == rdbZiplistInt64:
+			hdr = 9
+		case c > rdbZiplistInt24 && c < rdbZiplistInt8:
+			v = int64(c&rdbZiplistInt4) - 1
+			return []byte(strconv.FormatInt(v, 10)), 1, nil
+		default:
+			return nil, 0, errors.Errorf("invalid ziplist entry encoding %02x", c)
+		}
+		if err := need(hdr); err != nil {
+			return nil, 0, err
+		}
+		switch b := p[1:hdr]; len(b) {
+		case 1:
+			v = int64(int8(b[0]))
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(b)))
+		case 3:
+			v = int64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8)
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(b)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(b))
+		}
+		return []byte(strconv.FormatInt(v, 10)), hdr, nil
+	}
+	if err := need(hdr + size); err != nil {
+		return nil, 0, err
+	}
+	return p[hdr : hdr+size], hdr + size, nil
+}
+
+const (
+	zipmapBigLen = 254
+	zipmapEnd    = 255
+)
+
+// decodeZipmapDump decodes a zipmap, the encoding of small hashes before redis
+// 2.6, into a Hash.
+func decodeZipmapDump(p []byte) (interface{}, error) {
+	_, val, err := splitDump(p)
+	if err != nil {
+		return nil, err
+	}
+	r := newRdbReader(bytes.NewReader(val))
+	zm, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	return zipmapHash(zm)
+}
+
+// zipmapHash parses <zmlen><len>field<len><free>value<free bytes>...<end>.
+// Lengths take one byte below 254, or 254 followed by a 4 bytes little endian
+// length. zmlen is the number of pairs, unless it has reached 254.
+func zipmapHash(p []byte) (Hash, error) {
+	if len(p) == 0 {
+		return nil, errors.Errorf("invalid zipmap, len = 0")
+	}
+	i := 1
+	readLen := func() (int, error) {
+		if i >= len(p) || p[i] == zipmapEnd {
+			return 0, errors.Errorf("invalid zipmap, truncated entry")
+		}
+		if c := p[i]; c < zipmapBigLen {
+			i++
+			return int(c), nil
+		}
+		if i+5 > len(p) {
+			return 0, errors.Errorf("invalid zipmap, truncated entry")
+		}
+		n, err := lengthToInt(uint64(binary.LittleEndian.Uint32(p[i+1 : i+5])))
+		i += 5
+		return n, err
+	}
+	readBytes := func(n int) ([]byte, error) {
+		if n > len(p)-i {
+			return nil, errors.Errorf("invalid zipmap, truncated entry")
+		}
+		b := p[i : i+n]
+		i += n
+		return b, nil
+	}
+	hash := Hash{}
+	for {
+		if i >= len(p) {
+			return nil, errors.Errorf("invalid zipmap, missing end byte")
+		}
+		if p[i] == zipmapEnd {
+			break
+		}
+		n, err := readLen()
+		if err != nil {
+			return nil, err
+		}
+		field, err := readBytes(n)
+		if err != nil {
+			return nil, err
+		}
+		if n, err = readLen(); err != nil {
+			return nil, err
+		}
+		free, err := readBytes(1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readBytes(n)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := readBytes(int(free[0])); err != nil {
+			return nil, err
+		}
+		hash = append(hash, &HashElement{Field: field, Value: value})
+	}
+	if n := int(p[0]); n < zipmapBigLen && n != len(hash) {
+		return nil, errors.Errorf("invalid zipmap, zmlen = %d, has %d pairs", n, len(hash))
+	}
+	return hash, nil
+}
@@ -0,0 +1,322 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/assert"
+	"github.com/wandoulabs/redis-port/pkg/rdb/digest"
+)
+
+// newZiplist builds a ziplist the way redis does, integer-like elements get
+// the smallest integer encoding.
+func newZiplist(elems ...string) []byte {
+	var b bytes.Buffer
+	var prev int
+	for _, s := range elems {
+		var e bytes.Buffer
+		if prev < 254 {
+			e.WriteByte(byte(prev))
+		} else {
+			e.WriteByte(0xfe)
+			binary.Write(&e, binary.LittleEndian, uint32(prev))
+		}
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(v, 10) == s {
+			switch {
+			case v >= 0 && v <= 12:
+				e.WriteByte(byte(0xf1 + v))
+			case v == int64(int8(v)):
+				e.WriteByte(rdbZiplistInt8)
+				e.WriteByte(byte(v))
+			case v == int64(int16(v)):
+				e.WriteByte(rdbZiplistInt16)
+				binary.Write(&e, binary.LittleEndian, int16(v))
+			case v >= -1<<23 && v < 1<<23:
+				e.WriteByte(rdbZiplistInt24)
+				e.Write([]byte{byte(v), byte(v >> 8), byte(v >> 16)})
+			case v == int64(int32(v)):
+				e.WriteByte(rdbZiplistInt32)
+				binary.Write(&e, binary.LittleEndian, int32(v))
+			default:
+				e.WriteByte(rdbZiplistInt64)
+				binary.Write(&e, binary.LittleEndian, v)
+			}
+		} else {
+			switch n := len(s); {
+			case n < 1<<6:
+				e.WriteByte(byte(n))
+			case n < 1<<14:
+				e.WriteByte(byte(n>>8) | 0x40)
+				e.WriteByte(byte(n))
+			default:
+				e.WriteByte(0x80)
+				binary.Write(&e, binary.BigEndian, uint32(n))
+			}
+			e.WriteString(s)
+		}
+		prev = e.Len()
+		b.Write(e.Bytes())
+	}
+	var z bytes.Buffer
+	binary.Write(&z, binary.LittleEndian, uint32(10+b.Len()+1))
+	binary.Write(&z, binary.LittleEndian, uint32(10+b.Len()-prev))
+	binary.Write(&z, binary.LittleEndian, uint16(len(elems)))
+	z.Write(b.Bytes())
+	z.WriteByte(0xff)
+	return z.Bytes()
+}
+
+// lzfCompress is a plain greedy lzf compressor, good enough to produce the
+// compressed quicklist nodes redis writes.
+func lzfCompress(in []byte) []byte {
+	var out, lit []byte
+	flush := func() {
+		for len(lit) != 0 {
+			n := len(lit)
+			if n > 32 {
+				n = 32
+			}
+			out = append(out, byte(n-1))
+			out = append(out, lit[:n]...)
+			lit = lit[n:]
+		}
+	}
+	table := make(map[[3]byte]int)
+	for i := 0; i < len(in); {
+		if i+3 <= len(in) {
+			var k [3]byte
+			copy(k[:], in[i:i+3])
+			ref, ok := table[k]
+			table[k] = i
+			if ok && i-ref-1 < 8192 {
+				n := 3
+				for i+n < len(in) && n < 264 && in[ref+n] == in[i+n] {
+					n++
+				}
+				flush()
+				off, l := i-ref-1, n-2
+				if l < 7 {
+					out = append(out, byte(l<<5|off>>8), byte(off))
+				} else {
+					out = append(out, byte(7<<5|off>>8), byte(l-7), byte(off))
+				}
+				i += n
+				continue
+			}
+		}
+		lit = append(lit, in[i])
+		i++
+	}
+	flush()
+	return out
+}
+
+// newQuicklistDump builds the dump payload of a quicklist, every node holds
+// size elements and all nodes but the first and last ones are compressed.
+func newQuicklistDump(elems []string, size int) []byte {
+	var nodes [][]byte
+	for i := 0; i < len(elems); i += size {
+		j := i + size
+		if j > len(elems) {
+			j = len(elems)
+		}
+		nodes = append(nodes, newZiplist(elems[i:j]...))
+	}
+	var b bytes.Buffer
+	writeLength := func(n int) {
+		b.WriteByte(rdb32bitLenByte)
+		binary.Write(&b, binary.BigEndian, uint32(n))
+	}
+	writeLength(len(nodes))
+	for i, node := range nodes {
+		if i == 0 || i == len(nodes)-1 {
+			writeLength(len(node))
+			b.Write(node)
+			continue
+		}
+		z := lzfCompress(node)
+		b.WriteByte(rdbEncVal<<6 | rdbEncLZF)
+		writeLength(len(z))
+		writeLength(len(node))
+		b.Write(z)
+	}
+	return createValueDump(rdbTypeListQuicklist, b.Bytes())
+}
+
+func TestZiplistEntries(t *testing.T) {
+	elems := []string{"", "a", "0", "12", "13", "-1", "127", "-128", "32767", "-32768",
+		"8388607", "-8388608", "2147483647", "-2147483648", "9223372036854775807", "-9223372036854775808",
+		"007", "1.5", string(make([]byte, 300)), string(make([]byte, 20000))}
+	var list []string
+	err := ziplistForEach(newZiplist(elems...), func(ele []byte) error {
+		list = append(list, string(ele))
+		return nil
+	})
+	assert.MustNoError(err)
+	assert.Must(len(list) == len(elems))
+	for i := range elems {
+		assert.Must(list[i] == elems[i])
+	}
+	for _, p := range [][]byte{nil, newZiplist("abc")[:12], {11, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0xd5, 0xff}} {
+		assert.Must(ziplistForEach(p, func([]byte) error { return nil }) != nil)
+	}
+}
+
+func TestLoadQuicklist(t *testing.T) {
+	var elems []string
+	for i := 0; i < 1000; i++ {
+		if i%3 == 0 {
+			elems = append(elems, strconv.Itoa(i*i))
+		} else {
+			elems = append(elems, fmt.Sprintf("element-%d", i))
+		}
+	}
+	p := newQuicklistDump(elems, 128)
+	assert.Must(TypeName(p) == "list" && EncodingName(p) == "quicklist" && !IsEmptyObject(p))
+
+	var b bytes.Buffer
+	b.WriteString("REDIS0007")
+	b.WriteByte(rdbFlagSelectDB)
+	b.WriteByte(0)
+	b.WriteByte(rdbTypeListQuicklist)
+	b.WriteByte(4)
+	b.WriteString("list")
+	b.Write(p[1 : len(p)-10])
+	b.WriteByte(rdbFlagEOF)
+	c := digest.New()
+	c.Write(b.Bytes())
+	binary.Write(&b, binary.LittleEndian, c.Sum64())
+
+	entries := DecodeHexRdb(t, hex.EncodeToString(b.Bytes()), 1)
+	e, obj := getobj(t, entries, "list")
+	assert.Must(bytes.Equal(e.Value, p))
+	checkList(t, obj, elems)
+
+	var i int
+	err := ForEachListElement(e.Value, func(ele []byte) error {
+		assert.Must(string(ele) == elems[i])
+		i++
+		return nil
+	})
+	assert.MustNoError(err)
+	assert.Must(i == len(elems))
+
+	assert.Must(IsEmptyObject(newQuicklistDump(nil, 128)))
+}
+
+func benchmarkQuicklist() []byte {
+	var elems []string
+	for i := 0; i < 1<<20; i++ {
+		elems = append(elems, fmt.Sprintf("quicklist-element-%064d", i%1024))
+	}
+	return newQuicklistDump(elems, 2048)
+}
+
+// BenchmarkQuicklistStream and BenchmarkQuicklistDecode compare the memory
+// needed to go through a compressed 1M elements list, see -benchmem.
+func BenchmarkQuicklistStream(b *testing.B) {
+	p := benchmarkQuicklist()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		ForEachListElement(p, func(ele []byte) error {
+			n += len(ele)
+			return nil
+		})
+	}
+}
+
+func BenchmarkQuicklistDecode(b *testing.B) {
+	p := benchmarkQuicklist()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		o, _ := DecodeDump(p)
+		for _, ele := range o.(List) {
+			n += len(ele)
+		}
+	}
+}
+
+// newZipmap builds a zipmap the way redis 2.4 does, free bytes of every
+// value are left as given.
+func newZipmap(free int, pairs ...string) []byte {
+	var b bytes.Buffer
+	writeLen := func(n int) {
+		if n < zipmapBigLen {
+			b.WriteByte(byte(n))
+		} else {
+			b.WriteByte(zipmapBigLen)
+			binary.Write(&b, binary.LittleEndian, uint32(n))
+		}
+	}
+	if n := len(pairs) / 2; n < zipmapBigLen {
+		b.WriteByte(byte(n))
+	} else {
+		b.WriteByte(zipmapBigLen)
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		writeLen(len(pairs[i]))
+		b.WriteString(pairs[i])
+		writeLen(len(pairs[i+1]))
+		b.WriteByte(byte(free))
+		b.WriteString(pairs[i+1])
+		b.Write(make([]byte, free))
+	}
+	b.WriteByte(zipmapEnd)
+	return b.Bytes()
+}
+
+func TestLoadHashZipmap(t *testing.T) {
+	big := string(bytes.Repeat([]byte("x"), 300))
+	pairs := []string{"name", "redis", "version", "2.4", "", "empty", big, "big", "big", big}
+	zm := newZipmap(3, pairs...)
+
+	// a redis 2.4 rdb: version 3, no checksum after the EOF opcode.
+	var b bytes.Buffer
+	b.WriteString("REDIS0003")
+	b.WriteByte(rdbFlagSelectDB)
+	b.WriteByte(0)
+	b.WriteByte(rdbTypeHashZipmap)
+	b.WriteByte(4)
+	b.WriteString("hash")
+	b.WriteByte(rdb14bitLen<<6 | byte(len(zm)>>8))
+	b.WriteByte(byte(len(zm)))
+	b.Write(zm)
+	b.WriteByte(rdbFlagEOF)
+
+	entries := DecodeHexRdb(t, hex.EncodeToString(b.Bytes()), 1)
+	e, obj := getobj(t, entries, "hash")
+	assert.Must(TypeName(e.Value) == "hash" && !IsEmptyObject(e.Value))
+	hash := obj.(Hash)
+	assert.Must(len(hash) == len(pairs)/2)
+	for i, ele := range hash {
+		assert.Must(string(ele.Field) == pairs[i*2] && string(ele.Value) == pairs[i*2+1])
+	}
+
+	var many []string
+	for i := 0; i < 300; i++ {
+		many = append(many, strconv.Itoa(i), strconv.Itoa(i*i))
+	}
+	hash, err := zipmapHash(newZipmap(0, many...))
+	assert.MustNoError(err)
+	assert.Must(len(hash) == 300 && string(hash[299].Value) == "89401")
+
+	hash, err = zipmapHash(newZipmap(0))
+	assert.MustNoError(err)
+	assert.Must(len(hash) == 0)
+
+	for _, p := range [][]byte{nil, zm[:len(zm)-1], zm[:10], {2, 1, 'a', 1, 0, 'b', zipmapEnd}} {
+		_, err := zipmapHash(p)
+		assert.Must(err != nil)
+	}
+}